@@ -0,0 +1,97 @@
+// Command indexadvisor reports the missing indexes and insensitive flags of
+// the schemas searched by an application, from the searches recorded with a
+// custodia.SearchRecorder and saved with its Save method.
+//
+// Usage:
+//
+//	indexadvisor -url URL [-json] [-apply] FILE...
+//
+// The customer credentials are read from the CHINO_CUSTOMER_ID and
+// CHINO_CUSTOMER_KEY environment variables. The report lists the suggested
+// changes of each schema and user schema with the UpdateSchema payload
+// applying them; -apply sends it.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/dzanotelli/chino/custodia"
+)
+
+func main() {
+	serverUrl := flag.String("url", "", "Custodia server URL (required)")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	apply := flag.Bool("apply", false, "update the schemas with the advice")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] FILE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *serverUrl == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(os.Stdout, *serverUrl, flag.Args(), *asJSON, *apply)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "indexadvisor:", err)
+		os.Exit(1)
+	}
+}
+
+// run writes to out the report of the searches saved in paths, and applies
+// it if apply is true
+func run(out io.Writer, serverUrl string, paths []string, asJSON,
+	apply bool) error {
+	if parsed, err := url.Parse(serverUrl); err != nil || parsed.Scheme == "" {
+		return fmt.Errorf("bad server URL: %s", serverUrl)
+	}
+	recorder, err := custodia.LoadSearchRecorder(paths...)
+	if err != nil {
+		return err
+	}
+
+	auth := common.NewClientAuth(nil)
+	err = auth.SetCustomerAuth(os.Getenv("CHINO_CUSTOMER_ID"),
+		os.Getenv("CHINO_CUSTOMER_KEY"))
+	if err != nil {
+		return fmt.Errorf("CHINO_CUSTOMER_ID and CHINO_CUSTOMER_KEY: %w", err)
+	}
+	auth.SwitchTo(common.CustomerAuth)
+	api := custodia.NewCustodiaAPIv1(common.NewClient(serverUrl, auth))
+
+	report, err := api.AdviseIndexes(recorder)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(data))
+	} else {
+		fmt.Fprint(out, report)
+	}
+
+	if !apply {
+		return nil
+	}
+	for _, advice := range report.Advice {
+		if advice.Structure == nil {
+			continue
+		}
+		if err := api.ApplyIndexAdvice(advice); err != nil {
+			return fmt.Errorf("schema %s: %w", advice.SchemaId, err)
+		}
+		fmt.Fprintf(out, "schema %s updated\n", advice.SchemaId)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/dzanotelli/chino/custodia"
+	"github.com/google/uuid"
+)
+
+func TestRun(t *testing.T) {
+	envelope := custodia.CustodiaEnvelope{Result: "success", ResultCode: 200}
+	schemaId := uuid.New()
+	var updateBody map[string]any
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		var response map[string]any
+		if r.URL.Path == fmt.Sprintf("/api/v1/schemas/%s", schemaId) {
+			if r.Method == "PUT" {
+				updateBody = map[string]any{}
+				json.NewDecoder(r.Body).Decode(&updateBody)
+			}
+			response = map[string]any{"schema": map[string]any{
+				"schema_id": schemaId.String(),
+				"description": "patients",
+				"is_active": true,
+				"structure": []any{
+					map[string]any{"name": "age", "type": "integer",
+						"indexed": true},
+					map[string]any{"name": "city", "type": "string"},
+				},
+			}}
+		} else if strings.HasPrefix(r.URL.Path, "/api/v1/search/") {
+			response = map[string]any{"count": 0}
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(response)
+		envelope.Data = data
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	// record and save the searches of an application
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	api := custodia.NewCustodiaAPIv1(client)
+	api.SearchRecorder = custodia.NewSearchRecorder()
+	api.CountDocuments(schemaId, map[string]any{"field": "city",
+		"type": "eq", "value": "Rome"})
+	path := filepath.Join(t.TempDir(), "searches.json")
+	if err := api.SearchRecorder.Save(path); err != nil {
+		t.Fatalf("save: unexpected error: %v", err)
+	}
+
+	t.Setenv("CHINO_CUSTOMER_ID", "00000000-0000-0000-0000-000000000000")
+	t.Setenv("CHINO_CUSTOMER_KEY", "00000000-0000-0000-0000-000000000000")
+
+	var out bytes.Buffer
+	if err := run(&out, server.URL, []string{path}, false, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("schema %s (1 searches)", schemaId),
+		"[index] city: used in 1 filters and 0 sorts, not indexed",
+		"update payload: {",
+		`"structure":[{"name":"age","type":"integer","indexed":true},` +
+			`{"name":"city","type":"string","indexed":true}]}`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report: missing '%s' in:\n%s", want, out.String())
+		}
+	}
+	if updateBody != nil {
+		t.Errorf("schema updated without -apply")
+	}
+
+	// as JSON, applied
+	out.Reset()
+	if err := run(&out, server.URL, []string{path}, true, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	report := custodia.IndexReport{}
+	data, _, _ := strings.Cut(out.String(), "\nschema")
+	if err := json.Unmarshal([]byte(data), &report); err != nil ||
+		len(report.Advice) != 1 {
+		t.Errorf("bad JSON report: %v, %s", err, out.String())
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("schema %s updated",
+		schemaId)) || updateBody == nil {
+		t.Errorf("schema not updated: %s", out.String())
+	}
+
+	// errors
+	var errorTests = []struct {
+		serverUrl string
+		paths []string
+		want string
+	}{
+		{"localhost", []string{path}, "bad server URL"},
+		{server.URL, []string{path + ".missing"}, "no such file"},
+	}
+	for i, test := range errorTests {
+		err := run(&out, test.serverUrl, test.paths, false, false)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("error %d: expected '%s', got: %v", i, test.want, err)
+		}
+	}
+	t.Setenv("CHINO_CUSTOMER_KEY", "")
+	if err := run(&out, server.URL, []string{path}, false, false); err == nil {
+		t.Errorf("expected error without credentials")
+	}
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/google/uuid"
@@ -46,6 +47,30 @@ func ConvertSliceItems[T any](input any) ([]T, error) {
 				return nil, fmt.Errorf(
 					"unsupported number conversion for type %T", converted)
 			}
+		case json.Number:
+			// decoded with UseNumber, convert without losing precision
+			if _, isInt := any(converted).(int); isInt {
+				n, err := v.Int64()
+				if err != nil {
+					return nil, fmt.Errorf("failed to convert item: %w", err)
+				}
+				converted = any(int(n)).(T)
+			} else if _, isInt64 := any(converted).(int64); isInt64 {
+				n, err := v.Int64()
+				if err != nil {
+					return nil, fmt.Errorf("failed to convert item: %w", err)
+				}
+				converted = any(n).(T)
+			} else if _, isFloat := any(converted).(float64); isFloat {
+				n, err := v.Float64()
+				if err != nil {
+					return nil, fmt.Errorf("failed to convert item: %w", err)
+				}
+				converted = any(n).(T)
+			} else {
+				return nil, fmt.Errorf(
+					"unsupported number conversion for type %T", converted)
+			}
 		case string:
 			if _, isString := any(converted).(string); isString {
 				converted = any(v).(T)
@@ -0,0 +1,599 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// maxCaseVariants caps the distinct values recorded per field to detect
+// case-insensitive searches (as hashes, the values are never kept)
+const maxCaseVariants = 1000
+
+// searchTarget is a searched schema (or user schema)
+type searchTarget struct {
+	id uuid.UUID
+	users bool
+}
+
+// FieldUsage is how a field was used in the recorded searches
+type FieldUsage struct {
+	Field string
+	// Operators counts the filters by operator
+	Operators map[string]int
+	// Sorted counts the searches sorted on the field
+	Sorted int
+	// caseVariants maps the hashes of the lowered string values to the
+	// hashes of the original ones
+	caseVariants map[uint64]map[uint64]bool
+	// savedConflicts are the case conflicts loaded from saved searches
+	savedConflicts int
+}
+
+// Filters returns the number of filters on the field
+func (fu *FieldUsage) Filters() int {
+	count := 0
+	for _, n := range fu.Operators {
+		count += n
+	}
+	return count
+}
+
+// caseConflicts returns the number of values searched with different cases
+func (fu *FieldUsage) caseConflicts() int {
+	conflicts := fu.savedConflicts
+	for _, variants := range fu.caseVariants {
+		if len(variants) > 1 {
+			conflicts++
+		}
+	}
+	return conflicts
+}
+
+// SearchRecorder records the fields and operators used by SearchDocuments
+// and SearchUsers (and the calls built on them). It's opt-in: set
+// CustodiaAPIv1.SearchRecorder to start recording. The searched values are
+// not recorded, only their salted hashes to detect the values searched with
+// different cases. It's safe for concurrent use; the zero value is an empty
+// recorder.
+type SearchRecorder struct {
+	mutex sync.Mutex
+	// seed salts the hashes of the searched values, it's never saved
+	seed maphash.Seed
+	searches map[searchTarget]int
+	usage map[searchTarget]map[string]*FieldUsage
+}
+
+// NewSearchRecorder returns an empty SearchRecorder
+func NewSearchRecorder() *SearchRecorder {
+	sr := &SearchRecorder{}
+	sr.Reset()
+	return sr
+}
+
+// Reset forgets all the recorded searches
+func (sr *SearchRecorder) Reset() {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.searches = map[searchTarget]int{}
+	sr.usage = map[searchTarget]map[string]*FieldUsage{}
+}
+
+// Usage returns the recorded usage of the fields of the schema schemaId,
+// or of the user schema if users is true, sorted by field name
+func (sr *SearchRecorder) Usage(schemaId uuid.UUID, users bool) []FieldUsage {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	result := []FieldUsage{}
+	for _, fu := range sr.usage[searchTarget{id: schemaId, users: users}] {
+		operators := map[string]int{}
+		for op, count := range fu.Operators {
+			operators[op] = count
+		}
+		result = append(result, FieldUsage{Field: fu.Field,
+			Operators: operators, Sorted: fu.Sorted})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Field < result[j].Field
+	})
+	return result
+}
+
+// recordedSearches is the JSON form of the searches of a target
+type recordedSearches struct {
+	SchemaId uuid.UUID `json:"schema_id"`
+	Users bool `json:"users"`
+	Searches int `json:"searches"`
+	Fields []recordedField `json:"fields"`
+}
+
+// recordedField is the JSON form of a FieldUsage
+type recordedField struct {
+	Field string `json:"field"`
+	Operators map[string]int `json:"operators"`
+	Sorted int `json:"sorted"`
+	// CaseConflicts is the number of values searched with different cases
+	CaseConflicts int `json:"case_conflicts,omitempty"`
+}
+
+// MarshalJSON returns the recorded searches, to be saved and advised later
+// (e.g. by cmd/indexadvisor). The searched values are not included, only
+// the number of values searched with different cases.
+func (sr *SearchRecorder) MarshalJSON() ([]byte, error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	records := []recordedSearches{}
+	for target, searches := range sr.searches {
+		record := recordedSearches{SchemaId: target.id, Users: target.users,
+			Searches: searches, Fields: []recordedField{}}
+		for _, fu := range sr.usage[target] {
+			field := recordedField{Field: fu.Field, Operators: fu.Operators,
+				Sorted: fu.Sorted, CaseConflicts: fu.caseConflicts()}
+			record.Fields = append(record.Fields, field)
+		}
+		sort.Slice(record.Fields, func(i, j int) bool {
+			return record.Fields[i].Field < record.Fields[j].Field
+		})
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Users != records[j].Users {
+			return !records[i].Users
+		}
+		return records[i].SchemaId.String() < records[j].SchemaId.String()
+	})
+	return json.Marshal(records)
+}
+
+// UnmarshalJSON adds the searches saved with MarshalJSON to the recorded
+// ones
+func (sr *SearchRecorder) UnmarshalJSON(data []byte) error {
+	records := []recordedSearches{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if sr.searches == nil {
+		sr.searches = map[searchTarget]int{}
+	}
+	for _, record := range records {
+		target := searchTarget{id: record.SchemaId, users: record.Users}
+		sr.searches[target] += record.Searches
+		for _, field := range record.Fields {
+			fu := sr.fieldUsage(target, field.Field)
+			for op, count := range field.Operators {
+				fu.Operators[op] += count
+			}
+			fu.Sorted += field.Sorted
+			fu.savedConflicts += field.CaseConflicts
+		}
+	}
+	return nil
+}
+
+// Save writes the recorded searches to the JSON file path. The file is
+// replaced atomically, so it can be saved periodically by a running service.
+func (sr *SearchRecorder) Save(path string) error {
+	data, err := json.Marshal(sr)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path),
+		filepath.Base(path) + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSearchRecorder returns a SearchRecorder with the searches saved in the
+// JSON files paths (see Save), merged
+func LoadSearchRecorder(paths ...string) (*SearchRecorder, error) {
+	sr := NewSearchRecorder()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, sr); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return sr, nil
+}
+
+// fieldUsage returns the usage of field in target, creating it. Call with
+// the mutex locked.
+func (sr *SearchRecorder) fieldUsage(target searchTarget,
+	field string) *FieldUsage {
+	if sr.usage == nil {
+		sr.usage = map[searchTarget]map[string]*FieldUsage{}
+	}
+	fields, ok := sr.usage[target]
+	if !ok {
+		fields = map[string]*FieldUsage{}
+		sr.usage[target] = fields
+	}
+	fu, ok := fields[field]
+	if !ok {
+		fu = &FieldUsage{Field: field, Operators: map[string]int{},
+			caseVariants: map[uint64]map[uint64]bool{}}
+		fields[field] = fu
+	}
+	return fu
+}
+
+// hash returns the salted hash of a searched value. Call with the mutex
+// locked.
+func (sr *SearchRecorder) hash(value string) uint64 {
+	if sr.seed == (maphash.Seed{}) {
+		sr.seed = maphash.MakeSeed()
+	}
+	return maphash.String(sr.seed, value)
+}
+
+// record records a search on target with query (the search DSL) and sort
+// (the sort DSL or a []SortSpec). Malformed nodes are ignored.
+func (sr *SearchRecorder) record(target searchTarget, query map[string]any,
+	sortSpec any) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if sr.searches == nil {
+		sr.searches = map[searchTarget]int{}
+	}
+	sr.searches[target]++
+	sr.recordNode(target, query)
+
+	switch specs := sortSpec.(type) {
+	case []SortSpec:
+		for _, spec := range specs {
+			sr.fieldUsage(target, spec.Field).Sorted++
+		}
+	case []any, []map[string]any:
+		nodes, _ := queryNodes(specs)
+		for _, node := range nodes {
+			if name, ok := node["field"].(string); ok {
+				sr.fieldUsage(target, name).Sorted++
+			}
+		}
+	}
+}
+
+func (sr *SearchRecorder) recordNode(target searchTarget,
+	node map[string]any) {
+	for _, op := range []string{"and", "or"} {
+		if value, ok := node[op]; ok {
+			children, _ := queryNodes(value)
+			for _, child := range children {
+				sr.recordNode(target, child)
+			}
+			return
+		}
+	}
+	if child, ok := node["not"].(map[string]any); ok {
+		sr.recordNode(target, child)
+		return
+	}
+
+	name, _ := node["field"].(string)
+	op, _ := node["type"].(string)
+	if name == "" || op == "" {
+		return
+	}
+	fu := sr.fieldUsage(target, name)
+	fu.Operators[op]++
+
+	values := []any{node["value"]}
+	if isSlice(node["value"]) {
+		values, _ = decodeArray(node["value"])
+	}
+	for _, value := range values {
+		s, isString := value.(string)
+		if !isString || op == OpLike {
+			continue
+		}
+		lowered := sr.hash(strings.ToLower(s))
+		variants, ok := fu.caseVariants[lowered]
+		if !ok {
+			if len(fu.caseVariants) >= maxCaseVariants {
+				continue
+			}
+			variants = map[uint64]bool{}
+			fu.caseVariants[lowered] = variants
+		}
+		variants[sr.hash(s)] = true
+	}
+}
+
+// Define SuggestionKind
+type SuggestionKind int
+
+const (
+	// SuggestIndex: the field is searched or sorted but not indexed
+	SuggestIndex SuggestionKind = iota + 1
+	// SuggestInsensitive: the field is searched with values differing only
+	// by case
+	SuggestInsensitive
+	// the field is not in the structure
+	SuggestUnknownField
+	// the field type can't be searched, or not with the used operator
+	SuggestUnsupported
+)
+
+func (sk SuggestionKind) Choices() []string {
+	return []string{"index", "insensitive", "unknown_field", "unsupported"}
+}
+
+func (sk SuggestionKind) String() string {
+	return sk.Choices()[sk-1]
+}
+
+func (sk SuggestionKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sk.String())
+}
+
+func (sk *SuggestionKind) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, sk.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("SuggestionKind: received unknown value '%v'",
+			value)
+	}
+
+	*sk = SuggestionKind(intValue)
+	return nil
+}
+
+// IndexSuggestion is a suggested change to a field, or a problem the
+// structure can't fix (unknown fields, unsupported operators)
+type IndexSuggestion struct {
+	Field string `json:"field"`
+	Kind SuggestionKind `json:"kind"`
+	Reason string `json:"reason"`
+}
+
+// IndexAdvice is the advice for a searched schema (or user schema)
+type IndexAdvice struct {
+	SchemaId uuid.UUID `json:"schema_id"`
+	// Users is true for user schemas
+	Users bool `json:"users"`
+	Searches int `json:"searches"`
+	Suggestions []IndexSuggestion `json:"suggestions"`
+	// Description, IsActive and Structure are the UpdateSchema (or
+	// UpdateUserSchema) arguments applying the suggestions. Structure is
+	// nil when nothing has to change.
+	Description string `json:"description"`
+	IsActive bool `json:"is_active"`
+	Structure []SchemaField `json:"structure"`
+}
+
+// Payload returns the body of the UpdateSchema (or UpdateUserSchema)
+// request applying the suggestions, nil if nothing has to change
+func (ia *IndexAdvice) Payload() ([]byte, error) {
+	if ia.Structure == nil {
+		return nil, nil
+	}
+	// as sent by UpdateSchema and UpdateUserSchema
+	if ia.Users {
+		return json.Marshal(UserSchema{Description: ia.Description,
+			IsActive: ia.IsActive, Structure: ia.Structure})
+	}
+	return json.Marshal(Schema{Description: ia.Description,
+		IsActive: ia.IsActive, Structure: ia.Structure})
+}
+
+// ApplyIndexAdvice updates the schema (or user schema) of ia with the
+// suggested structure.
+// Changing the indexes makes Custodia reindex the contents.
+func (ca *CustodiaAPIv1) ApplyIndexAdvice(ia *IndexAdvice) error {
+	if ia.Structure == nil {
+		return nil
+	}
+	var err error
+	if ia.Users {
+		_, err = ca.UpdateUserSchema(ia.SchemaId, ia.Description,
+			ia.IsActive, ia.Structure)
+	} else {
+		_, err = ca.UpdateSchema(ia.SchemaId, ia.Description, ia.IsActive,
+			ia.Structure)
+	}
+	return err
+}
+
+// IndexReport is the advice for all the recorded schemas
+type IndexReport struct {
+	Advice []*IndexAdvice `json:"advice"`
+}
+
+// String returns the report as text, with the update payloads
+func (ir *IndexReport) String() string {
+	var sb strings.Builder
+	for _, advice := range ir.Advice {
+		kind := "schema"
+		if advice.Users {
+			kind = "user schema"
+		}
+		fmt.Fprintf(&sb, "%s %s (%d searches)\n", kind, advice.SchemaId,
+			advice.Searches)
+		if len(advice.Suggestions) == 0 {
+			sb.WriteString("  no changes needed\n")
+		}
+		for _, suggestion := range advice.Suggestions {
+			fmt.Fprintf(&sb, "  [%s] %s: %s\n", suggestion.Kind,
+				suggestion.Field, suggestion.Reason)
+		}
+		if payload, err := advice.Payload(); err == nil && payload != nil {
+			fmt.Fprintf(&sb, "  update payload: %s\n", payload)
+		}
+	}
+	return sb.String()
+}
+
+// AdviseIndexes compares the searches recorded by recorder with the
+// structures of the searched schemas and user schemas (read from the API,
+// once then cached) and suggests the changes needed
+func (ca *CustodiaAPIv1) AdviseIndexes(recorder *SearchRecorder) (
+	*IndexReport, error) {
+	recorder.mutex.Lock()
+	targets := []searchTarget{}
+	for target := range recorder.searches {
+		targets = append(targets, target)
+	}
+	recorder.mutex.Unlock()
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].users != targets[j].users {
+			return !targets[i].users
+		}
+		return targets[i].id.String() < targets[j].id.String()
+	})
+
+	report := &IndexReport{Advice: []*IndexAdvice{}}
+	for _, target := range targets {
+		advice := &IndexAdvice{SchemaId: target.id, Users: target.users}
+		var structure []SchemaField
+		if target.users {
+			userSchema, err := ca.cachedUserSchema(target.id)
+			if err != nil {
+				return nil, err
+			}
+			advice.Description = userSchema.Description
+			advice.IsActive = userSchema.IsActive
+			structure = userSchema.Structure
+		} else {
+			schema, err := ca.cachedSchema(target.id)
+			if err != nil {
+				return nil, err
+			}
+			advice.Description = schema.Description
+			advice.IsActive = schema.IsActive
+			structure = schema.Structure
+		}
+
+		recorder.mutex.Lock()
+		advice.Searches = recorder.searches[target]
+		advice.Suggestions, advice.Structure = adviseStructure(structure,
+			recorder.usage[target], target.users)
+		recorder.mutex.Unlock()
+		report.Advice = append(report.Advice, advice)
+	}
+	return report, nil
+}
+
+// adviseStructure returns the suggestions for the fields in usage and the
+// structure applying them, nil if unchanged
+func adviseStructure(structure []SchemaField,
+	usage map[string]*FieldUsage, users bool) ([]IndexSuggestion,
+	[]SchemaField) {
+	names := []string{}
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	positions := map[string]int{}
+	for i, field := range structure {
+		positions[field.Name] = i
+	}
+	updated := append([]SchemaField{}, structure...)
+	changed := false
+
+	suggestions := []IndexSuggestion{}
+	for _, name := range names {
+		fu := usage[name]
+		position, ok := positions[name]
+		if !ok {
+			// users can always be searched by username
+			if !(users && name == "username") {
+				suggestions = append(suggestions, IndexSuggestion{Field: name,
+					Kind: SuggestUnknownField,
+					Reason: "not defined in structure"})
+			}
+			continue
+		}
+		field := structure[position]
+
+		operators, searchable := searchOperators[field.Type]
+		_, isArray := arrayItemType(field.Type)
+		if isArray {
+			operators, searchable = arraySearchOperators, true
+		}
+		if !searchable {
+			suggestions = append(suggestions, IndexSuggestion{Field: name,
+				Kind: SuggestUnsupported,
+				Reason: fmt.Sprintf("type '%s' can't be searched",
+					field.Type)})
+			continue
+		}
+		unsupported := []string{}
+		for op := range fu.Operators {
+			if indexOf(op, operators) < 0 {
+				unsupported = append(unsupported, op)
+			}
+		}
+		sort.Strings(unsupported)
+		if len(unsupported) > 0 {
+			suggestions = append(suggestions, IndexSuggestion{Field: name,
+				Kind: SuggestUnsupported,
+				Reason: fmt.Sprintf("operators %v not supported by type " +
+					"'%s'", unsupported, field.Type)})
+		}
+		if fu.Sorted > 0 && isArray {
+			suggestions = append(suggestions, IndexSuggestion{Field: name,
+				Kind: SuggestUnsupported,
+				Reason: fmt.Sprintf("type '%s' can't be sorted", field.Type)})
+		}
+
+		if !field.Indexed {
+			suggestions = append(suggestions, IndexSuggestion{Field: name,
+				Kind: SuggestIndex,
+				Reason: fmt.Sprintf("used in %d filters and %d sorts, " +
+					"not indexed", fu.Filters(), fu.Sorted)})
+			updated[position].Indexed = true
+			changed = true
+		}
+		if conflicts := fu.caseConflicts(); conflicts > 0 &&
+			!field.Insensitive && isStringType(field.Type) {
+			suggestions = append(suggestions, IndexSuggestion{Field: name,
+				Kind: SuggestInsensitive,
+				Reason: fmt.Sprintf("searched with values differing only " +
+					"by case (%d values)", conflicts)})
+			updated[position].Indexed = true
+			updated[position].Insensitive = true
+			changed = true
+		}
+	}
+
+	if !changed {
+		return suggestions, nil
+	}
+	return suggestions, updated
+}
+
+// isStringType returns true for string and text fields, and their arrays
+func isStringType(fieldType string) bool {
+	if itemType, isArray := arrayItemType(fieldType); isArray {
+		fieldType = itemType
+	}
+	return fieldType == TypeStr || fieldType == TypeText
+}
@@ -0,0 +1,221 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestAdviseIndexes(t *testing.T) {
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	schemaId, userSchemaId := uuid.New(), uuid.New()
+	var updateBody map[string]any
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		var response map[string]any
+		if r.URL.Path == fmt.Sprintf("/api/v1/schemas/%s", schemaId) {
+			if r.Method == "PUT" {
+				updateBody = map[string]any{}
+				json.NewDecoder(r.Body).Decode(&updateBody)
+			}
+			response = map[string]any{"schema": map[string]any{
+				"schema_id": schemaId.String(),
+				"description": "patients",
+				"is_active": true,
+				"structure": []any{
+					map[string]any{"name": "age", "type": "integer",
+						"indexed": true},
+					map[string]any{"name": "surname", "type": "string",
+						"indexed": true},
+					map[string]any{"name": "city", "type": "string"},
+					map[string]any{"name": "photo", "type": "base64"},
+				},
+			}}
+		} else if r.URL.Path == fmt.Sprintf("/api/v1/user_schemas/%s",
+			userSchemaId) {
+			response = map[string]any{"user_schema": map[string]any{
+				"user_schema_id": userSchemaId.String(),
+				"description": "doctors",
+				"is_active": true,
+				"structure": []any{map[string]any{"name": "code",
+					"type": "string", "indexed": true}},
+			}}
+		} else if strings.HasPrefix(r.URL.Path, "/api/v1/search/") {
+			response = map[string]any{"count": 0}
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(response)
+		envelope.Data = data
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	// not recorded: the recorder is opt-in
+	query, _ := BuildQuery(nil, Field("city").Eq("Rome"))
+	custodia.CountDocuments(schemaId, query)
+
+	recorder := NewSearchRecorder()
+	custodia.SearchRecorder = recorder
+	searches := []Query{
+		And(Field("age").Gt(30), Field("surname").Eq("Rossi")),
+		Or(Field("surname").In("ROSSI", "Bianchi"), Field("city").Eq("Rome")),
+		Not(Field("photo").Eq("eA==")),
+		Field("nickname").Like("x*"),
+		Field("surname").Gt("M"),
+	}
+	for _, search := range searches {
+		query, _ := BuildQuery(nil, search)
+		custodia.CountDocuments(schemaId, query)
+	}
+	custodia.SearchDocuments(schemaId, Count, query,
+		[]SortSpec{Field("city").Asc()}, nil)
+	query, _ = BuildQuery(nil, Field("username").Eq("jdoe"))
+	custodia.CountUsers(userSchemaId, query)
+
+	usage := recorder.Usage(schemaId, false)
+	fields := []string{}
+	for _, fu := range usage {
+		fields = append(fields, fu.Field)
+	}
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{[]string{"age", "city", "nickname", "photo", "surname"}, fields},
+		{map[string]int{OpEq: 2}, usage[1].Operators},
+		{1, usage[1].Sorted},
+		{map[string]int{OpEq: 1, OpIn: 1, OpGt: 1}, usage[4].Operators},
+	}
+
+	report, err := custodia.AdviseIndexes(recorder)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(report.Advice) != 2 {
+		t.Fatalf("expected advice for 2 schemas, got: %v", report)
+	}
+	advice, userAdvice := report.Advice[0], report.Advice[1]
+	kinds := map[string]SuggestionKind{}
+	for _, suggestion := range advice.Suggestions {
+		kinds[suggestion.Field+":"+suggestion.Reason[:5]] = suggestion.Kind
+	}
+	payload, _ := advice.Payload()
+	userPayload, _ := userAdvice.Payload()
+	tests = append(tests, []struct {
+		want any
+		got any
+	}{
+		{6, advice.Searches},
+		{map[string]SuggestionKind{
+			"city:used ": SuggestIndex,
+			"nickname:not d": SuggestUnknownField,
+			"photo:type ": SuggestUnsupported,
+			"surname:opera": SuggestUnsupported,
+			"surname:searc": SuggestInsensitive,
+		}, kinds},
+		{true, strings.Contains(string(payload), `"structure":[` +
+			`{"name":"age","type":"integer","indexed":true},` +
+			`{"name":"surname","type":"string","indexed":true,` +
+			`"insensitive":true},` +
+			`{"name":"city","type":"string","indexed":true},` +
+			`{"name":"photo","type":"base64"}]`)},
+		{true, userAdvice.Users},
+		{0, len(userAdvice.Suggestions)},
+		{[]byte(nil), userPayload},
+	}...)
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	text := report.String()
+	for _, want := range []string{
+		fmt.Sprintf("schema %s (6 searches)", schemaId),
+		"[insensitive] surname: searched with values differing only by " +
+			"case (1 values)",
+		"[index] city: used in 2 filters and 1 sorts, not indexed",
+		"update payload: {",
+		fmt.Sprintf("user schema %s (1 searches)\n  no changes needed",
+			userSchemaId),
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("report: missing '%s' in:\n%s", want, text)
+		}
+	}
+
+	// apply the advice
+	if err := custodia.ApplyIndexAdvice(advice); err != nil {
+		t.Fatalf("apply: unexpected error: %v", err)
+	}
+	var want map[string]any
+	json.Unmarshal(payload, &want)
+	if !reflect.DeepEqual(want, updateBody) {
+		t.Errorf("apply: got body %v want %s", updateBody, payload)
+	}
+
+	// saved and loaded, e.g. by cmd/indexadvisor
+	path := filepath.Join(t.TempDir(), "searches.json")
+	if err := recorder.Save(path); err != nil {
+		t.Fatalf("save: unexpected error: %v", err)
+	}
+	// the searched values are not saved
+	saved, _ := os.ReadFile(path)
+	for _, value := range []string{"Rossi", "ROSSI", "Bianchi", "Rome"} {
+		if strings.Contains(strings.ToLower(string(saved)),
+			strings.ToLower(value)) {
+			t.Errorf("save: value '%s' saved in: %s", value, saved)
+		}
+	}
+	loaded, err := LoadSearchRecorder(path)
+	if err != nil {
+		t.Fatalf("load: unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(recorder.Usage(schemaId, false),
+		loaded.Usage(schemaId, false)) {
+		t.Errorf("load: got usage %v want %v", loaded.Usage(schemaId, false),
+			recorder.Usage(schemaId, false))
+	}
+	loadedReport, err := custodia.AdviseIndexes(loaded)
+	if err != nil || loadedReport.String() != text {
+		t.Errorf("load: got report %v, %v want:\n%s", loadedReport, err,
+			text)
+	}
+	merged, err := LoadSearchRecorder(path, path)
+	if err != nil || merged.Usage(schemaId, false)[1].Sorted != 2 {
+		t.Errorf("load: searches not merged, got: %v, %v",
+			merged.Usage(schemaId, false), err)
+	}
+
+	recorder.Reset()
+	if len(recorder.Usage(schemaId, false)) != 0 {
+		t.Errorf("reset: usage not cleared")
+	}
+
+	// the zero value records too
+	custodia.SearchRecorder = &SearchRecorder{}
+	query, _ = BuildQuery(nil, Field("city").Eq("Rome"))
+	custodia.CountDocuments(schemaId, query)
+	usage = custodia.SearchRecorder.Usage(schemaId, false)
+	if len(usage) != 1 || usage[0].Operators[OpEq] != 1 {
+		t.Errorf("zero recorder: got usage %v", usage)
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dzanotelli/chino/common"
 )
@@ -19,6 +23,22 @@ type CustodiaEnvelope struct {
 type CustodiaAPIv1 struct {
 	client *common.Client
 	RawResponse *http.Response
+	// FillDefaults: when true, CreateDocument and CreateUser set the missing
+	// fields of the content to the schema default values
+	FillDefaults bool
+	// SearchRecorder (optional) records the fields used by the searches,
+	// see AdviseIndexes
+	SearchRecorder *SearchRecorder
+	// History (optional) records the revisions of the documents changed
+	// with UpdateDocument and DeleteDocument. A revision not recorded
+	// fails the call with a *HistoryError, after the change was applied.
+	History *History
+
+	// schemas and user schemas fetched to convert search results, by id
+	schemaCache sync.Map
+	userSchemaCache sync.Map
+	// rawResponseMutex guards RawResponse when calls run concurrently
+	rawResponseMutex sync.Mutex
 }
 
 // NewCustodiaAPI returns a new CustodiaAPI object to interact
@@ -31,6 +51,15 @@ func NewCustodiaAPIv1(client *common.Client) *CustodiaAPIv1 {
 
 func (ca *CustodiaAPIv1) Call(method, path string,
 	params map[string]interface{}) (string, error) {
+	_, data, err := ca.call(method, path, params)
+	return data, err
+}
+
+// call is Call returning the HTTP response too: the calls reading the
+// response must use it instead of RawResponse, which is overwritten by the
+// calls running concurrently (e.g. a pager with prefetch)
+func (ca *CustodiaAPIv1) call(method, path string,
+	params map[string]interface{}) (*http.Response, string, error) {
 	rawResponse, ok := params["_rawResponse"].(bool)
 	if !ok {
 		rawResponse = false
@@ -39,22 +68,74 @@ func (ca *CustodiaAPIv1) Call(method, path string,
 	httpResp, err := ca.client.Call(method, "/api/v1" + path, params)
 
 	// save the response for further inspection on need
+	ca.rawResponseMutex.Lock()
 	ca.RawResponse = httpResp
+	ca.rawResponseMutex.Unlock()
 
 	if err != nil || rawResponse {
-		return "", err
+		return httpResp, "", err
 	}
 	defer httpResp.Body.Close()
 
 	resp := CustodiaEnvelope{}
+	failed := httpResp.StatusCode < 200 || httpResp.StatusCode > 299
 	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
-		return "", err
+		if !failed {
+			return httpResp, "", err
+		}
+		// not a Custodia response (e.g. from a proxy)
+		resp.ResultCode = uint64(httpResp.StatusCode)
+		resp.Message = json.RawMessage(http.StatusText(httpResp.StatusCode))
 	}
 
-	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
-		err := fmt.Errorf("error %v: %s", resp.ResultCode, resp.Message)
-		return "", err
+	if failed {
+		return httpResp, "", &APIError{StatusCode: httpResp.StatusCode,
+			ResultCode: resp.ResultCode, Message: string(resp.Message),
+			RetryAfter: retryAfter(httpResp.Header.Get("Retry-After"))}
 	}
 
-	return string(resp.Data), nil
-}
\ No newline at end of file
+	return httpResp, string(resp.Data), nil
+}
+
+// APIError is the error of a call answered with a non-2xx status
+type APIError struct {
+	StatusCode int
+	ResultCode uint64
+	// Message is the message of the response, as received
+	Message string
+	// RetryAfter is the delay asked by the server (Retry-After header)
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("error %v: %s", e.ResultCode, e.Message)
+}
+
+// Temporary returns true if the call can be retried: the server is
+// overloaded (429) or failed (5xx)
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode >= 500
+}
+
+// retryAfter parses a Retry-After header: seconds or an HTTP date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// decodeJSON unmarshals data into v decoding numbers as json.Number, so no
+// precision is lost before the schema-based conversion of the content
+func decodeJSON(data string, v any) error {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,129 @@
+package custodia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// arrayGoTypes maps the item type of an array field to the Go type of its
+// items in contents (e.g. array[integer] is []int64)
+var arrayGoTypes = map[string]reflect.Type{
+	TypeInt: reflect.TypeOf(int64(0)),
+	TypeFloat: reflect.TypeOf(float64(0)),
+	TypeStr: reflect.TypeOf(""),
+	TypeText: reflect.TypeOf(""),
+	TypeBase64: reflect.TypeOf(""),
+	TypeJson: reflect.TypeOf(""),
+	TypeBlob: reflect.TypeOf(""),
+	TypeBool: reflect.TypeOf(false),
+	TypeDate: reflect.TypeOf(Date{}),
+	TypeTime: reflect.TypeOf(TimeOfDay{}),
+	TypeDateTime: reflect.TypeOf(DateTime{}),
+}
+
+// arrayItemType returns the item type of an array field type, e.g.
+// "integer" for "array[integer]". ok is false for non-array types.
+func arrayItemType(fieldType string) (itemType string, ok bool) {
+	if strings.HasPrefix(fieldType, "array[") &&
+		strings.HasSuffix(fieldType, "]") {
+		return fieldType[len("array[") : len(fieldType)-1], true
+	}
+	return "", false
+}
+
+// decodeArray returns the items of an array value as received from
+// Custodia, which can be a native JSON array (already decoded) or a
+// stringified one. null and empty strings are nil arrays.
+func decodeArray(value any) ([]any, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []any:
+		return v, nil
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return nil, nil
+		}
+		var items []any
+		decoder := json.NewDecoder(strings.NewReader(v))
+		decoder.UseNumber()
+		if err := decoder.Decode(&items); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+		return items, nil
+	}
+
+	// typed slices (e.g. default values set in code)
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice {
+		items := make([]any, rv.Len())
+		for i := range items {
+			items[i] = rv.Index(i).Interface()
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("expected an array, got: %T", value)
+}
+
+// convertArray converts an array value to the typed slice of its field,
+// converting each item as a field of the item type
+func convertArray(value any, field SchemaField) (any, error) {
+	itemType, _ := arrayItemType(field.Type)
+	goType, ok := arrayGoTypes[itemType]
+	if !ok {
+		panic(fmt.Sprintf("field '%s': type '%s' not handled", field.Name,
+			field.Type))
+	}
+
+	items, err := decodeArray(value)
+	if err != nil {
+		return nil, fmt.Errorf("field '%s': %w", field.Name, err)
+	}
+
+	if items == nil {
+		return reflect.Zero(reflect.SliceOf(goType)).Interface(), nil
+	}
+	result := reflect.MakeSlice(reflect.SliceOf(goType), 0, len(items))
+	var ee []error
+	for i, item := range items {
+		itemField := SchemaField{Name: fmt.Sprintf("%s[%d]", field.Name, i),
+			Type: itemType}
+		if item == nil {
+			ee = append(ee, fmt.Errorf("field '%s': null item",
+				itemField.Name))
+			continue
+		}
+		converted, err := convertField(item, itemField)
+		if err != nil {
+			ee = append(ee, err)
+			continue
+		}
+		result = reflect.Append(result, reflect.ValueOf(converted))
+	}
+
+	if len(ee) > 0 {
+		return result.Interface(), errors.Join(ee...)
+	}
+	return result.Interface(), nil
+}
+
+// checkArrayType checks that value is the typed slice expected for the
+// array fieldType and that all its items are valid
+func checkArrayType(value any, fieldType string) error {
+	itemType, _ := arrayItemType(fieldType)
+	goType := arrayGoTypes[itemType]
+
+	rv := reflect.ValueOf(value)
+	if !rv.IsValid() || rv.Type() != reflect.SliceOf(goType) {
+		return fmt.Errorf("expected to be a slice of %s", goType)
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := checkType(rv.Index(i).Interface(), itemType); err != nil {
+			return fmt.Errorf("item %d: %w", i, err)
+		}
+	}
+	return nil
+}
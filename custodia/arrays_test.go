@@ -0,0 +1,107 @@
+package custodia
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertArray(t *testing.T) {
+	// native arrays, as decoded by decodeJSON
+	var native map[string]any
+	decodeJSON(`{"ints": [1, 9007199254740993], "strs": ["a,b", "c"]}`,
+		&native)
+
+	var tests = []struct {
+		fieldType string
+		value any
+		want any
+	}{
+		{TypeArrayInt, `[0, 1, 2]`, []int64{0, 1, 2}},
+		{TypeArrayInt, native["ints"], []int64{1, 9007199254740993}},
+		{TypeArrayFloat, `[1.1, 2]`, []float64{1.1, 2}},
+		{TypeArrayStr, `["Hello, world", "say \"hi\"", "café"]`,
+			[]string{"Hello, world", `say "hi"`, "café"}},
+		{TypeArrayStr, native["strs"], []string{"a,b", "c"}},
+		{TypeArrayStr, `[]`, []string{}},
+		{TypeArrayStr, `null`, []string(nil)},
+		{TypeArrayStr, nil, []string(nil)},
+		{TypeArrayStr, "", []string(nil)},
+		{TypeArrayBool, `[true, false]`, []bool{true, false}},
+		{TypeArrayDate, []any{"2023-03-15"}, []Date{NewDate(2023, 3, 15)}},
+		{TypeArrayTime, `["11:43:04"]`, []TimeOfDay{
+			NewTimeOfDay(11, 43, 4, 0)}},
+	}
+	for i, test := range tests {
+		field := SchemaField{Name: "field", Type: test.fieldType}
+		got, err := convertField(test.value, field)
+		if err != nil {
+			t.Errorf("ConvertArray %d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("ConvertArray %d: bad value, got: %#v want: %#v", i, got,
+				test.want)
+		}
+	}
+
+	// errors
+	var errorTests = []struct {
+		fieldType string
+		value any
+	}{
+		{TypeArrayInt, `[1, "a"]`},
+		{TypeArrayInt, `[1, 1.5]`},
+		{TypeArrayInt, `[1, null]`},
+		{TypeArrayStr, `["unterminated]`},
+		{TypeArrayDate, `["2023-02-30"]`},
+		{TypeArrayBool, 42},
+	}
+	for i, test := range errorTests {
+		field := SchemaField{Name: "field", Type: test.fieldType}
+		if _, err := convertField(test.value, field); err == nil {
+			t.Errorf("ConvertArray error %d: expected error", i)
+		}
+	}
+}
+
+func TestValidateArrays(t *testing.T) {
+	structure := map[string]SchemaField{
+		"ints": {Name: "ints", Type: TypeArrayInt},
+		"strs": {Name: "strs", Type: TypeArrayStr},
+		"dates": {Name: "dates", Type: TypeArrayDate},
+		"bools": {Name: "bools", Type: TypeArrayBool},
+	}
+
+	valid := map[string]any{
+		"ints": []int64{1, 2},
+		"strs": []string{"a, b"},
+		"dates": []Date{NewDate(2023, 3, 15)},
+		"bools": []bool(nil),
+	}
+	if errs := validateContent(valid, structure); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	invalid := map[string]any{
+		"ints": []int{1, 2},
+		"strs": []string{strings.Repeat("x", 256)},
+		"dates": []Date{NewDate(2023, 2, 30)},
+		"bools": "[true]",
+	}
+	if errs := validateContent(invalid, structure); len(errs) != 4 {
+		t.Errorf("expected 4 errors, got: %v", errs)
+	}
+
+	// typed slices are sent as native JSON arrays
+	data, _ := json.Marshal(valid)
+	want := `{"bools":null,"dates":["2023-03-15"],"ints":[1,2],` +
+		`"strs":["a, b"]}`
+	if string(data) != want {
+		t.Errorf("bad json, got: %s want: %s", data, want)
+	}
+
+	// array types not handled
+	if isKnownType("array[antani]") || !isKnownType(TypeArrayDateTime) {
+		t.Errorf("isKnownType: bad result on array types")
+	}
+}
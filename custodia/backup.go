@@ -0,0 +1,832 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BackupVersion is the version of the manifest written by BackupAccount
+const BackupVersion = 1
+
+// BackupOptions are the options of BackupAccount
+type BackupOptions struct {
+	// Archive is the format of the archive, ArchiveTar if not given
+	Archive ArchiveFormat
+	// Since makes an incremental backup: only the documents and users
+	// updated after it (and their blobs) are saved, with everything else.
+	// Use the CreatedAt of the previous backup. The zero time makes a full
+	// backup.
+	Since time.Time
+	// SkipBlobs saves the documents without downloading their blobs
+	SkipBlobs bool
+	// PageSize is the page size of the list calls, 0 means DefaultPageSize
+	PageSize int
+}
+
+// BackupGroup is a backed up group, with the ids of its users
+type BackupGroup struct {
+	Group
+	Users []uuid.UUID `json:"users"`
+}
+
+// BackupCollection is a backed up collection, with the ids of its documents
+type BackupCollection struct {
+	Collection
+	Documents []uuid.UUID `json:"documents"`
+}
+
+// BackupManifest describes a backup archive. It's the last entry of the
+// archive, named ManifestName.
+type BackupManifest struct {
+	Version int `json:"version"`
+	// CreatedAt is when the backup started, the Since of the next
+	// incremental backup
+	CreatedAt time.Time `json:"created_at"`
+	// Since is zero for full backups
+	Since time.Time `json:"since"`
+	// Counts are the number of items saved, by kind (e.g. "documents")
+	Counts map[string]int `json:"counts"`
+	Blobs []ManifestBlob `json:"blobs"`
+	// Files has the checksums of all the other entries
+	Files []ManifestFile `json:"files"`
+}
+
+// Incremental returns true if the backup has only the recent changes of
+// documents and users
+func (bm *BackupManifest) Incremental() bool {
+	return !bm.Since.IsZero()
+}
+
+// backuper writes a backup archive
+type backuper struct {
+	ca *CustodiaAPIv1
+	ctx context.Context
+	opts *BackupOptions
+	archive archiveWriter
+	manifest *BackupManifest
+}
+
+// writeLines writes the entry name with write, as JSON lines, adding the
+// number of lines written to the counts of kind
+func (b *backuper) writeLines(name, kind string,
+	write func(encode func(any) error) error) error {
+	_, err := writeArchiveEntry(b.archive, &b.manifest.Files, name,
+		func(w io.Writer) error {
+			encoder := json.NewEncoder(w)
+			return write(func(item any) error {
+				b.manifest.Counts[kind]++
+				return encoder.Encode(item)
+			})
+		})
+	return err
+}
+
+// writeAll writes items to the entry name, as JSON lines
+func writeAll[T any](b *backuper, name, kind string, items []T) error {
+	return b.writeLines(name, kind, func(encode func(any) error) error {
+		for _, item := range items {
+			if err := encode(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// changedParams returns the query params listing the full items changed
+// since the last backup, if incremental
+func (b *backuper) changedParams(offset, limit int,
+	full string) map[string]string {
+	params := pageParams(offset, limit)
+	params[full] = "true"
+	if !b.opts.Since.IsZero() {
+		params["last_update__gt"] = lastUpdateFilter(b.opts.Since)
+	}
+	return params
+}
+
+// backupDocuments writes the documents of schema and their blobs
+func (b *backuper) backupDocuments(schema *Schema) error {
+	docs := NewPager(b.ctx, b.opts.PageSize, func(offset, limit int) (
+		[]*Document, PageInfo, error) {
+		return b.ca.listDocuments(schema, b.changedParams(offset, limit,
+			"full_document"))
+	})
+	refs := []blobRef{}
+	name := fmt.Sprintf("documents/%s.ndjson", schema.Id)
+	err := b.writeLines(name, "documents", func(encode func(any) error) (
+		error) {
+		for docs.Next() {
+			doc := docs.Value()
+			if err := encode(doc); err != nil {
+				return fmt.Errorf("document %s: %w", doc.Id, err)
+			}
+			refs = append(refs, blobRefs(doc, schema)...)
+		}
+		return docs.Err()
+	})
+	if err != nil || b.opts.SkipBlobs {
+		return err
+	}
+
+	for _, ref := range refs {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+		blob, err := b.ca.archiveBlob(b.archive, &b.manifest.Files,
+			schema.Id, ref)
+		if err != nil {
+			return err
+		}
+		b.manifest.Blobs = append(b.manifest.Blobs, blob)
+		b.manifest.Counts["blobs"]++
+	}
+	return nil
+}
+
+// backupUsers writes the users of userSchema, without their passwords
+func (b *backuper) backupUsers(userSchema *UserSchema) error {
+	users := NewPager(b.ctx, b.opts.PageSize, func(offset, limit int) (
+		[]*User, PageInfo, error) {
+		return b.ca.listUsers(userSchema.Id, b.changedParams(offset, limit,
+			"full_user"))
+	})
+	name := fmt.Sprintf("users/%s.ndjson", userSchema.Id)
+	return b.writeLines(name, "users", func(encode func(any) error) error {
+		for users.Next() {
+			user := users.Value()
+			user.Password = ""
+			if err := encode(user); err != nil {
+				return fmt.Errorf("user %s: %w", user.Id, err)
+			}
+		}
+		return users.Err()
+	})
+}
+
+// BackupAccount writes to w an archive of the whole account: repositories,
+// schemas and their documents with the blobs, user schemas and their users
+// (without passwords), groups with their users, collections with their
+// documents, applications (without secrets) and the permissions returned
+// by ReadAllPermissions, followed by the manifest, which is also returned.
+// See RestoreAccount.
+// Incremental backups (see BackupOptions.Since) have only the documents and
+// users changed since the previous backup, but all the other items: they
+// are small and can't be filtered.
+func (ca *CustodiaAPIv1) BackupAccount(ctx context.Context, w io.Writer,
+	opts *BackupOptions) (*BackupManifest, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	b := &backuper{ca: ca, ctx: ctx, opts: opts,
+		archive: newArchiveWriter(opts.Archive, w),
+		manifest: &BackupManifest{Version: BackupVersion,
+			CreatedAt: time.Now().UTC(), Since: opts.Since.UTC(),
+			Counts: map[string]int{}, Blobs: []ManifestBlob{},
+			Files: []ManifestFile{}}}
+
+	repositories, err := ca.IterRepositories(ctx, opts.PageSize).All()
+	if err != nil {
+		return nil, err
+	}
+	schemas := []*Schema{}
+	for _, repository := range repositories {
+		repoSchemas, err := ca.IterSchemas(ctx, repository.Id,
+			opts.PageSize).All()
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, repoSchemas...)
+	}
+	userSchemas, err := ca.IterUserSchemas(ctx, opts.PageSize).All()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []BackupGroup{}
+	pagedGroups, err := ca.IterGroups(ctx, opts.PageSize).All()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range pagedGroups {
+		users, err := ca.IterGroupUsers(ctx, group.Id, opts.PageSize).All()
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", group.Id, err)
+		}
+		backupGroup := BackupGroup{Group: group, Users: []uuid.UUID{}}
+		for _, user := range users {
+			backupGroup.Users = append(backupGroup.Users, user.Id)
+		}
+		groups = append(groups, backupGroup)
+	}
+
+	collections := []BackupCollection{}
+	pagedCollections, err := ca.IterCollections(ctx, opts.PageSize).All()
+	if err != nil {
+		return nil, err
+	}
+	for _, collection := range pagedCollections {
+		docs, err := ca.IterCollectionDocuments(ctx, collection.Id,
+			opts.PageSize).All()
+		if err != nil {
+			return nil, fmt.Errorf("collection %s: %w", collection.Id, err)
+		}
+		backupCollection := BackupCollection{Collection: *collection,
+			Documents: []uuid.UUID{}}
+		for _, doc := range docs {
+			backupCollection.Documents = append(backupCollection.Documents,
+				doc.Id)
+		}
+		collections = append(collections, backupCollection)
+	}
+
+	applications, err := ca.IterApplications(ctx, opts.PageSize).All()
+	if err != nil {
+		return nil, err
+	}
+	for _, application := range applications {
+		application.Secret = ""
+	}
+	permissions, err := ca.ReadAllPermissions()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []error{
+		writeAll(b, "repositories.ndjson", "repositories", repositories),
+		writeAll(b, "schemas.ndjson", "schemas", schemas),
+		writeAll(b, "user_schemas.ndjson", "user_schemas", userSchemas),
+		writeAll(b, "groups.ndjson", "groups", groups),
+		writeAll(b, "collections.ndjson", "collections", collections),
+		writeAll(b, "applications.ndjson", "applications", applications),
+		writeAll(b, "permissions.ndjson", "permissions", permissions),
+	}
+	if err := errors.Join(entries...); err != nil {
+		return nil, err
+	}
+	for _, userSchema := range userSchemas {
+		if err := b.backupUsers(userSchema); err != nil {
+			return nil, err
+		}
+	}
+	for _, schema := range schemas {
+		if err := b.backupDocuments(schema); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := closeArchive(b.archive, b.manifest); err != nil {
+		return nil, err
+	}
+	return b.manifest, nil
+}
+
+// VerifyBackup checks the entries of the backup archive at path against
+// the checksums of its manifest, returning the manifest
+func VerifyBackup(archivePath string) (*BackupManifest, error) {
+	return verifyArchive(archivePath, func(manifest *BackupManifest) (
+		[]ManifestFile) {
+		return manifest.Files
+	})
+}
+
+// RestoreOptions are the options of RestoreAccount
+type RestoreOptions struct {
+	// SkipBlobs restores the documents without their blobs
+	SkipBlobs bool
+	// SkipPermissions doesn't grant the backed up permissions
+	SkipPermissions bool
+}
+
+// RestoreResult maps the backed up items to the restored ones
+type RestoreResult struct {
+	// Ids maps the old ids to the new ones, for all kinds of items
+	Ids map[uuid.UUID]uuid.UUID `json:"ids"`
+	// ApplicationIds maps the old application ids to the new ones
+	ApplicationIds map[string]string `json:"application_ids"`
+	// Applications are the restored applications, with their new secrets
+	Applications []*Application `json:"applications"`
+	// Counts are the number of items restored, by kind (e.g. "documents")
+	Counts map[string]int `json:"counts"`
+	// SkippedPermissions are the permissions owned by applications, which
+	// the permission calls can't grant: they must be granted again by hand
+	SkippedPermissions []Resource `json:"skipped_permissions"`
+}
+
+// errApplicationOwner is the error granting a permission of an application
+var errApplicationOwner = errors.New("owned by an application")
+
+// backupSet keeps the last version of the backed up items, in order of
+// first appearance
+type backupSet[K comparable, T any] struct {
+	keys []K
+	items map[K]T
+}
+
+func (bs *backupSet[K, T]) put(key K, item T) {
+	if bs.items == nil {
+		bs.items = map[K]T{}
+	}
+	if _, ok := bs.items[key]; !ok {
+		bs.keys = append(bs.keys, key)
+	}
+	bs.items[key] = item
+}
+
+// values returns the items, in order of first appearance
+func (bs *backupSet[K, T]) values() []T {
+	values := []T{}
+	for _, key := range bs.keys {
+		values = append(values, bs.items[key])
+	}
+	return values
+}
+
+// decodeLines decodes each JSON line of r, passing it to fn
+func decodeLines[T any](r io.Reader, fn func(T) error) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for {
+		var item T
+		if err := decoder.Decode(&item); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// blobField is the blob field of a document
+type blobField struct {
+	documentId uuid.UUID
+	field string
+}
+
+// restorer restores backup archives
+type restorer struct {
+	ca *CustodiaAPIv1
+	ctx context.Context
+	opts *RestoreOptions
+	result *RestoreResult
+	errs []error
+
+	repositories backupSet[uuid.UUID, *Repository]
+	schemas backupSet[uuid.UUID, *Schema]
+	userSchemas backupSet[uuid.UUID, *UserSchema]
+	groups backupSet[uuid.UUID, BackupGroup]
+	collections backupSet[uuid.UUID, BackupCollection]
+	applications backupSet[string, *Application]
+	permissions []Resource
+	// blobFiles are the blobs extracted to blobDir, by old id
+	blobDir string
+	blobFiles map[uuid.UUID]string
+	// blobs are the last blobs of the blob fields, by old document id
+	blobs backupSet[blobField, uuid.UUID]
+}
+
+// readStructure reads the items of an archive but documents and users,
+// extracting the blobs
+func (rs *restorer) readStructure(name string, r io.Reader) error {
+	switch {
+	case name == "repositories.ndjson":
+		return decodeLines(r, func(item *Repository) error {
+			rs.repositories.put(item.Id, item)
+			return nil
+		})
+	case name == "schemas.ndjson":
+		return decodeLines(r, func(item *Schema) error {
+			rs.schemas.put(item.Id, item)
+			return nil
+		})
+	case name == "user_schemas.ndjson":
+		return decodeLines(r, func(item *UserSchema) error {
+			rs.userSchemas.put(item.Id, item)
+			return nil
+		})
+	case name == "groups.ndjson":
+		return decodeLines(r, func(item BackupGroup) error {
+			rs.groups.put(item.Id, item)
+			return nil
+		})
+	case name == "collections.ndjson":
+		return decodeLines(r, func(item BackupCollection) error {
+			rs.collections.put(item.Id, item)
+			return nil
+		})
+	case name == "applications.ndjson":
+		return decodeLines(r, func(item *Application) error {
+			rs.applications.put(item.Id, item)
+			return nil
+		})
+	case name == "permissions.ndjson":
+		// each backup has all the permissions
+		rs.permissions = []Resource{}
+		return decodeLines(r, func(item Resource) error {
+			rs.permissions = append(rs.permissions, item)
+			return nil
+		})
+	case strings.HasPrefix(name, "blobs/") && !rs.opts.SkipBlobs:
+		id, err := uuid.Parse(path.Base(name))
+		if err != nil {
+			return fmt.Errorf("%s: bad blob id: %w", name, err)
+		}
+		file, err := os.Create(filepath.Join(rs.blobDir, id.String()))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, r)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		rs.blobFiles[id] = file.Name()
+		return err
+	}
+	return nil
+}
+
+// restoreStructure creates the repositories, schemas, user schemas, groups,
+// collections and applications
+func (rs *restorer) restoreStructure() error {
+	ids := rs.result.Ids
+	for _, repository := range rs.repositories.values() {
+		created, err := rs.ca.CreateRepository(repository.Description,
+			repository.IsActive)
+		if err != nil {
+			return fmt.Errorf("repository %s: %w", repository.Id, err)
+		}
+		ids[repository.Id] = created.Id
+		rs.result.Counts["repositories"]++
+	}
+	for _, schema := range rs.schemas.values() {
+		repositoryId, ok := ids[schema.RepositoryId]
+		if !ok {
+			return fmt.Errorf("schema %s: repository %s not in the backup",
+				schema.Id, schema.RepositoryId)
+		}
+		created, err := rs.ca.CreateSchema(repositoryId, schema.Description,
+			schema.IsActive, schema.Structure)
+		if err != nil {
+			return fmt.Errorf("schema %s: %w", schema.Id, err)
+		}
+		ids[schema.Id] = created.Id
+		rs.result.Counts["schemas"]++
+	}
+	for _, userSchema := range rs.userSchemas.values() {
+		created, err := rs.ca.CreateUserSchema(userSchema.Description,
+			userSchema.IsActive, userSchema.Structure)
+		if err != nil {
+			return fmt.Errorf("user schema %s: %w", userSchema.Id, err)
+		}
+		ids[userSchema.Id] = created.Id
+		rs.result.Counts["user_schemas"]++
+	}
+	for _, group := range rs.groups.values() {
+		created, err := rs.ca.CreateGroup(group.Name, group.IsActive,
+			group.Attributes)
+		if err != nil {
+			return fmt.Errorf("group %s: %w", group.Id, err)
+		}
+		ids[group.Id] = created.Id
+		rs.result.Counts["groups"]++
+	}
+	for _, collection := range rs.collections.values() {
+		created, err := rs.ca.CreateCollection(collection.Name)
+		if err != nil {
+			return fmt.Errorf("collection %s: %w", collection.Id, err)
+		}
+		ids[collection.Id] = created.Id
+		rs.result.Counts["collections"]++
+	}
+	for _, application := range rs.applications.values() {
+		created, err := rs.ca.CreateApplication(application.Name,
+			application.GrantType, application.ClientType,
+			application.RedirectUrl)
+		if err != nil {
+			return fmt.Errorf("application %s: %w", application.Id, err)
+		}
+		rs.result.ApplicationIds[application.Id] = created.Id
+		rs.result.Applications = append(rs.result.Applications, created)
+		rs.result.Counts["applications"]++
+	}
+	return nil
+}
+
+// restoreItem creates the item of an old id at createPath, mapping the
+// new id and counting it as kind, or updates it at updatePath if restored
+// by a previous archive
+func (rs *restorer) restoreItem(kind string, oldId uuid.UUID, createPath,
+	updatePath string, item any) error {
+	ids := rs.result.Ids
+	method, url := "POST", createPath
+	if newId, ok := ids[oldId]; ok {
+		method, url = "PUT", fmt.Sprintf(updatePath, newId)
+	}
+	resp, err := rs.ca.Call(method, url, map[string]any{"_data": item})
+	if err != nil {
+		return err
+	}
+	if method == "PUT" {
+		return nil
+	}
+	created := struct {
+		Document *Document `json:"document"`
+		User *User `json:"user"`
+	}{}
+	if err := decodeJSON(resp, &created); err != nil {
+		return err
+	}
+	if created.Document != nil {
+		ids[oldId] = created.Document.Id
+	} else if created.User != nil {
+		ids[oldId] = created.User.Id
+	} else {
+		return fmt.Errorf("missing item in response")
+	}
+	rs.result.Counts[kind]++
+	return nil
+}
+
+// restoreData creates or updates the documents and users of an archive.
+// The content is sent as it is, without validation; blob fields are set
+// later, by uploading the blobs.
+func (rs *restorer) restoreData(name string, r io.Reader) error {
+	ids := rs.result.Ids
+	switch {
+	case strings.HasPrefix(name, "documents/"):
+		schemaId, err := uuid.Parse(strings.TrimSuffix(path.Base(name),
+			".ndjson"))
+		if err != nil {
+			return fmt.Errorf("%s: bad schema id: %w", name, err)
+		}
+		schema, ok := rs.schemas.items[schemaId]
+		if !ok {
+			return fmt.Errorf("%s: schema not in the backup", name)
+		}
+		return decodeLines(r, func(doc *Document) error {
+			for _, field := range schema.Structure {
+				if field.Type != TypeBlob {
+					continue
+				}
+				// uuid.Nil drops the blob of a previous archive
+				blobId, _ := uuid.Parse(fmt.Sprint(doc.Content[field.Name]))
+				rs.blobs.put(blobField{documentId: doc.Id, field: field.Name},
+					blobId)
+				delete(doc.Content, field.Name)
+			}
+			content := Document{IsActive: doc.IsActive, Content: doc.Content}
+			err := rs.restoreItem("documents", doc.Id, fmt.Sprintf(
+				"/schemas/%s/documents", ids[schemaId]), "/documents/%s",
+				content)
+			if err != nil {
+				rs.errs = append(rs.errs, fmt.Errorf("document %s: %w",
+					doc.Id, err))
+			}
+			return rs.ctx.Err()
+		})
+	case strings.HasPrefix(name, "users/"):
+		userSchemaId, err := uuid.Parse(strings.TrimSuffix(path.Base(name),
+			".ndjson"))
+		if err != nil {
+			return fmt.Errorf("%s: bad user schema id: %w", name, err)
+		}
+		if _, ok := ids[userSchemaId]; !ok {
+			return fmt.Errorf("%s: user schema not in the backup", name)
+		}
+		return decodeLines(r, func(user *User) error {
+			content := User{Username: user.Username, IsActive: user.IsActive,
+				Attributes: user.Attributes}
+			err := rs.restoreItem("users", user.Id, fmt.Sprintf(
+				"/user_schemas/%s/users", ids[userSchemaId]), "/users/%s",
+				content)
+			if err != nil {
+				rs.errs = append(rs.errs, fmt.Errorf("user %s: %w", user.Id,
+					err))
+			}
+			return rs.ctx.Err()
+		})
+	}
+	return nil
+}
+
+// restoreBlobs uploads the last blob of each blob field
+func (rs *restorer) restoreBlobs() {
+	ids := rs.result.Ids
+	for _, key := range rs.blobs.keys {
+		blobId := rs.blobs.items[key]
+		if blobId == uuid.Nil {
+			continue
+		}
+		file, ok := rs.blobFiles[blobId]
+		if !ok {
+			rs.errs = append(rs.errs, fmt.Errorf("blob %s of document %s: "+
+				"not in the backup", blobId, key.documentId))
+			continue
+		}
+		documentId, ok := ids[key.documentId]
+		if !ok {
+			continue  // the document failed
+		}
+		blob, err := rs.ca.CreateBlobFromFile(file, documentId, key.field, 0)
+		if err != nil {
+			rs.errs = append(rs.errs, fmt.Errorf("blob %s of document %s: %w",
+				blobId, key.documentId, err))
+			continue
+		}
+		ids[blobId] = blob.Id
+		rs.result.Counts["blobs"]++
+	}
+}
+
+// restoreMembers adds the restored users and documents to their groups and
+// collections
+func (rs *restorer) restoreMembers() {
+	ids := rs.result.Ids
+	for _, group := range rs.groups.values() {
+		for _, userId := range group.Users {
+			newId, ok := ids[userId]
+			if !ok {
+				rs.errs = append(rs.errs, fmt.Errorf("group %s: user %s not "+
+					"restored", group.Id, userId))
+				continue
+			}
+			if err := rs.ca.AddUserToGroup(newId, ids[group.Id]); err != nil {
+				rs.errs = append(rs.errs, fmt.Errorf("group %s: user %s: %w",
+					group.Id, userId, err))
+			}
+		}
+	}
+	for _, collection := range rs.collections.values() {
+		for _, docId := range collection.Documents {
+			newId, ok := ids[docId]
+			if !ok {
+				rs.errs = append(rs.errs, fmt.Errorf("collection %s: "+
+					"document %s not restored", collection.Id, docId))
+				continue
+			}
+			err := rs.ca.AddDocumentToCollection(newId, ids[collection.Id])
+			if err != nil {
+				rs.errs = append(rs.errs, fmt.Errorf("collection %s: "+
+					"document %s: %w", collection.Id, docId, err))
+			}
+		}
+	}
+}
+
+// parentType returns the type of the parent of the resources of type rt
+func parentType(rt ResourceType) (ResourceType, error) {
+	switch rt {
+	case ResourceSchema:
+		return ResourceRepository, nil
+	case ResourceDocument:
+		return ResourceSchema, nil
+	case ResourceUser:
+		return ResourceUserSchema, nil
+	}
+	return 0, fmt.Errorf("%s has no parent", rt)
+}
+
+// grant grants again a backed up permission, with the new ids
+func (rs *restorer) grant(resource Resource) error {
+	if _, ok := rs.result.ApplicationIds[resource.OwnerId.String()]; ok {
+		return errApplicationOwner
+	}
+	ids := rs.result.Ids
+	ownerId, ok := ids[resource.OwnerId]
+	if !ok {
+		return fmt.Errorf("owner %s not restored", resource.OwnerId)
+	}
+	switch {
+	case resource.Id != uuid.Nil:
+		resourceId, ok := ids[resource.Id]
+		if !ok {
+			return fmt.Errorf("resource not restored")
+		}
+		return rs.ca.PermissionOnResource(PermissionActionGrant,
+			resource.Type, resourceId, resource.OwnerType, ownerId,
+			resource.Permission)
+	case resource.ParentId != uuid.Nil:
+		parentId, ok := ids[resource.ParentId]
+		if !ok {
+			return fmt.Errorf("parent %s not restored", resource.ParentId)
+		}
+		parent, err := parentType(resource.Type)
+		if err != nil {
+			return err
+		}
+		return rs.ca.PermissionOnResourceChildren(PermissionActionGrant,
+			parent, parentId, resource.Type, resource.OwnerType, ownerId,
+			resource.Permission)
+	}
+	return rs.ca.PermissionOnResources(PermissionActionGrant, resource.Type,
+		resource.OwnerType, ownerId, resource.Permission)
+}
+
+// RestoreAccount restores the backups at archivePaths, made by
+// BackupAccount, into an empty account: a full backup followed by the
+// incremental ones, in order. The archives are verified first.
+// All the items are created again with new ids, mapped in the result: blob
+// fields, group and collection members and the permissions refer to the new
+// ids. Documents and users keep the content of their last backup; the ones
+// deleted after the full backup are restored too. Users have no password,
+// applications new secrets, and their permissions are not granted (see
+// SkippedPermissions).
+// The restore stops on the first error creating repositories, schemas, user
+// schemas, groups, collections or applications; the other errors are
+// collected and returned at the end. On errors the partial result is
+// returned, to clean up the account.
+func (ca *CustodiaAPIv1) RestoreAccount(ctx context.Context,
+	archivePaths []string, opts *RestoreOptions) (*RestoreResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	if len(archivePaths) == 0 {
+		return nil, fmt.Errorf("no archives to restore")
+	}
+	var previous *BackupManifest
+	for i, archivePath := range archivePaths {
+		manifest, err := VerifyBackup(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 && manifest.Incremental() {
+			return nil, fmt.Errorf("%s: the first backup must be full",
+				archivePath)
+		} else if i > 0 && !manifest.Incremental() {
+			return nil, fmt.Errorf("%s: full backup after the first",
+				archivePath)
+		} else if i > 0 && !manifest.CreatedAt.After(previous.CreatedAt) {
+			return nil, fmt.Errorf("%s: backups are not in order",
+				archivePath)
+		}
+		previous = manifest
+	}
+
+	blobDir, err := os.MkdirTemp("", "custodia-restore-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(blobDir)
+	rs := &restorer{ca: ca, ctx: ctx, opts: opts,
+		result: &RestoreResult{Ids: map[uuid.UUID]uuid.UUID{},
+			ApplicationIds: map[string]string{},
+			Applications: []*Application{}, Counts: map[string]int{},
+			SkippedPermissions: []Resource{}},
+		blobDir: blobDir, blobFiles: map[uuid.UUID]string{}}
+
+	for _, archivePath := range archivePaths {
+		if err := walkArchive(archivePath, rs.readStructure); err != nil {
+			return nil, err
+		}
+	}
+	if err := rs.restoreStructure(); err != nil {
+		return rs.result, err
+	}
+	for _, archivePath := range archivePaths {
+		if err := walkArchive(archivePath, rs.restoreData); err != nil {
+			return rs.result, err
+		}
+	}
+	if !opts.SkipBlobs {
+		rs.restoreBlobs()
+	}
+	rs.restoreMembers()
+	if !opts.SkipPermissions {
+		for _, resource := range rs.permissions {
+			err := rs.grant(resource)
+			if errors.Is(err, errApplicationOwner) {
+				rs.result.SkippedPermissions = append(
+					rs.result.SkippedPermissions, resource)
+			} else if err != nil {
+				rs.errs = append(rs.errs, fmt.Errorf("permission on %s %s: %w",
+					resource.Type, resource.Id, err))
+			} else {
+				rs.result.Counts["permissions"]++
+			}
+		}
+	}
+
+	if len(rs.errs) > 0 {
+		return rs.result, fmt.Errorf("%d restore errors: %w", len(rs.errs),
+			errors.Join(rs.errs...))
+	}
+	return rs.result, nil
+}
@@ -0,0 +1,470 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+	"github.com/simplereach/timeutils"
+)
+
+// accountServer serves a whole account. Items can be created, documents
+// searched, repositories, schemas, documents and users updated (replacing
+// their content), blobs deleted, and permissions granted.
+type accountServer struct {
+	repoServer
+	repositories []*Repository
+	userSchemas []*UserSchema
+	users map[uuid.UUID][]*User
+	groups []*Group
+	groupUsers map[uuid.UUID][]uuid.UUID
+	collections []*Collection
+	collectionDocs map[uuid.UUID][]uuid.UUID
+	applications []*Application
+	permissions []Resource
+	// grants are the paths and the bodies of the permission calls
+	grants []string
+}
+
+func newAccountServer() *accountServer {
+	return &accountServer{repoServer: repoServer{
+		docs: map[uuid.UUID][]*Document{}, blobs: map[uuid.UUID][]byte{}},
+		users: map[uuid.UUID][]*User{},
+		groupUsers: map[uuid.UUID][]uuid.UUID{},
+		collectionDocs: map[uuid.UUID][]uuid.UUID{}}
+}
+
+// changed returns the items of r updated after its last_update__gt filter
+func changed[T any](r *http.Request, items []T,
+	lastUpdate func(T) time.Time) []T {
+	filter := r.URL.Query().Get("last_update__gt")
+	if filter == "" {
+		return items
+	}
+	since, _ := time.Parse(time.RFC3339, filter)
+	result := []T{}
+	for _, item := range items {
+		if lastUpdate(item).After(since) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (s *accountServer) user(id uuid.UUID) *User {
+	for _, users := range s.users {
+		for _, user := range users {
+			if user.Id == id {
+				return user
+			}
+		}
+	}
+	return nil
+}
+
+func (s *accountServer) findRepository(id uuid.UUID) *Repository {
+	for _, repository := range s.repositories {
+		if repository.Id == id {
+			return repository
+		}
+	}
+	return nil
+}
+
+func (s *accountServer) findSchema(id uuid.UUID) *Schema {
+	for _, schema := range s.schemas {
+		if schema.Id == id {
+			return schema
+		}
+	}
+	return nil
+}
+
+func (s *accountServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "blobs" && r.Method == "DELETE" {
+		id, _ := uuid.Parse(parts[1])
+		delete(s.blobs, id)
+		s.reply(w, map[string]any{})
+		return
+	}
+	if parts[0] == "blobs" && r.Method != "GET" {
+		s.upload(w, r, parts)
+		return
+	}
+	if parts[0] == "perms" && r.Method == "POST" {
+		body, _ := io.ReadAll(r.Body)
+		s.grants = append(s.grants, path + " " + string(body))
+		s.reply(w, map[string]any{})
+		return
+	}
+	var id uuid.UUID
+	if len(parts) > 1 {
+		id, _ = uuid.Parse(parts[1])
+	}
+	now := timeutils.Time{Time: time.Now()}
+	switch {
+	case path == "/repositories" && r.Method == "POST":
+		repository := &Repository{}
+		json.NewDecoder(r.Body).Decode(repository)
+		repository.Id = uuid.New()
+		s.repositories = append(s.repositories, repository)
+		s.reply(w, map[string]any{"repository": repository})
+	case path == "/repositories":
+		s.reply(w, page(r, "repositories", s.repositories))
+	case parts[0] == "repositories" && len(parts) == 2 && r.Method == "PUT":
+		repository := s.findRepository(id)
+		json.NewDecoder(r.Body).Decode(repository)
+		repository.Id = id
+		s.reply(w, map[string]any{"repository": repository})
+	case parts[0] == "repositories" && len(parts) == 2:
+		s.reply(w, map[string]any{"repository": s.findRepository(id)})
+	case parts[0] == "repositories" && r.Method == "POST":
+		schema := &Schema{}
+		json.NewDecoder(r.Body).Decode(schema)
+		schema.Id, schema.RepositoryId = uuid.New(), id
+		s.schemas = append(s.schemas, schema)
+		s.reply(w, map[string]any{"schema": schema})
+	case parts[0] == "repositories":
+		schemas := []*Schema{}
+		for _, schema := range s.schemas {
+			if schema.RepositoryId == id {
+				schemas = append(schemas, schema)
+			}
+		}
+		s.reply(w, page(r, "schemas", schemas))
+	case parts[0] == "schemas" && r.Method == "POST":
+		doc := &Document{}
+		json.NewDecoder(r.Body).Decode(doc)
+		doc.Id, doc.SchemaId = uuid.New(), id
+		doc.InsertDate, doc.LastUpdate = now, now
+		s.docs[id] = append(s.docs[id], doc)
+		s.reply(w, map[string]any{"document": doc})
+	case parts[0] == "schemas" && r.Method == "PUT":
+		schema := s.findSchema(id)
+		repositoryId := schema.RepositoryId
+		json.NewDecoder(r.Body).Decode(schema)
+		schema.Id, schema.RepositoryId = id, repositoryId
+		s.reply(w, map[string]any{"schema": schema})
+	case parts[0] == "search":
+		id, _ = uuid.Parse(parts[2])
+		search := map[string]map[string]any{}
+		json.NewDecoder(r.Body).Decode(&search)
+		docs, _ := NewEvaluator(s.findSchema(id)).FilterDocuments(
+			search["query"], s.docs[id])
+		s.reply(w, page(r, "documents", docs))
+	case parts[0] == "schemas":
+		s.reply(w, page(r, "documents", changed(r, s.docs[id],
+			func(doc *Document) time.Time { return doc.LastUpdate.Time })))
+	case parts[0] == "documents" && r.Method == "PUT":
+		// the content is replaced, not merged
+		doc := s.document(id)
+		doc.Content = nil
+		json.NewDecoder(r.Body).Decode(doc)
+		doc.Id, doc.LastUpdate = id, now
+		s.reply(w, map[string]any{"document": doc})
+	case path == "/user_schemas" && r.Method == "POST":
+		userSchema := &UserSchema{}
+		json.NewDecoder(r.Body).Decode(userSchema)
+		userSchema.Id = uuid.New()
+		s.userSchemas = append(s.userSchemas, userSchema)
+		s.reply(w, map[string]any{"user_schema": userSchema})
+	case path == "/user_schemas":
+		s.reply(w, page(r, "user_schemas", s.userSchemas))
+	case parts[0] == "user_schemas" && r.Method == "POST":
+		user := &User{}
+		json.NewDecoder(r.Body).Decode(user)
+		user.Id, user.UserSchemaId = uuid.New(), id
+		user.InsertDate, user.LastUpdate = now, now
+		s.users[id] = append(s.users[id], user)
+		s.reply(w, map[string]any{"user": user})
+	case parts[0] == "user_schemas":
+		s.reply(w, page(r, "users", changed(r, s.users[id],
+			func(user *User) time.Time { return user.LastUpdate.Time })))
+	case parts[0] == "users" && r.Method == "PUT":
+		user := s.user(id)
+		user.Attributes = nil
+		json.NewDecoder(r.Body).Decode(user)
+		user.Id, user.LastUpdate = id, now
+		s.reply(w, map[string]any{"user": user})
+	case path == "/groups" && r.Method == "POST":
+		group := &Group{}
+		json.NewDecoder(r.Body).Decode(group)
+		group.Id = uuid.New()
+		s.groups = append(s.groups, group)
+		s.reply(w, map[string]any{"group": group})
+	case path == "/groups":
+		s.reply(w, page(r, "groups", s.groups))
+	case parts[0] == "groups" && r.Method == "POST":
+		userId, _ := uuid.Parse(parts[3])
+		s.groupUsers[id] = append(s.groupUsers[id], userId)
+		s.reply(w, map[string]any{})
+	case parts[0] == "groups":
+		users := []*User{}
+		for _, userId := range s.groupUsers[id] {
+			users = append(users, s.user(userId))
+		}
+		s.reply(w, page(r, "users", users))
+	case path == "/collections" && r.Method == "POST":
+		collection := &Collection{}
+		json.NewDecoder(r.Body).Decode(collection)
+		collection.Id = uuid.New()
+		s.collections = append(s.collections, collection)
+		s.reply(w, collection)
+	case path == "/collections":
+		s.reply(w, page(r, "collections", s.collections))
+	case parts[0] == "collections" && r.Method == "POST":
+		docId, _ := uuid.Parse(parts[3])
+		s.collectionDocs[id] = append(s.collectionDocs[id], docId)
+		s.reply(w, map[string]any{})
+	case parts[0] == "collections":
+		docs := []*Document{}
+		for _, docId := range s.collectionDocs[id] {
+			docs = append(docs, s.document(docId))
+		}
+		s.reply(w, page(r, "documents", docs))
+	case path == "/auth/applications" && r.Method == "POST":
+		application := &Application{}
+		json.NewDecoder(r.Body).Decode(application)
+		application.Id = fmt.Sprintf("app-%d", len(s.applications) + 1)
+		application.Secret = "new secret"
+		s.applications = append(s.applications, application)
+		s.reply(w, map[string]any{"application": application})
+	case path == "/auth/applications":
+		s.reply(w, page(r, "applications", s.applications))
+	case path == "/perms":
+		s.reply(w, map[string]any{"permissions": s.permissions})
+	case parts[0] == "blobs" && s.blobs[id] != nil:
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.blobs[id])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newBackupAccount returns an account with a repository, a schema of two
+// documents (the first one with a blob, the second one in a collection)
+// and a user in a group, with permissions on them
+func newBackupAccount() *accountServer {
+	s := newAccountServer()
+	past := timeutils.Time{Time: time.Now().Add(-time.Hour)}
+	repository := &Repository{Id: uuid.New(), Description: "people",
+		IsActive: true}
+	schema := &Schema{Id: uuid.New(), RepositoryId: repository.Id,
+		Description: "person", IsActive: true, Structure: []SchemaField{
+			{Name: "name", Type: TypeStr},
+			{Name: "photo", Type: TypeBlob},
+		}}
+	blobId := uuid.New()
+	alice := &Document{Id: uuid.New(), SchemaId: schema.Id, IsActive: true,
+		InsertDate: past, LastUpdate: past, Content: map[string]any{
+			"name": "alice", "photo": blobId.String()}}
+	bob := &Document{Id: uuid.New(), SchemaId: schema.Id, IsActive: true,
+		InsertDate: past, LastUpdate: past, Content: map[string]any{
+			"name": "bob"}}
+	userSchema := &UserSchema{Id: uuid.New(), Description: "staff",
+		IsActive: true, Structure: []SchemaField{
+			{Name: "email", Type: TypeStr}}}
+	user := &User{Id: uuid.New(), UserSchemaId: userSchema.Id,
+		Username: "jdoe", Password: "secret", IsActive: true,
+		InsertDate: past, LastUpdate: past,
+		Attributes: map[string]any{"email": "jdoe@example.com"}}
+	group := &Group{Id: uuid.New(), Name: "admins", IsActive: true}
+	collection := &Collection{Id: uuid.New(), Name: "favourites",
+		IsActive: true}
+	perms := map[PermissionScope][]PermissionType{
+		PermissionScopeManage: {PermissionTypeRead}}
+	appId := uuid.New().String()
+
+	s.repositories = []*Repository{repository}
+	s.schemas = []*Schema{schema}
+	s.docs[schema.Id] = []*Document{alice, bob}
+	s.blobs[blobId] = []byte("hello blob")
+	s.userSchemas = []*UserSchema{userSchema}
+	s.users[userSchema.Id] = []*User{user}
+	s.groups = []*Group{group}
+	s.groupUsers[group.Id] = []uuid.UUID{user.Id}
+	s.collections = []*Collection{collection}
+	s.collectionDocs[collection.Id] = []uuid.UUID{bob.Id}
+	s.applications = []*Application{{Id: appId, Secret: "app secret",
+		Name: "web", GrantType: GrantPassword, ClientType: ClientPublic}}
+	s.permissions = []Resource{
+		{Type: ResourceRepository, OwnerId: user.Id, OwnerType: ResourceUser,
+			Permission: perms},
+		{Id: schema.Id, Type: ResourceSchema, OwnerId: user.Id,
+			OwnerType: ResourceUser, Permission: perms},
+		{ParentId: schema.Id, Type: ResourceDocument, OwnerId: group.Id,
+			OwnerType: ResourceGroup, Permission: perms},
+		{Id: schema.Id, Type: ResourceSchema,
+			OwnerId: uuid.MustParse(appId), Permission: perms},
+	}
+	return s
+}
+
+func TestBackupAccount(t *testing.T) {
+	source := newBackupAccount()
+	server := httptest.NewServer(source)
+	defer server.Close()
+	custodia := NewCustodiaAPIv1(common.NewClient(server.URL,
+		common.GetFakeAuth()))
+	schema := source.schemas[0]
+	alice, bob := source.docs[schema.Id][0], source.docs[schema.Id][1]
+	userSchema := source.userSchemas[0]
+	var blobId uuid.UUID
+	for id := range source.blobs {
+		blobId = id
+	}
+
+	dir := t.TempDir()
+	fullPath := filepath.Join(dir, "full.tar")
+	file, _ := os.Create(fullPath)
+	full, err := custodia.BackupAccount(nil, file, &BackupOptions{
+		PageSize: 1})
+	file.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verified, verifyErr := VerifyBackup(fullPath)
+	users := string(readEntry(t, fullPath, fmt.Sprintf("users/%s.ndjson",
+		userSchema.Id)))
+	groups := []BackupGroup{}
+	decodeLines(strings.NewReader(string(readEntry(t, fullPath,
+		"groups.ndjson"))), func(group BackupGroup) error {
+		groups = append(groups, group)
+		return nil
+	})
+
+	// bob is updated and carol created: they are in the incremental backup
+	source.mutex.Lock()
+	bob.Content["name"] = "robert"
+	bob.LastUpdate = timeutils.Time{Time: time.Now()}
+	carol := &Document{Id: uuid.New(), SchemaId: schema.Id, IsActive: true,
+		InsertDate: bob.LastUpdate, LastUpdate: bob.LastUpdate,
+		Content: map[string]any{"name": "carol"}}
+	source.docs[schema.Id] = append(source.docs[schema.Id], carol)
+	source.mutex.Unlock()
+	incrementalPath := filepath.Join(dir, "incremental.zip")
+	file, _ = os.Create(incrementalPath)
+	incremental, err := custodia.BackupAccount(nil, file, &BackupOptions{
+		Archive: ArchiveZip, Since: full.CreatedAt})
+	file.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{nil, verifyErr},
+		{full.Files, verified.Files},
+		{false, full.Incremental()},
+		{map[string]int{"repositories": 1, "schemas": 1, "user_schemas": 1,
+			"groups": 1, "collections": 1, "applications": 1,
+			"permissions": 4, "users": 1, "documents": 2, "blobs": 1},
+			full.Counts},
+		{1, len(full.Blobs)},
+		{blobId, full.Blobs[0].Id},
+		{alice.Id.String(), full.Blobs[0].DocumentId},
+		{[]byte("hello blob"), readEntry(t, fullPath, "blobs/" +
+			blobId.String())},
+		{true, strings.Contains(users, "jdoe")},
+		{false, strings.Contains(users, "secret")},
+		{false, strings.Contains(string(readEntry(t, fullPath,
+			"applications.ndjson")), "secret")},
+		{[]uuid.UUID{source.users[userSchema.Id][0].Id}, groups[0].Users},
+		{true, incremental.Incremental()},
+		{2, incremental.Counts["documents"]},
+		{0, incremental.Counts["users"]},
+		{0, len(incremental.Blobs)},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("BackupAccount %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+
+	// restore both backups into an empty account
+	target := newAccountServer()
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+	restoring := NewCustodiaAPIv1(common.NewClient(targetServer.URL,
+		common.GetFakeAuth()))
+	_, err = restoring.RestoreAccount(nil, []string{incrementalPath}, nil)
+	if err == nil || !strings.Contains(err.Error(), "must be full") {
+		t.Errorf("expected a missing full backup error, got: %v", err)
+	}
+	result, err := restoring.RestoreAccount(nil, []string{fullPath,
+		incrementalPath}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ids := result.Ids
+	newSchema := ids[schema.Id]
+	restored := map[string]*Document{}
+	for _, doc := range target.docs[newSchema] {
+		restored[fmt.Sprint(doc.Content["name"])] = doc
+	}
+	newBlob := ids[blobId]
+	newUser := target.users[ids[userSchema.Id]][0]
+	manage := `{"manage":["R"]}`
+	tests = []struct {
+		want any
+		got any
+	}{
+		{map[string]int{"repositories": 1, "schemas": 1, "user_schemas": 1,
+			"groups": 1, "collections": 1, "applications": 1,
+			"permissions": 3, "users": 1, "documents": 3, "blobs": 1},
+			result.Counts},
+		{ids[source.repositories[0].Id], target.schemas[0].RepositoryId},
+		{schema.Structure, target.schemas[0].Structure},
+		{3, len(restored)},
+		{ids[alice.Id], restored["alice"].Id},
+		{ids[bob.Id], restored["robert"].Id},
+		{ids[carol.Id], restored["carol"].Id},
+		{newBlob.String(), restored["alice"].Content["photo"]},
+		{[]byte("hello blob"), target.blobs[newBlob]},
+		{ids[source.users[userSchema.Id][0].Id], newUser.Id},
+		{"jdoe", newUser.Username},
+		{"", newUser.Password},
+		{"jdoe@example.com", newUser.Attributes["email"]},
+		{[]uuid.UUID{newUser.Id}, target.groupUsers[ids[source.groups[0].Id]]},
+		{[]uuid.UUID{ids[bob.Id]},
+			target.collectionDocs[ids[source.collections[0].Id]]},
+		{map[string]string{source.applications[0].Id: "app-1"},
+			result.ApplicationIds},
+		// the permission of the application is not granted
+		{[]Resource{source.permissions[3]}, result.SkippedPermissions},
+		{"new secret", result.Applications[0].Secret},
+		{[]string{
+			fmt.Sprintf("/perms/grant/repositories/users/%s %s", newUser.Id,
+				manage),
+			fmt.Sprintf("/perms/grant/schemas/%s/users/%s %s", newSchema,
+				newUser.Id, manage),
+			fmt.Sprintf("/perms/grant/schemas/%s/documents/groups/%s %s",
+				newSchema, ids[source.groups[0].Id], manage),
+		}, target.grants},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("RestoreAccount %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+}
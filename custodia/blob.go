@@ -1,7 +1,6 @@
 package custodia
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -53,12 +52,12 @@ func (ca *CustodiaAPIv1) CreateBlob(documentId uuid.UUID, fieldName string,
 		return nil, err
 	}
 	blobEnvelope := BlobEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &blobEnvelope); err != nil {
+	if err := decodeJSON(resp, &blobEnvelope); err != nil {
 		return nil, err
 	}
 
 	uploadBlobEnvelope := &UploadBlobEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &uploadBlobEnvelope); err != nil {
+	if err := decodeJSON(resp, &uploadBlobEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -87,12 +86,12 @@ func (ca *CustodiaAPIv1) UploadChunk(uploadId uuid.UUID, data []byte,
 	}
 
 	blobEnvelope := BlobEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &blobEnvelope); err != nil {
+	if err := decodeJSON(resp, &blobEnvelope); err != nil {
 		return nil, err
 	}
 
 	uploadBlobEnvelope := &UploadBlobEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &uploadBlobEnvelope); err != nil {
+	if err := decodeJSON(resp, &uploadBlobEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -109,7 +108,7 @@ func (ca *CustodiaAPIv1) CommitBlob(uploadId uuid.UUID) (*Blob, error) {
 		return nil, err
 	}
 	blobEnvelope := BlobEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &blobEnvelope); err != nil {
+	if err := decodeJSON(resp, &blobEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -120,12 +119,12 @@ func (ca *CustodiaAPIv1) CommitBlob(uploadId uuid.UUID) (*Blob, error) {
 func (ca *CustodiaAPIv1) GetBlobData(blobId uuid.UUID) (io.Reader, error) {
 	url := fmt.Sprintf("/blobs/%s", blobId)
 	params := map[string]any{"_rawResponse": true}
-	_, err := ca.Call("GET", url, params)
+	httpResp, _, err := ca.call("GET", url, params)
 	if err != nil {
 		return nil, err
 	}
 
-	return ca.RawResponse.Body, nil
+	return httpResp.Body, nil
 }
 
 // Delete a blob
@@ -149,7 +148,7 @@ func (ca *CustodiaAPIv1) GenerateBlobToken(blobId uuid.UUID, oneTime bool,
 	// since one_time is a bool, but we already know it (it's a func param)
 	// we return just the map with two strings
 	blobToken := &BlobToken{}
-	if err := json.Unmarshal([]byte(resp), blobToken); err != nil {
+	if err := decodeJSON(resp, blobToken); err != nil {
 		return nil, err
 	}
 
@@ -164,14 +163,14 @@ func (ca *CustodiaAPIv1) GetBlobDataWithToken(blobId uuid.UUID, token string) (
 
 	ca.client.GetAuth().SwitchTo(common.NoAuth)
 
-	_, err := ca.Call("GET", url, params)
+	httpResp, _, err := ca.call("GET", url, params)
 	if err != nil {
 		return nil, err
 	}
 
 	ca.client.GetAuth().SwitchBack()
 
-	return ca.RawResponse.Body, nil
+	return httpResp.Body, nil
 }
 
 // Upload a blob from a file
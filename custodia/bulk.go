@@ -0,0 +1,389 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultRetryBackoff is the delay before the first retry of a bulk item
+// when not given, doubled at each retry
+const DefaultRetryBackoff = 500 * time.Millisecond
+
+// errFailFast is the error of the items not processed after a failure in
+// fail-fast mode
+var errFailFast = errors.New("not processed: a previous item failed")
+
+// BulkOptions are the options of the bulk operations
+type BulkOptions struct {
+	// Concurrency is the number of concurrent requests, 0 means
+	// DefaultConcurrency
+	Concurrency int
+	// FailFast stops sending at the first failed item. The items not sent
+	// are reported as skipped. By default, all the items are sent.
+	FailFast bool
+	// MaxRetries is the number of retries of an item failing with a
+	// temporary error (network errors, 429 and 5xx responses)
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled at each
+	// retry, 0 means DefaultRetryBackoff. A longer Retry-After of the
+	// server is honoured and pauses all the workers.
+	RetryBackoff time.Duration
+	// RequestsPerSecond limits the rate of the requests, 0 means no limit
+	RequestsPerSecond float64
+}
+
+// BulkResult is the outcome of a single item of a bulk operation
+type BulkResult struct {
+	// Index is the position of the item in the input stream
+	Index int
+	DocumentId uuid.UUID
+	Status ItemStatus
+	// Attempts is the number of tries of the item, retries included
+	Attempts int
+	// Error is a validation error, an *APIError or a network error. A
+	// succeeded item has a *HistoryError if its revision wasn't recorded.
+	Error error
+}
+
+// BulkReport reports the outcome of a bulk operation
+type BulkReport struct {
+	// Results has a result for each item read, sorted by Index
+	Results []BulkResult
+}
+
+// Count returns the number of results with status
+func (r *BulkReport) Count(status ItemStatus) int {
+	count := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Failed returns the results of the failed items
+func (r *BulkReport) Failed() []BulkResult {
+	failed := []BulkResult{}
+	for _, result := range r.Results {
+		if result.Status == ItemFailed {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Stream returns a closed channel with items, as input of the bulk
+// operations
+func Stream[T any](items []T) <-chan T {
+	stream := make(chan T, len(items))
+	for _, item := range items {
+		stream <- item
+	}
+	close(stream)
+	return stream
+}
+
+// rateLimiter spaces the requests of all the workers by interval, and
+// pauses them when the server asks to
+type rateLimiter struct {
+	mutex sync.Mutex
+	interval time.Duration
+	next time.Time
+}
+
+func newRateLimiter(requestsPerSecond float64) *rateLimiter {
+	rl := &rateLimiter{}
+	if requestsPerSecond > 0 {
+		rl.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return rl
+}
+
+// wait blocks until the next request can be sent
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	rl.mutex.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(rl.interval)
+	rl.mutex.Unlock()
+	return sleep(ctx, delay)
+}
+
+// pause delays all the requests by at least delay from now
+func (rl *rateLimiter) pause(delay time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if until := time.Now().Add(delay); rl.next.Before(until) {
+		rl.next = until
+	}
+}
+
+// sleep waits for delay or until ctx is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isTemporary returns true for the errors worth a retry
+func isTemporary(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// runBulk reads items until the stream is closed and runs process on each
+// of them with a pool of workers, retrying the temporary errors
+func runBulk[T any](ctx context.Context, items <-chan T, opts *BulkOptions,
+	process func(item T) (uuid.UUID, error)) (*BulkReport, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	backoff := opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	limiter := newRateLimiter(opts.RequestsPerSecond)
+
+	// stopped is closed on the first failure in fail-fast mode
+	stopped := make(chan struct{})
+	var stopOnce sync.Once
+
+	send := func(item T) BulkResult {
+		result := BulkResult{Status: ItemFailed}
+		for {
+			if err := limiter.wait(ctx); err != nil {
+				result.Error = err
+				return result
+			}
+			result.Attempts++
+			id, err := process(item)
+			result.DocumentId, result.Error = id, err
+			// a change applied without its revision is not retried
+			var historyErr *HistoryError
+			if err == nil || errors.As(err, &historyErr) {
+				result.Status = ItemSucceeded
+				return result
+			}
+			if result.Attempts > opts.MaxRetries || !isTemporary(err) {
+				return result
+			}
+
+			delay := backoff << (result.Attempts - 1)
+			var apiErr *APIError
+			if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+				delay = apiErr.RetryAfter
+				limiter.pause(delay)
+			}
+			if err := sleep(ctx, delay); err != nil {
+				return result
+			}
+		}
+	}
+
+	type job struct {
+		index int
+		item T
+	}
+	jobs := make(chan job)
+	var mutex sync.Mutex
+	report := &BulkReport{Results: []BulkResult{}}
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				var result BulkResult
+				select {
+				case <-stopped:
+					result = BulkResult{Status: ItemSkipped, Error: errFailFast}
+				default:
+					result = send(j.item)
+				}
+				result.Index = j.index
+				if result.Status == ItemFailed && opts.FailFast {
+					stopOnce.Do(func() { close(stopped) })
+				}
+				mutex.Lock()
+				report.Results = append(report.Results, result)
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	// read the whole stream, so the producer is never blocked: in
+	// fail-fast mode the remaining items are skipped
+	index := 0
+reading:
+	for {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				break reading
+			}
+			select {
+			case jobs <- job{index: index, item: item}:
+			case <-ctx.Done():
+				break reading
+			}
+			index++
+		case <-ctx.Done():
+			break reading
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].Index < report.Results[j].Index
+	})
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if failed := report.Failed(); len(failed) > 0 {
+		return report, fmt.Errorf("%d of %d items failed, first (item %d): " +
+			"%w", len(failed), len(report.Results), failed[0].Index,
+			failed[0].Error)
+	}
+	ee := []error{}
+	for _, result := range report.Results {
+		if result.Status == ItemSucceeded && result.Error != nil {
+			ee = append(ee, fmt.Errorf("item %d: %w", result.Index,
+				result.Error))
+		}
+	}
+	if len(ee) > 0 {
+		return report, fmt.Errorf("%d of %d revisions not recorded: %w",
+			len(ee), len(report.Results), errors.Join(ee...))
+	}
+	return report, nil
+}
+
+// contentOf returns the content of item: a map is returned as it is, a
+// struct (or a pointer to struct) is converted with the schema, its fields
+// matched by their `json` tag
+func contentOf(item any, schema StructureMapper) (map[string]any, error) {
+	if content, ok := item.(map[string]any); ok {
+		return content, nil
+	}
+	rv := reflect.ValueOf(item)
+	if rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a map[string]any or a struct, " +
+			"got: %T", item)
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	content := map[string]any{}
+	if err := decodeJSON(string(data), &content); err != nil {
+		return nil, err
+	}
+	converted, ee := convertData(content, schema)
+	if len(ee) > 0 {
+		return nil, fmt.Errorf("conversion errors: %w", errors.Join(ee...))
+	}
+	return converted, nil
+}
+
+// BulkCreateDocuments creates a document of schema for each item read from
+// contents, until it's closed. Items are content maps or structs (see
+// BulkUpdate for the conversion), validated before being sent.
+// When some items fail the report is returned with an error. A creation
+// retried after a server error may create a duplicate, if the server
+// stored the document before failing.
+func (ca *CustodiaAPIv1) BulkCreateDocuments(ctx context.Context,
+	schema *Schema, isActive bool, contents <-chan any, opts *BulkOptions) (
+	*BulkReport, error) {
+	if schema == nil {
+		return nil, fmt.Errorf("schema is nil")
+	}
+	return runBulk(ctx, contents, opts, func(item any) (uuid.UUID, error) {
+		content, err := contentOf(item, schema)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		doc, err := ca.CreateDocument(schema, isActive, content)
+		if doc != nil {
+			return doc.Id, err
+		}
+		return uuid.Nil, err
+	})
+}
+
+// BulkUpdate is an update of BulkUpdateDocuments. Content is a content map
+// or a struct, whose fields are matched by their `json` tag and converted
+// with the schema (e.g. a string for a date field).
+type BulkUpdate struct {
+	DocumentId uuid.UUID
+	IsActive bool
+	Content any
+}
+
+// BulkUpdateDocuments applies each update read from updates, until it's
+// closed. Errors are reported as in BulkCreateDocuments.
+func (ca *CustodiaAPIv1) BulkUpdateDocuments(ctx context.Context,
+	schema *Schema, updates <-chan BulkUpdate, opts *BulkOptions) (
+	*BulkReport, error) {
+	if schema == nil {
+		return nil, fmt.Errorf("schema is nil")
+	}
+	return runBulk(ctx, updates, opts, func(update BulkUpdate) (uuid.UUID,
+		error) {
+		content, err := contentOf(update.Content, schema)
+		if err != nil {
+			return update.DocumentId, err
+		}
+		_, err = ca.UpdateDocument(*schema, update.DocumentId,
+			update.IsActive, content)
+		return update.DocumentId, err
+	})
+}
+
+// BulkDeleteDocuments deletes (see DeleteDocument) each document read from
+// documentIds, until it's closed. Errors are reported as in
+// BulkCreateDocuments.
+func (ca *CustodiaAPIv1) BulkDeleteDocuments(ctx context.Context,
+	documentIds <-chan uuid.UUID, force, consistent bool,
+	opts *BulkOptions) (*BulkReport, error) {
+	return runBulk(ctx, documentIds, opts, func(id uuid.UUID) (uuid.UUID,
+		error) {
+		return id, ca.DeleteDocument(id, force, consistent)
+	})
+}
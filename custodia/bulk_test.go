@@ -0,0 +1,213 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+type bulkPatient struct {
+	Name string `json:"name"`
+	Born string `json:"born"`
+	Age int `json:"age"`
+}
+
+func TestBulkCreateDocuments(t *testing.T) {
+	schema := &Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr},
+		{Name: "born", Type: TypeDate},
+		{Name: "age", Type: TypeInt},
+	}}
+
+	var mutex sync.Mutex
+	attempts := map[string]int{}
+	created := []map[string]any{}
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		content := body["content"].(map[string]any)
+		name := content["name"].(string)
+
+		mutex.Lock()
+		attempts[name]++
+		count := attempts[name]
+		mutex.Unlock()
+
+		envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+		status := http.StatusOK
+		switch {
+		case name == "flaky" && count == 1:
+			status = http.StatusServiceUnavailable
+		case name == "busy" && count == 1:
+			status = http.StatusTooManyRequests
+			w.Header().Set("Retry-After", "1")
+		case name == "rejected":
+			status = http.StatusBadRequest
+		}
+		if status != http.StatusOK {
+			envelope = CustodiaEnvelope{Result: "error",
+				ResultCode: uint64(status),
+				Message: json.RawMessage(`"nope"`)}
+		} else {
+			mutex.Lock()
+			created = append(created, content)
+			mutex.Unlock()
+			envelope.Data, _ = json.Marshal(map[string]any{
+				"document": map[string]any{
+					"document_id": uuid.New().String(),
+					"schema_id": schema.Id.String(),
+					"is_active": true,
+					"content": content,
+				}})
+		}
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(status)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	items := []any{
+		map[string]any{"name": "map", "born": NewDate(1980, 1, 2),
+			"age": int64(44)},
+		bulkPatient{Name: "struct", Born: "1990-03-04", Age: 34},
+		&bulkPatient{Name: "flaky", Born: "1990-03-04", Age: 34},
+		map[string]any{"name": "invalid", "age": "old"},
+		bulkPatient{Name: "rejected", Born: "1990-03-04"},
+		42,
+	}
+	opts := &BulkOptions{Concurrency: 3, MaxRetries: 2,
+		RetryBackoff: time.Millisecond}
+	report, err := custodia.BulkCreateDocuments(context.Background(), schema,
+		true, Stream(items), opts)
+	if err == nil || !strings.Contains(err.Error(), "3 of 6 items failed") {
+		t.Errorf("expected failures, got: %v", err)
+	}
+
+	statuses := []ItemStatus{}
+	for _, result := range report.Results {
+		statuses = append(statuses, result.Status)
+	}
+	var apiErr *APIError
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{[]ItemStatus{ItemSucceeded, ItemSucceeded, ItemSucceeded,
+			ItemFailed, ItemFailed, ItemFailed}, statuses},
+		{2, report.Results[2].Attempts},
+		{2, attempts["flaky"]},
+		// validation errors are not sent, client errors not retried
+		{0, attempts["invalid"]},
+		{1, report.Results[3].Attempts},
+		{1, attempts["rejected"]},
+		{true, errors.As(report.Results[4].Error, &apiErr)},
+		{http.StatusBadRequest, apiErr.StatusCode},
+		{true, strings.Contains(report.Results[5].Error.Error(),
+			"got: int")},
+		{true, report.Results[0].DocumentId != uuid.Nil},
+		{3, len(report.Failed())},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+	for _, content := range created {
+		if content["name"] == "struct" && (content["born"] != "1990-03-04" ||
+			content["age"] != float64(34)) {
+			t.Errorf("bad struct content: %v", content)
+		}
+	}
+
+	// fail fast: the items after the failure are skipped
+	report, err = custodia.BulkCreateDocuments(context.Background(), schema,
+		true, Stream([]any{map[string]any{"name": "rejected"},
+			map[string]any{"name": "a"}, map[string]any{"name": "b"}}),
+		&BulkOptions{Concurrency: 1, FailFast: true})
+	if err == nil || report.Count(ItemFailed) != 1 ||
+		report.Count(ItemSkipped) != 2 {
+		t.Errorf("fail fast: got %+v, %v", report, err)
+	}
+
+	// Retry-After pauses the workers
+	start := time.Now()
+	report, err = custodia.BulkCreateDocuments(context.Background(), schema,
+		true, Stream([]any{map[string]any{"name": "busy"}}),
+		&BulkOptions{MaxRetries: 1, RetryBackoff: time.Millisecond})
+	if err != nil || report.Results[0].Attempts != 2 ||
+		time.Since(start) < time.Second {
+		t.Errorf("retry after: got %+v, %v in %v", report, err,
+			time.Since(start))
+	}
+
+	// rate limit
+	names := []any{}
+	for i := 0; i < 5; i++ {
+		names = append(names, map[string]any{"name": fmt.Sprint(i)})
+	}
+	start = time.Now()
+	_, err = custodia.BulkCreateDocuments(context.Background(), schema, true,
+		Stream(names), &BulkOptions{RequestsPerSecond: 50})
+	if err != nil || time.Since(start) < 80*time.Millisecond {
+		t.Errorf("rate limit: %v in %v", err, time.Since(start))
+	}
+}
+
+func TestBulkUpdateDeleteDocuments(t *testing.T) {
+	store := newFakeDocumentStore("a", "b", "c")
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := &Schema{Id: store.schemaId, Structure: []SchemaField{
+		{Name: "status", Type: TypeStr}}}
+
+	type status struct {
+		Status string `json:"status"`
+	}
+	missing := uuid.New()
+	report, err := custodia.BulkUpdateDocuments(context.Background(), schema,
+		Stream([]BulkUpdate{
+			{DocumentId: store.order[0], IsActive: true,
+				Content: status{Status: "x"}},
+			{DocumentId: missing, Content: map[string]any{"status": "y"}},
+		}), nil)
+	if err == nil || report.Count(ItemSucceeded) != 1 ||
+		report.Results[1].DocumentId != missing {
+		t.Errorf("update: got %+v, %v", report, err)
+	}
+	if store.docs[store.order[0]]["status"] != "x" {
+		t.Errorf("update: document not updated")
+	}
+
+	report, err = custodia.BulkDeleteDocuments(context.Background(),
+		Stream(store.order[1:]), true, false, &BulkOptions{Concurrency: 2})
+	if err != nil || report.Count(ItemSucceeded) != 2 ||
+		len(store.docs) != 1 {
+		t.Errorf("delete: got %+v, %v", report, err)
+	}
+
+	// canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = custodia.BulkDeleteDocuments(ctx, make(chan uuid.UUID), true,
+		false, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+}
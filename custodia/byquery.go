@@ -0,0 +1,452 @@
+package custodia
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// DefaultConcurrency is the number of concurrent requests of the by-query
+// operations when not given
+const DefaultConcurrency = 4
+
+// ItemStatus is the outcome of an operation on a single item
+type ItemStatus int
+
+const (
+	ItemSucceeded ItemStatus = iota + 1
+	ItemSkipped
+	ItemFailed
+)
+
+func (is ItemStatus) Choices() []string {
+	return []string{"succeeded", "skipped", "failed"}
+}
+
+func (is ItemStatus) String() string {
+	return is.Choices()[is-1]
+}
+
+func (is ItemStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(is.String())
+}
+
+func (is *ItemStatus) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, is.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("ItemStatus: received unknown value '%v'", value)
+	}
+
+	*is = ItemStatus(intValue)
+	return nil
+}
+
+// Checkpoint records the documents already processed by UpdateByQuery or
+// DeleteByQuery, so that an interrupted run can be resumed skipping them.
+// Failed documents are not recorded, they are retried.
+type Checkpoint interface {
+	// Load returns the ids of the processed documents
+	Load() ([]uuid.UUID, error)
+	// Save records documentId as processed
+	Save(documentId uuid.UUID) error
+}
+
+// MemoryCheckpoint is a Checkpoint kept in memory, to resume a run in the
+// same process
+type MemoryCheckpoint struct {
+	mutex sync.Mutex
+	ids []uuid.UUID
+}
+
+func (mc *MemoryCheckpoint) Load() ([]uuid.UUID, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return append([]uuid.UUID{}, mc.ids...), nil
+}
+
+func (mc *MemoryCheckpoint) Save(documentId uuid.UUID) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	mc.ids = append(mc.ids, documentId)
+	return nil
+}
+
+// FileCheckpoint is a Checkpoint stored in a file, one id per line. The
+// file is created on the first Save.
+type FileCheckpoint struct {
+	Path string
+}
+
+func (fc FileCheckpoint) Load() ([]uuid.UUID, error) {
+	file, err := os.Open(fc.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []uuid.UUID{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ids := []uuid.UUID{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, err := uuid.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %s: %w", fc.Path, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, scanner.Err()
+}
+
+func (fc FileCheckpoint) Save(documentId uuid.UUID) error {
+	file, err := os.OpenFile(fc.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, documentId); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ByQueryOptions are the options of UpdateByQuery and DeleteByQuery
+type ByQueryOptions struct {
+	// DryRun only counts the matching documents, and those the Checkpoint
+	// skips, nothing is changed
+	DryRun bool
+	// Concurrency is the number of concurrent requests, 0 means
+	// DefaultConcurrency
+	Concurrency int
+	// PageSize is the page size of the search, 0 means DefaultPageSize
+	PageSize int
+	// Force and Consistent are the DeleteDocument options
+	Force bool
+	Consistent bool
+	// Checkpoint (optional) records the processed documents
+	Checkpoint Checkpoint
+}
+
+// ByQueryResult is the outcome of the operation on a single document
+type ByQueryResult struct {
+	DocumentId uuid.UUID
+	Status ItemStatus
+	// Error is a *HistoryError for a succeeded document whose revision
+	// wasn't recorded
+	Error error
+}
+
+// ByQueryReport reports the outcome of UpdateByQuery and DeleteByQuery
+type ByQueryReport struct {
+	DryRun bool
+	// Matched is the number of documents matching the query
+	Matched int
+	// Resumed is the number of matching documents skipped because already
+	// processed according to the checkpoint
+	Resumed int
+	// Results has a result for each processed document, in search order
+	Results []ByQueryResult
+}
+
+// Count returns the number of results with status
+func (r *ByQueryReport) Count(status ItemStatus) int {
+	count := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// MutateFunc changes doc in place (content and active flag). It returns
+// false to leave the document unchanged.
+type MutateFunc func(doc *Document) (bool, error)
+
+// UpdateByQuery updates the documents of schema matching query: the
+// documents are searched with their content, passed to mutate and then
+// saved with UpdateDocument. Each document is processed once, even if it
+// still matches after the change; see byQuery for the iteration.
+// When some documents fail the report is returned with an error; the
+// iteration stops only when ctx is done.
+func (ca *CustodiaAPIv1) UpdateByQuery(ctx context.Context, schema *Schema,
+	query map[string]any, mutate MutateFunc, opts *ByQueryOptions) (
+	*ByQueryReport, error) {
+	if schema == nil {
+		return nil, fmt.Errorf("schema is nil")
+	}
+	if mutate == nil {
+		return nil, fmt.Errorf("mutate function is nil")
+	}
+	return ca.byQuery(ctx, schema.Id, schema, FullContent, query, opts,
+		func(doc *Document) (ItemStatus, error) {
+			// the searched document is the revision of the history
+			var prior *Document
+			if ca.History != nil {
+				snapshot := *doc
+				snapshot.Content = map[string]any{}
+				for name, value := range doc.Content {
+					snapshot.Content[name] = value
+				}
+				prior = &snapshot
+			}
+			changed, err := mutate(doc)
+			if err != nil {
+				return ItemFailed, err
+			} else if !changed {
+				return ItemSkipped, nil
+			}
+			if err := validate(doc.Content, schema); err != nil {
+				return ItemFailed, err
+			}
+			_, err = ca.updateDocument(*schema, prior, doc.Id, doc.IsActive,
+				doc.Content)
+			if err != nil {
+				return ItemFailed, err
+			}
+			return ItemSucceeded, nil
+		})
+}
+
+// DeleteByQuery deletes (or deactivates, see DeleteDocument) the documents
+// of schemaId matching query, with the Force and Consistent options.
+// Errors are reported as in UpdateByQuery.
+func (ca *CustodiaAPIv1) DeleteByQuery(ctx context.Context,
+	schemaId uuid.UUID, query map[string]any, opts *ByQueryOptions) (
+	*ByQueryReport, error) {
+	if opts == nil {
+		opts = &ByQueryOptions{}
+	}
+	return ca.byQuery(ctx, schemaId, nil, OnlyId, query, opts,
+		func(doc *Document) (ItemStatus, error) {
+			err := ca.DeleteDocument(doc.Id, opts.Force, opts.Consistent)
+			if err != nil {
+				return ItemFailed, err
+			}
+			return ItemSucceeded, nil
+		})
+}
+
+// matchingIds returns the ids of all the documents matching query
+func (ca *CustodiaAPIv1) matchingIds(ctx context.Context,
+	schemaId uuid.UUID, query map[string]any, pageSize int) (
+	[]uuid.UUID, error) {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]uuid.UUID,
+		PageInfo, error) {
+		resp, err := ca.searchDocuments(schemaId, nil, OnlyId, query, nil,
+			pageParams(offset, limit))
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		return resp.Ids, resp.Page(), nil
+	}).All()
+}
+
+// byQuery applies process to the documents matching query, searched with
+// resultType (FullContent or OnlyId) page by page, with a pool of workers.
+// Only a page is kept in memory. The changes of a page can shift the
+// following documents to the pages already read, so the search is
+// repeated, skipping the documents already seen, until a pass processes
+// no document.
+func (ca *CustodiaAPIv1) byQuery(ctx context.Context, schemaId uuid.UUID,
+	schema *Schema, resultType ResultType, query map[string]any,
+	opts *ByQueryOptions, process func(doc *Document) (ItemStatus, error)) (
+	*ByQueryReport, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts == nil {
+		opts = &ByQueryOptions{}
+	}
+	report := &ByQueryReport{DryRun: opts.DryRun, Results: []ByQueryResult{}}
+
+	// skip the documents already processed
+	done := map[uuid.UUID]bool{}
+	if opts.Checkpoint != nil {
+		processed, err := opts.Checkpoint.Load()
+		if err != nil {
+			return nil, fmt.Errorf("error loading checkpoint: %w", err)
+		}
+		for _, id := range processed {
+			done[id] = true
+		}
+	}
+
+	if opts.DryRun {
+		if opts.Checkpoint == nil {
+			count, err := ca.CountDocuments(schemaId, query)
+			if err != nil {
+				return nil, err
+			}
+			report.Matched = count
+			return report, nil
+		}
+		ids, err := ca.matchingIds(ctx, schemaId, query, opts.PageSize)
+		if err != nil {
+			return nil, fmt.Errorf("error searching documents: %w", err)
+		}
+		report.Matched = len(ids)
+		for _, id := range ids {
+			if done[id] {
+				report.Resumed++
+			}
+		}
+		return report, nil
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	// a failing checkpoint stops the workers too
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var checkpointErr error
+	var mutex sync.Mutex
+
+	// processPage processes docs with the workers, in order
+	processPage := func(docs []*Document) []ByQueryResult {
+		results := make([]ByQueryResult, len(docs))
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < min(concurrency, len(docs)); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					if ctx.Err() != nil {
+						continue
+					}
+					status, err := process(docs[i])
+					// the change was applied, only its revision is missing
+					var historyErr *HistoryError
+					if errors.As(err, &historyErr) {
+						status = ItemSucceeded
+					}
+					results[i] = ByQueryResult{DocumentId: docs[i].Id,
+						Status: status, Error: err}
+					if status == ItemFailed || opts.Checkpoint == nil {
+						continue
+					}
+					mutex.Lock()
+					if err := opts.Checkpoint.Save(docs[i].Id); err != nil &&
+						checkpointErr == nil {
+						checkpointErr = err
+						cancel()
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
+		for i := range docs {
+			if ctx.Err() != nil {
+				break
+			}
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		return results
+	}
+
+	// seen are the matching documents of this run, processed or resumed
+	seen := map[uuid.UUID]bool{}
+	processed := 0
+	var searchErr error
+	for pass := true; pass && searchErr == nil && ctx.Err() == nil; {
+		pass = false
+		for offset := 0; ctx.Err() == nil; offset += pageSize {
+			resp, err := ca.searchDocuments(schemaId, schema, resultType,
+				query, nil, pageParams(offset, pageSize))
+			if err != nil {
+				searchErr = err
+				break
+			}
+			docs := resp.Documents
+			if resultType == OnlyId {
+				docs = []*Document{}
+				for _, id := range resp.Ids {
+					docs = append(docs, &Document{Id: id})
+				}
+			}
+
+			pending := []*Document{}
+			for _, doc := range docs {
+				if seen[doc.Id] {
+					continue
+				}
+				seen[doc.Id] = true
+				report.Matched++
+				if done[doc.Id] {
+					report.Resumed++
+				} else {
+					pending = append(pending, doc)
+				}
+			}
+			for _, result := range processPage(pending) {
+				if result.Status != 0 {
+					report.Results = append(report.Results, result)
+				}
+			}
+			processed += len(pending)
+			pass = pass || len(pending) > 0
+			if len(docs) < pageSize || offset+len(docs) >= resp.TotalCount {
+				break
+			}
+		}
+	}
+
+	// collect the errors of the processed documents
+	ee, unrecorded := []error{}, []error{}
+	for _, result := range report.Results {
+		err := fmt.Errorf("document %s: %w", result.DocumentId, result.Error)
+		if result.Status == ItemFailed {
+			ee = append(ee, err)
+		} else if result.Error != nil {
+			unrecorded = append(unrecorded, err)
+		}
+	}
+
+	if checkpointErr != nil {
+		return report, fmt.Errorf("error saving checkpoint: %w",
+			checkpointErr)
+	}
+	// context canceled by the caller
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if searchErr != nil {
+		return report, fmt.Errorf("error searching documents: %w",
+			searchErr)
+	}
+	if len(ee) > 0 {
+		return report, fmt.Errorf("%d of %d documents failed: %w", len(ee),
+			processed, errors.Join(ee...))
+	}
+	if len(unrecorded) > 0 {
+		return report, fmt.Errorf("%d of %d revisions not recorded: %w",
+			len(unrecorded), processed, errors.Join(unrecorded...))
+	}
+	return report, nil
+}
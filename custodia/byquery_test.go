@@ -0,0 +1,283 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// fakeDocumentStore serves search, read, update and delete of the documents
+// of a single schema. The calls on the ids in failing fail.
+type fakeDocumentStore struct {
+	mutex sync.Mutex
+	schemaId uuid.UUID
+	docs map[uuid.UUID]map[string]any
+	order []uuid.UUID
+	failing map[uuid.UUID]bool
+	updated []uuid.UUID
+	deleted []string
+	// resultTypes are the result types of the searches
+	resultTypes []any
+	// reads counts the documents read one by one
+	reads int
+}
+
+func newFakeDocumentStore(statuses ...string) *fakeDocumentStore {
+	store := &fakeDocumentStore{schemaId: uuid.New(),
+		docs: map[uuid.UUID]map[string]any{}, failing: map[uuid.UUID]bool{}}
+	for _, status := range statuses {
+		id := uuid.New()
+		store.docs[id] = map[string]any{"status": status}
+		store.order = append(store.order, id)
+	}
+	return store
+}
+
+func (s *fakeDocumentStore) reply(w http.ResponseWriter, status int,
+	data any) {
+	envelope := CustodiaEnvelope{Result: "success",
+		ResultCode: uint64(status)}
+	if status != http.StatusOK {
+		envelope.Result = "error"
+		envelope.Message = json.RawMessage(`"boom"`)
+	}
+	envelope.Data, _ = json.Marshal(data)
+	out, _ := json.Marshal(envelope)
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func (s *fakeDocumentStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path,
+		"/api/v1/search/documents/") {
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		query := body["query"].(map[string]any)
+		s.resultTypes = append(s.resultTypes, body["result_type"])
+		matching := []uuid.UUID{}
+		for _, id := range s.order {
+			content, ok := s.docs[id]
+			if ok && content["status"] == query["value"] {
+				matching = append(matching, id)
+			}
+		}
+		if body["result_type"] == "COUNT" {
+			s.reply(w, http.StatusOK, map[string]any{"count": len(matching)})
+			return
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := min(offset+limit, len(matching))
+		page := map[string]any{"count": end - offset,
+			"total_count": len(matching), "limit": limit, "offset": offset}
+		if body["result_type"] == "ONLY_ID" {
+			page["IDs"] = matching[offset:end]
+		} else {
+			docs := []any{}
+			for _, id := range matching[offset:end] {
+				docs = append(docs, map[string]any{"document_id": id,
+					"schema_id": s.schemaId, "is_active": true,
+					"content": s.docs[id]})
+			}
+			page["documents"] = docs
+		}
+		s.reply(w, http.StatusOK, page)
+		return
+	}
+
+	id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/api/v1/documents/"))
+	if err != nil || s.docs[id] == nil {
+		s.reply(w, http.StatusNotFound, nil)
+		return
+	}
+	if s.failing[id] {
+		s.reply(w, http.StatusInternalServerError, nil)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		s.reads++
+		s.reply(w, http.StatusOK, map[string]any{"document": map[string]any{
+			"document_id": id, "schema_id": s.schemaId, "is_active": true,
+			"content": s.docs[id]}})
+	case "PUT":
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		content := body["content"].(map[string]any)
+		s.docs[id] = content
+		s.updated = append(s.updated, id)
+		s.reply(w, http.StatusOK, map[string]any{"document": map[string]any{
+			"document_id": id, "schema_id": s.schemaId,
+			"is_active": body["is_active"], "content": content}})
+	case "DELETE":
+		delete(s.docs, id)
+		s.deleted = append(s.deleted, r.URL.RawQuery)
+		s.reply(w, http.StatusOK, nil)
+	}
+}
+
+func TestUpdateByQuery(t *testing.T) {
+	store := newFakeDocumentStore("expired", "active", "expired", "expired",
+		"expired")
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	schema := &Schema{Id: store.schemaId, Structure: []SchemaField{
+		{Name: "status", Type: TypeStr, Indexed: true}}}
+	query, _ := BuildQuery(schema, Field("status").Eq("expired"))
+	archive := func(doc *Document) (bool, error) {
+		if doc.Id == store.order[4] {
+			return false, nil
+		}
+		doc.Content["status"] = "archived"
+		return true, nil
+	}
+
+	// dry run
+	report, err := custodia.UpdateByQuery(context.Background(), schema,
+		query, archive, &ByQueryOptions{DryRun: true})
+	if err != nil || !report.DryRun || report.Matched != 4 ||
+		len(report.Results) != 0 || len(store.updated) != 0 {
+		t.Fatalf("dry run: got %+v, %v", report, err)
+	}
+
+	// a failure is reported, the other documents are updated
+	store.failing[store.order[2]] = true
+	checkpoint := &MemoryCheckpoint{}
+	opts := &ByQueryOptions{Concurrency: 2, PageSize: 2,
+		Checkpoint: checkpoint}
+	report, err = custodia.UpdateByQuery(context.Background(), schema, query,
+		archive, opts)
+	if err == nil || !strings.Contains(err.Error(), store.order[2].String()) {
+		t.Errorf("expected error on document %s, got: %v", store.order[2],
+			err)
+	}
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{4, report.Matched},
+		{4, len(report.Results)},
+		{2, report.Count(ItemSucceeded)},
+		{1, report.Count(ItemSkipped)},
+		{1, report.Count(ItemFailed)},
+		{store.order[0], report.Results[0].DocumentId},
+		{ItemFailed, report.Results[1].Status},
+		{"archived", store.docs[store.order[0]]["status"]},
+		{"expired", store.docs[store.order[2]]["status"]},
+		// the document shifted to the first page by the changes is found
+		// by a second pass, a third one finds nothing new
+		{"archived", store.docs[store.order[3]]["status"]},
+		{[]any{"COUNT", "FULL_CONTENT", "FULL_CONTENT", "FULL_CONTENT",
+			"FULL_CONTENT", "FULL_CONTENT"}, store.resultTypes},
+		// the documents come with the search, none is read
+		{0, store.reads},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	// resume: only the failed document is processed, the skipped one is
+	// in the checkpoint, as the dry run reports
+	store.failing = map[uuid.UUID]bool{}
+	store.updated = nil
+	report, err = custodia.UpdateByQuery(context.Background(), schema, query,
+		archive, &ByQueryOptions{DryRun: true, Checkpoint: checkpoint})
+	if err != nil || report.Matched != 2 || report.Resumed != 1 ||
+		len(store.updated) != 0 {
+		t.Errorf("resume dry run: got %+v, %v", report, err)
+	}
+	report, err = custodia.UpdateByQuery(context.Background(), schema, query,
+		archive, opts)
+	if err != nil || report.Matched != 2 || report.Resumed != 1 ||
+		len(report.Results) != 1 {
+		t.Errorf("resume: got %+v, %v", report, err)
+	}
+	if !reflect.DeepEqual(store.updated, []uuid.UUID{store.order[2]}) {
+		t.Errorf("resume: bad updated documents %v", store.updated)
+	}
+
+	// bad arguments
+	if _, err := custodia.UpdateByQuery(nil, nil, query, archive,
+		nil); err == nil {
+		t.Errorf("expected error with nil schema")
+	}
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	statuses := []string{}
+	for i := 0; i < 25; i++ {
+		statuses = append(statuses, "expired")
+	}
+	store := newFakeDocumentStore(append(statuses, "active")...)
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	query, _ := BuildQuery(nil, Field("status").Eq("expired"))
+	checkpoint := FileCheckpoint{Path: filepath.Join(t.TempDir(), "ids")}
+	report, err := custodia.DeleteByQuery(context.Background(),
+		store.schemaId, query, &ByQueryOptions{PageSize: 10, Force: true,
+			Consistent: true, Checkpoint: checkpoint})
+	if err != nil || report.Matched != 25 ||
+		report.Count(ItemSucceeded) != 25 {
+		t.Fatalf("got %+v, %v", report, err)
+	}
+	if len(store.docs) != 1 || store.deleted[0] !=
+		"force=true&consistent=true" {
+		t.Errorf("bad deletes: %d documents left, %v", len(store.docs),
+			store.deleted[0])
+	}
+
+	saved, err := checkpoint.Load()
+	if err != nil || len(saved) != 25 {
+		t.Errorf("checkpoint: got %d ids, %v", len(saved), err)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].String() < saved[j].String()
+	})
+	want := append([]uuid.UUID{}, store.order[:25]...)
+	sort.Slice(want, func(i, j int) bool {
+		return want[i].String() < want[j].String()
+	})
+	if !reflect.DeepEqual(want, saved) {
+		t.Errorf("checkpoint: bad ids")
+	}
+
+	// missing checkpoint file
+	ids, err := FileCheckpoint{Path: filepath.Join(t.TempDir(),
+		"missing")}.Load()
+	if err != nil || len(ids) != 0 {
+		t.Errorf("missing checkpoint: got %v, %v", ids, err)
+	}
+
+	// canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = custodia.DeleteByQuery(ctx, store.schemaId, query, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+}
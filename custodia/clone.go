@@ -0,0 +1,673 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Define ConflictPolicy
+type ConflictPolicy int
+
+const (
+	// ConflictSkip leaves the existing items as they are
+	ConflictSkip ConflictPolicy = iota + 1
+	// ConflictOverwrite updates the existing items to match the source
+	ConflictOverwrite
+	// ConflictRename creates new items, with a description made unique
+	// with a number (e.g. "people (2)"). Documents, which have no name, are
+	// created again.
+	ConflictRename
+)
+
+func (cp ConflictPolicy) Choices() []string {
+	return []string{"skip", "overwrite", "rename"}
+}
+
+func (cp ConflictPolicy) String() string {
+	return cp.Choices()[cp-1]
+}
+
+func (cp ConflictPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cp.String())
+}
+
+func (cp *ConflictPolicy) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, cp.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("ConflictPolicy: received unknown value '%v'", value)
+	}
+
+	*cp = ConflictPolicy(intValue)
+	return nil
+}
+
+// Define CloneAction
+type CloneAction int
+
+const (
+	CloneCreate CloneAction = iota + 1
+	CloneUpdate
+	// CloneKeep leaves an existing item as it is
+	CloneKeep
+)
+
+func (cla CloneAction) Choices() []string {
+	return []string{"create", "update", "keep"}
+}
+
+func (cla CloneAction) String() string {
+	return cla.Choices()[cla-1]
+}
+
+func (cla CloneAction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cla.String())
+}
+
+func (cla *CloneAction) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, cla.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("CloneAction: received unknown value '%v'", value)
+	}
+
+	*cla = CloneAction(intValue)
+	return nil
+}
+
+// CloneOptions are the options of CloneRepository
+type CloneOptions struct {
+	// Repository is the target repository. If uuid.Nil, the repository is
+	// matched by description in the target, and created if missing.
+	Repository uuid.UUID
+	// Conflict is the policy for the items matched in the target,
+	// ConflictSkip if not given
+	Conflict ConflictPolicy
+	// Schemas are the descriptions of the schemas to clone, all if empty.
+	// Schemas are matched by description in the target repository.
+	Schemas []string
+	// Documents maps the descriptions of the schemas whose documents are
+	// cloned to the query selecting them (search DSL, see BuildQuery), nil
+	// for all of them
+	Documents map[string]map[string]any
+	// DocumentKeys maps the descriptions of the schemas to a field
+	// identifying their documents in both environments: a document with the
+	// key of a target document is matched to it. Without a key, documents
+	// are always created.
+	DocumentKeys map[string]string
+	// SkipBlobs clones the documents without copying their blobs. The
+	// updated documents of the target keep their blobs, which are otherwise
+	// replaced (and deleted) when the source document has a different one:
+	// the blobs of the matched documents are downloaded to compare them.
+	SkipBlobs bool
+	// DryRun reports the changes, with the differences of the matched
+	// items, without writing to the target. The documents to write are
+	// validated.
+	DryRun bool
+	// PageSize is the page size of the list calls, 0 means DefaultPageSize
+	PageSize int
+}
+
+// CloneItem is the outcome of cloning a repository, schema or document
+type CloneItem struct {
+	// Kind is "repository", "schema" or "document"
+	Kind string
+	SourceId uuid.UUID
+	// TargetId is uuid.Nil for the items not created (dry-run, errors)
+	TargetId uuid.UUID
+	// Name is the description in the target of repositories and schemas,
+	// the key of documents (if any)
+	Name string
+	Action CloneAction
+	// Changes are the differences of a matched item from the source (the
+	// structure of schemas, the content of documents), applied with
+	// CloneUpdate
+	Changes []FieldChange
+	// Status is ItemSkipped in dry-run
+	Status ItemStatus
+	Error error
+}
+
+// CloneReport reports the outcome of a clone
+type CloneReport struct {
+	DryRun bool
+	// Ids maps the source ids to the target ones
+	Ids map[uuid.UUID]uuid.UUID
+	Items []CloneItem
+}
+
+// Count returns the number of items with the given status
+func (r *CloneReport) Count(status ItemStatus) int {
+	count := 0
+	for _, item := range r.Items {
+		if item.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Failed returns the failed items
+func (r *CloneReport) Failed() []CloneItem {
+	failed := []CloneItem{}
+	for _, item := range r.Items {
+		if item.Status == ItemFailed {
+			failed = append(failed, item)
+		}
+	}
+	return failed
+}
+
+// cloner clones a repository between two clients
+type cloner struct {
+	source *CustodiaAPIv1
+	target *CustodiaAPIv1
+	ctx context.Context
+	opts *CloneOptions
+	report *CloneReport
+}
+
+// add reports item, with the id of the target item and the error
+func (cl *cloner) add(item CloneItem, targetId uuid.UUID, err error) {
+	item.TargetId = targetId
+	switch {
+	case err != nil:
+		item.Status, item.Error = ItemFailed, err
+	case cl.opts.DryRun:
+		item.Status = ItemSkipped
+	default:
+		item.Status = ItemSucceeded
+	}
+	if targetId != uuid.Nil {
+		cl.report.Ids[item.SourceId] = targetId
+	}
+	cl.report.Items = append(cl.report.Items, item)
+}
+
+// uniqueName returns name followed by the first number making it not
+// taken
+func uniqueName(name string, taken map[string]bool) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", name, i)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+// structureDiff returns the changes of the fields from old to new
+func structureDiff(old, new []SchemaField) []FieldChange {
+	fields := func(structure []SchemaField) map[string]any {
+		result := map[string]any{}
+		for _, field := range structure {
+			field.Constraints = nil  // client-side only
+			result[field.Name] = field
+		}
+		return result
+	}
+	return Diff(fields(old), fields(new))
+}
+
+// cloneRepository returns the target repository, with uuid.Nil id if it
+// would be created in dry-run
+func (cl *cloner) cloneRepository(repository *Repository) (*Repository,
+	error) {
+	item := CloneItem{Kind: "repository", SourceId: repository.Id,
+		Name: repository.Description, Action: CloneKeep}
+	if cl.opts.Repository != uuid.Nil {
+		existing, err := cl.target.ReadRepository(cl.opts.Repository)
+		if err != nil {
+			return nil, fmt.Errorf("target repository: %w", err)
+		}
+		item.Name = existing.Description
+		cl.add(item, existing.Id, nil)
+		return existing, nil
+	}
+
+	repositories, err := cl.target.IterRepositories(cl.ctx,
+		cl.opts.PageSize).All()
+	if err != nil {
+		return nil, fmt.Errorf("target repositories: %w", err)
+	}
+	var existing *Repository
+	taken := map[string]bool{}
+	for _, candidate := range repositories {
+		taken[candidate.Description] = true
+		if existing == nil &&
+			candidate.Description == repository.Description {
+			existing = candidate
+		}
+	}
+
+	result := existing
+	switch {
+	case existing == nil || cl.opts.Conflict == ConflictRename:
+		item.Action = CloneCreate
+		if existing != nil {
+			item.Name = uniqueName(repository.Description, taken)
+		}
+		result = &Repository{Description: item.Name,
+			IsActive: repository.IsActive}
+		if !cl.opts.DryRun {
+			result, err = cl.target.CreateRepository(item.Name,
+				repository.IsActive)
+		}
+	case cl.opts.Conflict == ConflictOverwrite &&
+		existing.IsActive != repository.IsActive:
+		item.Action = CloneUpdate
+		result = &Repository{Id: existing.Id, Description: item.Name,
+			IsActive: repository.IsActive}
+		if !cl.opts.DryRun {
+			result, err = cl.target.UpdateRepository(existing.Id, item.Name,
+				repository.IsActive)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("target repository: %w", err)
+	}
+	cl.add(item, result.Id, nil)
+	return result, nil
+}
+
+// cloneSchema returns the target schema, with uuid.Nil id if it would be
+// created in dry-run
+func (cl *cloner) cloneSchema(schema *Schema, repositoryId uuid.UUID,
+	existing *Schema, taken map[string]bool) (*Schema, error) {
+	item := CloneItem{Kind: "schema", SourceId: schema.Id,
+		Name: schema.Description, Action: CloneKeep}
+	result := existing
+	var err error
+	switch {
+	case existing == nil || cl.opts.Conflict == ConflictRename:
+		item.Action = CloneCreate
+		if existing != nil {
+			item.Name = uniqueName(schema.Description, taken)
+		}
+		taken[item.Name] = true
+		result = &Schema{RepositoryId: repositoryId, Description: item.Name,
+			IsActive: schema.IsActive, Structure: schema.Structure,
+			Rules: schema.Rules}
+		if !cl.opts.DryRun {
+			result, err = cl.target.CreateSchema(repositoryId, item.Name,
+				schema.IsActive, schema.Structure)
+		}
+	case cl.opts.Conflict == ConflictOverwrite:
+		item.Changes = structureDiff(existing.Structure, schema.Structure)
+		if len(item.Changes) == 0 && existing.IsActive == schema.IsActive {
+			break
+		}
+		item.Action = CloneUpdate
+		result = &Schema{Id: existing.Id, RepositoryId: repositoryId,
+			Description: item.Name, IsActive: schema.IsActive,
+			Structure: schema.Structure, Rules: schema.Rules}
+		if !cl.opts.DryRun {
+			result, err = cl.target.UpdateSchema(existing.Id, item.Name,
+				schema.IsActive, schema.Structure)
+		}
+	default:
+		item.Changes = structureDiff(existing.Structure, schema.Structure)
+	}
+	if err != nil {
+		cl.add(item, uuid.Nil, err)
+		return nil, err
+	}
+	cl.add(item, result.Id, nil)
+	return result, nil
+}
+
+// documentKey returns the key of doc, "" if none
+func documentKey(doc *Document, key string) string {
+	if key == "" || doc.Content[key] == nil {
+		return ""
+	}
+	return fmt.Sprint(doc.Content[key])
+}
+
+// blobFields splits the content of doc into the values of the blob fields
+// and the rest
+func blobFields(doc *Document, schema *Schema) (map[string]any,
+	map[uuid.UUID]string) {
+	content := map[string]any{}
+	for name, value := range doc.Content {
+		content[name] = value
+	}
+	blobs := map[uuid.UUID]string{}
+	for _, ref := range blobRefs(doc, schema) {
+		blobs[ref.id] = ref.field
+	}
+	for _, field := range schema.Structure {
+		if field.Type == TypeBlob {
+			delete(content, field.Name)
+		}
+	}
+	return content, blobs
+}
+
+// copyBlob copies a blob of the source to field of a target document
+func (cl *cloner) copyBlob(blobId, documentId uuid.UUID, field string) error {
+	data, err := cl.source.GetBlobData(blobId)
+	if err != nil {
+		return err
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+	file, err := os.CreateTemp("", "custodia-clone-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	blob, err := cl.target.CreateBlobFromFile(file.Name(), documentId, field,
+		0)
+	if err != nil {
+		return err
+	}
+	cl.report.Ids[blobId] = blob.Id
+	return nil
+}
+
+// blobSum returns the sha1 of the data of a blob
+func blobSum(ca *CustodiaAPIv1, blobId uuid.UUID) (string, error) {
+	data, err := ca.GetBlobData(blobId)
+	if err != nil {
+		return "", err
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+	hw := newHashWriter()
+	if _, err := io.Copy(hw, data); err != nil {
+		return "", err
+	}
+	return hexSum(hw.sha1), nil
+}
+
+// blobChanges returns the changes of the blobs of a source document from
+// the ones of existing, with the blobs to copy by field. Blobs of the
+// same field are compared by checksum.
+func (cl *cloner) blobChanges(blobs map[uuid.UUID]string,
+	existing *Document, target *Schema) ([]FieldChange,
+	map[uuid.UUID]string, error) {
+	existingBlobs := map[string]uuid.UUID{}
+	for _, ref := range blobRefs(existing, target) {
+		existingBlobs[ref.field] = ref.id
+	}
+	changes, changed := []FieldChange{}, map[uuid.UUID]string{}
+	for blobId, field := range blobs {
+		old, ok := existingBlobs[field]
+		if !ok {
+			changes = append(changes, FieldChange{Field: field,
+				Kind: FieldAdded, New: blobId.String()})
+			changed[blobId] = field
+			continue
+		}
+		sum, err := blobSum(cl.source, blobId)
+		if err != nil {
+			return nil, nil, fmt.Errorf("blob %s: %w", blobId, err)
+		}
+		oldSum, err := blobSum(cl.target, old)
+		if err != nil {
+			return nil, nil, fmt.Errorf("blob %s: %w", old, err)
+		}
+		if sum != oldSum {
+			changes = append(changes, FieldChange{Field: field,
+				Kind: FieldModified, Old: old.String(), New: blobId.String()})
+			changed[blobId] = field
+		}
+	}
+	return changes, changed, nil
+}
+
+// cloneDocument clones doc into target, matched with existing
+func (cl *cloner) cloneDocument(doc *Document, schema, target *Schema,
+	existing *Document, key string) {
+	item := CloneItem{Kind: "document", SourceId: doc.Id,
+		Name: documentKey(doc, key), Action: CloneKeep}
+	content, blobs := blobFields(doc, schema)
+	targetId := uuid.Nil
+	var err error
+	switch {
+	case existing == nil || cl.opts.Conflict == ConflictRename:
+		item.Action = CloneCreate
+		if cl.opts.DryRun {
+			// the checks of CreateDocument
+			if cl.target.FillDefaults {
+				content, err = target.ApplyDefaults(content)
+			}
+			if err == nil {
+				err = validate(content, target)
+			}
+			break
+		}
+		var created *Document
+		if created, err = cl.target.CreateDocument(target, doc.IsActive,
+			content); err == nil {
+			targetId = created.Id
+		}
+	case cl.opts.Conflict == ConflictOverwrite:
+		targetId = existing.Id
+		existingContent, _ := blobFields(existing, target)
+		item.Changes = Diff(existingContent, content)
+		update := len(item.Changes) > 0 || existing.IsActive != doc.IsActive
+		if !cl.opts.SkipBlobs {
+			// only the blobs changed are copied
+			var changes []FieldChange
+			changes, blobs, err = cl.blobChanges(blobs, existing, target)
+			if err != nil {
+				break
+			}
+			item.Changes = append(item.Changes, changes...)
+			sort.SliceStable(item.Changes, func(i, j int) bool {
+				return item.Changes[i].Field < item.Changes[j].Field
+			})
+		}
+		if !update && len(item.Changes) == 0 {
+			break
+		}
+		item.Action = CloneUpdate
+		// the update replaces the whole content: the blobs of the target
+		// are kept, and replaced once copied
+		for _, ref := range blobRefs(existing, target) {
+			content[ref.field] = ref.id.String()
+		}
+		if cl.opts.DryRun {
+			err = validate(content, target)
+			break
+		}
+		if update {
+			_, err = cl.target.UpdateDocument(*target, existing.Id,
+				doc.IsActive, content)
+		}
+	default:
+		targetId = existing.Id
+		existingContent, _ := blobFields(existing, target)
+		item.Changes = Diff(existingContent, content)
+	}
+
+	if err == nil && item.Action != CloneKeep && !cl.opts.DryRun &&
+		!cl.opts.SkipBlobs {
+		for blobId, field := range blobs {
+			if err = cl.copyBlob(blobId, targetId, field); err != nil {
+				err = fmt.Errorf("blob %s: %w", blobId, err)
+				break
+			}
+			// the replaced blob of the target is not referenced anymore
+			if old, ok := content[field].(string); ok &&
+				item.Action == CloneUpdate {
+				oldId, _ := uuid.Parse(old)
+				if err = cl.target.DeleteBlob(oldId); err != nil {
+					err = fmt.Errorf("blob %s: %w", oldId, err)
+					break
+				}
+			}
+		}
+	}
+	cl.add(item, targetId, err)
+}
+
+// cloneDocuments clones the documents of schema matching query into target
+func (cl *cloner) cloneDocuments(schema, target *Schema,
+	query map[string]any) error {
+	key := cl.opts.DocumentKeys[schema.Description]
+	existing := map[string]*Document{}
+	if key != "" && target.Id != uuid.Nil {
+		docs, err := NewPager(cl.ctx, cl.opts.PageSize, func(offset,
+			limit int) ([]*Document, PageInfo, error) {
+			params := pageParams(offset, limit)
+			params["full_document"] = "true"
+			return cl.target.listDocuments(target, params)
+		}).All()
+		if err != nil {
+			return fmt.Errorf("target documents: %w", err)
+		}
+		for _, doc := range docs {
+			if value := documentKey(doc, key); value != "" {
+				existing[value] = doc
+			}
+		}
+	}
+
+	docs := NewPager(cl.ctx, cl.opts.PageSize, func(offset, limit int) (
+		[]*Document, PageInfo, error) {
+		params := pageParams(offset, limit)
+		if query == nil {
+			params["full_document"] = "true"
+			return cl.source.listDocuments(schema, params)
+		}
+		resp, err := cl.source.searchDocuments(schema.Id, schema,
+			FullContent, query, nil, params)
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		return resp.Documents, resp.Page(), nil
+	})
+	for docs.Next() {
+		doc := docs.Value()
+		var match *Document
+		if value := documentKey(doc, key); value != "" {
+			match = existing[value]
+		}
+		cl.cloneDocument(doc, schema, target, match, key)
+	}
+	return docs.Err()
+}
+
+// CloneRepository copies the repository of this client, its schemas and
+// (optionally) a selection of their documents with their blobs, to the
+// target client, e.g. from a staging to a production environment.
+// Repositories and schemas are matched in the target by description,
+// documents by key (see CloneOptions), and the matched ones are handled
+// with the conflict policy. The report maps the source ids to the target
+// ones, and has the differences of the matched items: with DryRun, it's
+// the plan of the changes.
+// Errors reading the repositories stop the clone; the errors of the single
+// schemas and documents are reported, returning an error at the end.
+func (ca *CustodiaAPIv1) CloneRepository(ctx context.Context,
+	repositoryId uuid.UUID, target *CustodiaAPIv1, opts *CloneOptions) (
+	*CloneReport, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if target == nil {
+		return nil, fmt.Errorf("target is nil")
+	}
+	if opts == nil {
+		opts = &CloneOptions{}
+	}
+	options := *opts
+	if options.Conflict == 0 {
+		options.Conflict = ConflictSkip
+	} else if options.Conflict < 0 || options.Conflict > ConflictRename {
+		return nil, fmt.Errorf("unknown conflict policy %d", options.Conflict)
+	}
+	cl := &cloner{source: ca, target: target, ctx: ctx, opts: &options,
+		report: &CloneReport{DryRun: options.DryRun,
+			Ids: map[uuid.UUID]uuid.UUID{}, Items: []CloneItem{}}}
+
+	repository, err := ca.ReadRepository(repositoryId)
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := ca.IterSchemas(ctx, repositoryId, options.PageSize).All()
+	if err != nil {
+		return nil, err
+	}
+	if len(options.Schemas) > 0 {
+		byName := map[string]*Schema{}
+		for _, schema := range schemas {
+			byName[schema.Description] = schema
+		}
+		schemas = []*Schema{}
+		for _, name := range options.Schemas {
+			schema, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("schema '%s' not found", name)
+			}
+			schemas = append(schemas, schema)
+		}
+	}
+
+	targetRepository, err := cl.cloneRepository(repository)
+	if err != nil {
+		return cl.report, err
+	}
+	targetSchemas := []*Schema{}
+	if targetRepository.Id != uuid.Nil {
+		targetSchemas, err = target.IterSchemas(ctx, targetRepository.Id,
+			options.PageSize).All()
+		if err != nil {
+			return cl.report, fmt.Errorf("target schemas: %w", err)
+		}
+	}
+	existing := map[string]*Schema{}
+	taken := map[string]bool{}
+	for _, schema := range targetSchemas {
+		taken[schema.Description] = true
+		if _, ok := existing[schema.Description]; !ok {
+			existing[schema.Description] = schema
+		}
+	}
+
+	for _, schema := range schemas {
+		targetSchema, err := cl.cloneSchema(schema, targetRepository.Id,
+			existing[schema.Description], taken)
+		if err != nil {
+			continue
+		}
+		query, ok := options.Documents[schema.Description]
+		if !ok {
+			continue
+		}
+		if err := cl.cloneDocuments(schema, targetSchema, query); err != nil {
+			return cl.report, fmt.Errorf("schema '%s': %w",
+				schema.Description, err)
+		}
+	}
+
+	if failed := cl.report.Failed(); len(failed) > 0 {
+		return cl.report, fmt.Errorf("%d of %d items failed, first: %w",
+			len(failed), len(cl.report.Items), failed[0].Error)
+	}
+	return cl.report, nil
+}
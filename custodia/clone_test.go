@@ -0,0 +1,314 @@
+package custodia
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// newCloneAccounts returns a source account with the schemas "person" (of
+// three documents, the first one with a blob) and "note", and a target
+// account with an older "person" schema, without the blob field, and a
+// document of bob
+func newCloneAccounts() (*accountServer, *accountServer) {
+	source := newAccountServer()
+	repository := &Repository{Id: uuid.New(), Description: "people",
+		IsActive: true}
+	person := &Schema{Id: uuid.New(), RepositoryId: repository.Id,
+		Description: "person", IsActive: true, Structure: []SchemaField{
+			{Name: "name", Type: TypeStr, Indexed: true},
+			{Name: "age", Type: TypeInt, Indexed: true},
+			{Name: "photo", Type: TypeBlob},
+		}}
+	note := &Schema{Id: uuid.New(), RepositoryId: repository.Id,
+		Description: "note", IsActive: true, Structure: []SchemaField{
+			{Name: "text", Type: TypeStr}}}
+	blobId := uuid.New()
+	for i, name := range []string{"alice", "bob", "carol"} {
+		doc := &Document{Id: uuid.New(), SchemaId: person.Id, IsActive: true,
+			Content: map[string]any{"name": name, "age": 30 + i}}
+		if i == 0 {
+			doc.Content["photo"] = blobId.String()
+		}
+		source.docs[person.Id] = append(source.docs[person.Id], doc)
+	}
+	source.docs[note.Id] = []*Document{{Id: uuid.New(), SchemaId: note.Id,
+		IsActive: true, Content: map[string]any{"text": "hello"}}}
+	source.repositories = []*Repository{repository}
+	source.schemas = []*Schema{person, note}
+	source.blobs[blobId] = []byte("hello blob")
+
+	target := newAccountServer()
+	targetRepository := &Repository{Id: uuid.New(), Description: "people",
+		IsActive: true}
+	targetPerson := &Schema{Id: uuid.New(),
+		RepositoryId: targetRepository.Id, Description: "person",
+		IsActive: true, Structure: person.Structure[:2]}
+	target.repositories = []*Repository{targetRepository}
+	target.schemas = []*Schema{targetPerson}
+	target.docs[targetPerson.Id] = []*Document{{Id: uuid.New(),
+		SchemaId: targetPerson.Id, IsActive: true,
+		Content: map[string]any{"name": "bob", "age": 99}}}
+	return source, target
+}
+
+func TestCloneRepository(t *testing.T) {
+	source, target := newCloneAccounts()
+	sourceServer := httptest.NewServer(source)
+	defer sourceServer.Close()
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+	staging := NewCustodiaAPIv1(common.NewClient(sourceServer.URL,
+		common.GetFakeAuth()))
+	production := NewCustodiaAPIv1(common.NewClient(targetServer.URL,
+		common.GetFakeAuth()))
+
+	repository := source.repositories[0]
+	person := source.schemas[0]
+	alice := source.docs[person.Id][0]
+	targetRepository := target.repositories[0]
+	targetPerson := target.schemas[0]
+	targetBob := target.docs[targetPerson.Id][0]
+	query, err := BuildQuery(person, Field("age").Gte(31))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// dry-run: the plan, with the differences, and nothing written
+	plan, err := staging.CloneRepository(nil, repository.Id, production,
+		&CloneOptions{Conflict: ConflictOverwrite, DryRun: true,
+			Documents: map[string]map[string]any{"person": query},
+			DocumentKeys: map[string]string{"person": "name"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	summary := func(report *CloneReport) [][]any {
+		result := [][]any{}
+		for _, item := range report.Items {
+			result = append(result, []any{item.Kind, item.Name,
+				item.Action, item.TargetId, item.Status})
+		}
+		return result
+	}
+	tests := []struct {
+		want any
+		got any
+	}{
+		{[][]any{
+			{"repository", "people", CloneKeep, targetRepository.Id,
+				ItemSkipped},
+			{"schema", "person", CloneUpdate, targetPerson.Id, ItemSkipped},
+			{"document", "bob", CloneUpdate, targetBob.Id, ItemSkipped},
+			{"document", "carol", CloneCreate, uuid.Nil, ItemSkipped},
+			{"schema", "note", CloneCreate, uuid.Nil, ItemSkipped},
+		}, summary(plan)},
+		{[]FieldChange{{Field: "photo", Kind: FieldAdded,
+			New: person.Structure[2]}}, plan.Items[1].Changes},
+		{[]FieldChange{{Field: "age", Kind: FieldModified, Old: int64(99),
+			New: int64(31)}}, plan.Items[2].Changes},
+		{1, len(target.schemas)},
+		{2, len(targetPerson.Structure)},
+		{1, len(target.docs[targetPerson.Id])},
+		{99, targetBob.Content["age"]},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("CloneRepository dry-run %d: bad value, got: %v "+
+				"want: %v", i, test.got, test.want)
+		}
+	}
+
+	// overwrite all the documents into the given repository
+	opts := &CloneOptions{Repository: targetRepository.Id,
+		Conflict: ConflictOverwrite,
+		Documents: map[string]map[string]any{"person": nil},
+		DocumentKeys: map[string]string{"person": "name"}}
+	report, err := staging.CloneRepository(nil, repository.Id, production,
+		opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	targetDocs := map[string]*Document{}
+	for _, doc := range target.docs[targetPerson.Id] {
+		targetDocs[doc.Content["name"].(string)] = doc
+	}
+	var blobId uuid.UUID
+	for id := range source.blobs {
+		blobId = id
+	}
+	newBlob := report.Ids[blobId]
+	tests = []struct {
+		want any
+		got any
+	}{
+		{6, report.Count(ItemSucceeded)},
+		{person.Structure, targetPerson.Structure},
+		{2, len(target.schemas)},
+		{"note", target.schemas[1].Description},
+		{targetRepository.Id, target.schemas[1].RepositoryId},
+		{report.Ids[source.schemas[1].Id], target.schemas[1].Id},
+		{3, len(targetDocs)},
+		{targetBob, targetDocs["bob"]},
+		{31.0, targetBob.Content["age"]},
+		{report.Ids[alice.Id], targetDocs["alice"].Id},
+		{newBlob.String(), targetDocs["alice"].Content["photo"]},
+		{[]byte("hello blob"), target.blobs[newBlob]},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("CloneRepository overwrite %d: bad value, got: %v "+
+				"want: %v", i, test.got, test.want)
+		}
+	}
+
+	// skipping, everything is kept as it is
+	opts.Conflict = ConflictSkip
+	report, err = staging.CloneRepository(nil, repository.Id, production,
+		opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kept := 0
+	for _, item := range report.Items {
+		if item.Action == CloneKeep && len(item.Changes) == 0 {
+			kept++
+		}
+	}
+	tests = []struct {
+		want any
+		got any
+	}{
+		{6, len(report.Items)},
+		{6, kept},
+		{3, len(target.docs[targetPerson.Id])},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("CloneRepository skip %d: bad value, got: %v want: %v",
+				i, test.got, test.want)
+		}
+	}
+
+	// bob has a blob in the target only: kept with SkipBlobs
+	targetBlob := uuid.New()
+	target.blobs[targetBlob] = []byte("target blob")
+	targetBob.Content["photo"] = targetBlob.String()
+	sourceBob := source.docs[person.Id][1]
+	sourceBob.Content["age"] = 40
+	opts.Conflict, opts.SkipBlobs = ConflictOverwrite, true
+	_, err = staging.CloneRepository(nil, repository.Id, production, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keptPhoto, keptAge := targetBob.Content["photo"], targetBob.Content["age"]
+
+	// then replaced (and deleted) by the blob of the source
+	sourceBlob := uuid.New()
+	source.blobs[sourceBlob] = []byte("source blob")
+	sourceBob.Content["photo"] = sourceBlob.String()
+	sourceBob.Content["age"] = 41
+	opts.SkipBlobs = false
+	report, err = staging.CloneRepository(nil, repository.Id, production,
+		opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests = []struct {
+		want any
+		got any
+	}{
+		{targetBlob.String(), keptPhoto},
+		{40.0, keptAge},
+		{report.Ids[sourceBlob].String(), targetBob.Content["photo"]},
+		{41.0, targetBob.Content["age"]},
+		{[]byte("source blob"), target.blobs[report.Ids[sourceBlob]]},
+		{false, target.blobs[targetBlob] != nil},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("CloneRepository blobs %d: bad value, got: %v "+
+				"want: %v", i, test.got, test.want)
+		}
+	}
+
+	// bobItem returns the item of bob in report
+	bobItem := func(report *CloneReport) CloneItem {
+		for _, item := range report.Items {
+			if item.SourceId == sourceBob.Id {
+				return item
+			}
+		}
+		return CloneItem{}
+	}
+	// the same blob is not copied again
+	copiedBlob := report.Ids[sourceBlob]
+	report, err = staging.CloneRepository(nil, repository.Id, production,
+		opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	same := bobItem(report)
+
+	// a blob changed alone is copied
+	source.blobs[sourceBlob] = []byte("changed blob")
+	report, err = staging.CloneRepository(nil, repository.Id, production,
+		opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	changed := bobItem(report)
+	tests = []struct {
+		want any
+		got any
+	}{
+		{CloneKeep, same.Action},
+		{0, len(same.Changes)},
+		{CloneUpdate, changed.Action},
+		{[]FieldChange{{Field: "photo", Kind: FieldModified,
+			Old: copiedBlob.String(), New: sourceBlob.String()}},
+			changed.Changes},
+		{report.Ids[sourceBlob].String(), targetBob.Content["photo"]},
+		{[]byte("changed blob"), target.blobs[report.Ids[sourceBlob]]},
+		{false, target.blobs[copiedBlob] != nil},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("CloneRepository blob changes %d: bad value, got: %v "+
+				"want: %v", i, test.got, test.want)
+		}
+	}
+
+	// renaming, a new repository is created with only the "note" schema
+	report, err = staging.CloneRepository(nil, repository.Id, production,
+		&CloneOptions{Conflict: ConflictRename, Schemas: []string{"note"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests = []struct {
+		want any
+		got any
+	}{
+		{2, len(target.repositories)},
+		{"people (2)", target.repositories[1].Description},
+		{report.Ids[repository.Id], target.repositories[1].Id},
+		{3, len(target.schemas)},
+		{target.repositories[1].Id, target.schemas[2].RepositoryId},
+		{"note", target.schemas[2].Description},
+		{0, len(target.docs[target.schemas[2].Id])},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("CloneRepository rename %d: bad value, got: %v "+
+				"want: %v", i, test.got, test.want)
+		}
+	}
+
+	_, err = staging.CloneRepository(nil, repository.Id, production,
+		&CloneOptions{Schemas: []string{"missing"}})
+	if err == nil || err.Error() != "schema 'missing' not found" {
+		t.Errorf("expected a missing schema error, got: %v", err)
+	}
+}
@@ -1,9 +1,8 @@
 package custodia
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/url"
 
 	"github.com/google/uuid"
 	"github.com/simplereach/timeutils"
@@ -37,7 +36,7 @@ func (ca *CustodiaAPIv1) CreateCollection(name string) (*Collection, error) {
 
 	// JSON: unmarshal resp content
 	collection := Collection{}
-	if err := json.Unmarshal([]byte(resp), &collection); err != nil {
+	if err := decodeJSON(resp, &collection); err != nil {
 		return nil, err
 	}
 
@@ -55,7 +54,7 @@ func (ca *CustodiaAPIv1) ReadCollection(collectionId uuid.UUID) (*Collection,
 
 	// JSON: unmarshal resp content
 	collection := Collection{}
-	if err := json.Unmarshal([]byte(resp), &collection); err != nil {
+	if err := decodeJSON(resp, &collection); err != nil {
 		return nil, err
 	}
 
@@ -76,7 +75,7 @@ func (ca *CustodiaAPIv1) UpdateCollection(collectionId uuid.UUID,
 
 	// JSON: unmarshal resp content
 	collection := Collection{}
-	if err := json.Unmarshal([]byte(resp), &collection); err != nil {
+	if err := decodeJSON(resp, &collection); err != nil {
 		return nil, err
 	}
 
@@ -104,27 +103,16 @@ func (ca *CustodiaAPIv1) DeleteCollection(collectionId uuid.UUID, force bool) (
 func (ca *CustodiaAPIv1) ListCollections(queryParams map[string]string) (
 	[]*Collection, error,
 ) {
-	u, err := url.Parse("/collections")
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+	result, _, err := ca.listCollections("/collections", queryParams)
+	return result, err
+}
 
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listCollections(path string,
+	queryParams map[string]string) ([]*Collection, PageInfo, error) {
 	collectionEnvelope := CollectionEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &collectionEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage(path, queryParams, &collectionEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
 
 	result := []*Collection{}
@@ -132,7 +120,16 @@ func (ca *CustodiaAPIv1) ListCollections(queryParams map[string]string) (
 		result = append(result, &collection)
 	}
 
-	return result, nil
+	return result, page, nil
+}
+
+// IterCollections returns a Pager over all the collections
+func (ca *CustodiaAPIv1) IterCollections(ctx context.Context,
+	pageSize int) *Pager[*Collection] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Collection,
+		PageInfo, error) {
+		return ca.listCollections("/collections", pageParams(offset, limit))
+	})
 }
 
 // List the collections of a document
@@ -142,34 +139,20 @@ func (ca *CustodiaAPIv1) ListCollections(queryParams map[string]string) (
 func (ca *CustodiaAPIv1) ListDocumentCollections(documentId uuid.UUID,
 	queryParams map[string]string) ([]*Collection, error,
 ) {
-	u, err := url.Parse(fmt.Sprintf("/collections/documents/%s", documentId))
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	// JSON: unmarshal resp content
-	collectionEnvelope := CollectionEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &collectionEnvelope); err != nil {
-		return nil, err
-	}
+	path := fmt.Sprintf("/collections/documents/%s", documentId)
+	result, _, err := ca.listCollections(path, queryParams)
+	return result, err
+}
 
-	result := []*Collection{}
-	for _, collection := range collectionEnvelope.Collections {
-		result = append(result, &collection)
-	}
-	return result, nil
+// IterDocumentCollections returns a Pager over all the collections of a
+// document
+func (ca *CustodiaAPIv1) IterDocumentCollections(ctx context.Context,
+	documentId uuid.UUID, pageSize int) *Pager[*Collection] {
+	path := fmt.Sprintf("/collections/documents/%s", documentId)
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Collection,
+		PageInfo, error) {
+		return ca.listCollections(path, pageParams(offset, limit))
+	})
 }
 
 // List the documents of a collection
@@ -180,27 +163,17 @@ func (ca *CustodiaAPIv1) ListDocumentCollections(documentId uuid.UUID,
 func (ca *CustodiaAPIv1) ListCollectionDocuments(collectionId uuid.UUID,
 	queryParams map[string]string) ([]*Document, error,
 ) {
-	u, err := url.Parse(fmt.Sprintf("/collections/%s/documents", collectionId))
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+	result, _, err := ca.listCollectionDocuments(collectionId, queryParams)
+	return result, err
+}
 
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listCollectionDocuments(collectionId uuid.UUID,
+	queryParams map[string]string) ([]*Document, PageInfo, error) {
 	documentsEnvelope := DocumentsEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &documentsEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage(fmt.Sprintf("/collections/%s/documents",
+		collectionId), queryParams, &documentsEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
 
 	// FIXME: the underlying type of interfaces is not the expected concrete
@@ -210,7 +183,18 @@ func (ca *CustodiaAPIv1) ListCollectionDocuments(collectionId uuid.UUID,
 	for _, document := range documentsEnvelope.Documents {
 		result = append(result, &document)
 	}
-	return result, nil
+	return result, page, nil
+}
+
+// IterCollectionDocuments returns a Pager over all the documents of a
+// collection
+func (ca *CustodiaAPIv1) IterCollectionDocuments(ctx context.Context,
+	collectionId uuid.UUID, pageSize int) *Pager[*Document] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Document,
+		PageInfo, error) {
+		return ca.listCollectionDocuments(collectionId,
+			pageParams(offset, limit))
+	})
 }
 
 // Add a document to a collection
@@ -251,7 +235,7 @@ func (ca *CustodiaAPIv1) SearchCollection(name string, contains bool) (
 
 	// JSON: unmarshal resp content
 	collectionEnvelope := CollectionEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &collectionEnvelope); err != nil {
+	if err := decodeJSON(resp, &collectionEnvelope); err != nil {
 		return nil, err
 	}
 
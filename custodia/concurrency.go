@@ -0,0 +1,129 @@
+package custodia
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxModifyAttempts is the number of read-modify-write attempts of
+// ModifyDocument and ModifyUser before giving up on conflicts
+const MaxModifyAttempts = 5
+
+// ConflictError is returned by the conditional updates when the document
+// (or user) changed since it was read
+type ConflictError struct {
+	Id uuid.UUID
+	// Expected is the last update read by the caller, Actual the current one
+	Expected time.Time
+	Actual time.Time
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict on %s: last update is %s, expected %s",
+		e.Id, e.Actual.Format(time.RFC3339Nano),
+		e.Expected.Format(time.RFC3339Nano))
+}
+
+// checkUnchanged returns a *ConflictError if actual is not lastUpdate
+func checkUnchanged(id uuid.UUID, lastUpdate, actual time.Time) error {
+	if lastUpdate.IsZero() {
+		return fmt.Errorf("last update of %s not given", id)
+	}
+	if !actual.Equal(lastUpdate) {
+		return &ConflictError{Id: id, Expected: lastUpdate, Actual: actual}
+	}
+	return nil
+}
+
+// UpdateDocumentIfUnchanged updates the document as UpdateDocument, only if
+// its LastUpdate is still lastUpdate (as read by the caller), otherwise it
+// fails with a *ConflictError.
+// The check is done re-reading the document just before writing it: it
+// catches the changes made since the caller read it, but not the ones made
+// between the check and the write, as Custodia has no conditional writes.
+func (ca *CustodiaAPIv1) UpdateDocumentIfUnchanged(schema Schema,
+	documentId uuid.UUID, lastUpdate time.Time, isActive bool,
+	content map[string]any) (*Document, error) {
+	current, err := ca.ReadDocument(schema, documentId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkUnchanged(documentId, lastUpdate, current.LastUpdate.Time)
+	if err != nil {
+		return nil, err
+	}
+	return ca.UpdateDocument(schema, documentId, isActive, content)
+}
+
+// ModifyDocument reads the document, passes it to modify, which changes it
+// in place, and writes it back with UpdateDocumentIfUnchanged. On conflicts
+// the whole read-modify-write is retried, up to MaxModifyAttempts times.
+// An error of modify stops it, and is returned as it is.
+func (ca *CustodiaAPIv1) ModifyDocument(schema Schema, documentId uuid.UUID,
+	modify func(*Document) error) (*Document, error) {
+	var err error
+	for attempt := 0; attempt < MaxModifyAttempts; attempt++ {
+		var doc *Document
+		doc, err = ca.ReadDocument(schema, documentId)
+		if err != nil {
+			return nil, err
+		}
+		if err := modify(doc); err != nil {
+			return nil, err
+		}
+		var updated *Document
+		updated, err = ca.UpdateDocumentIfUnchanged(schema, documentId,
+			doc.LastUpdate.Time, doc.IsActive, doc.Content)
+		if _, isConflict := err.(*ConflictError); !isConflict {
+			return updated, err
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w",
+		MaxModifyAttempts, err)
+}
+
+// UpdateUserIfUnchanged updates the user as UpdateUser, only if its
+// LastUpdate is still lastUpdate, otherwise it fails with a
+// *ConflictError. See UpdateDocumentIfUnchanged for the limits of the
+// check.
+func (ca *CustodiaAPIv1) UpdateUserIfUnchanged(userSchema UserSchema,
+	userId uuid.UUID, lastUpdate time.Time, isActive bool,
+	content map[string]any) (*User, error) {
+	current, err := ca.ReadUser(userSchema, userId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkUnchanged(userId, lastUpdate, current.LastUpdate.Time)
+	if err != nil {
+		return nil, err
+	}
+	return ca.UpdateUserWithSchema(&userSchema, userId, isActive,
+		content)
+}
+
+// ModifyUser is ModifyDocument for users: modify changes the user
+// attributes (and active flag) in place
+func (ca *CustodiaAPIv1) ModifyUser(userSchema UserSchema, userId uuid.UUID,
+	modify func(*User) error) (*User, error) {
+	var err error
+	for attempt := 0; attempt < MaxModifyAttempts; attempt++ {
+		var user *User
+		user, err = ca.ReadUser(userSchema, userId)
+		if err != nil {
+			return nil, err
+		}
+		if err := modify(user); err != nil {
+			return nil, err
+		}
+		var updated *User
+		updated, err = ca.UpdateUserIfUnchanged(userSchema, userId,
+			user.LastUpdate.Time, user.IsActive, user.Attributes)
+		if _, isConflict := err.(*ConflictError); !isConflict {
+			return updated, err
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w",
+		MaxModifyAttempts, err)
+}
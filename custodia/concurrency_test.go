@@ -0,0 +1,167 @@
+package custodia
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// versionedServer serves a single document (or user, when users is true)
+// whose last update moves forward on each PUT
+type versionedServer struct {
+	mutex sync.Mutex
+	id uuid.UUID
+	users bool
+	content map[string]any
+	lastUpdate time.Time
+	puts int
+}
+
+func (s *versionedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Method == "PUT" {
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if s.users {
+			s.content = body["attributes"].(map[string]any)
+		} else {
+			s.content = body["content"].(map[string]any)
+		}
+		s.lastUpdate = s.lastUpdate.Add(time.Second)
+		s.puts++
+	}
+
+	item := map[string]any{
+		"is_active": true,
+		"last_update": s.lastUpdate.Format(time.RFC3339Nano),
+	}
+	key := "document"
+	if s.users {
+		key = "user"
+		item["user_id"] = s.id.String()
+		item["username"] = "jdoe"
+		item["attributes"] = s.content
+	} else {
+		item["document_id"] = s.id.String()
+		item["content"] = s.content
+	}
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	envelope.Data, _ = json.Marshal(map[string]any{key: item})
+	out, _ := json.Marshal(envelope)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func TestModifyDocument(t *testing.T) {
+	store := &versionedServer{id: uuid.New(),
+		content: map[string]any{"count": 0},
+		lastUpdate: time.Date(2025, 4, 14, 5, 9, 54, 915000000, time.UTC)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "count", Type: TypeInt}}}
+
+	// conditional update
+	doc, err := custodia.ReadDocument(schema, store.id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stale := doc.LastUpdate.Time
+	doc, err = custodia.UpdateDocumentIfUnchanged(schema, store.id, stale,
+		true, map[string]any{"count": int64(1)})
+	if err != nil || doc.Content["count"] != int64(1) {
+		t.Fatalf("update: got %v, %v", doc, err)
+	}
+	_, err = custodia.UpdateDocumentIfUnchanged(schema, store.id, stale, true,
+		map[string]any{"count": int64(2)})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || conflict.Id != store.id ||
+		!conflict.Expected.Equal(stale) ||
+		!conflict.Actual.Equal(stale.Add(time.Second)) {
+		t.Errorf("expected a conflict, got: %v", err)
+	}
+	if store.puts != 1 {
+		t.Errorf("conflicting update was written")
+	}
+	_, err = custodia.UpdateDocumentIfUnchanged(schema, store.id, time.Time{},
+		true, map[string]any{"count": int64(2)})
+	if err == nil || !strings.Contains(err.Error(), "not given") {
+		t.Errorf("expected error without last update, got: %v", err)
+	}
+
+	// modify retries when a concurrent writer gets first
+	attempts := 0
+	increment := func(doc *Document) error {
+		attempts++
+		if attempts == 1 {
+			custodia.UpdateDocument(schema, store.id, true,
+				map[string]any{"count": int64(10)})
+		}
+		doc.Content["count"] = doc.Content["count"].(int64) + 1
+		return nil
+	}
+	doc, err = custodia.ModifyDocument(schema, store.id, increment)
+	if err != nil || doc.Content["count"] != int64(11) || attempts != 2 {
+		t.Errorf("modify: got %v, %v after %d attempts", doc, err, attempts)
+	}
+
+	// errors of modify stop it
+	modifyErr := errors.New("boom")
+	_, err = custodia.ModifyDocument(schema, store.id, func(*Document) error {
+		return modifyErr
+	})
+	if err != modifyErr {
+		t.Errorf("expected the modify error, got: %v", err)
+	}
+
+	// always conflicting
+	_, err = custodia.ModifyDocument(schema, store.id, func(*Document) error {
+		custodia.UpdateDocument(schema, store.id, true,
+			map[string]any{"count": int64(0)})
+		return nil
+	})
+	if !errors.As(err, &conflict) || !strings.Contains(err.Error(),
+		"giving up after 5 attempts") {
+		t.Errorf("expected to give up, got: %v", err)
+	}
+}
+
+func TestModifyUser(t *testing.T) {
+	store := &versionedServer{id: uuid.New(), users: true,
+		content: map[string]any{"name": "John"},
+		lastUpdate: time.Date(2025, 4, 14, 5, 9, 54, 0, time.UTC)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	userSchema := UserSchema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+
+	user, err := custodia.ModifyUser(userSchema, store.id, func(u *User) error {
+		u.Attributes["name"] = "Jane"
+		return nil
+	})
+	if err != nil || user.Attributes["name"] != "Jane" || store.puts != 1 {
+		t.Errorf("modify: got %v, %v", user, err)
+	}
+
+	stale := store.lastUpdate.Add(-time.Second)
+	_, err = custodia.UpdateUserIfUnchanged(userSchema, store.id, stale, true,
+		map[string]any{"name": "Joe"})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("expected a conflict, got: %v", err)
+	}
+}
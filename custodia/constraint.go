@@ -0,0 +1,437 @@
+package custodia
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Cross-field rule operators
+const RuleLt, RuleLte, RuleGt, RuleGte = "lt", "lte", "gt", "gte"
+const RuleEq, RuleNeq = "eq", "neq"
+const RuleRequires, RuleExcludes = "requires", "excludes"
+
+// FieldConstraints holds the client-side constraints of a SchemaField.
+// They are never sent to Custodia, they are checked before any HTTP call.
+//   Required: the field must be present in the content
+//   Nullable: the field may be present with a nil value
+//   Min, Max: bounds for numbers and dates (Date, TimeOfDay, DateTime or
+//     the equivalent string)
+//   Pattern: regular expression that string values must match
+//   Enum: list of the allowed values
+//   MinLength, MaxLength: bounds on the length of strings and arrays
+type FieldConstraints struct {
+	Required bool `json:"required,omitempty"`
+	Nullable bool `json:"nullable,omitempty"`
+	Min any `json:"min,omitempty"`
+	Max any `json:"max,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Enum []any `json:"enum,omitempty"`
+	MinLength *int `json:"min_length,omitempty"`
+	MaxLength *int `json:"max_length,omitempty"`
+}
+
+// CrossFieldRule is a constraint involving more than one field.
+// Declarative rules compare `Field` with `Other` using `Op`; if `Check` is
+// set (only from code) it is called with the whole content instead.
+type CrossFieldRule struct {
+	Field string `json:"field"`
+	Op string `json:"op,omitempty"`
+	Other string `json:"other,omitempty"`
+	Message string `json:"message,omitempty"`
+	Check func(content map[string]any) error `json:"-"`
+}
+
+// Constraints groups field constraints and cross-field rules, as loaded
+// from a sidecar file
+type Constraints struct {
+	Fields map[string]*FieldConstraints `json:"fields"`
+	Rules []CrossFieldRule `json:"rules,omitempty"`
+}
+
+// FieldError is a single violation of a field type or constraint
+type FieldError struct {
+	Field string
+	Rule string
+	Message string
+}
+
+func (fe *FieldError) Error() string {
+	return fmt.Sprintf("field '%s': %s", fe.Field, fe.Message)
+}
+
+// ValidationError collects all the FieldErrors found validating a content
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (ve *ValidationError) Error() string {
+	messages := []string{}
+	for _, fe := range ve.Errors {
+		messages = append(messages, fe.Error())
+	}
+	return "content errors: " + strings.Join(messages, "\n")
+}
+
+func (ve *ValidationError) Unwrap() []error {
+	errs := []error{}
+	for _, fe := range ve.Errors {
+		errs = append(errs, fe)
+	}
+	return errs
+}
+
+// ByField returns the errors grouped by field name
+func (ve *ValidationError) ByField() map[string][]*FieldError {
+	result := map[string][]*FieldError{}
+	for _, fe := range ve.Errors {
+		result[fe.Field] = append(result[fe.Field], fe)
+	}
+	return result
+}
+
+// LoadConstraints reads a JSON sidecar file in the format:
+//   {"fields": {"age": {"required": true, "min": 0}},
+//    "rules": [{"field": "start", "op": "lt", "other": "end"}]}
+func LoadConstraints(path string) (*Constraints, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	constraints := &Constraints{}
+	if err := json.Unmarshal(data, constraints); err != nil {
+		return nil, fmt.Errorf("error parsing constraints file: %w", err)
+	}
+	return constraints, nil
+}
+
+// applyConstraints attaches the constraints to the fields of structure,
+// returning the cross-field rules
+func applyConstraints(structure []SchemaField, c *Constraints) (
+	[]CrossFieldRule, error) {
+	fields := map[string]int{}
+	for i, field := range structure {
+		fields[field.Name] = i
+	}
+
+	for name, fc := range c.Fields {
+		i, ok := fields[name]
+		if !ok {
+			return nil, fmt.Errorf("constraints: field '%s' not in structure",
+				name)
+		}
+		if fc.Pattern != "" {
+			if _, err := compilePattern(fc.Pattern); err != nil {
+				return nil, fmt.Errorf("constraints: field '%s': %w", name,
+					err)
+			}
+		}
+		structure[i].Constraints = fc
+	}
+
+	for _, rule := range c.Rules {
+		for _, name := range []string{rule.Field, rule.Other} {
+			if _, ok := fields[name]; name != "" && !ok {
+				return nil, fmt.Errorf("constraints: rule on field '%s' " +
+					"not in structure", name)
+			}
+		}
+	}
+	return c.Rules, nil
+}
+
+// ApplyConstraints attaches constraints and rules to the schema
+func (s *Schema) ApplyConstraints(c *Constraints) error {
+	rules, err := applyConstraints(s.Structure, c)
+	if err != nil {
+		return err
+	}
+	s.Rules = append(s.Rules, rules...)
+	return nil
+}
+
+// ApplyConstraints attaches constraints and rules to the user schema
+func (us *UserSchema) ApplyConstraints(c *Constraints) error {
+	rules, err := applyConstraints(us.Structure, c)
+	if err != nil {
+		return err
+	}
+	us.Rules = append(us.Rules, rules...)
+	return nil
+}
+
+// compiled patterns are cached, since the same schema validates many
+// contents. Only the patterns of the schemas are cached: the like patterns
+// of the queries have their own bounded cache (see compileLike).
+var patternCache sync.Map
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patternCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patternCache.Store(pattern, re)
+	return re, nil
+}
+
+// isInteger returns true if v is an integer number (json.Number included)
+func isInteger(v any) bool {
+	switch n := v.(type) {
+	case int, int32, int64:
+		return true
+	case json.Number:
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
+
+// toFloat64 returns the numeric value of v as float64
+func toFloat64(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// compareValues returns -1, 0, +1 comparing a with b. Numbers, dates, times
+// and strings are supported.
+func compareValues(a, b any) (int, error) {
+	if c, ok, err := compareTemporal(a, b); ok {
+		return c, err
+	}
+	// integers are compared exactly, without passing through float64
+	if ia, err := toInt64(a); err == nil && isInteger(a) {
+		if ib, err := toInt64(b); err == nil && isInteger(b) {
+			return cmp.Compare(ia, ib), nil
+		}
+	}
+	if fa, ok := toFloat64(a); ok {
+		fb, ok := toFloat64(b)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare %v with %v", a, b)
+		}
+		switch {
+		case fa < fb:
+			return -1, nil
+		case fa > fb:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return strings.Compare(sa, sb), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %v (%T) with %v (%T)", a, a, b, b)
+}
+
+// valuesEqual compares two values, treating all the numbers alike
+func valuesEqual(a, b any) bool {
+	if c, err := compareValues(a, b); err == nil {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// checkConstraints validates a single value, already type-checked
+func checkConstraints(name string, value any, fc *FieldConstraints) (
+	[]*FieldError) {
+	var errs []*FieldError
+	fail := func(rule, format string, args ...any) {
+		errs = append(errs, &FieldError{Field: name, Rule: rule,
+			Message: fmt.Sprintf(format, args...)})
+	}
+
+	if fc.Min != nil {
+		if c, err := compareValues(value, fc.Min); err != nil {
+			fail("min", "%v", err)
+		} else if c < 0 {
+			fail("min", "must be greater than or equal to %v", fc.Min)
+		}
+	}
+	if fc.Max != nil {
+		if c, err := compareValues(value, fc.Max); err != nil {
+			fail("max", "%v", err)
+		} else if c > 0 {
+			fail("max", "must be less than or equal to %v", fc.Max)
+		}
+	}
+
+	if fc.Pattern != "" {
+		str, ok := value.(string)
+		re, err := compilePattern(fc.Pattern)
+		if err != nil {
+			fail("pattern", "invalid pattern: %v", err)
+		} else if !ok || !re.MatchString(str) {
+			fail("pattern", "must match pattern '%s'", fc.Pattern)
+		}
+	}
+
+	if len(fc.Enum) > 0 {
+		found := false
+		for _, allowed := range fc.Enum {
+			if valuesEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("enum", "must be one of %v", fc.Enum)
+		}
+	}
+
+	if fc.MinLength != nil || fc.MaxLength != nil {
+		length := -1
+		if str, ok := value.(string); ok {
+			length = len([]rune(str))
+		} else if rv := reflect.ValueOf(value); rv.Kind() == reflect.Slice {
+			length = rv.Len()
+		}
+		if length < 0 {
+			fail("length", "length constraints apply only to strings and " +
+				"arrays")
+		} else if fc.MinLength != nil && length < *fc.MinLength {
+			fail("min_length", "length must be at least %d", *fc.MinLength)
+		} else if fc.MaxLength != nil && length > *fc.MaxLength {
+			fail("max_length", "length must be at most %d", *fc.MaxLength)
+		}
+	}
+
+	return errs
+}
+
+// checkRule validates a single cross-field rule over the whole content
+func checkRule(content map[string]any, rule CrossFieldRule) *FieldError {
+	fail := func(format string, args ...any) *FieldError {
+		message := rule.Message
+		if message == "" {
+			message = fmt.Sprintf(format, args...)
+		}
+		return &FieldError{Field: rule.Field, Rule: rule.Op, Message: message}
+	}
+
+	if rule.Check != nil {
+		if err := rule.Check(content); err != nil {
+			fe := fail("%v", err)
+			if fe.Rule == "" {
+				fe.Rule = "custom"
+			}
+			return fe
+		}
+		return nil
+	}
+
+	value, hasValue := content[rule.Field]
+	other, hasOther := content[rule.Other]
+
+	switch rule.Op {
+	case RuleRequires:
+		if hasValue && !hasOther {
+			return fail("requires field '%s'", rule.Other)
+		}
+		return nil
+	case RuleExcludes:
+		if hasValue && hasOther {
+			return fail("cannot be set together with field '%s'", rule.Other)
+		}
+		return nil
+	}
+
+	// comparisons are checked only when both values are set
+	if !hasValue || !hasOther || value == nil || other == nil {
+		return nil
+	}
+	if rule.Op == RuleEq || rule.Op == RuleNeq {
+		equal := valuesEqual(value, other)
+		if rule.Op == RuleEq && !equal {
+			return fail("must be equal to field '%s'", rule.Other)
+		} else if rule.Op == RuleNeq && equal {
+			return fail("must differ from field '%s'", rule.Other)
+		}
+		return nil
+	}
+
+	c, err := compareValues(value, other)
+	if err != nil {
+		return fail("%v", err)
+	}
+	switch rule.Op {
+	case RuleLt:
+		if c >= 0 {
+			return fail("must be less than field '%s'", rule.Other)
+		}
+	case RuleLte:
+		if c > 0 {
+			return fail("must be less than or equal to field '%s'",
+				rule.Other)
+		}
+	case RuleGt:
+		if c <= 0 {
+			return fail("must be greater than field '%s'", rule.Other)
+		}
+	case RuleGte:
+		if c < 0 {
+			return fail("must be greater than or equal to field '%s'",
+				rule.Other)
+		}
+	default:
+		return fail("unknown rule operator '%s'", rule.Op)
+	}
+	return nil
+}
+
+// validate checks types, field constraints and cross-field rules of data
+// against schema. It returns a *ValidationError or nil.
+func validate(data map[string]any, schema StructureMapper) error {
+	structure := schema.getStructureAsMap()
+	errs := validateContent(data, structure)
+
+	// required fields, sorted for a stable report
+	names := []string{}
+	for name := range structure {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fc := structure[name].Constraints
+		if _, ok := data[name]; !ok && fc != nil && fc.Required {
+			errs = append(errs, &FieldError{Field: name, Rule: "required",
+				Message: "is required"})
+		}
+	}
+
+	for _, rule := range schema.getRules() {
+		if fe := checkRule(data, rule); fe != nil {
+			errs = append(errs, fe)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package custodia
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestConstraints(t *testing.T) {
+	minLength, maxLength := 1, 2
+	schema := Schema{
+		Id: uuid.New(),
+		Description: "unittest",
+		Structure: []SchemaField{
+			{Name: "age", Type: TypeInt, Constraints: &FieldConstraints{
+				Required: true, Min: 0, Max: 150}},
+			{Name: "city", Type: TypeStr, Constraints: &FieldConstraints{
+				Enum: []any{"Trento", "Rovereto"}}},
+			{Name: "code", Type: TypeStr, Constraints: &FieldConstraints{
+				Pattern: `^[A-Z]{3}$`, Nullable: true}},
+			{Name: "tags", Type: TypeArrayStr, Constraints: &FieldConstraints{
+				MinLength: &minLength, MaxLength: &maxLength}},
+			{Name: "start", Type: TypeDate, Constraints: &FieldConstraints{
+				Min: "2000-01-01"}},
+			{Name: "end", Type: TypeDate},
+		},
+		Rules: []CrossFieldRule{
+			{Field: "start", Op: RuleLt, Other: "end"},
+			{Field: "end", Op: RuleRequires, Other: "start"},
+		},
+	}
+
+	// valid content
+	content := map[string]any{
+		"age": int64(42),
+		"city": "Trento",
+		"code": nil,
+		"tags": []string{"a"},
+		"start": NewDate(2020, 1, 1),
+		"end": NewDate(2021, 1, 1),
+	}
+	if err := validate(content, &schema); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// invalid content: every field breaks a rule
+	content = map[string]any{
+		"city": "Milano",
+		"code": "abc",
+		"tags": []string{"a", "b", "c"},
+		"start": NewDate(1999, 1, 1),
+		"end": NewDate(1998, 1, 1),
+	}
+	err := validate(content, &schema)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("expected a ValidationError, got: %v", err)
+	}
+	got := map[string]string{}
+	for _, fe := range ve.Errors {
+		got[fe.Field] = fe.Rule
+	}
+	want := map[string]string{
+		"age": "required",
+		"city": "enum",
+		"code": "pattern",
+		"tags": "max_length",
+		"start": RuleLt,  // breaks both min and lt, the last one wins
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("bad errors, got: %v want: %v", got, want)
+	}
+	if len(ve.ByField()["start"]) != 2 {
+		t.Errorf("expected 2 errors on 'start', got: %v",
+			ve.ByField()["start"])
+	}
+
+	// wrong type, constraints are not checked
+	err = validate(map[string]any{"age": "42"}, &schema)
+	if !errors.As(err, &ve) || ve.Errors[0].Rule != "type" {
+		t.Errorf("expected a type error, got: %v", err)
+	}
+
+	// custom rule
+	schema.Rules = []CrossFieldRule{{Field: "age", Check: func(
+		c map[string]any) error {
+		return errors.New("always failing")
+	}}}
+	err = validate(map[string]any{"age": int64(1)}, &schema)
+	if !errors.As(err, &ve) || ve.Errors[0].Rule != "custom" {
+		t.Errorf("expected a custom error, got: %v", err)
+	}
+}
+
+func TestLoadConstraints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "constraints.json")
+	data := `{"fields": {"age": {"required": true, "min": 18}},
+		"rules": [{"field": "age", "op": "requires", "other": "name"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	constraints, err := LoadConstraints(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	userSchema := UserSchema{Structure: []SchemaField{
+		{Name: "age", Type: TypeInt},
+		{Name: "name", Type: TypeStr},
+	}}
+	if err := userSchema.ApplyConstraints(constraints); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{true, userSchema.Structure[0].Constraints.Required},
+		{18.0, userSchema.Structure[0].Constraints.Min},
+		{(*FieldConstraints)(nil), userSchema.Structure[1].Constraints},
+		{1, len(userSchema.Rules)},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("LoadConstraints %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+
+	err = validate(map[string]any{"age": int64(10)}, &userSchema)
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Errors) != 2 {
+		t.Errorf("expected min and requires errors, got: %v", err)
+	}
+
+	// unknown fields are rejected
+	constraints.Fields["unknown"] = &FieldConstraints{}
+	if err := userSchema.ApplyConstraints(constraints); err == nil {
+		t.Errorf("expected error on unknown field")
+	}
+}
+
+func TestConstraintsBeforeCall(t *testing.T) {
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected call: %s %s", r.Method, r.URL.Path)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	structure := []SchemaField{{Name: "age", Type: TypeInt,
+		Constraints: &FieldConstraints{Required: true}}}
+	schema := &Schema{Id: uuid.New(), Structure: structure}
+	userSchema := &UserSchema{Id: uuid.New(), Structure: structure}
+	content := map[string]any{}
+
+	var ve *ValidationError
+	_, err := custodia.CreateDocument(schema, true, content)
+	if !errors.As(err, &ve) {
+		t.Errorf("CreateDocument: expected ValidationError, got: %v", err)
+	}
+	_, err = custodia.UpdateDocument(*schema, uuid.New(), true, content)
+	if !errors.As(err, &ve) {
+		t.Errorf("UpdateDocument: expected ValidationError, got: %v", err)
+	}
+	_, err = custodia.CreateUser(userSchema, true, content)
+	if !errors.As(err, &ve) {
+		t.Errorf("CreateUser: expected ValidationError, got: %v", err)
+	}
+	_, err = custodia.UpdateUserWithSchema(userSchema, uuid.New(), true, content)
+	if !errors.As(err, &ve) {
+		t.Errorf("UpdateUserWithSchema: expected ValidationError, got: %v", err)
+	}
+}
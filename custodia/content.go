@@ -0,0 +1,195 @@
+package custodia
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// applyDefaults returns a copy of content where the missing fields are
+// filled with the (converted) default values of the structure
+func applyDefaults(content map[string]any,
+	structure map[string]SchemaField) (map[string]any, error) {
+	result := map[string]any{}
+	for name, value := range content {
+		result[name] = value
+	}
+
+	for name, field := range structure {
+		if _, ok := result[name]; ok || field.Default == nil {
+			continue
+		}
+		if !isKnownType(field.Type) {
+			return nil, fmt.Errorf("field '%s': type '%s' not handled", name,
+				field.Type)
+		}
+		value, err := convertDefault(field.Default, field)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': bad default value: %w", name,
+				err)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// ApplyDefaults returns a copy of content with the missing fields set to
+// the schema default values
+func (s *Schema) ApplyDefaults(content map[string]any) (map[string]any,
+	error) {
+	return applyDefaults(content, s.getStructureAsMap())
+}
+
+// ApplyDefaults returns a copy of content with the missing fields set to
+// the user schema default values
+func (us *UserSchema) ApplyDefaults(content map[string]any) (map[string]any,
+	error) {
+	return applyDefaults(content, us.getStructureAsMap())
+}
+
+// ContentBuilder builds a document (or user) content for a schema,
+// starting from the default values of its fields
+type ContentBuilder struct {
+	schema StructureMapper
+	content map[string]any
+	errors []error
+}
+
+// NewContent returns a ContentBuilder for schema (*Schema or *UserSchema),
+// pre-populated with the schema default values
+func NewContent(schema StructureMapper) *ContentBuilder {
+	cb := &ContentBuilder{schema: schema}
+	content, err := applyDefaults(map[string]any{},
+		schema.getStructureAsMap())
+	if err != nil {
+		cb.errors = append(cb.errors, err)
+		content = map[string]any{}
+	}
+	cb.content = content
+	return cb
+}
+
+// Set the value of a field. Go int values are converted to int64 for
+// integer fields, other values must already be of the expected type.
+func (cb *ContentBuilder) Set(name string, value any) *ContentBuilder {
+	field, ok := cb.schema.getStructureAsMap()[name]
+	if !ok {
+		cb.errors = append(cb.errors, fmt.Errorf("field '%s': not defined " +
+			"in given structure", name))
+		return cb
+	}
+
+	if i, ok := value.(int); ok && field.Type == TypeInt {
+		value = int64(i)
+	}
+	cb.content[name] = value
+	return cb
+}
+
+// Unset removes a field from the content (default values included)
+func (cb *ContentBuilder) Unset(name string) *ContentBuilder {
+	delete(cb.content, name)
+	return cb
+}
+
+// Build validates and returns the content map
+func (cb *ContentBuilder) Build() (map[string]any, error) {
+	if len(cb.errors) > 0 {
+		err := fmt.Errorf("content errors: %w", errors.Join(cb.errors...))
+		return nil, err
+	}
+	if err := validate(cb.content, cb.schema); err != nil {
+		return nil, err
+	}
+
+	result := map[string]any{}
+	for name, value := range cb.content {
+		result[name] = value
+	}
+	return result, nil
+}
+
+// BuildInto validates the content and copies it into dst, which must be a
+// pointer to a struct. Struct fields are matched by their `json` tag name,
+// or by their name when the tag is missing. Numbers are converted to the
+// kind of the struct field only when they fit it.
+func (cb *ContentBuilder) BuildInto(dst any) error {
+	content, err := cb.Build()
+	if err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("dst must be a pointer to struct, got: %T", dst)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := sf.Name
+		if tag, ok := sf.Tag.Lookup("json"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			} else if tagName != "" {
+				name = tagName
+			}
+		}
+
+		value, ok := content[name]
+		if !ok || value == nil {
+			continue
+		}
+		fv := reflect.ValueOf(value)
+		switch {
+		case fv.Type().AssignableTo(sf.Type):
+			rv.Field(i).Set(fv)
+		case fv.Type().ConvertibleTo(sf.Type) && fv.Kind() != reflect.String:
+			if !convertsExactly(fv, rv.Field(i)) {
+				return fmt.Errorf("field '%s': cannot convert %v to %s "+
+					"without loss", name, value, sf.Type)
+			}
+			rv.Field(i).Set(fv.Convert(sf.Type))
+		default:
+			return fmt.Errorf("field '%s': cannot assign %T to %s", name,
+				value, sf.Type)
+		}
+	}
+	return nil
+}
+
+// convertsExactly reports whether the numeric value v fits the kind of dst,
+// i.e. converting it neither wraps, overflows nor drops a fraction
+func convertsExactly(v reflect.Value, dst reflect.Value) bool {
+	switch {
+	case v.CanInt() && dst.CanInt():
+		return !dst.OverflowInt(v.Int())
+	case v.CanInt() && dst.CanUint():
+		return v.Int() >= 0 && !dst.OverflowUint(uint64(v.Int()))
+	case v.CanUint() && dst.CanInt():
+		return v.Uint() <= math.MaxInt64 && !dst.OverflowInt(int64(v.Uint()))
+	case v.CanUint() && dst.CanUint():
+		return !dst.OverflowUint(v.Uint())
+	case v.CanFloat() && dst.CanFloat():
+		return math.IsNaN(v.Float()) || math.IsInf(v.Float(), 0) ||
+			!dst.OverflowFloat(v.Float())
+	case v.CanFloat() && (dst.CanInt() || dst.CanUint()):
+		f := v.Float()
+		if f != math.Trunc(f) || math.IsInf(f, 0) {
+			return false
+		}
+		if dst.CanInt() {
+			return f >= math.MinInt64 && f < math.MaxInt64 &&
+				!dst.OverflowInt(int64(f))
+		}
+		return f >= 0 && f < math.MaxUint64 && !dst.OverflowUint(uint64(f))
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	// defaults as decoded by json.Unmarshal
+	schema := Schema{Structure: []SchemaField{
+		{Name: "int", Type: TypeInt, Default: 42.0},
+		{Name: "float", Type: TypeFloat, Default: 3.14},
+		{Name: "str", Type: TypeStr, Default: "asd"},
+		{Name: "bool", Type: TypeBool, Default: false},
+		{Name: "date", Type: TypeDate, Default: "2023-03-15"},
+		{Name: "arrayInt", Type: TypeArrayInt, Default: []any{1.0, 2.0}},
+		{Name: "arrayStr", Type: TypeArrayStr, Default: `["a", "b"]`},
+		{Name: "noDefault", Type: TypeStr},
+	}}
+
+	content, err := schema.ApplyDefaults(map[string]any{"str": "given"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{int64(42), content["int"]},
+		{3.14, content["float"]},
+		{"given", content["str"]},
+		{false, content["bool"]},
+		{NewDate(2023, 3, 15), content["date"]},
+		{[]int64{1, 2}, content["arrayInt"]},
+		{[]string{"a", "b"}, content["arrayStr"]},
+		{false, content["noDefault"] != nil},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("ApplyDefaults %d: bad value, got: %v (%T) want: %v (%T)",
+				i, test.got, test.got, test.want, test.want)
+		}
+	}
+
+	// the resulting content is valid
+	if err := validate(content, &schema); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewContent(t *testing.T) {
+	type Patient struct {
+		Name string `json:"name"`
+		Age int64 `json:"age"`
+		City string `json:"city,omitempty"`
+		Ignored string `json:"-"`
+	}
+
+	userSchema := UserSchema{Structure: []SchemaField{
+		{Name: "name", Type: TypeStr,
+			Constraints: &FieldConstraints{Required: true}},
+		{Name: "age", Type: TypeInt, Default: 18.0},
+		{Name: "city", Type: TypeStr, Default: "Trento"},
+	}}
+
+	content, err := NewContent(&userSchema).Set("name", "Mario").
+		Set("age", 42).Unset("city").Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]any{"name": "Mario", "age": int64(42)}
+	if !reflect.DeepEqual(want, content) {
+		t.Errorf("bad content, got: %v want: %v", content, want)
+	}
+
+	patient := Patient{}
+	err = NewContent(&userSchema).Set("name", "Luigi").BuildInto(&patient)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantPatient := Patient{Name: "Luigi", Age: 18, City: "Trento"}
+	if patient != wantPatient {
+		t.Errorf("bad struct, got: %v want: %v", patient, wantPatient)
+	}
+
+	// numbers which don't fit the struct field are not converted
+	type Small struct {
+		Age int8 `json:"age"`
+		Count uint `json:"count"`
+		Score int `json:"score"`
+	}
+	smallSchema := UserSchema{Structure: []SchemaField{
+		{Name: "age", Type: TypeInt},
+		{Name: "count", Type: TypeInt},
+		{Name: "score", Type: TypeFloat},
+	}}
+	small := Small{}
+	err = NewContent(&smallSchema).Set("age", 100).Set("count", 3).
+		Set("score", 7.0).BuildInto(&small)
+	if err != nil || small != (Small{Age: 100, Count: 3, Score: 7}) {
+		t.Errorf("bad struct, got: %v, %v", small, err)
+	}
+	var overflowTests = []struct {
+		field string
+		value any
+	}{
+		{"age", 300},
+		{"count", -1},
+		{"score", 7.5},
+		{"score", 1e30},
+	}
+	for i, test := range overflowTests {
+		err := NewContent(&smallSchema).Set(test.field, test.value).
+			BuildInto(&Small{})
+		if err == nil || !strings.Contains(err.Error(), "without loss") {
+			t.Errorf("test %d: expected conversion error, got: %v", i, err)
+		}
+	}
+
+	// errors: missing required field and unknown field
+	if _, err := NewContent(&userSchema).Build(); err == nil {
+		t.Errorf("expected error on missing required field")
+	}
+	_, err = NewContent(&userSchema).Set("name", "x").Set("foo", 1).Build()
+	if err == nil {
+		t.Errorf("expected error on unknown field")
+	}
+}
+
+func TestCreateDocumentFillDefaults(t *testing.T) {
+	dummyUUID := uuid.New()
+	var sent map[string]any
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == fmt.Sprintf(
+			"/api/v1/schemas/%s/documents", dummyUUID,
+		) && r.Method == "POST" {
+			doc := Document{}
+			json.NewDecoder(r.Body).Decode(&doc)
+			sent = doc.Content
+
+			envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+			data := map[string]any{"document": map[string]any{
+				"document_id": dummyUUID.String(),
+				"schema_id": dummyUUID.String(),
+				"is_active": true,
+			}}
+			envelope.Data, _ = json.Marshal(data)
+			out, _ := json.Marshal(envelope)
+			w.WriteHeader(http.StatusCreated)
+			w.Write(out)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	custodia.FillDefaults = true
+
+	schema := Schema{Id: dummyUUID, Structure: []SchemaField{
+		{Name: "count", Type: TypeInt, Default: 7.0},
+	}}
+	_, err := custodia.CreateDocument(&schema, true, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent["count"] != 7.0 {
+		t.Errorf("default not sent, got: %v", sent)
+	}
+}
@@ -0,0 +1,319 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Custodia wire formats of date, time and datetime fields
+const dateLayout = "2006-01-02"
+const timeLayout = "15:04:05"
+const dateTimeLayout = "2006-01-02T15:04:05"
+
+// ZonePolicy defines how datetime strings without a UTC offset are decoded
+type ZonePolicy int
+
+const (
+	ZoneAssumeUTC ZonePolicy = iota + 1
+	ZoneAssumeLocal
+	ZoneReject
+)
+
+func (zp ZonePolicy) Choices() []string {
+	return []string{"UTC", "Local", "Reject"}
+}
+
+func (zp ZonePolicy) String() string {
+	return zp.Choices()[zp-1]
+}
+
+// DefaultZonePolicy is used when decoding datetime fields from Custodia.
+// Custodia stores datetimes in UTC without offset, so UTC is assumed.
+var DefaultZonePolicy = ZoneAssumeUTC
+
+// Date is a civil date (no time, no time zone) used for `date` fields
+type Date struct {
+	Year int
+	Month time.Month
+	Day int
+}
+
+// NewDate returns a Date, it doesn't normalize out of range values
+func NewDate(year int, month time.Month, day int) Date {
+	return Date{Year: year, Month: month, Day: day}
+}
+
+// DateOf returns the civil date of t, in t's location
+func DateOf(t time.Time) Date {
+	year, month, day := t.Date()
+	return Date{Year: year, Month: month, Day: day}
+}
+
+// ParseDate parses a date in the format YYYY-MM-DD
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return Date{}, fmt.Errorf("invalid date '%s': %w", s, err)
+	}
+	return DateOf(t), nil
+}
+
+func (d Date) String() string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// IsValid returns true if d is an existing date
+func (d Date) IsValid() bool {
+	return DateOf(d.In(time.UTC)) == d
+}
+
+// In returns the time at midnight of d in the given location
+func (d Date) In(loc *time.Location) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, loc)
+}
+
+// Compare returns -1, 0, +1 if d is before, equal or after other
+func (d Date) Compare(other Date) int {
+	return d.In(time.UTC).Compare(other.In(time.UTC))
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	if !d.IsValid() {
+		return nil, fmt.Errorf("Date: invalid value '%s'", d)
+	}
+	return json.Marshal(d.String())
+}
+
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := ParseDate(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// TimeOfDay is a civil time (no date, no time zone) used for `time` fields
+type TimeOfDay struct {
+	Hour int
+	Minute int
+	Second int
+	Nanosecond int
+}
+
+// NewTimeOfDay returns a TimeOfDay, it doesn't normalize out of range values
+func NewTimeOfDay(hour, minute, second, nanosecond int) TimeOfDay {
+	return TimeOfDay{Hour: hour, Minute: minute, Second: second,
+		Nanosecond: nanosecond}
+}
+
+// TimeOfDayOf returns the civil time of t, in t's location
+func TimeOfDayOf(t time.Time) TimeOfDay {
+	return TimeOfDay{Hour: t.Hour(), Minute: t.Minute(), Second: t.Second(),
+		Nanosecond: t.Nanosecond()}
+}
+
+// ParseTimeOfDay parses a time in the format HH:MM:SS[.fraction]
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	t, err := time.Parse(timeLayout, s)
+	if err != nil {
+		return TimeOfDay{}, fmt.Errorf("invalid time '%s': %w", s, err)
+	}
+	return TimeOfDayOf(t), nil
+}
+
+// formatFraction returns the fraction of seconds with 3, 6 or 9 digits
+// (the minimum needed to be lossless), or an empty string if ns is zero
+func formatFraction(ns int) string {
+	switch {
+	case ns == 0:
+		return ""
+	case ns%1000000 == 0:
+		return fmt.Sprintf(".%03d", ns/1000000)
+	case ns%1000 == 0:
+		return fmt.Sprintf(".%06d", ns/1000)
+	}
+	return fmt.Sprintf(".%09d", ns)
+}
+
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d:%02d", t.Hour, t.Minute, t.Second) +
+		formatFraction(t.Nanosecond)
+}
+
+// IsValid returns true if all the values are in range
+func (t TimeOfDay) IsValid() bool {
+	return t.Hour >= 0 && t.Hour < 24 && t.Minute >= 0 && t.Minute < 60 &&
+		t.Second >= 0 && t.Second < 60 && t.Nanosecond >= 0 &&
+		t.Nanosecond < 1000000000
+}
+
+// Compare returns -1, 0, +1 if t is before, equal or after other
+func (t TimeOfDay) Compare(other TimeOfDay) int {
+	a := []int{t.Hour, t.Minute, t.Second, t.Nanosecond}
+	b := []int{other.Hour, other.Minute, other.Second, other.Nanosecond}
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (t TimeOfDay) MarshalJSON() ([]byte, error) {
+	if !t.IsValid() {
+		return nil, fmt.Errorf("TimeOfDay: invalid value '%s'", t)
+	}
+	return json.Marshal(t.String())
+}
+
+func (t *TimeOfDay) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := ParseTimeOfDay(value)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// DateTime is an instant used for `datetime` fields. It's always sent to
+// Custodia in UTC, in the format YYYY-MM-DDTHH:MM:SS[.fraction]
+type DateTime struct {
+	time.Time
+}
+
+// NewDateTime wraps t in a DateTime
+func NewDateTime(t time.Time) DateTime {
+	return DateTime{Time: t}
+}
+
+// ParseDateTime parses a datetime in the format
+// YYYY-MM-DDTHH:MM:SS[.fraction][Z|±HH:MM]. The policy is applied when the
+// string has no UTC offset.
+func ParseDateTime(s string, policy ZonePolicy) (DateTime, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return DateTime{Time: t}, nil
+	}
+
+	var loc *time.Location
+	switch policy {
+	case ZoneAssumeUTC:
+		loc = time.UTC
+	case ZoneAssumeLocal:
+		loc = time.Local
+	case ZoneReject:
+		return DateTime{}, fmt.Errorf("invalid datetime '%s': missing UTC " +
+			"offset", s)
+	default:
+		return DateTime{}, fmt.Errorf("unhandled zone policy %d", policy)
+	}
+
+	t, err := time.ParseInLocation(dateTimeLayout, s, loc)
+	if err != nil {
+		return DateTime{}, fmt.Errorf("invalid datetime '%s': %w", s, err)
+	}
+	return DateTime{Time: t}, nil
+}
+
+func (dt DateTime) String() string {
+	utc := dt.Time.UTC()
+	return utc.Format(dateTimeLayout) + formatFraction(utc.Nanosecond())
+}
+
+// Compare returns -1, 0, +1 if dt is before, equal or after other
+func (dt DateTime) Compare(other DateTime) int {
+	return dt.Time.Compare(other.Time)
+}
+
+// Equal reports whether dt and other represent the same instant
+func (dt DateTime) Equal(other DateTime) bool {
+	return dt.Time.Equal(other.Time)
+}
+
+func (dt DateTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(dt.String())
+}
+
+func (dt *DateTime) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := ParseDateTime(value, DefaultZonePolicy)
+	if err != nil {
+		return err
+	}
+	*dt = parsed
+	return nil
+}
+
+// parseTemporal converts a date, time or datetime string to the
+// corresponding concrete type of fieldType
+func parseTemporal(s string, fieldType string) (any, error) {
+	s = strings.TrimSpace(s)
+	switch fieldType {
+	case TypeDate:
+		return ParseDate(s)
+	case TypeTime:
+		return ParseTimeOfDay(s)
+	case TypeDateTime:
+		return ParseDateTime(s, DefaultZonePolicy)
+	}
+	return nil, fmt.Errorf("type '%s' is not a date type", fieldType)
+}
+
+// compareTemporal compares a Date, TimeOfDay or DateTime with b, which can
+// be of the same type or a string. ok is false if a is not temporal.
+func compareTemporal(a, b any) (result int, ok bool, err error) {
+	var fieldType string
+	switch a.(type) {
+	case Date:
+		fieldType = TypeDate
+	case TimeOfDay:
+		fieldType = TypeTime
+	case DateTime:
+		fieldType = TypeDateTime
+	default:
+		return 0, false, nil
+	}
+
+	if s, isString := b.(string); isString {
+		parsed, err := parseTemporal(s, fieldType)
+		if err != nil {
+			return 0, true, err
+		}
+		b = parsed
+	}
+
+	switch va := a.(type) {
+	case Date:
+		if vb, isDate := b.(Date); isDate {
+			return va.Compare(vb), true, nil
+		}
+	case TimeOfDay:
+		if vb, isTime := b.(TimeOfDay); isTime {
+			return va.Compare(vb), true, nil
+		}
+	case DateTime:
+		switch vb := b.(type) {
+		case DateTime:
+			return va.Compare(vb), true, nil
+		case time.Time:
+			return va.Time.Compare(vb), true, nil
+		}
+	}
+	return 0, true, fmt.Errorf("cannot compare %v (%T) with %v (%T)", a, a,
+		b, b)
+}
@@ -0,0 +1,133 @@
+package custodia
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDateTimeTypes(t *testing.T) {
+	date, err := ParseDate("2023-03-15")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	timeOfDay, err := ParseTimeOfDay("11:43:04.058")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dateTime, err := ParseDateTime("2023-03-15T11:43:04.058", ZoneAssumeUTC)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	withOffset, err := ParseDateTime("2023-03-15T13:43:04.058+02:00",
+		ZoneReject)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rome, _ := time.LoadLocation("Europe/Rome")
+
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{NewDate(2023, 3, 15), date},
+		{"2023-03-15", date.String()},
+		{NewTimeOfDay(11, 43, 4, 58000000), timeOfDay},
+		{"11:43:04.058", timeOfDay.String()},
+		{"11:43:04", NewTimeOfDay(11, 43, 4, 0).String()},
+		{"11:43:04.000001", NewTimeOfDay(11, 43, 4, 1000).String()},
+		{"2023-03-15T11:43:04.058", dateTime.String()},
+		{true, dateTime.Equal(withOffset)},
+		{"2023-03-15T11:43:04.058", withOffset.String()},
+		// a date doesn't shift across time zones
+		{date, DateOf(date.In(rome))},
+		{true, date.IsValid()},
+		{false, NewDate(2023, 2, 30).IsValid()},
+		{false, NewTimeOfDay(24, 0, 0, 0).IsValid()},
+		{-1, NewDate(2023, 3, 14).Compare(date)},
+		{1, NewTimeOfDay(12, 0, 0, 0).Compare(timeOfDay)},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("DateTimeTypes %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+
+	// zone policies
+	local, err := ParseDateTime("2023-03-15T11:43:04", ZoneAssumeLocal)
+	if err != nil || local.Location() != time.Local {
+		t.Errorf("ZoneAssumeLocal: got %v (%v)", local, err)
+	}
+	if _, err := ParseDateTime("2023-03-15T11:43:04", ZoneReject); err == nil {
+		t.Errorf("ZoneReject: expected error on missing offset")
+	}
+	if _, err := ParseDate("2023-15-03"); err == nil {
+		t.Errorf("ParseDate: expected error on bad date")
+	}
+}
+
+func TestDateTimeJSON(t *testing.T) {
+	type content struct {
+		Date Date `json:"date"`
+		Time TimeOfDay `json:"time"`
+		DateTime DateTime `json:"datetime"`
+	}
+	rome, _ := time.LoadLocation("Europe/Rome")
+	original := content{
+		Date: NewDate(1970, 1, 1),
+		Time: NewTimeOfDay(0, 1, 30, 0),
+		DateTime: NewDateTime(time.Date(2001, 3, 9, 0, 31, 42, 0, rome)),
+	}
+
+	data, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{"date":"1970-01-01","time":"00:01:30",` +
+		`"datetime":"2001-03-08T23:31:42"}`
+	if string(data) != want {
+		t.Errorf("bad json, got: %s want: %s", data, want)
+	}
+
+	decoded := content{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded.Date != original.Date || decoded.Time != original.Time ||
+		!decoded.DateTime.Equal(original.DateTime) {
+		t.Errorf("bad round trip, got: %v want: %v", decoded, original)
+	}
+
+	// invalid values are not marshalled
+	if _, err := json.Marshal(NewDate(2023, 2, 30)); err == nil {
+		t.Errorf("expected error marshalling an invalid date")
+	}
+}
+
+func TestValidateDateTimeTypes(t *testing.T) {
+	structure := map[string]SchemaField{
+		"date": {Name: "date", Type: TypeDate},
+		"time": {Name: "time", Type: TypeTime},
+		"datetime": {Name: "datetime", Type: TypeDateTime},
+	}
+
+	valid := map[string]any{
+		"date": NewDate(2023, 3, 15),
+		"time": NewTimeOfDay(11, 43, 4, 0),
+		"datetime": NewDateTime(time.Now()),
+	}
+	if errs := validateContent(valid, structure); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	invalid := map[string]any{
+		"date": time.Now(),
+		"time": NewTimeOfDay(25, 0, 0, 0),
+		"datetime": DateTime{},
+	}
+	if errs := validateContent(invalid, structure); len(errs) != 3 {
+		t.Errorf("expected 3 errors, got: %v", errs)
+	}
+}
@@ -1,10 +1,9 @@
 package custodia
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"net/url"
 
 	"github.com/google/uuid"
 	"github.com/simplereach/timeutils"
@@ -32,11 +31,17 @@ type DocumentsEnvelope struct {
 // [C]reate a new document
 func (ca *CustodiaAPIv1) CreateDocument(schema *Schema, isActive bool,
 	content map[string]any) (*Document, error) {
-	// validate document content
-	contentErrors := validateContent(content, schema.getStructureAsMap())
-	if len(contentErrors) > 0 {
-		e := fmt.Errorf("content errors: %w", errors.Join(contentErrors...))
-		return nil, e
+	if ca.FillDefaults {
+		withDefaults, err := schema.ApplyDefaults(content)
+		if err != nil {
+			return nil, err
+		}
+		content = withDefaults
+	}
+
+	// validate document content (types and constraints)
+	if err := validate(content, schema); err != nil {
+		return nil, err
 	}
 
 	doc := Document{IsActive: isActive, Content: content}
@@ -50,7 +55,7 @@ func (ca *CustodiaAPIv1) CreateDocument(schema *Schema, isActive bool,
 	}
 	// JSON: unmarshal resp content
 	docEnvelope := DocumentEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &docEnvelope); err != nil {
+	if err := decodeJSON(resp, &docEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -78,7 +83,7 @@ func (ca *CustodiaAPIv1) ReadDocument(schema Schema, documentId uuid.UUID) (
 
 	// JSON: unmarshal resp content
 	docEnvelope := DocumentEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &docEnvelope); err != nil {
+	if err := decodeJSON(resp, &docEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -104,6 +109,27 @@ func (ca *CustodiaAPIv1) ReadDocument(schema Schema, documentId uuid.UUID) (
 // [U]pdate an existent document
 func (ca *CustodiaAPIv1) UpdateDocument(schema Schema, documentId uuid.UUID,
 	isActive bool, content map[string]any) (*Document, error) {
+	// validate document content (types and constraints)
+	if err := validate(content, &schema); err != nil {
+		return nil, err
+	}
+
+	// snapshot the current document for the history
+	var prior *Document
+	if ca.History != nil {
+		var err error
+		if prior, err = ca.ReadDocument(schema, documentId); err != nil {
+			return nil, fmt.Errorf("error reading revision: %w", err)
+		}
+	}
+	return ca.updateDocument(schema, prior, documentId, isActive, content)
+}
+
+// updateDocument updates the document with a validated content. prior is
+// the current document, recorded in the history if not nil.
+func (ca *CustodiaAPIv1) updateDocument(schema Schema, prior *Document,
+	documentId uuid.UUID, isActive bool, content map[string]any) (
+	*Document, error) {
 	url := fmt.Sprintf("/documents/%s", documentId)
 
 	// create a doc with just the values we can send, and marshal it
@@ -118,7 +144,7 @@ func (ca *CustodiaAPIv1) UpdateDocument(schema Schema, documentId uuid.UUID,
 
 	// JSON: unmarshal resp content and return a fresh document instance
 	docEnvelope := DocumentEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &docEnvelope); err != nil {
+	if err := decodeJSON(resp, &docEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -131,6 +157,13 @@ func (ca *CustodiaAPIv1) UpdateDocument(schema Schema, documentId uuid.UUID,
 
 	// PUT call returns the whole documents, along with its content
 	docEnvelope.Document.Content = converted
+	if prior != nil {
+		err := ca.History.record(prior, RevisionUpdated,
+			Diff(prior.Content, converted))
+		if err != nil {
+			return docEnvelope.Document, err
+		}
+	}
 	return docEnvelope.Document, nil
 }
 
@@ -139,6 +172,15 @@ func (ca *CustodiaAPIv1) UpdateDocument(schema Schema, documentId uuid.UUID,
 // if consisten=true the operation is done sync (server waits to respond)
 func (ca *CustodiaAPIv1) DeleteDocument(documentId uuid.UUID, force,
 	consistent bool) (error) {
+	// snapshot the current document for the history
+	var prior *Document
+	if ca.History != nil {
+		var err error
+		if prior, err = ca.readPrior(documentId); err != nil {
+			return fmt.Errorf("error reading revision: %w", err)
+		}
+	}
+
 	url := fmt.Sprintf("/documents/%s", documentId)
 	url += fmt.Sprintf("?force=%v&consistent=%v", force, consistent)
 
@@ -146,6 +188,13 @@ func (ca *CustodiaAPIv1) DeleteDocument(documentId uuid.UUID, force,
 	if err != nil {
 		return err
 	}
+	if prior != nil {
+		operation := RevisionDeactivated
+		if force {
+			operation = RevisionDeleted
+		}
+		return ca.History.record(prior, operation, nil)
+	}
 	return nil
 }
 
@@ -162,39 +211,38 @@ func (ca *CustodiaAPIv1) DeleteDocument(documentId uuid.UUID, force,
 func (ca *CustodiaAPIv1) ListDocuments(schema Schema,
 	queryParams map[string]string) ([]*Document, error,
 ) {
-	u, err := url.Parse(fmt.Sprintf("/schemas/%s/documents", schema.Id))
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range(queryParams) {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+	result, _, err := ca.listDocuments(&schema, queryParams)
+	return result, err
+}
 
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listDocuments(schema *Schema,
+	queryParams map[string]string) ([]*Document, PageInfo, error) {
 	docusEnvelope := DocumentsEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &docusEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage(fmt.Sprintf("/schemas/%s/documents", schema.Id),
+		queryParams, &docusEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
 
 	result := []*Document{}
 	for _, doc := range docusEnvelope.Documents {
-		converted, ee := convertData(doc.Content, &schema)
+		converted, ee := convertData(doc.Content, schema)
 		if len(ee) > 0 {
 			err := fmt.Errorf("conversion errors: %w", errors.Join(ee...))
-			return nil, err
+			return nil, page, err
 		}
 		doc.Content = converted
 		result = append(result, &doc)
 	}
 
-	return result, nil
+	return result, page, nil
+}
+
+// IterDocuments returns a Pager over all the documents of a schema
+func (ca *CustodiaAPIv1) IterDocuments(ctx context.Context, schema Schema,
+	pageSize int) *Pager[*Document] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Document,
+		PageInfo, error) {
+		return ca.listDocuments(&schema, pageParams(offset, limit))
+	})
 }
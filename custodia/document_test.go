@@ -189,19 +189,6 @@ func TestDocumentCRUDL(t *testing.T) {
     if err != nil {
         t.Errorf("unexpected error: %v", err)
     } else if doc != nil {
-        // debug
-        //fmt.Printf("-----> %v (%T)", doc.Content["arrayIntegerField"], doc.Content["arrayIntegerField"])
-        // some values need type conversion
-        convArrayString, _ := common.ConvertSliceItems[string](
-            doc.Content["arrayStringField"],
-        )
-        convArrayInteger, _ := common.ConvertSliceItems[int64](
-            doc.Content["arrayIntegerField"],
-        )
-        convArrayFloat, _ := common.ConvertSliceItems[float64](
-            doc.Content["arrayFloatField"],
-        )
-
         // setup tests now
         var tests = []struct {
             want any
@@ -224,22 +211,15 @@ func TestDocumentCRUDL(t *testing.T) {
                 doc.Content["base64Field"]},
             {`{"success": true}`, doc.Content["jsonField"]},
             {dummyUUID.String(), doc.Content["blobField"].(string)},
-            {[]int64{0, 1, 2, 3, 4, 5}, convArrayInteger},
-            {[]float64{1.1, 2.2, 3.3, 4.4}, convArrayFloat},
-            {[]string{"Hello", "world", "!"}, convArrayString},
+            {[]int64{0, 1, 2, 3, 4, 5}, doc.Content["arrayIntegerField"]},
+            {[]float64{1.1, 2.2, 3.3, 4.4}, doc.Content["arrayFloatField"]},
+            {[]string{"Hello", "world", "!"}, doc.Content["arrayStringField"]},
             // for date/time/datetime we check all
-            {1970, doc.Content["dateField"].(time.Time).Year()},
-            {1, int(doc.Content["dateField"].(time.Time).Month())},
-            {1, doc.Content["dateField"].(time.Time).Day()},
-            {0, doc.Content["timeField"].(time.Time).Hour()},
-            {1, doc.Content["timeField"].(time.Time).Minute()},
-            {30, doc.Content["timeField"].(time.Time).Second()},
-            {2001, doc.Content["datetimeField"].(time.Time).Year()},
-            {3, int(doc.Content["datetimeField"].(time.Time).Month())},
-            {8, doc.Content["datetimeField"].(time.Time).Day()},
-            {23, doc.Content["datetimeField"].(time.Time).Hour()},
-            {31, doc.Content["datetimeField"].(time.Time).Minute()},
-            {42, doc.Content["datetimeField"].(time.Time).Second()},
+            {NewDate(1970, 1, 1), doc.Content["dateField"]},
+            {NewTimeOfDay(0, 1, 30, 0), doc.Content["timeField"]},
+            {"2001-03-08T23:31:42",
+                doc.Content["datetimeField"].(DateTime).String()},
+            {time.UTC, doc.Content["datetimeField"].(DateTime).Location()},
         }
         // add othere tests that need type conversion before
 
@@ -259,17 +239,6 @@ func TestDocumentCRUDL(t *testing.T) {
     if err != nil {
         t.Errorf("unexpected error: %v", err)
     } else if doc != nil {
-        // some values need type conversion
-        convArrayString, _ := common.ConvertSliceItems[string](
-            doc.Content["arrayStringField"],
-        )
-        convArrayInteger, _ := common.ConvertSliceItems[int64](
-            doc.Content["arrayIntegerField"],
-        )
-        convArrayFloat, _ := common.ConvertSliceItems[float64](
-            doc.Content["arrayFloatField"],
-        )
-
         var tests = []struct {
             want any
             got  any
@@ -292,25 +261,15 @@ func TestDocumentCRUDL(t *testing.T) {
                 doc.Content["base64Field"]},
             {`{"success": true}`, doc.Content["jsonField"]},
             {dummyUUID.String(), doc.Content["blobField"].(string)},
-            // {[]int64{0, 1, 2, 3, 4, 5}, doc.Content["arrayIntegerField"]},
-            // {[]float64{1.1, 2.2, 3.3, 4.4}, doc.Content["arrayFloatField"]},
-            // {[]string{"Hello", "world", "!"}, doc.Content["arrayStringField"]},
-            {[]int64{0, 1, 2, 3, 4, 5}, convArrayInteger},
-            {[]float64{1.1, 2.2, 3.3, 4.4}, convArrayFloat},
-            {[]string{"Hello", "world", "!"}, convArrayString},
+            {[]int64{0, 1, 2, 3, 4, 5}, doc.Content["arrayIntegerField"]},
+            {[]float64{1.1, 2.2, 3.3, 4.4}, doc.Content["arrayFloatField"]},
+            {[]string{"Hello", "world", "!"}, doc.Content["arrayStringField"]},
             // for date/time/datetime we check all
-            {1970, doc.Content["dateField"].(time.Time).Year()},
-            {1, int(doc.Content["dateField"].(time.Time).Month())},
-            {1, doc.Content["dateField"].(time.Time).Day()},
-            {0, doc.Content["timeField"].(time.Time).Hour()},
-            {1, doc.Content["timeField"].(time.Time).Minute()},
-            {30, doc.Content["timeField"].(time.Time).Second()},
-            {2001, doc.Content["datetimeField"].(time.Time).Year()},
-            {3, int(doc.Content["datetimeField"].(time.Time).Month())},
-            {8, doc.Content["datetimeField"].(time.Time).Day()},
-            {23, doc.Content["datetimeField"].(time.Time).Hour()},
-            {31, doc.Content["datetimeField"].(time.Time).Minute()},
-            {42, doc.Content["datetimeField"].(time.Time).Second()},
+            {NewDate(1970, 1, 1), doc.Content["dateField"]},
+            {NewTimeOfDay(0, 1, 30, 0), doc.Content["timeField"]},
+            {"2001-03-08T23:31:42",
+                doc.Content["datetimeField"].(DateTime).String()},
+            {time.UTC, doc.Content["datetimeField"].(DateTime).Location()},
         }
         for i, test := range tests {
             if !reflect.DeepEqual(test.want, test.got) {
@@ -373,3 +332,60 @@ func TestDocumentCRUDL(t *testing.T) {
         }
     }
 }
+
+func TestDocumentIntegerPrecision(t *testing.T) {
+    dummyUUID := uuid.New()
+    content := `{"document": {"document_id": "` + dummyUUID.String() + `",
+        "is_active": true, "content": {"big": 9007199254740993,
+        "float": 0.1, "overflow": 9223372036854775808}}}`
+
+    mockHandler := func(w http.ResponseWriter, r *http.Request) {
+        envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+        envelope.Data = json.RawMessage(content)
+        out, _ := json.Marshal(envelope)
+        w.WriteHeader(http.StatusOK)
+        w.Write(out)
+    }
+    server := httptest.NewServer(http.HandlerFunc(mockHandler))
+    defer server.Close()
+
+    client := common.NewClient(server.URL, common.GetFakeAuth())
+    custodia := NewCustodiaAPIv1(client)
+
+    schema := Schema{Id: dummyUUID, Structure: []SchemaField{
+        {Name: "big", Type: TypeInt},
+        {Name: "float", Type: TypeFloat},
+    }}
+    doc, err := custodia.ReadDocument(schema, dummyUUID)
+    if err == nil {
+        t.Errorf("expected error on field not in schema")
+    }
+
+    schema.Structure = append(schema.Structure,
+        SchemaField{Name: "overflow", Type: TypeInt})
+    doc, err = custodia.ReadDocument(schema, dummyUUID)
+    if err == nil {
+        t.Errorf("expected overflow error")
+    }
+
+    // overflow is a float, no error
+    schema.Structure[2].Type = TypeFloat
+    doc, err = custodia.ReadDocument(schema, dummyUUID)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    var tests = []struct {
+        want any
+        got any
+    }{
+        {int64(9007199254740993), doc.Content["big"]},
+        {0.1, doc.Content["float"]},
+        {9223372036854775808.0, doc.Content["overflow"]},
+    }
+    for i, test := range tests {
+        if !reflect.DeepEqual(test.want, test.got) {
+            t.Errorf("IntegerPrecision %d: bad value, got: %v (%T) want: " +
+                "%v (%T)", i, test.got, test.got, test.want, test.want)
+        }
+    }
+}
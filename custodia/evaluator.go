@@ -0,0 +1,454 @@
+package custodia
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Evaluator evaluates the search DSL (as built by BuildQuery or decoded
+// from JSON) against in-memory contents, following the server semantics:
+//   - fields marked Insensitive are compared ignoring the case
+//   - dates, times and datetimes are compared as such, not as strings
+//   - filters on array fields match if at least one item matches
+//
+// Without a schema, values are compared as they are.
+type Evaluator struct {
+	structure map[string]SchemaField
+}
+
+// Explanation tells why a query node matched or not
+type Explanation struct {
+	// Node is the evaluated node, e.g. "age gt 30" or "and"
+	Node string
+	Matched bool
+	Reason string
+	Children []*Explanation
+}
+
+// String returns the explanation as an indented tree
+func (ex *Explanation) String() string {
+	var sb strings.Builder
+	ex.write(&sb, 0)
+	return sb.String()
+}
+
+func (ex *Explanation) write(sb *strings.Builder, depth int) {
+	result := "no match"
+	if ex.Matched {
+		result = "match"
+	}
+	sb.WriteString(strings.Repeat("  ", depth))
+	fmt.Fprintf(sb, "[%s] %s", result, ex.Node)
+	if ex.Reason != "" {
+		fmt.Fprintf(sb, ": %s", ex.Reason)
+	}
+	sb.WriteString("\n")
+	for _, child := range ex.Children {
+		child.write(sb, depth+1)
+	}
+}
+
+// NewEvaluator returns an Evaluator for the contents of schema, which can
+// be nil
+func NewEvaluator(schema StructureMapper) *Evaluator {
+	ev := &Evaluator{}
+	if schema != nil && !reflect.ValueOf(schema).IsNil() {
+		ev.structure = schema.getStructureAsMap()
+		// users can be searched by username too
+		if _, isUserSchema := schema.(*UserSchema); isUserSchema {
+			ev.structure["username"] = SchemaField{Name: "username",
+				Type: TypeStr}
+		}
+	}
+	return ev
+}
+
+// Match returns true if content matches query
+func (ev *Evaluator) Match(query map[string]any, content map[string]any) (
+	bool, error) {
+	ex, err := ev.Explain(query, content)
+	if err != nil {
+		return false, err
+	}
+	return ex.Matched, nil
+}
+
+// MatchDocument returns true if the content of doc matches query
+func (ev *Evaluator) MatchDocument(query map[string]any, doc *Document) (
+	bool, error) {
+	return ev.Match(query, doc.Content)
+}
+
+// MatchUser returns true if the attributes (or the username) of user match
+// query
+func (ev *Evaluator) MatchUser(query map[string]any, user *User) (bool,
+	error) {
+	return ev.Match(query, userContent(user))
+}
+
+// userContent returns the attributes of user plus its username, which can
+// be searched too
+func userContent(user *User) map[string]any {
+	content := map[string]any{"username": user.Username}
+	for k, v := range user.Attributes {
+		content[k] = v
+	}
+	return content
+}
+
+// FilterDocuments returns the documents matching query
+func (ev *Evaluator) FilterDocuments(query map[string]any,
+	docs []*Document) ([]*Document, error) {
+	result := []*Document{}
+	for _, doc := range docs {
+		matched, err := ev.MatchDocument(query, doc)
+		if err != nil {
+			return nil, fmt.Errorf("document %s: %w", doc.Id, err)
+		}
+		if matched {
+			result = append(result, doc)
+		}
+	}
+	return result, nil
+}
+
+// FilterUsers returns the users matching query
+func (ev *Evaluator) FilterUsers(query map[string]any, users []*User) (
+	[]*User, error) {
+	result := []*User{}
+	for _, user := range users {
+		matched, err := ev.MatchUser(query, user)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Id, err)
+		}
+		if matched {
+			result = append(result, user)
+		}
+	}
+	return result, nil
+}
+
+// Explain evaluates query against content, returning why each node
+// matched or not. Malformed queries and values which can't be compared
+// are errors.
+func (ev *Evaluator) Explain(query map[string]any, content map[string]any) (
+	*Explanation, error) {
+	return ev.explain(query, content)
+}
+
+// queryNodes returns the list of nodes of and/or, as decoded from JSON
+// ([]any) or built by BuildQuery ([]map[string]any)
+func queryNodes(value any) ([]map[string]any, error) {
+	switch v := value.(type) {
+	case []map[string]any:
+		return v, nil
+	case []any:
+		nodes := []map[string]any{}
+		for _, item := range v {
+			node, ok := item.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("expected a query node, got: %v", item)
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes, nil
+	}
+	return nil, fmt.Errorf("expected a list of query nodes, got: %v", value)
+}
+
+func (ev *Evaluator) explain(node map[string]any, content map[string]any) (
+	*Explanation, error) {
+	if len(node) == 0 {
+		return nil, fmt.Errorf("empty query node")
+	}
+
+	for _, op := range []string{"and", "or"} {
+		value, ok := node[op]
+		if !ok {
+			continue
+		}
+		if len(node) != 1 {
+			return nil, fmt.Errorf("'%s' node with other keys", op)
+		}
+		children, err := queryNodes(value)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", op, err)
+		}
+		if len(children) == 0 {
+			return nil, fmt.Errorf("'%s' expects at least one query", op)
+		}
+
+		ex := &Explanation{Node: op, Matched: op == "and"}
+		for _, child := range children {
+			childEx, err := ev.explain(child, content)
+			if err != nil {
+				return nil, err
+			}
+			ex.Children = append(ex.Children, childEx)
+			if op == "and" {
+				ex.Matched = ex.Matched && childEx.Matched
+			} else {
+				ex.Matched = ex.Matched || childEx.Matched
+			}
+		}
+		return ex, nil
+	}
+
+	if value, ok := node["not"]; ok {
+		child, isNode := value.(map[string]any)
+		if !isNode || len(node) != 1 {
+			return nil, fmt.Errorf("'not' expects a single query node")
+		}
+		childEx, err := ev.explain(child, content)
+		if err != nil {
+			return nil, err
+		}
+		return &Explanation{Node: "not", Matched: !childEx.Matched,
+			Children: []*Explanation{childEx}}, nil
+	}
+
+	return ev.explainFilter(node, content)
+}
+
+// explainFilter evaluates a field filter node
+func (ev *Evaluator) explainFilter(node map[string]any,
+	content map[string]any) (*Explanation, error) {
+	name, _ := node["field"].(string)
+	op, _ := node["type"].(string)
+	queryValue, hasValue := node["value"]
+	if name == "" || op == "" || !hasValue || len(node) != 3 {
+		return nil, fmt.Errorf("bad query node %v: expected 'field', " +
+			"'type' and 'value'", node)
+	}
+	ex := &Explanation{Node: fmt.Sprintf("%s %s %v", name, op,
+		jsonValue(queryValue))}
+
+	field, known := ev.structure[name]
+	if ev.structure != nil && !known {
+		return nil, fmt.Errorf("field '%s': not defined in structure", name)
+	}
+	itemType, isArray := arrayItemType(field.Type)
+	if !isArray {
+		itemType = field.Type
+	}
+
+	value, present := content[name]
+	if op == OpIs {
+		switch queryValue {
+		case nil:
+			ex.Matched = value == nil
+		case true, false:
+			ex.Matched = value == queryValue
+		default:
+			return nil, fmt.Errorf("field '%s': 'is' expects null, true " +
+				"or false, got: %v", name, queryValue)
+		}
+		ex.Reason = describeValue(value, present)
+		return ex, nil
+	}
+	if value == nil {
+		ex.Reason = describeValue(value, present)
+		return ex, nil
+	}
+
+	// normalize the query value(s) as the field values
+	var queryValues []any
+	if op == OpIn {
+		values, err := queryNodesValues(queryValue)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", name, err)
+		}
+		queryValues = values
+	} else {
+		queryValues = []any{queryValue}
+	}
+	for i, qv := range queryValues {
+		normalized, err := ev.normalize(qv, name, itemType, field.Insensitive)
+		if err != nil && op != OpLike {
+			return nil, fmt.Errorf("field '%s': bad query value: %w", name,
+				err)
+		}
+		queryValues[i] = normalized
+	}
+
+	// arrays match if at least one item matches
+	items := []any{value}
+	if isArray || isSlice(value) {
+		decoded, err := decodeArray(value)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", name, err)
+		}
+		items = decoded
+		isArray = true
+	}
+
+	for i, item := range items {
+		normalized, err := ev.normalize(item, name, itemType,
+			field.Insensitive)
+		if err != nil {
+			normalized = item
+		}
+		matched, err := matchValue(op, normalized, queryValues)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", name, err)
+		}
+		if matched {
+			ex.Matched = true
+			if isArray {
+				ex.Reason = fmt.Sprintf("item %d is %v", i, jsonValue(item))
+			} else {
+				ex.Reason = fmt.Sprintf("value is %v", jsonValue(item))
+			}
+			return ex, nil
+		}
+	}
+	if isArray {
+		ex.Reason = fmt.Sprintf("no item matches in %v", items)
+	} else {
+		ex.Reason = fmt.Sprintf("value is %v", jsonValue(value))
+	}
+	return ex, nil
+}
+
+func describeValue(value any, present bool) string {
+	if !present {
+		return "field is missing"
+	} else if value == nil {
+		return "value is null"
+	}
+	return fmt.Sprintf("value is %v", jsonValue(value))
+}
+
+// queryNodesValues returns the values of an 'in' filter
+func queryNodesValues(value any) ([]any, error) {
+	if !isSlice(value) {
+		return nil, fmt.Errorf("'in' expects a list, got: %v", value)
+	}
+	values, err := decodeArray(value)
+	if err != nil {
+		return nil, err
+	}
+	// copied: values are normalized in place
+	return append([]any{}, values...), nil
+}
+
+// isSlice returns true if value is a slice (e.g. an array field content)
+func isSlice(value any) bool {
+	return value != nil && reflect.TypeOf(value).Kind() == reflect.Slice
+}
+
+// normalize converts value to the concrete type of the field (when the
+// schema is known), lowering the strings of insensitive fields
+func (ev *Evaluator) normalize(value any, name, fieldType string,
+	insensitive bool) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if ev.structure != nil && fieldType != "" {
+		converted, err := convertDefault(value, SchemaField{Name: name,
+			Type: fieldType})
+		if err != nil {
+			return value, err
+		}
+		value = converted
+	}
+	if s, isString := value.(string); isString && insensitive {
+		value = strings.ToLower(s)
+	}
+	return value, nil
+}
+
+// matchValue applies the operator op to a single (non null) value
+func matchValue(op string, value any, queryValues []any) (bool, error) {
+	switch op {
+	case OpEq:
+		return valuesEqual(value, queryValues[0]), nil
+	case OpIn:
+		for _, qv := range queryValues {
+			if valuesEqual(value, qv) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case OpLt, OpLte, OpGt, OpGte:
+		c, err := compareValues(value, queryValues[0])
+		if err != nil {
+			return false, err
+		}
+		switch op {
+		case OpLt:
+			return c < 0, nil
+		case OpLte:
+			return c <= 0, nil
+		case OpGt:
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case OpLike:
+		pattern, ok := queryValues[0].(string)
+		if !ok {
+			return false, fmt.Errorf("'like' expects a string pattern")
+		}
+		s, ok := value.(string)
+		if !ok {
+			return false, fmt.Errorf("'like' on a non-string value %v", value)
+		}
+		re, err := compileLike(pattern)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(s), nil
+	}
+	return false, fmt.Errorf("operator '%s' not supported", op)
+}
+
+// likeToRegexp converts a like pattern ('*' any sequence of characters,
+// '?' a single one) to an anchored regular expression
+func likeToRegexp(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// maxLikePatterns is the size of the cache of the like patterns
+const maxLikePatterns = 256
+
+// likePatterns caches the compiled like patterns. They come from the
+// queries, not from the schemas: the cache is emptied when full, so it
+// doesn't grow without bound.
+var likePatterns = struct {
+	sync.Mutex
+	cache map[string]*regexp.Regexp
+}{cache: map[string]*regexp.Regexp{}}
+
+// compileLike returns the regular expression of a like pattern
+func compileLike(pattern string) (*regexp.Regexp, error) {
+	likePatterns.Lock()
+	defer likePatterns.Unlock()
+	if re, ok := likePatterns.cache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(likeToRegexp(pattern))
+	if err != nil {
+		return nil, err
+	}
+	if len(likePatterns.cache) >= maxLikePatterns {
+		likePatterns.cache = map[string]*regexp.Regexp{}
+	}
+	likePatterns.cache[pattern] = re
+	return re, nil
+}
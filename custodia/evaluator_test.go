@@ -0,0 +1,162 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestEvaluator(t *testing.T) {
+	schema := &Schema{
+		Id: uuid.New(),
+		Description: "unittest",
+		Structure: []SchemaField{
+			{Name: "age", Type: TypeInt, Indexed: true},
+			{Name: "name", Type: TypeStr, Indexed: true, Insensitive: true},
+			{Name: "code", Type: TypeStr, Indexed: true},
+			{Name: "born", Type: TypeDate, Indexed: true},
+			{Name: "tags", Type: TypeArrayStr, Indexed: true},
+			{Name: "scores", Type: TypeArrayInt, Indexed: true},
+			{Name: "active", Type: TypeBool, Indexed: true},
+			{Name: "note", Type: TypeStr, Indexed: true},
+		},
+	}
+	content := map[string]any{
+		"age": int64(42),
+		"name": "Antani",
+		"code": "ABC",
+		"born": NewDate(1981, 9, 3),
+		"tags": []string{"red", "blue"},
+		"scores": []int64{3, 7},
+		"active": true,
+		"note": nil,
+	}
+	ev := NewEvaluator(schema)
+
+	var tests = []struct {
+		query Query
+		want bool
+	}{
+		{Field("age").Eq(42), true},
+		{Field("age").Gt(42), false},
+		{Field("age").Gte(42), true},
+		{Field("age").In(1, 2, 42), true},
+		// insensitive fields ignore the case
+		{Field("name").Eq("ANTANI"), true},
+		{Field("name").Like("ant*"), true},
+		{Field("name").Like("ant?ni"), true},
+		{Field("code").Eq("abc"), false},
+		{Field("code").Like("A?C"), true},
+		// dates are compared as dates
+		{Field("born").Lt("1990-01-01"), true},
+		{Field("born").Eq(NewDate(1981, 9, 3)), true},
+		// arrays match on any item
+		{Field("tags").Eq("blue"), true},
+		{Field("tags").In("green", "red"), true},
+		{Field("tags").Eq("green"), false},
+		{Field("scores").Gt(5), true},
+		{Field("active").Is(true), true},
+		{Field("note").Is(nil), true},
+		{Field("note").Eq("x"), false},
+		{And(Field("age").Lt(50), Not(Field("active").Is(false))), true},
+		{Or(Field("age").Lt(18), Field("tags").Eq("pink")), false},
+	}
+	for i, test := range tests {
+		query, err := BuildQuery(nil, test.query)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		got, err := ev.Match(query, content)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		} else if got != test.want {
+			t.Errorf("test %d: got %v want %v", i, got, test.want)
+		}
+	}
+
+	// the DSL decoded from JSON (raw content without schema)
+	var query map[string]any
+	decodeJSON(`{"and": [{"field": "age", "type": "gte", "value": 40},
+		{"not": {"field": "name", "type": "eq", "value": "x"}}]}`, &query)
+	raw := map[string]any{"age": json.Number("42"), "name": "Antani"}
+	if got, err := NewEvaluator(nil).Match(query, raw); err != nil || !got {
+		t.Errorf("raw: got %v, %v", got, err)
+	}
+
+	// explain
+	query, _ = BuildQuery(nil, And(Field("age").Gt(30),
+		Field("tags").Eq("pink")))
+	ex, err := ev.Explain(query, content)
+	if err != nil {
+		t.Fatalf("explain: unexpected error: %v", err)
+	}
+	want := "[no match] and\n" +
+		"  [match] age gt 30: value is 42\n" +
+		"  [no match] tags eq pink: no item matches in [red blue]\n"
+	if ex.String() != want {
+		t.Errorf("explain: got:\n%s\nwant:\n%s", ex, want)
+	}
+
+	// errors
+	var errorTests = []struct {
+		query string
+		want string
+	}{
+		{`{"field": "missing", "type": "eq", "value": 1}`, "not defined"},
+		{`{"field": "age", "type": "eq", "value": "abc"}`, "bad query value"},
+		{`{"field": "age", "type": "near", "value": 1}`, "not supported"},
+		{`{"field": "age", "type": "in", "value": 1}`, "expects a list"},
+		{`{"field": "age", "type": "is", "value": 1}`, "'is' expects"},
+		{`{"or": []}`, "at least one"},
+		{`{"not": [{"field": "age", "type": "eq", "value": 1}]}`, "'not'"},
+		{`{"field": "age"}`, "bad query node"},
+	}
+	for i, test := range errorTests {
+		query = map[string]any{}
+		decodeJSON(test.query, &query)
+		_, err := ev.Match(query, content)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("error %d: expected '%s', got: %v", i, test.want, err)
+		}
+	}
+
+	// filter documents and users
+	docs := []*Document{{Content: content},
+		{Content: map[string]any{"age": int64(10)}}}
+	query, _ = BuildQuery(nil, Field("age").Gt(18))
+	filtered, err := ev.FilterDocuments(query, docs)
+	if err != nil || len(filtered) != 1 || filtered[0] != docs[0] {
+		t.Errorf("FilterDocuments: got %v, %v", filtered, err)
+	}
+	users := []*User{{Username: "jdoe"}, {Username: "other"}}
+	query, _ = BuildQuery(nil, Field("username").Eq("jdoe"))
+	userSchema := &UserSchema{Structure: []SchemaField{
+		{Name: "age", Type: TypeInt, Indexed: true}}}
+	for _, ev := range []*Evaluator{NewEvaluator(nil),
+		NewEvaluator(userSchema)} {
+		filteredUsers, err := ev.FilterUsers(query, users)
+		if err != nil || len(filteredUsers) != 1 ||
+			filteredUsers[0].Username != "jdoe" {
+			t.Errorf("FilterUsers: got %v, %v", filteredUsers, err)
+		}
+	}
+}
+
+func TestCompileLike(t *testing.T) {
+	for i := 0; i < 2*maxLikePatterns; i++ {
+		re, err := compileLike(fmt.Sprintf("name %d*", i))
+		if err != nil || !re.MatchString(fmt.Sprintf("name %d!", i)) {
+			t.Fatalf("compileLike %d: got %v, %v", i, re, err)
+		}
+	}
+	likePatterns.Lock()
+	size := len(likePatterns.cache)
+	likePatterns.Unlock()
+	if size > maxLikePatterns {
+		t.Errorf("compileLike: %d patterns cached, max %d", size,
+			maxLikePatterns)
+	}
+}
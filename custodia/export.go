@@ -0,0 +1,701 @@
+package custodia
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ManifestName is the name of the manifest in the export archives
+const ManifestName = "manifest.json"
+
+// ManifestVersion is the version of the manifest written by
+// ExportRepository
+const ManifestVersion = 1
+
+// Define ExportFormat
+type ExportFormat int
+
+const (
+	ExportNDJSON ExportFormat = iota + 1
+	ExportCSV
+)
+
+func (ef ExportFormat) Choices() []string {
+	return []string{"ndjson", "csv"}
+}
+
+func (ef ExportFormat) String() string {
+	return ef.Choices()[ef-1]
+}
+
+func (ef ExportFormat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ef.String())
+}
+
+func (ef *ExportFormat) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, ef.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("ExportFormat: received unknown value '%v'", value)
+	}
+
+	*ef = ExportFormat(intValue)
+	return nil
+}
+
+// Define ArchiveFormat
+type ArchiveFormat int
+
+const (
+	ArchiveTar ArchiveFormat = iota + 1
+	ArchiveZip
+)
+
+func (af ArchiveFormat) Choices() []string {
+	return []string{"tar", "zip"}
+}
+
+func (af ArchiveFormat) String() string {
+	return af.Choices()[af-1]
+}
+
+func (af ArchiveFormat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(af.String())
+}
+
+func (af *ArchiveFormat) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, af.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("ArchiveFormat: received unknown value '%v'", value)
+	}
+
+	*af = ArchiveFormat(intValue)
+	return nil
+}
+
+// ExportOptions are the options of ExportRepository
+type ExportOptions struct {
+	// Format of the document files, ExportNDJSON if not given
+	Format ExportFormat
+	// Archive is the format of the archive, ArchiveTar if not given
+	Archive ArchiveFormat
+	// SkipBlobs exports the documents without downloading their blobs
+	SkipBlobs bool
+	// KnownBlobs are blobs with known checksums (e.g. as returned by
+	// CommitBlob): their downloads are verified, failing on mismatches.
+	// Custodia doesn't return the checksums of the existing blobs.
+	KnownBlobs []Blob
+	// PageSize is the page size of the list calls, 0 means DefaultPageSize
+	PageSize int
+}
+
+// ManifestFile is a file of the archive, with its checksum
+type ManifestFile struct {
+	Path string `json:"path"`
+	Size int64 `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// ManifestSchema is an exported schema, with the file of its documents
+type ManifestSchema struct {
+	Schema *Schema `json:"schema"`
+	File string `json:"file"`
+	Documents int `json:"documents"`
+}
+
+// ManifestBlob is an exported blob, referenced by Field of its document
+type ManifestBlob struct {
+	Blob
+	SchemaId uuid.UUID `json:"schema_id"`
+	Field string `json:"field"`
+	File string `json:"file"`
+	Size int64 `json:"size"`
+}
+
+// ExportManifest describes an export archive. It's the last entry of the
+// archive, named ManifestName.
+type ExportManifest struct {
+	Version int `json:"version"`
+	Repository *Repository `json:"repository"`
+	CreatedAt time.Time `json:"created_at"`
+	Format ExportFormat `json:"format"`
+	Schemas []ManifestSchema `json:"schemas"`
+	Blobs []ManifestBlob `json:"blobs"`
+	// Files has the checksums of all the other entries
+	Files []ManifestFile `json:"files"`
+}
+
+// archiveWriter writes the entries of an archive, one at a time
+type archiveWriter interface {
+	// create returns the writer of a new entry, to close before the next
+	create(name string) (io.WriteCloser, error)
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (za *zipArchive) create(name string) (io.WriteCloser, error) {
+	w, err := za.zw.Create(name)
+	return nopWriteCloser{w}, err
+}
+
+func (za *zipArchive) Close() error {
+	return za.zw.Close()
+}
+
+// tarArchive spools each entry to a temporary file, as tar headers need the
+// size of the entry
+type tarArchive struct {
+	tw *tar.Writer
+}
+
+type tarEntry struct {
+	*os.File
+	tw *tar.Writer
+	name string
+}
+
+func (ta *tarArchive) create(name string) (io.WriteCloser, error) {
+	file, err := os.CreateTemp("", "custodia-export-*")
+	if err != nil {
+		return nil, err
+	}
+	return &tarEntry{File: file, tw: ta.tw, name: name}, nil
+}
+
+func (te *tarEntry) Close() error {
+	defer os.Remove(te.File.Name())
+	defer te.File.Close()
+	size, err := te.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := te.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err = te.tw.WriteHeader(&tar.Header{Name: te.name, Mode: 0o644,
+		Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(te.tw, te.File)
+	return err
+}
+
+func (ta *tarArchive) Close() error {
+	return ta.tw.Close()
+}
+
+// hashWriter computes the size and checksums of what's written
+type hashWriter struct {
+	size int64
+	sha256 hash.Hash
+	sha1 hash.Hash
+	md5 hash.Hash
+}
+
+func newHashWriter() *hashWriter {
+	return &hashWriter{sha256: sha256.New(), sha1: sha1.New(), md5: md5.New()}
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	hw.sha256.Write(p)
+	hw.sha1.Write(p)
+	hw.md5.Write(p)
+	hw.size += int64(len(p))
+	return len(p), nil
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// exporter writes an export archive
+type exporter struct {
+	ca *CustodiaAPIv1
+	ctx context.Context
+	opts *ExportOptions
+	archive archiveWriter
+	manifest *ExportManifest
+	known map[uuid.UUID]Blob
+}
+
+// writeEntry writes an entry with write, adding it to the manifest files
+func (ex *exporter) writeEntry(name string, write func(io.Writer) error) (
+	*hashWriter, error) {
+	return writeArchiveEntry(ex.archive, &ex.manifest.Files, name, write)
+}
+
+// writeArchiveEntry writes an entry of archive with write, appending its
+// checksum to files
+func writeArchiveEntry(archive archiveWriter, files *[]ManifestFile,
+	name string, write func(io.Writer) error) (*hashWriter, error) {
+	entry, err := archive.create(name)
+	if err != nil {
+		return nil, err
+	}
+	hw := newHashWriter()
+	buffered := bufio.NewWriter(io.MultiWriter(entry, hw))
+	err = write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := entry.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	*files = append(*files, ManifestFile{Path: name, Size: hw.size,
+		Sha256: hexSum(hw.sha256)})
+	return hw, nil
+}
+
+// blobRef is a blob referenced by a document
+type blobRef struct {
+	id uuid.UUID
+	documentId uuid.UUID
+	field string
+}
+
+// blobRefs returns the blobs referenced by the blob fields of doc
+func blobRefs(doc *Document, schema *Schema) []blobRef {
+	refs := []blobRef{}
+	for _, field := range schema.Structure {
+		if field.Type != TypeBlob {
+			continue
+		}
+		id, err := uuid.Parse(fmt.Sprint(doc.Content[field.Name]))
+		if err == nil {
+			refs = append(refs, blobRef{id: id, documentId: doc.Id,
+				field: field.Name})
+		}
+	}
+	return refs
+}
+
+// exportSchema writes the documents of schema and their blobs
+func (ex *exporter) exportSchema(schema *Schema) error {
+	docs := NewPager(ex.ctx, ex.opts.PageSize, func(offset, limit int) (
+		[]*Document, PageInfo, error) {
+		params := pageParams(offset, limit)
+		params["full_document"] = "true"
+		return ex.ca.listDocuments(schema, params)
+	})
+
+	name := fmt.Sprintf("schemas/%s/documents.%s", schema.Id,
+		ex.opts.Format)
+	count := 0
+	refs := []blobRef{}
+	_, err := ex.writeEntry(name, func(w io.Writer) error {
+		var write func(*Document) error
+		var cw *csv.Writer
+		if ex.opts.Format == ExportCSV {
+			cw = csv.NewWriter(w)
+			if err := cw.Write(csvHeader(schema)); err != nil {
+				return err
+			}
+			write = func(doc *Document) error {
+				record, err := csvRecord(doc, schema)
+				if err != nil {
+					return err
+				}
+				return cw.Write(record)
+			}
+		} else {
+			encoder := json.NewEncoder(w)
+			write = func(doc *Document) error {
+				return encoder.Encode(doc)
+			}
+		}
+
+		for docs.Next() {
+			doc := docs.Value()
+			if err := write(doc); err != nil {
+				return fmt.Errorf("document %s: %w", doc.Id, err)
+			}
+			count++
+			refs = append(refs, blobRefs(doc, schema)...)
+		}
+		if cw != nil {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+		}
+		return docs.Err()
+	})
+	if err != nil {
+		return err
+	}
+	ex.manifest.Schemas = append(ex.manifest.Schemas, ManifestSchema{
+		Schema: schema, File: name, Documents: count})
+
+	if ex.opts.SkipBlobs {
+		return nil
+	}
+	for _, ref := range refs {
+		if err := ex.exportBlob(schema, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportBlob downloads a blob into the archive, verifying it if known
+func (ex *exporter) exportBlob(schema *Schema, ref blobRef) error {
+	if err := ex.ctx.Err(); err != nil {
+		return err
+	}
+	blob, err := ex.ca.archiveBlob(ex.archive, &ex.manifest.Files, schema.Id,
+		ref)
+	if err != nil {
+		return err
+	}
+	if known, ok := ex.known[ref.id]; ok {
+		if err := checkBlob(known, blob.Blob); err != nil {
+			return err
+		}
+	}
+	ex.manifest.Blobs = append(ex.manifest.Blobs, blob)
+	return nil
+}
+
+// archiveBlob downloads a blob into the entry blobs/<id> of archive
+func (ca *CustodiaAPIv1) archiveBlob(archive archiveWriter,
+	files *[]ManifestFile, schemaId uuid.UUID, ref blobRef) (ManifestBlob,
+	error) {
+	name := fmt.Sprintf("blobs/%s", ref.id)
+	hw, err := writeArchiveEntry(archive, files, name, func(w io.Writer) (
+		error) {
+		data, err := ca.GetBlobData(ref.id)
+		if err != nil {
+			return err
+		}
+		if closer, ok := data.(io.Closer); ok {
+			defer closer.Close()
+		}
+		_, err = io.Copy(w, data)
+		return err
+	})
+	if err != nil {
+		return ManifestBlob{}, err
+	}
+
+	blob := Blob{Id: ref.id, DocumentId: ref.documentId.String(),
+		Sha1: hexSum(hw.sha1), Md5: hexSum(hw.md5)}
+	return ManifestBlob{Blob: blob, SchemaId: schemaId, Field: ref.field,
+		File: name, Size: hw.size}, nil
+}
+
+// checkBlob returns an error if the checksums of got are not the expected
+// ones. Empty checksums are not checked.
+func checkBlob(expected, got Blob) error {
+	if expected.Sha1 != "" && !strings.EqualFold(expected.Sha1, got.Sha1) {
+		return fmt.Errorf("blob %s: sha1 is %s, expected %s", got.Id, got.Sha1,
+			expected.Sha1)
+	}
+	if expected.Md5 != "" && !strings.EqualFold(expected.Md5, got.Md5) {
+		return fmt.Errorf("blob %s: md5 is %s, expected %s", got.Id, got.Md5,
+			expected.Md5)
+	}
+	return nil
+}
+
+// csvHeader returns the columns of the CSV export of schema: the document
+// metadata, then a "<name>:<type>" column for each field
+func csvHeader(schema *Schema) []string {
+	header := []string{"document_id", "is_active", "insert_date",
+		"last_update"}
+	for _, field := range schema.Structure {
+		header = append(header, field.Name + ":" + field.Type)
+	}
+	return header
+}
+
+// csvRecord returns the CSV row of doc
+func csvRecord(doc *Document, schema *Schema) ([]string, error) {
+	record := []string{doc.Id.String(), strconv.FormatBool(doc.IsActive),
+		doc.InsertDate.Time.UTC().Format(time.RFC3339Nano),
+		doc.LastUpdate.Time.UTC().Format(time.RFC3339Nano)}
+	for _, field := range schema.Structure {
+		value, err := csvValue(doc.Content[field.Name])
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", field.Name, err)
+		}
+		record = append(record, value)
+	}
+	return record, nil
+}
+
+// csvValue formats a content value for a CSV cell: arrays are JSON arrays,
+// missing values are empty
+func csvValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case fmt.Stringer:
+		return v.String(), nil
+	}
+	if isSlice(value) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	}
+	return fmt.Sprint(value), nil
+}
+
+// ExportRepository writes an archive of the repository to w: its schemas,
+// all their documents (one file for each schema, see ExportFormat) and the
+// blobs they reference, followed by the manifest, which is also returned.
+// Documents and blobs are streamed, so the memory use doesn't depend on
+// the size of the repository; tar entries are spooled to temporary files.
+func (ca *CustodiaAPIv1) ExportRepository(ctx context.Context,
+	repositoryId uuid.UUID, w io.Writer, opts *ExportOptions) (
+	*ExportManifest, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	options := *opts
+	if options.Format == 0 {
+		options.Format = ExportNDJSON
+	}
+	if options.Archive == 0 {
+		options.Archive = ArchiveTar
+	}
+
+	repository, err := ca.ReadRepository(repositoryId)
+	if err != nil {
+		return nil, err
+	}
+	ex := &exporter{ca: ca, ctx: ctx, opts: &options,
+		manifest: &ExportManifest{Version: ManifestVersion,
+			Repository: repository, CreatedAt: time.Now().UTC(),
+			Format: options.Format, Schemas: []ManifestSchema{},
+			Blobs: []ManifestBlob{}, Files: []ManifestFile{}},
+		known: map[uuid.UUID]Blob{}}
+	for _, blob := range options.KnownBlobs {
+		ex.known[blob.Id] = blob
+	}
+	ex.archive = newArchiveWriter(options.Archive, w)
+
+	schemas := ca.IterSchemas(ctx, repositoryId, options.PageSize)
+	for schemas.Next() {
+		if err := ex.exportSchema(schemas.Value()); err != nil {
+			return nil, err
+		}
+	}
+	if err := schemas.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := closeArchive(ex.archive, ex.manifest); err != nil {
+		return nil, err
+	}
+	return ex.manifest, nil
+}
+
+// newArchiveWriter returns a writer of an archive of the given format to w
+func newArchiveWriter(format ArchiveFormat, w io.Writer) archiveWriter {
+	if format == ArchiveZip {
+		return &zipArchive{zw: zip.NewWriter(w)}
+	}
+	return &tarArchive{tw: tar.NewWriter(w)}
+}
+
+// closeArchive writes manifest as the last entry of archive, and closes it
+func closeArchive(archive archiveWriter, manifest any) error {
+	entry, err := archive.create(ManifestName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(manifest)
+	if closeErr := entry.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// walkArchive calls fn with each entry of the tar or zip archive at path,
+// in archive order
+func walkArchive(archivePath string, fn func(name string, r io.Reader) error) (
+	error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return fmt.Errorf("%s: not an archive: %w", archivePath, err)
+	}
+	if string(magic) == "PK\x03\x04" {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return err
+		}
+		for _, entry := range zr.File {
+			r, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(entry.Name, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", archivePath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(path.Clean(header.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadExportManifest returns the manifest of the export archive at path
+func ReadExportManifest(archivePath string) (*ExportManifest, error) {
+	var manifest *ExportManifest
+	err := walkArchive(archivePath, func(name string, r io.Reader) error {
+		if name != ManifestName {
+			return nil
+		}
+		manifest = &ExportManifest{}
+		return json.NewDecoder(r).Decode(manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s: %s not found", archivePath, ManifestName)
+	}
+	return manifest, nil
+}
+
+// VerifyExport checks the entries of the export archive at path against
+// the checksums of its manifest, returning the manifest
+func VerifyExport(archivePath string) (*ExportManifest, error) {
+	return verifyArchive(archivePath, func(manifest *ExportManifest) (
+		[]ManifestFile) {
+		return manifest.Files
+	})
+}
+
+// verifyArchive checks the entries of the archive at path against the
+// checksums returned by files, returning the manifest
+func verifyArchive[M any](archivePath string, files func(*M) []ManifestFile) (
+	*M, error) {
+	sums := map[string]ManifestFile{}
+	var manifest *M
+	err := walkArchive(archivePath, func(name string, r io.Reader) error {
+		if name == ManifestName {
+			manifest = new(M)
+			return json.NewDecoder(r).Decode(manifest)
+		}
+		hw := newHashWriter()
+		if _, err := io.Copy(hw, r); err != nil {
+			return err
+		}
+		sums[name] = ManifestFile{Path: name, Size: hw.size,
+			Sha256: hexSum(hw.sha256)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s: %s not found", archivePath, ManifestName)
+	}
+
+	var ee []error
+	for _, expected := range files(manifest) {
+		got, ok := sums[expected.Path]
+		if !ok {
+			ee = append(ee, fmt.Errorf("%s: missing", expected.Path))
+		} else if got != expected {
+			ee = append(ee, fmt.Errorf("%s: checksum mismatch",
+				expected.Path))
+		}
+		delete(sums, expected.Path)
+	}
+	extra := []string{}
+	for name := range sums {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		ee = append(ee, fmt.Errorf("%s: not in manifest", name))
+	}
+	if len(ee) > 0 {
+		return manifest, fmt.Errorf("verify errors: %w", errors.Join(ee...))
+	}
+	return manifest, nil
+}
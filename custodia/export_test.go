@@ -0,0 +1,309 @@
+package custodia
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// repoServer serves a repository with its schemas, documents and blobs.
+// Documents can be created and blobs uploaded.
+type repoServer struct {
+	mutex sync.Mutex
+	repository *Repository
+	schemas []*Schema
+	docs map[uuid.UUID][]*Document
+	blobs map[uuid.UUID][]byte
+	// uploads are the blobs being uploaded, by upload id
+	uploads map[uuid.UUID]*ManifestBlob
+	uploadData map[uuid.UUID][]byte
+}
+
+// document returns the document id
+func (s *repoServer) document(id uuid.UUID) *Document {
+	for _, docs := range s.docs {
+		for _, doc := range docs {
+			if doc.Id == id {
+				return doc
+			}
+		}
+	}
+	return nil
+}
+
+// upload handles the blob uploads
+func (s *repoServer) upload(w http.ResponseWriter, r *http.Request,
+	parts []string) {
+	if s.uploads == nil {
+		s.uploads = map[uuid.UUID]*ManifestBlob{}
+		s.uploadData = map[uuid.UUID][]byte{}
+	}
+	body, _ := io.ReadAll(r.Body)
+	values := map[string]string{}
+	json.Unmarshal(body, &values)
+	switch {
+	case len(parts) == 1:
+		id := uuid.New()
+		s.uploads[id] = &ManifestBlob{Blob: Blob{
+			DocumentId: values["document_id"]}, Field: values["field"]}
+		s.reply(w, map[string]any{"blob": map[string]any{"upload_id": id,
+			"expire_date": "2030-01-01T00:00:00Z"}})
+	case parts[1] == "commit":
+		id, _ := uuid.Parse(values["upload_id"])
+		upload := s.uploads[id]
+		upload.Id = uuid.New()
+		s.blobs[upload.Id] = s.uploadData[id]
+		docId, _ := uuid.Parse(upload.DocumentId)
+		s.document(docId).Content[upload.Field] = upload.Id.String()
+		s.reply(w, map[string]any{"blob": upload.Blob})
+	default:
+		id, _ := uuid.Parse(parts[1])
+		s.uploadData[id] = append(s.uploadData[id], body...)
+		s.reply(w, map[string]any{"blob": map[string]any{"upload_id": id,
+			"expire_date": "2030-01-01T00:00:00Z"}})
+	}
+}
+
+func (s *repoServer) reply(w http.ResponseWriter, data any) {
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	envelope.Data, _ = json.Marshal(data)
+	out, _ := json.Marshal(envelope)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// page returns the page of items requested by r
+func page[T any](r *http.Request, key string, items []T) map[string]any {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	end := min(offset+limit, len(items))
+	return map[string]any{"count": end - offset, "total_count": len(items),
+		"limit": limit, "offset": offset, key: items[offset:end]}
+}
+
+func (s *repoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "blobs" && r.Method != "GET" {
+		s.upload(w, r, parts)
+		return
+	}
+	id, _ := uuid.Parse(parts[1])
+	switch {
+	case parts[0] == "repositories" && len(parts) == 2:
+		s.reply(w, map[string]any{"repository": s.repository})
+	case parts[0] == "repositories" && parts[2] == "schemas":
+		s.reply(w, page(r, "schemas", s.schemas))
+	case parts[0] == "schemas" && parts[2] == "documents" &&
+		r.Method == "POST":
+		doc := &Document{}
+		json.NewDecoder(r.Body).Decode(doc)
+		doc.Id, doc.SchemaId = uuid.New(), id
+		s.docs[id] = append(s.docs[id], doc)
+		s.reply(w, map[string]any{"document": doc})
+	case parts[0] == "schemas" && parts[2] == "documents":
+		s.reply(w, page(r, "documents", s.docs[id]))
+	case parts[0] == "blobs" && s.blobs[id] != nil:
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.blobs[id])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newRepoServer returns a repository with a schema of three documents, the
+// first one with a blob
+func newRepoServer() *repoServer {
+	repository := &Repository{Id: uuid.New(), Description: "people",
+		IsActive: true}
+	schema := &Schema{Id: uuid.New(), RepositoryId: repository.Id,
+		Description: "person", IsActive: true, Structure: []SchemaField{
+			{Name: "name", Type: TypeStr, Indexed: true},
+			{Name: "age", Type: TypeInt},
+			{Name: "born", Type: TypeDate},
+			{Name: "tags", Type: TypeArrayStr},
+			{Name: "photo", Type: TypeBlob},
+		}}
+	blobId := uuid.New()
+	docs := []*Document{}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		doc := &Document{Id: uuid.New(), SchemaId: schema.Id,
+			IsActive: i != 1, Content: map[string]any{"name": name,
+				"age": 30 + i, "born": fmt.Sprintf("199%d-04-14", i),
+				"tags": []string{"a", name}}}
+		if i == 0 {
+			doc.Content["photo"] = blobId.String()
+		}
+		docs = append(docs, doc)
+	}
+	return &repoServer{repository: repository, schemas: []*Schema{schema},
+		docs: map[uuid.UUID][]*Document{schema.Id: docs},
+		blobs: map[uuid.UUID][]byte{blobId: []byte("hello blob")}}
+}
+
+// readEntry returns the content of the entry name of an archive
+func readEntry(t *testing.T, archivePath, name string) []byte {
+	var data []byte
+	err := walkArchive(archivePath, func(entry string, r io.Reader) error {
+		if entry == name {
+			data, _ = io.ReadAll(r)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		t.Fatalf("entry %s: %v", name, err)
+	}
+	return data
+}
+
+func TestExportRepository(t *testing.T) {
+	repo := newRepoServer()
+	server := httptest.NewServer(repo)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := repo.schemas[0]
+	var blobId uuid.UUID
+	for id := range repo.blobs {
+		blobId = id
+	}
+	sum := sha1.Sum([]byte("hello blob"))
+	blobSha1 := hex.EncodeToString(sum[:])
+
+	// tar + NDJSON
+	tarPath := filepath.Join(t.TempDir(), "export.tar")
+	file, _ := os.Create(tarPath)
+	manifest, err := custodia.ExportRepository(nil, repo.repository.Id, file,
+		&ExportOptions{PageSize: 2, KnownBlobs: []Blob{{Id: blobId,
+			Sha1: blobSha1}}})
+	file.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verified, verifyErr := VerifyExport(tarPath)
+	docsFile := fmt.Sprintf("schemas/%s/documents.ndjson", schema.Id)
+	lines := strings.Split(strings.TrimSpace(string(readEntry(t, tarPath,
+		docsFile))), "\n")
+	exported := Document{}
+	decodeJSON(lines[2], &exported)
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{nil, verifyErr},
+		{manifest.Files, verified.Files},
+		{1, manifest.Version},
+		{repo.repository.Id, manifest.Repository.Id},
+		{ExportNDJSON, manifest.Format},
+		{1, len(manifest.Schemas)},
+		{schema.Structure, manifest.Schemas[0].Schema.Structure},
+		{docsFile, manifest.Schemas[0].File},
+		{3, manifest.Schemas[0].Documents},
+		{1, len(manifest.Blobs)},
+		{blobId, manifest.Blobs[0].Id},
+		{repo.docs[schema.Id][0].Id.String(), manifest.Blobs[0].DocumentId},
+		{"photo", manifest.Blobs[0].Field},
+		{blobSha1, manifest.Blobs[0].Sha1},
+		{int64(10), manifest.Blobs[0].Size},
+		{[]string{docsFile, "blobs/" + blobId.String()},
+			[]string{manifest.Files[0].Path, manifest.Files[1].Path}},
+		{3, len(lines)},
+		{"carol", exported.Content["name"]},
+		{[]byte("hello blob"), readEntry(t, tarPath, "blobs/" +
+			blobId.String())},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("ExportRepository %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+
+	// a corrupted archive fails the verification
+	data, _ := os.ReadFile(tarPath)
+	os.WriteFile(tarPath, bytes.Replace(data, []byte("hello blob"),
+		[]byte("HELLO blob"), 1), 0o644)
+	_, err = VerifyExport(tarPath)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got: %v", err)
+	}
+
+	// a blob not matching its known checksum fails the export
+	_, err = custodia.ExportRepository(nil, repo.repository.Id, io.Discard,
+		&ExportOptions{KnownBlobs: []Blob{{Id: blobId, Md5: "abc"}}})
+	if err == nil || !strings.Contains(err.Error(), "md5 is") {
+		t.Errorf("expected a blob mismatch, got: %v", err)
+	}
+}
+
+func TestExportRepositoryCSV(t *testing.T) {
+	repo := newRepoServer()
+	server := httptest.NewServer(repo)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := repo.schemas[0]
+
+	zipPath := filepath.Join(t.TempDir(), "export.zip")
+	file, _ := os.Create(zipPath)
+	manifest, err := custodia.ExportRepository(nil, repo.repository.Id, file,
+		&ExportOptions{Format: ExportCSV, Archive: ArchiveZip,
+			SkipBlobs: true})
+	file.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := VerifyExport(zipPath); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	read, _ := ReadExportManifest(zipPath)
+	records, err := csv.NewReader(bytes.NewReader(readEntry(t, zipPath,
+		manifest.Schemas[0].File))).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := repo.docs[schema.Id][0]
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{ExportCSV, read.Format},
+		{0, len(read.Blobs)},
+		{4, len(records)},
+		{[]string{"document_id", "is_active", "insert_date", "last_update",
+			"name:string", "age:integer", "born:date", "tags:array[string]",
+			"photo:blob"}, records[0]},
+		{first.Id.String(), records[1][0]},
+		{"true", records[1][1]},
+		{[]string{"alice", "30", "1990-04-14", `["a","alice"]`,
+			first.Content["photo"].(string)}, records[1][4:]},
+		{"false", records[2][1]},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("ExportRepository CSV %d: bad value, got: %v want: %v",
+				i, test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package custodia
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// FederatedTarget is a schema searched by a federated search
+type FederatedTarget struct {
+	SchemaId uuid.UUID
+	// Schema (optional) is used to check the query and convert the results
+	Schema *Schema
+	// Fields maps the logical field names to the names in this schema.
+	// Names not mapped are the same.
+	Fields map[string]string
+}
+
+// FederatedSearch is a logical search run on several schemas
+type FederatedSearch struct {
+	Targets []FederatedTarget
+	// ResultType is FullContent (default) or NoContent
+	ResultType ResultType
+	// Query and Sort use the logical field names. A nil Query matches all.
+	// The merged results are sorted on their content, so Sort needs
+	// FullContent.
+	Query Query
+	Sort []SortSpec
+	// Concurrency is the maximum number of schemas searched at the same
+	// time, 0 means all
+	Concurrency int
+}
+
+// FederatedResult is a page of the merged results of a federated search
+type FederatedResult struct {
+	// Documents of all the schemas, sorted and paginated as a whole. Their
+	// content uses the logical field names.
+	Documents []*Document
+	// TotalCount is the sum of the total counts of the searched schemas
+	TotalCount int
+	// Failed holds the errors of the schemas which couldn't be searched,
+	// their documents are missing from the results
+	Failed map[uuid.UUID]error
+}
+
+// FederatedError reports the schemas which failed in a federated search
+type FederatedError struct {
+	Errors map[uuid.UUID]error
+}
+
+func (e *FederatedError) Error() string {
+	ids := []uuid.UUID{}
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	messages := []string{}
+	for _, id := range ids {
+		messages = append(messages, fmt.Sprintf("schema %s: %v", id,
+			e.Errors[id]))
+	}
+	return fmt.Sprintf("federated search failed on %d schema(s): %s",
+		len(e.Errors), strings.Join(messages, "; "))
+}
+
+func (e *FederatedError) Unwrap() []error {
+	ee := []error{}
+	for _, err := range e.Errors {
+		ee = append(ee, err)
+	}
+	return ee
+}
+
+// renameQuery returns a copy of query with the field names mapped
+func renameQuery(query Query, fields map[string]string) Query {
+	rename := func(name string) string {
+		if mapped, ok := fields[name]; ok {
+			return mapped
+		}
+		return name
+	}
+
+	switch q := query.(type) {
+	case *FieldFilter:
+		return &FieldFilter{Field: rename(q.Field), Op: q.Op, Value: q.Value}
+	case *logicalQuery:
+		queries := []Query{}
+		for _, child := range q.queries {
+			queries = append(queries, renameQuery(child, fields))
+		}
+		return &logicalQuery{op: q.op, queries: queries}
+	case *notQuery:
+		return &notQuery{query: renameQuery(q.query, fields)}
+	}
+	panic(fmt.Sprintf("unhandled query type '%T'", query))
+}
+
+// federatedTargetResult is the outcome of the search on a single schema
+type federatedTargetResult struct {
+	documents []*Document
+	totalCount int
+	err error
+}
+
+// FederatedSearch runs fs on all its targets concurrently and returns the
+// page [offset, offset+limit) of the merged results. When some schemas
+// fail, the results of the others are returned along with a
+// *FederatedError.
+func (ca *CustodiaAPIv1) FederatedSearch(ctx context.Context,
+	fs *FederatedSearch, offset, limit int) (*FederatedResult, error) {
+	resultType := fs.ResultType
+	if resultType == 0 {
+		resultType = FullContent
+	}
+	if resultType != FullContent && resultType != NoContent {
+		return nil, fmt.Errorf("result type %s not supported", resultType)
+	}
+	if resultType == NoContent && len(fs.Sort) > 0 {
+		return nil, fmt.Errorf("sort needs result type %s, got %s",
+			FullContent, resultType)
+	}
+	if len(fs.Targets) == 0 {
+		return nil, fmt.Errorf("no targets given")
+	}
+	if offset < 0 || limit <= 0 {
+		return nil, fmt.Errorf("bad offset %d or limit %d", offset, limit)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	concurrency := fs.Concurrency
+	if concurrency <= 0 || concurrency > len(fs.Targets) {
+		concurrency = len(fs.Targets)
+	}
+	semaphore := make(chan struct{}, concurrency)
+	results := make([]federatedTargetResult, len(fs.Targets))
+	var wg sync.WaitGroup
+	for i, target := range fs.Targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			results[i] = ca.federatedTargetSearch(ctx, fs, target, resultType,
+				offset+limit)
+		}()
+	}
+	wg.Wait()
+
+	// merge the results, in target order
+	result := &FederatedResult{Documents: []*Document{},
+		Failed: map[uuid.UUID]error{}}
+	for i, targetResult := range results {
+		if targetResult.err != nil {
+			result.Failed[fs.Targets[i].SchemaId] = targetResult.err
+			continue
+		}
+		result.TotalCount += targetResult.totalCount
+		result.Documents = append(result.Documents,
+			targetResult.documents...)
+	}
+	if len(fs.Sort) > 0 {
+		sort.SliceStable(result.Documents, func(i, j int) bool {
+			return lessByContent(result.Documents[i].Content,
+				result.Documents[j].Content, fs.Sort)
+		})
+	}
+
+	// paginate the union
+	start := min(offset, len(result.Documents))
+	end := min(offset+limit, len(result.Documents))
+	result.Documents = result.Documents[start:end]
+
+	if len(result.Failed) > 0 {
+		return result, &FederatedError{Errors: result.Failed}
+	}
+	return result, nil
+}
+
+// federatedTargetSearch returns the first count documents of a target,
+// with the content mapped to the logical field names
+func (ca *CustodiaAPIv1) federatedTargetSearch(ctx context.Context,
+	fs *FederatedSearch, target FederatedTarget, resultType ResultType,
+	count int) federatedTargetResult {
+	var schema StructureMapper
+	if target.Schema != nil {
+		schema = target.Schema
+	}
+
+	query := map[string]any{}
+	if fs.Query != nil {
+		var err error
+		query, err = BuildQuery(schema, renameQuery(fs.Query, target.Fields))
+		if err != nil {
+			return federatedTargetResult{err: err}
+		}
+	}
+	var sortSpecs any
+	if len(fs.Sort) > 0 {
+		specs := []SortSpec{}
+		for _, spec := range fs.Sort {
+			if mapped, ok := target.Fields[spec.Field]; ok {
+				spec.Field = mapped
+			}
+			specs = append(specs, spec)
+		}
+		specs, err := BuildSort(schema, specs...)
+		if err != nil {
+			return federatedTargetResult{err: err}
+		}
+		sortSpecs = specs
+	}
+
+	result := federatedTargetResult{documents: []*Document{}}
+	for len(result.documents) < count {
+		if err := ctx.Err(); err != nil {
+			return federatedTargetResult{err: err}
+		}
+		limit := min(count-len(result.documents), DefaultPageSize)
+		resp, err := ca.searchDocuments(target.SchemaId, target.Schema,
+			resultType, query, sortSpecs,
+			pageParams(len(result.documents), limit))
+		if err != nil {
+			return federatedTargetResult{err: err}
+		}
+		result.documents = append(result.documents, resp.Documents...)
+		result.totalCount = resp.TotalCount
+		if len(resp.Documents) < limit ||
+			len(result.documents) >= resp.TotalCount {
+			break
+		}
+	}
+
+	// map the content back to the logical names
+	logical := map[string]string{}
+	for name, mapped := range target.Fields {
+		logical[mapped] = name
+	}
+	for _, doc := range result.documents {
+		content := map[string]any{}
+		for name, value := range doc.Content {
+			if logicalName, ok := logical[name]; ok {
+				name = logicalName
+			}
+			content[name] = value
+		}
+		doc.Content = content
+	}
+	return result
+}
+
+// lessByContent compares two contents on the sort specs. Null (or
+// missing) values come first in ascending order.
+func lessByContent(a, b map[string]any, specs []SortSpec) bool {
+	for _, spec := range specs {
+		va, vb := a[spec.Field], b[spec.Field]
+		var c int
+		switch {
+		case va == nil && vb == nil:
+			c = 0
+		case va == nil:
+			c = -1
+		case vb == nil:
+			c = 1
+		default:
+			var err error
+			c, err = compareValues(va, vb)
+			if err != nil {
+				// different types: keep a stable, arbitrary order
+				c = strings.Compare(fmt.Sprint(va), fmt.Sprint(vb))
+			}
+		}
+		if c == 0 {
+			continue
+		}
+		if spec.Order == SortDesc {
+			return c > 0
+		}
+		return c < 0
+	}
+	return false
+}
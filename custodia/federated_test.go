@@ -0,0 +1,200 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestFederatedSearch(t *testing.T) {
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	italian, english, broken := uuid.New(), uuid.New(), uuid.New()
+
+	// documents of each schema, sorted on the age field by the "server"
+	contents := map[uuid.UUID][]map[string]any{
+		italian: {{"eta": 20}, {"eta": 40}, {"eta": 60}},
+		english: {{"age": 10}, {"age": 30}, {"age": 50}, {"age": 70}},
+	}
+	var mutex sync.Mutex
+	queries := map[uuid.UUID]any{}
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		// the english schema is read to convert the results
+		if r.URL.Path == fmt.Sprintf("/api/v1/schemas/%s", english) &&
+			r.Method == "GET" {
+			data, _ := json.Marshal(map[string]any{"schema": map[string]any{
+				"schema_id": english.String(),
+				"description": "english",
+				"is_active": true,
+				"structure": []any{map[string]any{"name": "age",
+					"type": "integer", "indexed": true}},
+			}})
+			envelope := envelope
+			envelope.Data = data
+			out, _ := json.Marshal(envelope)
+			w.WriteHeader(http.StatusOK)
+			w.Write(out)
+			return
+		}
+		id, _ := uuid.Parse(strings.TrimPrefix(r.URL.Path,
+			"/api/v1/search/documents/"))
+		items, ok := contents[id]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"result": "error", "result_code": 500, ` +
+				`"data": null, "message": "boom"}`))
+			return
+		}
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mutex.Lock()
+		queries[id] = body["query"]
+		mutex.Unlock()
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := min(offset+limit, len(items))
+		docs := []any{}
+		for _, content := range items[offset:end] {
+			docs = append(docs, map[string]any{
+				"document_id": uuid.New().String(),
+				"schema_id": id.String(),
+				"content": content,
+			})
+		}
+		data, _ := json.Marshal(map[string]any{"documents": docs,
+			"count": len(docs), "total_count": len(items), "limit": limit,
+			"offset": offset})
+		envelope := envelope
+		envelope.Data = data
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	italianSchema := &Schema{Id: italian, Structure: []SchemaField{
+		{Name: "eta", Type: TypeInt, Indexed: true}}}
+	fs := &FederatedSearch{
+		Targets: []FederatedTarget{
+			{SchemaId: italian, Schema: italianSchema,
+				Fields: map[string]string{"age": "eta"}},
+			{SchemaId: english},
+		},
+		Query: Field("age").Gt(5),
+		Sort: []SortSpec{Field("age").Asc()},
+		Concurrency: 1,
+	}
+
+	ages := func(docs []*Document) []string {
+		result := []string{}
+		for _, doc := range docs {
+			result = append(result, fmt.Sprint(doc.Content["age"]))
+		}
+		return result
+	}
+
+	result, err := custodia.FederatedSearch(context.Background(), fs, 1, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{[]string{"20", "30", "40", "50"}, ages(result.Documents)},
+		{7, result.TotalCount},
+		{int64(20), result.Documents[0].Content["age"]},
+		{italian, result.Documents[0].SchemaId},
+		{map[string]any{"field": "eta", "type": "gt", "value": float64(5)},
+			queries[italian]},
+		{map[string]any{"field": "age", "type": "gt", "value": float64(5)},
+			queries[english]},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	// descending, last page
+	fs.Sort = []SortSpec{Field("age").Desc()}
+	fs.Concurrency = 0
+	result, err = custodia.FederatedSearch(context.Background(), fs, 5, 10)
+	if err != nil || !reflect.DeepEqual(ages(result.Documents),
+		[]string{"20", "10"}) {
+		t.Errorf("desc: got %v, %v", ages(result.Documents), err)
+	}
+
+	// partial failures keep the successful results
+	fs.Targets = append(fs.Targets, FederatedTarget{SchemaId: broken})
+	result, err = custodia.FederatedSearch(context.Background(), fs, 0, 100)
+	var federatedErr *FederatedError
+	if !errors.As(err, &federatedErr) {
+		t.Fatalf("expected FederatedError, got: %v", err)
+	}
+	if len(federatedErr.Errors) != 1 || federatedErr.Errors[broken] == nil ||
+		len(result.Documents) != 7 {
+		t.Errorf("partial: got %v, %d documents", federatedErr,
+			len(result.Documents))
+	}
+
+	// schema checks fail the single target
+	fs.Targets = fs.Targets[:2]
+	fs.Query = Field("missing").Eq(1)
+	result, err = custodia.FederatedSearch(context.Background(), fs, 0, 10)
+	if !errors.As(err, &federatedErr) || len(federatedErr.Errors) != 1 ||
+		federatedErr.Errors[italian] == nil {
+		t.Errorf("check: got %v", err)
+	}
+
+	// bad arguments
+	_, err = custodia.FederatedSearch(context.Background(),
+		&FederatedSearch{Targets: fs.Targets, ResultType: Count}, 0, 10)
+	if err == nil {
+		t.Errorf("expected error with Count")
+	}
+	_, err = custodia.FederatedSearch(context.Background(),
+		&FederatedSearch{Targets: fs.Targets, ResultType: NoContent,
+		Sort: []SortSpec{Field("age").Asc()}}, 0, 10)
+	if err == nil || !strings.Contains(err.Error(), "sort needs") {
+		t.Errorf("expected error sorting NoContent results, got: %v", err)
+	}
+}
+
+func TestLessByContent(t *testing.T) {
+	contents := []map[string]any{
+		{"a": int64(2), "b": "x"},
+		{"a": nil, "b": "y"},
+		{"a": int64(1), "b": "z"},
+		{"a": int64(2), "b": "a"},
+	}
+	specs := []SortSpec{Field("a").Asc(), Field("b").Desc()}
+	sort.SliceStable(contents, func(i, j int) bool {
+		return lessByContent(contents[i], contents[j], specs)
+	})
+	got := []string{}
+	for _, content := range contents {
+		got = append(got, content["b"].(string))
+	}
+	if !reflect.DeepEqual(got, []string{"y", "z", "x", "a"}) {
+		t.Errorf("bad order: %v", got)
+	}
+}
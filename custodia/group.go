@@ -1,9 +1,8 @@
 package custodia
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/url"
 
 	"github.com/google/uuid"
 	"github.com/simplereach/timeutils"
@@ -38,7 +37,7 @@ func (ca *CustodiaAPIv1) CreateGroup(name string, isActive bool,
 	}
 	// JSON: unmarshal resp content
 	groupEnvelope := GroupEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &groupEnvelope); err != nil {
+	if err := decodeJSON(resp, &groupEnvelope); err != nil {
 		return nil, err
 	}
 	return groupEnvelope.Group, nil
@@ -53,7 +52,7 @@ func (ca *CustodiaAPIv1) ReadGroup(groupId uuid.UUID) (*Group, error) {
 	}
 	// JSON: unmarshal resp content
 	groupEnvelope := GroupEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &groupEnvelope); err != nil {
+	if err := decodeJSON(resp, &groupEnvelope); err != nil {
 		return nil, err
 	}
 	return groupEnvelope.Group, nil
@@ -71,7 +70,7 @@ func (ca *CustodiaAPIv1) UpdateGroup(groupId uuid.UUID, name string,
 	}
 	// JSON: unmarshal resp content
 	groupEnvelope := GroupEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &groupEnvelope); err != nil {
+	if err := decodeJSON(resp, &groupEnvelope); err != nil {
 		return nil, err
 	}
 	return groupEnvelope.Group, nil
@@ -91,28 +90,27 @@ func (ca *CustodiaAPIv1) DeleteGroup(groupId uuid.UUID, force bool) error {
 func (ca *CustodiaAPIv1) ListGroups(queryParams map[string]string) (
 	[]Group, error,
 ) {
-	u, err := url.Parse("/groups")
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
+	result, _, err := ca.listGroups(queryParams)
+	return result, err
+}
 
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listGroups(queryParams map[string]string) (
+	[]Group, PageInfo, error) {
 	groupsEnvelope := GroupsEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &groupsEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage("/groups", queryParams, &groupsEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
-	return groupsEnvelope.Groups, nil
+	return groupsEnvelope.Groups, page, nil
+}
+
+// IterGroups returns a Pager over all the groups
+func (ca *CustodiaAPIv1) IterGroups(ctx context.Context,
+	pageSize int) *Pager[Group] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]Group,
+		PageInfo, error) {
+		return ca.listGroups(pageParams(offset, limit))
+	})
 }
 
 // Group Members
@@ -124,28 +122,28 @@ func (ca *CustodiaAPIv1) ListGroups(queryParams map[string]string) (
 func (ca *CustodiaAPIv1) ListGroupUsers(groupId uuid.UUID,
 	queryParams map[string]string) ([]User, error,
 ) {
-	u, err := url.Parse(fmt.Sprintf("/groups/%s/users", groupId))
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
+	result, _, err := ca.listGroupUsers(groupId, queryParams)
+	return result, err
+}
 
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listGroupUsers(groupId uuid.UUID,
+	queryParams map[string]string) ([]User, PageInfo, error) {
 	usersEnvelope := UsersEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &usersEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage(fmt.Sprintf("/groups/%s/users", groupId),
+		queryParams, &usersEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
-	return usersEnvelope.Users, nil
+	return usersEnvelope.Users, page, nil
+}
+
+// IterGroupUsers returns a Pager over all the users of a group
+func (ca *CustodiaAPIv1) IterGroupUsers(ctx context.Context, groupId uuid.UUID,
+	pageSize int) *Pager[User] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]User,
+		PageInfo, error) {
+		return ca.listGroupUsers(groupId, pageParams(offset, limit))
+	})
 }
 
 // [C] Add a user to the group
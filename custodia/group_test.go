@@ -157,7 +157,7 @@ func TestGroupCRUDL(t *testing.T) {
         }{
             {gid, group.Id},
             {"unittest", group.Name},
-            {map[string]any{"antani": 3.14}, group.Attributes},
+            {map[string]any{"antani": json.Number("3.14")}, group.Attributes},
             {true, group.IsActive},
             {2015, group.InsertDate.Year()},
             {2, int(group.InsertDate.Month())},
@@ -195,8 +195,8 @@ func TestGroupCRUDL(t *testing.T) {
             {gid, group.Id},
             {"changed", group.Name},
             {false, group.IsActive},
-            {map[string]any{"antani": 3.14, "something": "else"},
-                group.Attributes},
+            {map[string]any{"antani": json.Number("3.14"),
+                "something": "else"}, group.Attributes},
             {2015, group.InsertDate.Year()},
             {2, int(group.InsertDate.Month())},
             {7, int(group.InsertDate.Day())},
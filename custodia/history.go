@@ -0,0 +1,486 @@
+package custodia
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Define RevisionOperation
+type RevisionOperation int
+
+const (
+	RevisionUpdated RevisionOperation = iota + 1
+	RevisionDeactivated
+	RevisionDeleted
+	// RevisionRestored links a deleted document to the one created again by
+	// RestoreRevision
+	RevisionRestored
+)
+
+func (ro RevisionOperation) Choices() []string {
+	return []string{"update", "deactivate", "delete", "restore"}
+}
+
+func (ro RevisionOperation) String() string {
+	return ro.Choices()[ro-1]
+}
+
+func (ro RevisionOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ro.String())
+}
+
+func (ro *RevisionOperation) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, ro.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("RevisionOperation: received unknown value '%v'",
+			value)
+	}
+
+	*ro = RevisionOperation(intValue)
+	return nil
+}
+
+// Revision is the snapshot of a document taken before a change made
+// through the SDK. Content values read back from a store are not converted
+// (e.g. dates are strings, numbers json.Number).
+type Revision struct {
+	DocumentId uuid.UUID `json:"document_id"`
+	SchemaId uuid.UUID `json:"schema_id"`
+	// Number is the position of the revision in the history of the
+	// document, starting from 1
+	Number int `json:"number"`
+	Operation RevisionOperation `json:"operation"`
+	Actor string `json:"actor"`
+	Timestamp time.Time `json:"timestamp"`
+	// IsActive, LastUpdate and Content are the ones before the change, the
+	// restored ones with RevisionRestored
+	IsActive bool `json:"is_active"`
+	LastUpdate time.Time `json:"last_update"`
+	Content map[string]any `json:"content"`
+	// Changes are the changes to the content made by an update
+	Changes []FieldChange `json:"changes,omitempty"`
+	// RestoredAs is the id of the document created again with
+	// RevisionRestored
+	RestoredAs uuid.UUID `json:"restored_as"`
+}
+
+// HistoryStore stores the revisions of the documents
+type HistoryStore interface {
+	// Append stores revision, setting its Number
+	Append(revision *Revision) error
+	// List returns the revisions of a document, oldest first
+	List(documentId uuid.UUID) ([]*Revision, error)
+}
+
+// History records the revisions of the documents changed with
+// UpdateDocument and DeleteDocument, when set in CustodiaAPIv1.History.
+// Each change costs an additional read of the document.
+type History struct {
+	Store HistoryStore
+	// Actor is recorded as the author of the changes
+	Actor string
+}
+
+// HistoryError is returned when a change was applied but its revision
+// couldn't be recorded: retrying the call would apply the change twice
+type HistoryError struct {
+	DocumentId uuid.UUID
+	Err error
+}
+
+func (e *HistoryError) Error() string {
+	return fmt.Sprintf("error recording revision of %s: %v", e.DocumentId,
+		e.Err)
+}
+
+func (e *HistoryError) Unwrap() error {
+	return e.Err
+}
+
+// record appends the revision of prior, changed by operation
+func (h *History) record(prior *Document, operation RevisionOperation,
+	changes []FieldChange) error {
+	return h.append(&Revision{DocumentId: prior.Id,
+		SchemaId: prior.SchemaId, Operation: operation,
+		IsActive: prior.IsActive, LastUpdate: prior.LastUpdate.Time,
+		Content: prior.Content, Changes: changes})
+}
+
+// append stores revision, with the actor and the current time
+func (h *History) append(revision *Revision) error {
+	revision.Actor, revision.Timestamp = h.Actor, time.Now().UTC()
+	if err := h.Store.Append(revision); err != nil {
+		return &HistoryError{DocumentId: revision.DocumentId, Err: err}
+	}
+	return nil
+}
+
+// Revisions returns the revisions of a document, oldest first
+func (h *History) Revisions(documentId uuid.UUID) ([]*Revision, error) {
+	return h.Store.List(documentId)
+}
+
+// Revision returns the revision number of a document
+func (h *History) Revision(documentId uuid.UUID, number int) (*Revision,
+	error) {
+	revisions, err := h.Store.List(documentId)
+	if err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		if revision.Number == number {
+			return revision, nil
+		}
+	}
+	return nil, fmt.Errorf("revision %d of %s not found", number, documentId)
+}
+
+// Diff returns the changes of the content of a document from revision
+// from to revision to
+func (h *History) Diff(documentId uuid.UUID, from, to int) ([]FieldChange,
+	error) {
+	old, err := h.Revision(documentId, from)
+	if err != nil {
+		return nil, err
+	}
+	new, err := h.Revision(documentId, to)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(old.Content, new.Content), nil
+}
+
+// readPrior reads a document to record its revision, converting its
+// content with its schema
+func (ca *CustodiaAPIv1) readPrior(documentId uuid.UUID) (*Document,
+	error) {
+	resp, err := ca.Call("GET", fmt.Sprintf("/documents/%s", documentId),
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	docEnvelope := DocumentEnvelope{}
+	if err := decodeJSON(resp, &docEnvelope); err != nil {
+		return nil, err
+	}
+	doc := docEnvelope.Document
+	schema, err := ca.cachedSchema(doc.SchemaId)
+	if err != nil {
+		return nil, err
+	}
+	converted, ee := convertData(doc.Content, schema)
+	if len(ee) > 0 {
+		return nil, fmt.Errorf("conversion errors: %w", errors.Join(ee...))
+	}
+	doc.Content = converted
+	return doc, nil
+}
+
+// RestoreRevision writes back the content and active flag of the revision
+// number of a document, with UpdateDocument (so the restore is recorded
+// too). A document deleted permanently is created again, with a new id,
+// recorded in a RevisionRestored revision of the deleted one: it can't be
+// restored again, the history continues with the new id.
+func (ca *CustodiaAPIv1) RestoreRevision(schema Schema, documentId uuid.UUID,
+	number int) (*Document, error) {
+	if ca.History == nil {
+		return nil, fmt.Errorf("history is not enabled")
+	}
+	revisions, err := ca.History.Revisions(documentId)
+	if err != nil {
+		return nil, err
+	}
+	var revision *Revision
+	for _, r := range revisions {
+		if r.Number == number {
+			revision = r
+		}
+	}
+	if revision == nil {
+		return nil, fmt.Errorf("revision %d of %s not found", number,
+			documentId)
+	}
+
+	content, ee := convertData(revision.Content, &schema)
+	if len(ee) > 0 {
+		return nil, fmt.Errorf("conversion errors: %w", errors.Join(ee...))
+	}
+	last := revisions[len(revisions)-1]
+	switch last.Operation {
+	case RevisionRestored:
+		return nil, fmt.Errorf("document %s already restored as %s",
+			documentId, last.RestoredAs)
+	case RevisionDeleted:
+		doc, err := ca.CreateDocument(&schema, revision.IsActive, content)
+		if err != nil {
+			return nil, err
+		}
+		return doc, ca.History.append(&Revision{DocumentId: documentId,
+			SchemaId: schema.Id, Operation: RevisionRestored,
+			IsActive: revision.IsActive, Content: revision.Content,
+			RestoredAs: doc.Id})
+	}
+	return ca.UpdateDocument(schema, documentId, revision.IsActive, content)
+}
+
+// FileHistoryStore stores the revisions of each document as JSON lines in
+// the file <document id>.ndjson of Dir
+type FileHistoryStore struct {
+	Dir string
+	mutex sync.Mutex
+}
+
+func (fs *FileHistoryStore) path(documentId uuid.UUID) string {
+	return filepath.Join(fs.Dir, documentId.String() + ".ndjson")
+}
+
+func (fs *FileHistoryStore) Append(revision *Revision) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	revisions, err := fs.list(revision.DocumentId)
+	if err != nil {
+		return err
+	}
+	revision.Number = len(revisions) + 1
+
+	data, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(fs.path(revision.DocumentId),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (fs *FileHistoryStore) List(documentId uuid.UUID) ([]*Revision,
+	error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.list(documentId)
+}
+
+func (fs *FileHistoryStore) list(documentId uuid.UUID) ([]*Revision,
+	error) {
+	revisions := []*Revision{}
+	file, err := os.Open(fs.path(documentId))
+	if errors.Is(err, os.ErrNotExist) {
+		return revisions, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16 * 1024 * 1024)
+	for scanner.Scan() {
+		revision := &Revision{}
+		if err := decodeJSON(scanner.Text(), revision); err != nil {
+			return nil, fmt.Errorf("%s: %w", fs.path(documentId), err)
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, scanner.Err()
+}
+
+// HistoryStructure returns the structure of a companion schema storing the
+// revisions in Custodia, see SchemaHistoryStore
+func HistoryStructure() []SchemaField {
+	return []SchemaField{
+		{Name: "document_id", Type: TypeStr, Indexed: true},
+		{Name: "schema_id", Type: TypeStr},
+		{Name: "number", Type: TypeInt, Indexed: true},
+		{Name: "operation", Type: TypeStr},
+		{Name: "actor", Type: TypeStr},
+		{Name: "timestamp", Type: TypeDateTime},
+		{Name: "is_active", Type: TypeBool},
+		{Name: "last_update", Type: TypeDateTime},
+		{Name: "content", Type: TypeJson},
+		{Name: "changes", Type: TypeJson},
+		{Name: "restored_as", Type: TypeStr},
+	}
+}
+
+// SchemaHistoryStore stores the revisions as documents of Schema, a schema
+// with the HistoryStructure. API must not record the history itself.
+// A revision is numbered after the highest of the stored one and the last
+// one appended by the store. Documents are searchable only after a while:
+// revisions of the same document appended by other clients or stores may
+// get the same number, so numbers are not unique and can't be used as keys.
+type SchemaHistoryStore struct {
+	API *CustodiaAPIv1
+	Schema *Schema
+
+	mutex sync.Mutex
+	// numbers are the last revision numbers appended, by document id
+	numbers map[uuid.UUID]int
+}
+
+func (ss *SchemaHistoryStore) documentQuery(documentId uuid.UUID) (
+	map[string]any, error) {
+	return BuildQuery(ss.Schema,
+		Field("document_id").Eq(documentId.String()))
+}
+
+func (ss *SchemaHistoryStore) Append(revision *Revision) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	number, err := ss.lastNumber(revision.DocumentId)
+	if err != nil {
+		return err
+	}
+	revision.Number = max(number, ss.numbers[revision.DocumentId]) + 1
+
+	content, err := historyContent(revision)
+	if err != nil {
+		return err
+	}
+	if _, err = ss.API.CreateDocument(ss.Schema, true, content); err != nil {
+		return err
+	}
+	if ss.numbers == nil {
+		ss.numbers = map[uuid.UUID]int{}
+	}
+	ss.numbers[revision.DocumentId] = revision.Number
+	return nil
+}
+
+// lastNumber returns the highest revision number stored for a document, 0
+// if none is
+func (ss *SchemaHistoryStore) lastNumber(documentId uuid.UUID) (int, error) {
+	query, err := ss.documentQuery(documentId)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ss.API.searchDocuments(ss.Schema.Id, ss.Schema, FullContent,
+		query, []SortSpec{Field("number").Desc()}, pageParams(0, 1))
+	if err != nil || len(resp.Documents) == 0 {
+		return 0, err
+	}
+	number, _ := resp.Documents[0].Content["number"].(int64)
+	return int(number), nil
+}
+
+// historyContent returns the content of the history document of revision
+func historyContent(revision *Revision) (map[string]any, error) {
+	content, err := json.Marshal(revision.Content)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := json.Marshal(revision.Changes)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"document_id": revision.DocumentId.String(),
+		"schema_id": revision.SchemaId.String(),
+		"number": int64(revision.Number),
+		"operation": revision.Operation.String(),
+		"actor": revision.Actor,
+		"timestamp": NewDateTime(revision.Timestamp),
+		"is_active": revision.IsActive,
+		"last_update": NewDateTime(revision.LastUpdate),
+		"content": string(content),
+		"changes": string(changes),
+		"restored_as": revision.RestoredAs.String(),
+	}, nil
+}
+
+func (ss *SchemaHistoryStore) List(documentId uuid.UUID) ([]*Revision,
+	error) {
+	query, err := ss.documentQuery(documentId)
+	if err != nil {
+		return nil, err
+	}
+	sort := []SortSpec{Field("number").Asc()}
+	docs, err := NewPager(context.Background(), 0, func(offset, limit int) (
+		[]*Document, PageInfo, error) {
+		resp, err := ss.API.searchDocuments(ss.Schema.Id, ss.Schema,
+			FullContent, query, sort, pageParams(offset, limit))
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		return resp.Documents, resp.Page(), nil
+	}).All()
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []*Revision{}
+	for _, doc := range docs {
+		revision, err := revisionOf(doc.Content)
+		if err != nil {
+			return nil, fmt.Errorf("history document %s: %w", doc.Id, err)
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// revisionOf returns the revision stored in a history document content
+func revisionOf(content map[string]any) (*Revision, error) {
+	revision := &Revision{Content: map[string]any{}}
+	var err error
+	if revision.DocumentId, err = uuid.Parse(fmt.Sprint(
+		content["document_id"])); err != nil {
+		return nil, err
+	}
+	if revision.SchemaId, err = uuid.Parse(fmt.Sprint(
+		content["schema_id"])); err != nil {
+		return nil, err
+	}
+	number, _ := content["number"].(int64)
+	revision.Number = int(number)
+	err = revision.Operation.UnmarshalJSON([]byte(fmt.Sprintf("%q",
+		content["operation"])))
+	if err != nil {
+		return nil, err
+	}
+	revision.Actor, _ = content["actor"].(string)
+	timestamp, _ := content["timestamp"].(DateTime)
+	revision.Timestamp = timestamp.Time
+	revision.IsActive, _ = content["is_active"].(bool)
+	lastUpdate, _ := content["last_update"].(DateTime)
+	revision.LastUpdate = lastUpdate.Time
+
+	data, _ := content["content"].(string)
+	if err := decodeJSON(data, &revision.Content); err != nil {
+		return nil, err
+	}
+	if data, _ := content["changes"].(string); data != "null" {
+		if err := decodeJSON(data, &revision.Changes); err != nil {
+			return nil, err
+		}
+	}
+	if restoredAs, _ := content["restored_as"].(string); restoredAs != "" {
+		if revision.RestoredAs, err = uuid.Parse(restoredAs); err != nil {
+			return nil, err
+		}
+	}
+	return revision, nil
+}
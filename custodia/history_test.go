@@ -0,0 +1,295 @@
+package custodia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// historyServer serves the documents of a single schema
+type historyServer struct {
+	mutex sync.Mutex
+	schema Schema
+	docs map[uuid.UUID]*Document
+}
+
+func (s *historyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var data any
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	id, _ := uuid.Parse(strings.TrimPrefix(path, "/documents/"))
+	switch {
+	case path == fmt.Sprintf("/schemas/%s", s.schema.Id):
+		data = map[string]any{"schema": s.schema}
+	case path == fmt.Sprintf("/schemas/%s/documents", s.schema.Id):
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		doc := &Document{Id: uuid.New(), SchemaId: s.schema.Id,
+			IsActive: body["is_active"].(bool),
+			Content: body["content"].(map[string]any)}
+		s.docs[doc.Id] = doc
+		data = map[string]any{"document": doc}
+	case s.docs[id] == nil:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case r.Method == "PUT":
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.docs[id].IsActive = body["is_active"].(bool)
+		s.docs[id].Content = body["content"].(map[string]any)
+		data = map[string]any{"document": s.docs[id]}
+	case r.Method == "DELETE":
+		if r.URL.Query().Get("force") == "true" {
+			delete(s.docs, id)
+		} else {
+			s.docs[id].IsActive = false
+		}
+	default:
+		data = map[string]any{"document": s.docs[id]}
+	}
+
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	envelope.Data, _ = json.Marshal(data)
+	out, _ := json.Marshal(envelope)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func TestHistory(t *testing.T) {
+	schema := Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}, {Name: "age", Type: TypeInt},
+		{Name: "born", Type: TypeDate}}}
+	docId := uuid.New()
+	store := &historyServer{schema: schema, docs: map[uuid.UUID]*Document{
+		docId: {Id: docId, SchemaId: schema.Id, IsActive: true,
+			Content: map[string]any{"name": "alice", "age": 30,
+				"born": "1995-04-14"}}}}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	custodia.History = &History{Store: &FileHistoryStore{Dir: t.TempDir()},
+		Actor: "auditor"}
+	born := NewDate(1995, 4, 14)
+
+	_, err1 := custodia.UpdateDocument(schema, docId, true,
+		map[string]any{"name": "alice", "age": int64(31), "born": born})
+	_, err2 := custodia.UpdateDocument(schema, docId, true,
+		map[string]any{"name": "Alice", "age": int64(31), "born": born})
+	revisions, err3 := custodia.History.Revisions(docId)
+	diff, err4 := custodia.History.Diff(docId, 1, 2)
+
+	// restore the original content
+	restored, err5 := custodia.RestoreRevision(schema, docId, 1)
+
+	// deactivate, delete and restore as a new document
+	err6 := custodia.DeleteDocument(docId, false, true)
+	err7 := custodia.DeleteDocument(docId, true, true)
+	recreated, err8 := custodia.RestoreRevision(schema, docId, 4)
+	final, err9 := custodia.History.Revisions(docId)
+	_, err10 := custodia.History.Revision(docId, 42)
+	// the deleted document is linked to the new one, and not restored twice
+	_, err11 := custodia.RestoreRevision(schema, docId, 4)
+
+	operations := []string{}
+	for _, revision := range final {
+		operations = append(operations, revision.Operation.String())
+	}
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{[]error{nil, nil, nil, nil, nil, nil, nil, nil, nil},
+			[]error{err1, err2, err3, err4, err5, err6, err7, err8, err9}},
+		{2, len(revisions)},
+		{1, revisions[0].Number},
+		{"auditor", revisions[0].Actor},
+		{docId, revisions[0].DocumentId},
+		{schema.Id, revisions[0].SchemaId},
+		{json.Number("30"), revisions[0].Content["age"]},
+		{[]FieldChange{{Field: "age", Kind: FieldModified,
+			Old: json.Number("30"), New: json.Number("31")}},
+			revisions[0].Changes},
+		{false, revisions[0].Timestamp.IsZero()},
+		// revisions have the content before the change
+		{[]FieldChange{{Field: "age", Kind: FieldModified,
+			Old: json.Number("30"), New: json.Number("31")}}, diff},
+		{json.Number("31"), revisions[1].Content["age"]},
+		{map[string]any{"name": "alice", "age": int64(30), "born": born},
+			restored.Content},
+		{[]string{"update", "update", "update", "deactivate", "delete",
+			"restore"}, operations},
+		{true, final[3].IsActive},
+		{false, final[4].IsActive},
+		{false, recreated.Id == docId},
+		{"alice", recreated.Content["name"]},
+		{recreated.Id, final[5].RestoredAs},
+		{"revision 42 of " + docId.String() + " not found", err10.Error()},
+		{fmt.Sprintf("document %s already restored as %s", docId,
+			recreated.Id), err11.Error()},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("History %d: bad value, got: %v (%T) want: %v (%T)", i,
+				test.got, test.got, test.want, test.want)
+		}
+	}
+}
+
+// failingHistoryStore fails to store the revisions
+type failingHistoryStore struct{}
+
+func (failingHistoryStore) Append(revision *Revision) error {
+	return &APIError{StatusCode: http.StatusServiceUnavailable,
+		Message: "unavailable"}
+}
+
+func (failingHistoryStore) List(documentId uuid.UUID) ([]*Revision, error) {
+	return nil, nil
+}
+
+func TestHistoryError(t *testing.T) {
+	schema := Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+	docId := uuid.New()
+	store := &historyServer{schema: schema, docs: map[uuid.UUID]*Document{
+		docId: {Id: docId, SchemaId: schema.Id, IsActive: true,
+			Content: map[string]any{"name": "alice"}}}}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	custodia.History = &History{Store: failingHistoryStore{}}
+
+	// the update is applied and returned, with the history error
+	doc, err := custodia.UpdateDocument(schema, docId, true,
+		map[string]any{"name": "bob"})
+	var historyErr *HistoryError
+	if !errors.As(err, &historyErr) || historyErr.DocumentId != docId ||
+		doc == nil || doc.Content["name"] != "bob" {
+		t.Errorf("UpdateDocument: got %v, %v", doc, err)
+	}
+
+	// a temporary error of the store is not retried
+	report, err := custodia.BulkUpdateDocuments(nil, &schema,
+		Stream([]BulkUpdate{{DocumentId: docId, IsActive: true,
+			Content: map[string]any{"name": "carol"}}}),
+		&BulkOptions{MaxRetries: 3, RetryBackoff: time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 revisions") ||
+		report.Count(ItemSucceeded) != 1 || report.Results[0].Attempts != 1 {
+		t.Errorf("BulkUpdateDocuments: got %+v, %v", report, err)
+	}
+}
+
+func TestHistoryContent(t *testing.T) {
+	revision := &Revision{DocumentId: uuid.New(), SchemaId: uuid.New(),
+		Number: 3, Operation: RevisionDeactivated, Actor: "jdoe",
+		Timestamp: time.Date(2025, 4, 14, 5, 9, 54, 0, time.UTC),
+		IsActive: true,
+		LastUpdate: time.Date(2025, 4, 13, 5, 9, 54, 0, time.UTC),
+		Content: map[string]any{"name": "alice"}}
+	historySchema := &Schema{Structure: HistoryStructure()}
+
+	// as stored and read back by SchemaHistoryStore
+	content, err := historyContent(revision)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := validate(content, historySchema); err != nil {
+		t.Errorf("invalid history content: %v", err)
+	}
+	data, _ := json.Marshal(content)
+	decoded := map[string]any{}
+	decodeJSON(string(data), &decoded)
+	converted, ee := convertData(decoded, historySchema)
+	if len(ee) > 0 {
+		t.Fatalf("unexpected errors: %v", ee)
+	}
+	got, err := revisionOf(converted)
+	if err != nil || !reflect.DeepEqual(got, revision) {
+		t.Errorf("revisionOf: got %+v, %v want %+v", got, err, revision)
+	}
+}
+
+func TestSchemaHistoryStoreNumbers(t *testing.T) {
+	schema := &Schema{Id: uuid.New(), Structure: HistoryStructure()}
+	docId := uuid.New()
+	// indexed are the history documents returned by the searches, lagging
+	// behind the created ones
+	var mutex sync.Mutex
+	indexed := []map[string]any{}
+	numbers := []any{}
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body := map[string]any{}
+		json.NewDecoder(r.Body).Decode(&body)
+		var data any
+		if strings.HasPrefix(r.URL.Path, "/api/v1/search/documents/") {
+			docs := []any{}
+			for _, content := range indexed {
+				docs = append(docs, map[string]any{"document_id": uuid.New(),
+					"schema_id": schema.Id, "content": content})
+			}
+			data = map[string]any{"count": len(docs), "total_count": len(docs),
+				"limit": 1, "offset": 0, "documents": docs}
+		} else {
+			content := body["content"].(map[string]any)
+			numbers = append(numbers, content["number"])
+			data = map[string]any{"document": map[string]any{
+				"document_id": uuid.New(), "content": content}}
+		}
+		envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+		envelope.Data, _ = json.Marshal(data)
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	store := &SchemaHistoryStore{API: NewCustodiaAPIv1(client),
+		Schema: schema}
+
+	now := time.Now()
+	revision := func() *Revision {
+		return &Revision{DocumentId: docId, Operation: RevisionUpdated,
+			Timestamp: now, LastUpdate: now}
+	}
+
+	// nothing indexed yet: the second revision follows the first anyway
+	err1 := store.Append(revision())
+	err2 := store.Append(revision())
+	// another client appended up to the revision 5
+	mutex.Lock()
+	indexed = append(indexed, map[string]any{"number": 5})
+	mutex.Unlock()
+	err3 := store.Append(revision())
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{[]error{nil, nil, nil}, []error{err1, err2, err3}},
+		{[]any{float64(1), float64(2), float64(6)}, numbers},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+}
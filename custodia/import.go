@@ -0,0 +1,508 @@
+package custodia
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ImportOptions are the options of ImportDocuments
+type ImportOptions struct {
+	// Format of the input, ExportNDJSON if not given (see ImportFile)
+	Format ExportFormat
+	// Mapping maps the columns (or NDJSON keys) to the schema fields, or to
+	// "is_active" for the active flag. The columns not mapped are matched
+	// with the field of the same name, ignoring case, spaces and dashes; a
+	// column mapped to "" is ignored.
+	Mapping map[string]string
+	// Comma is the CSV separator, ',' if not given
+	Comma rune
+	// BlobDir is the directory of the relative paths in blob columns
+	BlobDir string
+	// ExportDir is the directory of an extracted ExportRepository archive:
+	// blob values that are blob ids are read from its blobs/<id> files
+	ExportDir string
+	// DryRun converts and validates the rows without creating anything.
+	// Valid rows are reported as skipped.
+	DryRun bool
+	// FailFast stops at the first failed row
+	FailFast bool
+}
+
+// LoadColumnMapping reads a mapping of ImportOptions from a JSON file
+// with an object of column names to field names
+func LoadColumnMapping(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mapping := map[string]string{}
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return mapping, nil
+}
+
+// ImportResult is the outcome of a row of an import
+type ImportResult struct {
+	// Row is the line of the row in the input, starting from 1 (the
+	// header of a CSV input is line 1)
+	Row int
+	DocumentId uuid.UUID
+	Status ItemStatus
+	Error error
+}
+
+// ImportReport reports the outcome of an import
+type ImportReport struct {
+	DryRun bool
+	// Columns maps the input columns to the fields they were imported to
+	Columns map[string]string
+	// Ignored lists the input columns not imported, sorted
+	Ignored []string
+	Results []ImportResult
+}
+
+// Count returns the number of rows with status
+func (r *ImportReport) Count(status ItemStatus) int {
+	count := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Failed returns the results of the failed rows
+func (r *ImportReport) Failed() []ImportResult {
+	failed := []ImportResult{}
+	for _, result := range r.Results {
+		if result.Status == ItemFailed {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// normalizeColumn returns the name used to match columns and fields
+func normalizeColumn(name string) string {
+	// columns of the CSV exports are "<name>:<type>"
+	name, _, _ = strings.Cut(name, ":")
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+// importer converts the rows of an import
+type importer struct {
+	ca *CustodiaAPIv1
+	schema *Schema
+	opts *ImportOptions
+	structure map[string]SchemaField
+	// fields maps the normalized field names to the fields
+	fields map[string]string
+	report *ImportReport
+	ignored map[string]bool
+}
+
+// fieldOf returns the field of column, "" if the column is not imported.
+// The is_active column (when not a field) is returned as "is_active".
+func (im *importer) fieldOf(column string) string {
+	if field, ok := im.report.Columns[column]; ok {
+		return field
+	}
+	if im.ignored[column] {
+		return ""
+	}
+
+	field, mapped := im.opts.Mapping[column]
+	if !mapped {
+		normalized := normalizeColumn(column)
+		field = im.fields[normalized]
+		if field == "" && normalized == "is_active" {
+			field = "is_active"
+		}
+	}
+	if _, isField := im.structure[field]; !isField && field != "is_active" {
+		field = ""
+	}
+
+	if field == "" {
+		im.ignored[column] = true
+		im.report.Ignored = append(im.report.Ignored, column)
+		sort.Strings(im.report.Ignored)
+	} else {
+		im.report.Columns[column] = field
+	}
+	return field
+}
+
+// coerce converts a value of the input to the type of field: strings are
+// parsed (e.g. "42" for integers, "yes" for booleans, a JSON array for
+// arrays), empty strings are missing values
+func coerce(value any, field SchemaField) (any, error) {
+	s, isString := value.(string)
+	if value == nil {
+		return nil, nil
+	} else if !isString {
+		return convertDefault(value, field)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	switch field.Type {
+	case TypeInt, TypeFloat:
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, fmt.Errorf("field '%s': invalid number '%s'",
+				field.Name, s)
+		}
+		return convertDefault(json.Number(s), field)
+	case TypeBool:
+		switch strings.ToLower(s) {
+		case "true", "t", "yes", "y", "1":
+			return true, nil
+		case "false", "f", "no", "n", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("field '%s': invalid boolean '%s'", field.Name,
+			s)
+	}
+	return convertDefault(s, field)
+}
+
+// row converts the values of a row, keyed by column, to a content. Blob
+// values are returned apart, as local paths by field.
+func (im *importer) row(values map[string]any, columns []string) (
+	content map[string]any, isActive bool, blobs map[string]string,
+	err error) {
+	content, isActive, blobs = map[string]any{}, true, map[string]string{}
+	var ee []error
+	for _, column := range columns {
+		name := im.fieldOf(column)
+		if name == "" {
+			continue
+		}
+
+		value := values[column]
+		field, isField := im.structure[name]
+		if !isField {
+			active, err := coerce(value, SchemaField{Name: name,
+				Type: TypeBool})
+			if err != nil {
+				ee = append(ee, fmt.Errorf("column '%s': %w", column, err))
+			} else if active != nil {
+				isActive = active.(bool)
+			}
+			continue
+		}
+
+		if field.Type == TypeBlob {
+			if path := strings.TrimSpace(fmt.Sprint(value)); value != nil &&
+				path != "" {
+				blobs[name] = path
+			}
+			continue
+		}
+		converted, err := coerce(value, field)
+		if err != nil {
+			ee = append(ee, fmt.Errorf("column '%s': %w", column, err))
+		} else if converted != nil {
+			content[name] = converted
+		}
+	}
+	if len(ee) > 0 {
+		return nil, false, nil, errors.Join(ee...)
+	}
+	return content, isActive, blobs, nil
+}
+
+// blobPath returns the local path of a blob column value: a file of
+// BlobDir, or the file of an exported blob when the value is a blob id
+func (im *importer) blobPath(value string) (string, error) {
+	path := value
+	if !filepath.IsAbs(path) && im.opts.BlobDir != "" {
+		path = filepath.Join(im.opts.BlobDir, path)
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return path, nil
+	}
+	if im.opts.ExportDir == "" {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		return "", fmt.Errorf("blob %s of an export: ExportDir is not set",
+			id)
+	}
+	path = filepath.Join(im.opts.ExportDir, "blobs", id.String())
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("blob %s is not in the export (exported " +
+			"with SkipBlobs?)", id)
+	}
+	return path, nil
+}
+
+// create creates the document of a row, then uploads its blobs
+func (im *importer) create(values map[string]any, columns []string) (
+	uuid.UUID, error) {
+	content, isActive, blobs, err := im.row(values, columns)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	fields := []string{}
+	for name, value := range blobs {
+		path, err := im.blobPath(value)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("field '%s': %w", name, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("field '%s': %w", name, err)
+		} else if info.Size() == 0 {
+			return uuid.Nil, fmt.Errorf("field '%s': file '%s' is empty",
+				name, value)
+		}
+		blobs[name] = path
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	if im.opts.DryRun {
+		// the checks of CreateDocument
+		if im.ca.FillDefaults {
+			if content, err = im.schema.ApplyDefaults(content); err != nil {
+				return uuid.Nil, err
+			}
+		}
+		return uuid.Nil, validate(content, im.schema)
+	}
+
+	doc, err := im.ca.CreateDocument(im.schema, isActive, content)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	for _, name := range fields {
+		_, err := im.ca.CreateBlobFromFile(blobs[name], doc.Id, name, 0)
+		if err != nil {
+			return doc.Id, fmt.Errorf("document %s created, error uploading " +
+				"field '%s': %w", doc.Id, name, err)
+		}
+	}
+	return doc.Id, nil
+}
+
+// ImportDocuments creates a document of schema for each row of r, a CSV
+// file with a header or NDJSON (one content object per line, or documents
+// as written by ExportRepository). Values are mapped to the fields (see
+// ImportOptions.Mapping), converted to their types and validated, with
+// errors reporting row and column. Blob columns are paths of local files,
+// or blob ids of an export (see ImportOptions.ExportDir), uploaded with
+// CreateBlobFromFile once the document is created.
+// When some rows fail the report is returned with an error.
+func (ca *CustodiaAPIv1) ImportDocuments(ctx context.Context, schema *Schema,
+	r io.Reader, opts *ImportOptions) (*ImportReport, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if schema == nil {
+		return nil, fmt.Errorf("schema is nil")
+	}
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	im := &importer{ca: ca, schema: schema, opts: opts,
+		structure: schema.getStructureAsMap(), fields: map[string]string{},
+		report: &ImportReport{DryRun: opts.DryRun,
+			Columns: map[string]string{}, Ignored: []string{},
+			Results: []ImportResult{}},
+		ignored: map[string]bool{}}
+	for _, field := range schema.Structure {
+		im.fields[normalizeColumn(field.Name)] = field.Name
+	}
+	var ee []error
+	for column, field := range opts.Mapping {
+		_, ok := im.structure[field]
+		if !ok && field != "" && field != "is_active" {
+			ee = append(ee, fmt.Errorf("column '%s': mapped to field '%s', " +
+				"not defined in structure", column, field))
+		}
+	}
+	if len(ee) > 0 {
+		return nil, fmt.Errorf("mapping errors: %w", errors.Join(ee...))
+	}
+
+	process := func(line int, values map[string]any, columns []string) bool {
+		result := ImportResult{Row: line, Status: ItemSucceeded}
+		id, err := im.create(values, columns)
+		result.DocumentId = id
+		if err != nil {
+			result.Status = ItemFailed
+			result.Error = fmt.Errorf("row %d: %w", line, err)
+		} else if opts.DryRun {
+			result.Status = ItemSkipped
+		}
+		im.report.Results = append(im.report.Results, result)
+		return err == nil || !opts.FailFast
+	}
+
+	var err error
+	if opts.Format == ExportCSV {
+		err = im.readCSV(ctx, r, process)
+	} else {
+		err = im.readNDJSON(ctx, r, process)
+	}
+	if err != nil {
+		return im.report, err
+	}
+	if failed := im.report.Failed(); len(failed) > 0 {
+		return im.report, fmt.Errorf("%d of %d rows failed, first: %w",
+			len(failed), len(im.report.Results), failed[0].Error)
+	}
+	return im.report, nil
+}
+
+// readCSV passes each row of r to process, until it returns false
+func (im *importer) readCSV(ctx context.Context, r io.Reader,
+	process func(int, map[string]any, []string) bool) error {
+	cr := csv.NewReader(r)
+	if im.opts.Comma != 0 {
+		cr.Comma = im.opts.Comma
+	}
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(header) > 0 {
+		// a byte order mark of spreadsheet exports
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return fmt.Errorf("row %d: %w", parseErr.Line, err)
+		} else if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(record) != len(header) {
+			im.report.Results = append(im.report.Results, ImportResult{
+				Row: line, Status: ItemFailed, Error: fmt.Errorf("row %d: " +
+					"%d values, expected %d", line, len(record),
+					len(header))})
+			if im.opts.FailFast {
+				return nil
+			}
+			continue
+		}
+		values := map[string]any{}
+		for i, column := range header {
+			values[column] = record[i]
+		}
+		if !process(line, values, header) {
+			return nil
+		}
+	}
+}
+
+// readNDJSON passes each line of r to process, until it returns false
+func (im *importer) readNDJSON(ctx context.Context, r io.Reader,
+	process func(int, map[string]any, []string) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16 * 1024 * 1024)
+	_, hasContentField := im.structure["content"]
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		values := map[string]any{}
+		if err := decodeJSON(text, &values); err != nil {
+			im.report.Results = append(im.report.Results, ImportResult{
+				Row: line, Status: ItemFailed,
+				Error: fmt.Errorf("row %d: %w", line, err)})
+			if im.opts.FailFast {
+				return nil
+			}
+			continue
+		}
+		// a document of ExportRepository
+		if content, ok := values["content"].(map[string]any); ok &&
+			!hasContentField {
+			if isActive, ok := values["is_active"]; ok {
+				content["is_active"] = isActive
+			}
+			values = content
+		}
+
+		columns := []string{}
+		for column := range values {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		if !process(line, values, columns) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// ImportFile imports the documents of a CSV (.csv) or NDJSON file, as
+// ImportDocuments. The format is guessed from the extension when not
+// given, and relative blob paths are relative to the file directory when
+// BlobDir is not given. A documents file of an extracted export archive
+// (schemas/<id>/documents.<format>, next to the manifest) sets ExportDir
+// when not given.
+func (ca *CustodiaAPIv1) ImportFile(ctx context.Context, schema *Schema,
+	path string, opts *ImportOptions) (*ImportReport, error) {
+	options := ImportOptions{}
+	if opts != nil {
+		options = *opts
+	}
+	if options.Format == 0 && strings.EqualFold(filepath.Ext(path), ".csv") {
+		options.Format = ExportCSV
+	}
+	if options.BlobDir == "" {
+		options.BlobDir = filepath.Dir(path)
+	}
+	if options.ExportDir == "" {
+		root := filepath.Dir(filepath.Dir(filepath.Dir(path)))
+		_, err := os.Stat(filepath.Join(root, ManifestName))
+		if err == nil && filepath.Base(filepath.Dir(filepath.Dir(path))) ==
+			"schemas" {
+			options.ExportDir = root
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ca.ImportDocuments(ctx, schema, file, &options)
+}
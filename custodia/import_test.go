@@ -0,0 +1,243 @@
+package custodia
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+const importCSV = `Name,Age, Born ,Tags,Active,Photo,Notes
+alice,30,1990-04-14,"[""a"",""b""]",yes,photo.txt,first
+bob,abc,14/04/1991,,no,,
+carol,31,,,no,,
+`
+
+func TestImportFile(t *testing.T) {
+	repo := newRepoServer()
+	server := httptest.NewServer(repo)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := repo.schemas[0]
+	repo.docs[schema.Id] = nil
+
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "people.csv")
+	os.WriteFile(csvPath, []byte(importCSV), 0o644)
+	os.WriteFile(filepath.Join(dir, "photo.txt"), []byte("a photo"), 0o644)
+	mappingPath := filepath.Join(dir, "mapping.json")
+	os.WriteFile(mappingPath, []byte(`{"Active": "is_active"}`), 0o644)
+	mapping, err := LoadColumnMapping(mappingPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// dry-run creates nothing
+	dryRun, dryErr := custodia.ImportFile(nil, schema, csvPath,
+		&ImportOptions{Mapping: mapping, DryRun: true})
+	created := len(repo.docs[schema.Id])
+
+	report, err := custodia.ImportFile(nil, schema, csvPath,
+		&ImportOptions{Mapping: mapping})
+	docs := repo.docs[schema.Id]
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{true, dryErr != nil},
+		{[]ItemStatus{ItemSkipped, ItemFailed, ItemSkipped},
+			[]ItemStatus{dryRun.Results[0].Status, dryRun.Results[1].Status,
+				dryRun.Results[2].Status}},
+		{0, created},
+		{true, strings.HasPrefix(err.Error(), "1 of 3 rows failed, first: " +
+			"row 3: column 'Age': field 'age': invalid number 'abc'\n" +
+			"column ' Born ': field 'born': invalid date '14/04/1991'")},
+		{2, report.Count(ItemSucceeded)},
+		{[]int{2, 3, 4}, []int{report.Results[0].Row, report.Results[1].Row,
+			report.Results[2].Row}},
+		{map[string]string{"Name": "name", "Age": "age", " Born ": "born",
+			"Tags": "tags", "Active": "is_active", "Photo": "photo"},
+			report.Columns},
+		{[]string{"Notes"}, report.Ignored},
+		{2, len(docs)},
+		{docs[0].Id, report.Results[0].DocumentId},
+		{"alice", docs[0].Content["name"]},
+		{true, docs[0].IsActive},
+		{[]any{"a", "b"}, docs[0].Content["tags"]},
+		{"1990-04-14", docs[0].Content["born"]},
+		{false, docs[1].IsActive},
+		{nil, docs[1].Content["born"]},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("ImportFile %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+
+	// the photo was uploaded to the document
+	blobId, _ := uuid.Parse(docs[0].Content["photo"].(string))
+	if string(repo.blobs[blobId]) != "a photo" {
+		t.Errorf("blob not uploaded: %v", docs[0].Content)
+	}
+}
+
+func TestImportDocuments(t *testing.T) {
+	repo := newRepoServer()
+	server := httptest.NewServer(repo)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := repo.schemas[0]
+	repo.docs[schema.Id] = nil
+
+	// plain contents and documents of an export
+	input := `{"name": "dave", "age": 40, "extra": 1}
+not json
+{"document_id": "x", "is_active": false, "content": {"name": "erin"}}
+{"name": "frank", "age": 4.5}
+`
+	report, err := custodia.ImportDocuments(nil, schema,
+		strings.NewReader(input), &ImportOptions{})
+	docs := repo.docs[schema.Id]
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{true, err != nil},
+		{[]ItemStatus{ItemSucceeded, ItemFailed, ItemSucceeded, ItemFailed},
+			[]ItemStatus{report.Results[0].Status, report.Results[1].Status,
+				report.Results[2].Status, report.Results[3].Status}},
+		{[]string{"extra"}, report.Ignored},
+		{2, len(docs)},
+		{"erin", docs[1].Content["name"]},
+		{false, docs[1].IsActive},
+		{true, strings.HasPrefix(report.Results[3].Error.Error(),
+			"row 4: column 'age': field 'age': value 4.5 is not an integer")},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("ImportDocuments %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+
+	// fail fast stops at the first failure
+	report, _ = custodia.ImportDocuments(nil, schema,
+		strings.NewReader(input), &ImportOptions{FailFast: true})
+	if len(report.Results) != 2 {
+		t.Errorf("expected to stop at row 2, got: %v", report.Results)
+	}
+
+	// mapping to unknown fields
+	_, err = custodia.ImportDocuments(nil, schema, strings.NewReader(input),
+		&ImportOptions{Mapping: map[string]string{"x": "nope"}})
+	if err == nil || errors.Unwrap(err) == nil ||
+		!strings.Contains(err.Error(), "field 'nope', not defined") {
+		t.Errorf("expected a mapping error, got: %v", err)
+	}
+}
+
+// extractArchive extracts the entries of an archive to dir
+func extractArchive(t *testing.T, archivePath, dir string) {
+	err := walkArchive(archivePath, func(name string, r io.Reader) error {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, data, 0o644)
+	})
+	if err != nil {
+		t.Fatalf("extracting %s: %v", archivePath, err)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	source := newRepoServer()
+	sourceServer := httptest.NewServer(source)
+	defer sourceServer.Close()
+	target := newRepoServer()
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+	exporter := NewCustodiaAPIv1(common.NewClient(sourceServer.URL,
+		common.GetFakeAuth()))
+	importer := NewCustodiaAPIv1(common.NewClient(targetServer.URL,
+		common.GetFakeAuth()))
+	schema := target.schemas[0]
+	target.docs[schema.Id] = nil
+
+	export := func(skipBlobs bool) string {
+		dir := t.TempDir()
+		archivePath := filepath.Join(dir, "export.tar")
+		file, _ := os.Create(archivePath)
+		_, err := exporter.ExportRepository(nil, source.repository.Id, file,
+			&ExportOptions{SkipBlobs: skipBlobs})
+		file.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		extractArchive(t, archivePath, filepath.Join(dir, "export"))
+		return filepath.Join(dir, "export", "schemas",
+			source.schemas[0].Id.String(), "documents.ndjson")
+	}
+	docsPath := export(false)
+	report, err := importer.ImportFile(nil, schema, docsPath, nil)
+	docs := target.docs[schema.Id]
+	if len(docs) != 3 {
+		t.Fatalf("expected 3 documents, got %d: %v", len(docs), err)
+	}
+
+	// the blob ids need the export directory
+	data, _ := os.ReadFile(docsPath)
+	_, noDirErr := importer.ImportDocuments(nil, schema,
+		bytes.NewReader(data), &ImportOptions{DryRun: true})
+	// the blobs are not in an export without blobs
+	_, skippedErr := importer.ImportFile(nil, schema, export(true),
+		&ImportOptions{DryRun: true})
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{nil, err},
+		{3, report.Count(ItemSucceeded)},
+		{[]any{"alice", "bob", "carol"}, []any{docs[0].Content["name"],
+			docs[1].Content["name"], docs[2].Content["name"]}},
+		{[]bool{true, false, true}, []bool{docs[0].IsActive,
+			docs[1].IsActive, docs[2].IsActive}},
+		{nil, docs[1].Content["photo"]},
+		{true, noDirErr != nil && strings.Contains(noDirErr.Error(),
+			"row 1: field 'photo': blob ") && strings.Contains(
+			noDirErr.Error(), "of an export: ExportDir is not set")},
+		{true, skippedErr != nil && strings.Contains(skippedErr.Error(),
+			"is not in the export (exported with SkipBlobs?)")},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("ImportExport %d: bad value, got: %v want: %v", i,
+				test.got, test.want)
+		}
+	}
+
+	// the blob was uploaded to the new document
+	photo, _ := docs[0].Content["photo"].(string)
+	blobId, _ := uuid.Parse(photo)
+	if string(target.blobs[blobId]) != "hello blob" {
+		t.Errorf("blob not uploaded: %v", docs[0].Content)
+	}
+}
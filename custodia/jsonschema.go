@@ -0,0 +1,494 @@
+package custodia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// JSONSchemaDraft is the JSON Schema dialect produced and accepted
+const JSONSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// JSONSchema is the subset of a JSON Schema (draft 2020-12) document which
+// can be mapped to a Custodia structure. Keywords starting with
+// "x-custodia-" keep the Custodia details which JSON Schema can't express,
+// e.g. the bounds of dates, and are ignored by the standard validators.
+type JSONSchema struct {
+	Schema string `json:"$schema,omitempty"`
+	Id string `json:"$id,omitempty"`
+	Title string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Type is a string, or a list of two strings when nullable
+	Type any `json:"type,omitempty"`
+	Format string `json:"format,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	ContentMediaType string `json:"contentMediaType,omitempty"`
+	Default any `json:"default,omitempty"`
+	Enum []any `json:"enum,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Minimum any `json:"minimum,omitempty"`
+	Maximum any `json:"maximum,omitempty"`
+	FormatMinimum string `json:"x-custodia-formatMinimum,omitempty"`
+	FormatMaximum string `json:"x-custodia-formatMaximum,omitempty"`
+	MinLength *int `json:"minLength,omitempty"`
+	MaxLength *int `json:"maxLength,omitempty"`
+	MinItems *int `json:"minItems,omitempty"`
+	MaxItems *int `json:"maxItems,omitempty"`
+	Items *JSONSchema `json:"items,omitempty"`
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	Required []string `json:"required,omitempty"`
+	AdditionalProperties *bool `json:"additionalProperties,omitempty"`
+	CustodiaType string `json:"x-custodia-type,omitempty"`
+	Indexed bool `json:"x-custodia-indexed,omitempty"`
+	Insensitive bool `json:"x-custodia-insensitive,omitempty"`
+	Rules []CrossFieldRule `json:"x-custodia-rules,omitempty"`
+
+	// keywords found while decoding which are not mapped above
+	unknown []string
+}
+
+// jsonSchemaAnnotations are keywords ignored on import, since they don't
+// change the validation
+var jsonSchemaAnnotations = []string{"$comment", "$anchor", "examples",
+	"readOnly", "writeOnly", "deprecated"}
+
+func (js *JSONSchema) UnmarshalJSON(data []byte) error {
+	type Alias JSONSchema
+	alias := (*Alias)(js)
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(alias); err != nil {
+		return err
+	}
+
+	// find the keywords not mapped by the struct
+	keys := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	rt := reflect.TypeOf(*js)
+	for i := 0; i < rt.NumField(); i++ {
+		tag := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		known[tag] = true
+	}
+	js.unknown = nil
+	for key := range keys {
+		if !known[key] && indexOf(key, jsonSchemaAnnotations) < 0 {
+			js.unknown = append(js.unknown, key)
+		}
+	}
+	sort.Strings(js.unknown)
+	return nil
+}
+
+// ParseJSONSchema parses a JSON Schema document
+func ParseJSONSchema(data []byte) (*JSONSchema, error) {
+	js := &JSONSchema{}
+	if err := json.Unmarshal(data, js); err != nil {
+		return nil, fmt.Errorf("error parsing JSON Schema: %w", err)
+	}
+	return js, nil
+}
+
+// Export
+
+// fieldToJSONSchema returns the JSON Schema of a single field type
+func fieldToJSONSchema(fieldType string) (*JSONSchema, error) {
+	if itemType, isArray := arrayItemType(fieldType); isArray {
+		items, err := fieldToJSONSchema(itemType)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONSchema{Type: "array", Items: items}, nil
+	}
+
+	maxStringLength := 255
+	switch fieldType {
+	case TypeInt:
+		return &JSONSchema{Type: "integer"}, nil
+	case TypeFloat:
+		return &JSONSchema{Type: "number"}, nil
+	case TypeStr:
+		return &JSONSchema{Type: "string", MaxLength: &maxStringLength}, nil
+	case TypeText:
+		return &JSONSchema{Type: "string", CustodiaType: TypeText}, nil
+	case TypeBool:
+		return &JSONSchema{Type: "boolean"}, nil
+	case TypeDate:
+		return &JSONSchema{Type: "string", Format: "date"}, nil
+	case TypeTime:
+		return &JSONSchema{Type: "string", Format: "time"}, nil
+	case TypeDateTime:
+		return &JSONSchema{Type: "string", Format: "date-time"}, nil
+	case TypeBase64:
+		return &JSONSchema{Type: "string", ContentEncoding: "base64"}, nil
+	case TypeJson:
+		return &JSONSchema{Type: "string",
+			ContentMediaType: "application/json"}, nil
+	case TypeBlob:
+		return &JSONSchema{Type: "string", Format: "uuid",
+			CustodiaType: TypeBlob}, nil
+	}
+	return nil, fmt.Errorf("type '%s' not handled", fieldType)
+}
+
+// jsonValue returns the JSON representation of a content value (e.g. the
+// string of a Date), used for defaults, enums and bounds
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case Date, TimeOfDay, DateTime:
+		return fmt.Sprint(v)
+	}
+	return value
+}
+
+// structureToJSONSchema converts a structure to an object JSON Schema
+func structureToJSONSchema(structure []SchemaField,
+	rules []CrossFieldRule) (*JSONSchema, error) {
+	noAdditional := false
+	js := &JSONSchema{
+		Schema: JSONSchemaDraft,
+		Type: "object",
+		Properties: map[string]*JSONSchema{},
+		AdditionalProperties: &noAdditional,
+		Rules: rules,
+	}
+
+	var ee []error
+	for _, rule := range rules {
+		if rule.Check != nil {
+			ee = append(ee, fmt.Errorf("rule on field '%s': Check " +
+				"functions can't be exported", rule.Field))
+		}
+	}
+	for _, field := range structure {
+		property, err := fieldToJSONSchema(field.Type)
+		if err != nil {
+			ee = append(ee, fmt.Errorf("field '%s': %w", field.Name, err))
+			continue
+		}
+		property.Indexed = field.Indexed
+		property.Insensitive = field.Insensitive
+		property.Default = jsonValue(field.Default)
+
+		if fc := field.Constraints; fc != nil {
+			if fc.Required {
+				js.Required = append(js.Required, field.Name)
+			}
+			if fc.Nullable {
+				property.Type = []string{property.Type.(string), "null"}
+			}
+			property.Pattern = fc.Pattern
+			for _, value := range fc.Enum {
+				property.Enum = append(property.Enum, jsonValue(value))
+			}
+			if property.Format != "" && property.Format != "uuid" {
+				// dates: bounds are expressed as formatted strings
+				if fc.Min != nil {
+					property.FormatMinimum = fmt.Sprint(jsonValue(fc.Min))
+				}
+				if fc.Max != nil {
+					property.FormatMaximum = fmt.Sprint(jsonValue(fc.Max))
+				}
+			} else {
+				property.Minimum = fc.Min
+				property.Maximum = fc.Max
+			}
+			if property.Items != nil {
+				property.MinItems = fc.MinLength
+				property.MaxItems = fc.MaxLength
+			} else {
+				property.MinLength = fc.MinLength
+				if fc.MaxLength != nil {
+					property.MaxLength = fc.MaxLength
+				}
+			}
+		}
+		js.Properties[field.Name] = property
+	}
+
+	if len(ee) > 0 {
+		return nil, errors.Join(ee...)
+	}
+	return js, nil
+}
+
+// ToJSONSchema converts the schema structure, with its constraints, to a
+// JSON Schema document. Rules with a Check function can't be exported.
+func (s *Schema) ToJSONSchema() (*JSONSchema, error) {
+	js, err := structureToJSONSchema(s.Structure, s.Rules)
+	if err != nil {
+		return nil, err
+	}
+	if s.Id != uuid.Nil {
+		js.Id = "urn:uuid:" + s.Id.String()
+	}
+	js.Description = s.Description
+	return js, nil
+}
+
+// ToJSONSchema converts the user schema structure, with its constraints, to
+// a JSON Schema document. Rules with a Check function can't be exported.
+func (us *UserSchema) ToJSONSchema() (*JSONSchema, error) {
+	js, err := structureToJSONSchema(us.Structure, us.Rules)
+	if err != nil {
+		return nil, err
+	}
+	if us.Id != uuid.Nil {
+		js.Id = "urn:uuid:" + us.Id.String()
+	}
+	js.Description = us.Description
+	return js, nil
+}
+
+// Import
+
+// jsonSchemaTypes returns the type of js and whether null is allowed
+func jsonSchemaTypes(js *JSONSchema) (string, bool, error) {
+	switch t := js.Type.(type) {
+	case string:
+		return t, false, nil
+	case []any:
+		types := []string{}
+		nullable := false
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return "", false, fmt.Errorf("bad type %v", item)
+			}
+			if name == "null" {
+				nullable = true
+			} else {
+				types = append(types, name)
+			}
+		}
+		if len(types) != 1 {
+			return "", false, fmt.Errorf("union of types %v not supported",
+				types)
+		}
+		return types[0], nullable, nil
+	case []string:
+		return jsonSchemaTypes(&JSONSchema{Type: toAnySlice(t)})
+	case nil:
+		return "", false, fmt.Errorf("missing type")
+	}
+	return "", false, fmt.Errorf("bad type %v", js.Type)
+}
+
+func toAnySlice(items []string) []any {
+	result := []any{}
+	for _, item := range items {
+		result = append(result, item)
+	}
+	return result
+}
+
+// jsonSchemaToFieldType returns the Custodia type of a property
+func jsonSchemaToFieldType(js *JSONSchema) (string, bool, error) {
+	jsType, nullable, err := jsonSchemaTypes(js)
+	if err != nil {
+		return "", false, err
+	}
+
+	fieldType := ""
+	switch jsType {
+	case "integer":
+		fieldType = TypeInt
+	case "number":
+		fieldType = TypeFloat
+	case "boolean":
+		fieldType = TypeBool
+	case "string":
+		switch {
+		case js.CustodiaType != "":
+			fieldType = js.CustodiaType
+		case js.Format == "date":
+			fieldType = TypeDate
+		case js.Format == "time":
+			fieldType = TypeTime
+		case js.Format == "date-time":
+			fieldType = TypeDateTime
+		case js.Format != "" && js.Format != "uuid":
+			return "", false, fmt.Errorf("format '%s' not supported",
+				js.Format)
+		case js.ContentEncoding == "base64":
+			fieldType = TypeBase64
+		case js.ContentEncoding != "":
+			return "", false, fmt.Errorf("contentEncoding '%s' not " +
+				"supported", js.ContentEncoding)
+		case js.ContentMediaType == "application/json":
+			fieldType = TypeJson
+		case js.MaxLength != nil && *js.MaxLength <= 255:
+			fieldType = TypeStr
+		default:
+			// unbounded strings don't fit a Custodia string (255 chars)
+			fieldType = TypeText
+		}
+	case "array":
+		if js.Items == nil {
+			return "", false, fmt.Errorf("array without items")
+		}
+		if itemType, _, _ := jsonSchemaTypes(js.Items); itemType == "array" {
+			return "", false, fmt.Errorf("arrays of arrays not supported")
+		}
+		itemType, itemNullable, err := jsonSchemaToFieldType(js.Items)
+		if err != nil {
+			return "", false, fmt.Errorf("items: %w", err)
+		}
+		if itemNullable {
+			return "", false, fmt.Errorf("items: null items not supported")
+		}
+		fieldType = "array[" + itemType + "]"
+	case "object":
+		return "", false, fmt.Errorf("nested objects not supported")
+	default:
+		return "", false, fmt.Errorf("type '%s' not supported", jsType)
+	}
+
+	if !isKnownType(fieldType) {
+		return "", false, fmt.Errorf("type '%s' not supported", fieldType)
+	}
+	return fieldType, nullable, nil
+}
+
+// checkUnknown reports the keywords of js (and its items) which can't be
+// represented in a Custodia structure
+func checkUnknown(js *JSONSchema, path string) []error {
+	var ee []error
+	for _, keyword := range js.unknown {
+		ee = append(ee, fmt.Errorf("%s: keyword '%s' not supported", path,
+			keyword))
+	}
+	if js.Items != nil {
+		ee = append(ee, checkUnknown(js.Items, path+"/items")...)
+	}
+	return ee
+}
+
+// fieldFromJSONSchema converts a property to a SchemaField
+func fieldFromJSONSchema(name string, js *JSONSchema, required bool) (
+	SchemaField, []error) {
+	path := "/properties/" + name
+	ee := checkUnknown(js, path)
+
+	fieldType, nullable, err := jsonSchemaToFieldType(js)
+	if err != nil {
+		return SchemaField{}, append(ee, fmt.Errorf("%s: %w", path, err))
+	}
+
+	field := SchemaField{Name: name, Type: fieldType, Indexed: js.Indexed,
+		Insensitive: js.Insensitive, Default: js.Default}
+	field.adjustDefaultType()
+
+	fc := &FieldConstraints{Required: required, Nullable: nullable,
+		Pattern: js.Pattern, Enum: js.Enum, Min: js.Minimum, Max: js.Maximum}
+	if js.FormatMinimum != "" {
+		fc.Min = js.FormatMinimum
+	}
+	if js.FormatMaximum != "" {
+		fc.Max = js.FormatMaximum
+	}
+	if js.Items != nil {
+		fc.MinLength, fc.MaxLength = js.MinItems, js.MaxItems
+	} else {
+		fc.MinLength = js.MinLength
+		// the max length of Custodia strings is implicit
+		if fieldType != TypeStr || js.MaxLength == nil ||
+			*js.MaxLength != 255 {
+			fc.MaxLength = js.MaxLength
+		}
+	}
+	if fc.Pattern != "" {
+		if _, err := compilePattern(fc.Pattern); err != nil {
+			ee = append(ee, fmt.Errorf("%s: bad pattern: %w", path, err))
+		}
+	}
+
+	if !reflect.ValueOf(*fc).IsZero() {
+		field.Constraints = fc
+	}
+	return field, ee
+}
+
+// StructureFromJSONSchema converts an object JSON Schema to a Custodia
+// structure (with constraints) and its cross-field rules. All the
+// constructs that can't be represented are reported.
+func StructureFromJSONSchema(js *JSONSchema) ([]SchemaField,
+	[]CrossFieldRule, error) {
+	ee := checkUnknown(js, "")
+	if js.Schema != "" && js.Schema != JSONSchemaDraft {
+		ee = append(ee, fmt.Errorf("$schema '%s' not supported, expected " +
+			"'%s'", js.Schema, JSONSchemaDraft))
+	}
+	if jsType, _, err := jsonSchemaTypes(js); err != nil || jsType != "object" {
+		ee = append(ee, fmt.Errorf("root must be of type 'object'"))
+	}
+	if js.AdditionalProperties != nil && *js.AdditionalProperties {
+		ee = append(ee, fmt.Errorf("additionalProperties not supported"))
+	}
+
+	required := map[string]bool{}
+	for _, name := range js.Required {
+		if _, ok := js.Properties[name]; !ok {
+			ee = append(ee, fmt.Errorf("required property '%s' not defined",
+				name))
+		}
+		required[name] = true
+	}
+
+	// properties are sorted, JSON objects have no order
+	names := []string{}
+	for name := range js.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	structure := []SchemaField{}
+	for _, name := range names {
+		field, errs := fieldFromJSONSchema(name, js.Properties[name],
+			required[name])
+		ee = append(ee, errs...)
+		structure = append(structure, field)
+	}
+
+	if len(ee) > 0 {
+		return nil, nil, errors.Join(ee...)
+	}
+	return structure, js.Rules, nil
+}
+
+// NewSchemaFromJSONSchema returns a Schema (not yet created on Custodia)
+// from a JSON Schema document. Use its Structure with CreateSchema.
+func NewSchemaFromJSONSchema(js *JSONSchema) (*Schema, error) {
+	structure, rules, err := StructureFromJSONSchema(js)
+	if err != nil {
+		return nil, err
+	}
+	description := js.Description
+	if description == "" {
+		description = js.Title
+	}
+	return &Schema{Description: description, IsActive: true,
+		Structure: structure, Rules: rules}, nil
+}
+
+// NewUserSchemaFromJSONSchema returns a UserSchema (not yet created on
+// Custodia) from a JSON Schema document
+func NewUserSchemaFromJSONSchema(js *JSONSchema) (*UserSchema, error) {
+	structure, rules, err := StructureFromJSONSchema(js)
+	if err != nil {
+		return nil, err
+	}
+	description := js.Description
+	if description == "" {
+		description = js.Title
+	}
+	return &UserSchema{Description: description, IsActive: true,
+		Structure: structure, Rules: rules}, nil
+}
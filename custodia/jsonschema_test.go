@@ -0,0 +1,219 @@
+package custodia
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestJSONSchemaExport(t *testing.T) {
+	minLength, maxItems := 1, 3
+	schema := Schema{
+		Id: uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+		Description: "people",
+		Structure: []SchemaField{
+			{Name: "age", Type: TypeInt, Indexed: true,
+				Constraints: &FieldConstraints{Required: true, Min: 0,
+				Max: 150}},
+			{Name: "name", Type: TypeStr, Constraints: &FieldConstraints{
+				Nullable: true, MinLength: &minLength}},
+			{Name: "born", Type: TypeDate, Constraints: &FieldConstraints{
+				Min: "1900-01-01"}},
+			{Name: "tags", Type: TypeArrayStr, Constraints: &FieldConstraints{
+				MaxLength: &maxItems}},
+			{Name: "notes", Type: TypeText},
+		},
+		Rules: []CrossFieldRule{{Field: "born", Op: RuleRequires,
+			Other: "age"}},
+	}
+
+	js, err := schema.ToJSONSchema()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := json.Marshal(js)
+	got := map[string]any{}
+	json.Unmarshal(data, &got)
+	properties := got["properties"].(map[string]any)
+	age := properties["age"].(map[string]any)
+	name := properties["name"].(map[string]any)
+	born := properties["born"].(map[string]any)
+	tags := properties["tags"].(map[string]any)
+	notes := properties["notes"].(map[string]any)
+
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{JSONSchemaDraft, got["$schema"]},
+		{"urn:uuid:00000000-0000-0000-0000-000000000001", got["$id"]},
+		{"people", got["description"]},
+		{"object", got["type"]},
+		{false, got["additionalProperties"]},
+		{[]any{"age"}, got["required"]},
+		{"integer", age["type"]},
+		{float64(150), age["maximum"]},
+		{true, age["x-custodia-indexed"]},
+		{[]any{"string", "null"}, name["type"]},
+		{float64(255), name["maxLength"]},
+		{float64(1), name["minLength"]},
+		{"date", born["format"]},
+		{"1900-01-01", born["x-custodia-formatMinimum"]},
+		{nil, born["formatMinimum"]},
+		{"array", tags["type"]},
+		{float64(3), tags["maxItems"]},
+		{"string", tags["items"].(map[string]any)["type"]},
+		{"text", notes["x-custodia-type"]},
+		{nil, notes["maxLength"]},
+		{"born", got["x-custodia-rules"].([]any)[0].(map[string]any)["field"]},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	// rules with a Check function can't be exported
+	schema.Rules = append(schema.Rules, CrossFieldRule{Field: "name",
+		Check: func(content map[string]any) error { return nil }})
+	_, err = schema.ToJSONSchema()
+	want := "rule on field 'name': Check functions can't be exported"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error '%s', got: %v", want, err)
+	}
+}
+
+func TestJSONSchemaImport(t *testing.T) {
+	doc := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "people",
+		"type": "object",
+		"required": ["age"],
+		"properties": {
+			"age": {"type": "integer", "minimum": 0, "default": 18,
+				"x-custodia-indexed": true},
+			"name": {"type": ["string", "null"], "maxLength": 255,
+				"$comment": "ignored"},
+			"bio": {"type": "string"},
+			"born": {"type": "string", "format": "date",
+				"x-custodia-formatMaximum": "2020-12-31"},
+			"scores": {"type": "array", "items": {"type": "number"},
+				"minItems": 1},
+			"photo": {"type": "string", "contentEncoding": "base64"}
+		}
+	}`
+	js, err := ParseJSONSchema([]byte(doc))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	schema, err := NewSchemaFromJSONSchema(js)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fields := schema.getStructureAsMap()
+	one := 1
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{"people", schema.Description},
+		{6, len(schema.Structure)},
+		{TypeInt, fields["age"].Type},
+		{true, fields["age"].Indexed},
+		{int64(18), fields["age"].Default},
+		{true, fields["age"].Constraints.Required},
+		{json.Number("0"), fields["age"].Constraints.Min},
+		{TypeStr, fields["name"].Type},
+		{true, fields["name"].Constraints.Nullable},
+		{(*int)(nil), fields["name"].Constraints.MaxLength},
+		{TypeText, fields["bio"].Type},
+		{(*FieldConstraints)(nil), fields["bio"].Constraints},
+		{TypeDate, fields["born"].Type},
+		{"2020-12-31", fields["born"].Constraints.Max},
+		{TypeArrayFloat, fields["scores"].Type},
+		{&one, fields["scores"].Constraints.MinLength},
+		{TypeBase64, fields["photo"].Type},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %#v want: %#v", i, test.got,
+				test.want)
+		}
+	}
+
+	// imported constraints are enforced
+	err = validate(map[string]any{"age": int64(-1)}, schema)
+	if err == nil || !strings.Contains(err.Error(), "age") {
+		t.Errorf("expected validation error on age, got: %v", err)
+	}
+
+	// round trip
+	exported, err := schema.ToJSONSchema()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := json.Marshal(exported)
+	js, _ = ParseJSONSchema(data)
+	again, err := NewSchemaFromJSONSchema(js)
+	if err != nil {
+		t.Fatalf("round trip: unexpected error: %v", err)
+	}
+	for _, field := range again.Structure {
+		if field.Type != fields[field.Name].Type {
+			t.Errorf("round trip: field '%s' type %s, want %s", field.Name,
+				field.Type, fields[field.Name].Type)
+		}
+	}
+}
+
+func TestJSONSchemaImportErrors(t *testing.T) {
+	doc := `{
+		"type": "object",
+		"required": ["missing"],
+		"properties": {
+			"a": {"oneOf": [{"type": "integer"}, {"type": "string"}]},
+			"b": {"type": "object", "properties": {}},
+			"c": {"type": ["integer", "string"]},
+			"d": {"type": "array"},
+			"e": {"type": "string", "format": "email"},
+			"f": {"type": "array", "items": {"type": "array",
+				"items": {"type": "integer"}}},
+			"g": {"type": "integer", "multipleOf": 2}
+		}
+	}`
+	js, err := ParseJSONSchema([]byte(doc))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _, err = StructureFromJSONSchema(js)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+
+	msg := err.Error()
+	for _, want := range []string{
+		"required property 'missing' not defined",
+		"/properties/a: keyword 'oneOf' not supported",
+		"/properties/b: nested objects not supported",
+		"/properties/c: union of types",
+		"/properties/d: array without items",
+		"/properties/e: format 'email' not supported",
+		"/properties/f: arrays of arrays not supported",
+		"/properties/g: keyword 'multipleOf' not supported",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("missing error '%s' in: %s", want, msg)
+		}
+	}
+
+	// root must be an object
+	js, _ = ParseJSONSchema([]byte(`{"type": "string"}`))
+	if _, _, err := StructureFromJSONSchema(js); err == nil {
+		t.Errorf("expected error on non-object root")
+	}
+}
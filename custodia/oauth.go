@@ -6,10 +6,10 @@
 package custodia
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/url"
 	"time"
 
 	"github.com/dzanotelli/chino/common"
@@ -151,7 +151,7 @@ func (ca *CustodiaAPIv1) CreateApplication(name string, grantType GrantType,
 
 	// JSON: unmarshal resp content
 	appEnvelope := ApplicationEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &appEnvelope); err != nil {
+	if err := decodeJSON(resp, &appEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -168,7 +168,7 @@ func (ca *CustodiaAPIv1) ReadApplication(id string) (*Application, error) {
 
 	// JSON: unmarshal resp content
 	appEnvelope := ApplicationEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &appEnvelope); err != nil {
+	if err := decodeJSON(resp, &appEnvelope); err != nil {
 		return nil, err
 	}
 	return appEnvelope.Application, nil
@@ -200,7 +200,7 @@ func (ca *CustodiaAPIv1) UpdateApplication(id string, name string,
 
 	// JSON: unmarshal resp content and return a fresh application instance
 	appEnvelope := ApplicationEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &appEnvelope); err != nil {
+	if err := decodeJSON(resp, &appEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -224,27 +224,17 @@ func (ca *CustodiaAPIv1) DeleteApplication(id string) (error) {
 func (ca *CustodiaAPIv1) ListApplications(queryParams map[string]string) (
 	[]*Application, error,
 ) {
-	u, err := url.Parse("/auth/applications")
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+	result, _, err := ca.listApplications(queryParams)
+	return result, err
+}
 
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listApplications(queryParams map[string]string) (
+	[]*Application, PageInfo, error) {
 	appsEnvelope := ApplicationsEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &appsEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage("/auth/applications", queryParams,
+		&appsEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
 
 	result := []*Application{}
@@ -252,7 +242,16 @@ func (ca *CustodiaAPIv1) ListApplications(queryParams map[string]string) (
 		result = append(result, &app)
 	}
 
-	return result, nil
+	return result, page, nil
+}
+
+// IterApplications returns a Pager over all the applications
+func (ca *CustodiaAPIv1) IterApplications(ctx context.Context,
+	pageSize int) *Pager[*Application] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Application,
+		PageInfo, error) {
+		return ca.listApplications(pageParams(offset, limit))
+	})
 }
 
 
@@ -287,7 +286,7 @@ func (ca *CustodiaAPIv1) LoginUser(username string, password string,
 
 	// JSON: unmarshal resp content
 	respData := oauthResponseData{}
-	if err := json.Unmarshal([]byte(resp), &respData); err != nil {
+	if err := decodeJSON(resp, &respData); err != nil {
 		return err
 	}
 
@@ -331,7 +330,7 @@ func (ca *CustodiaAPIv1) LoginAuthCode(code string,
 
 	// JSON: unmarshal resp content
 	respData := oauthResponseData{}
-	if err := json.Unmarshal([]byte(resp), &respData); err != nil {
+	if err := decodeJSON(resp, &respData); err != nil {
 		return err
 	}
 
@@ -374,7 +373,7 @@ func (ca *CustodiaAPIv1) RefreshToken(application Application) (error) {
 
 	// JSON: unmarshal resp content
 	respData := oauthResponseData{}
-	if err := json.Unmarshal([]byte(resp), &respData); err != nil {
+	if err := decodeJSON(resp, &respData); err != nil {
 		return err
 	}
 
@@ -436,7 +435,7 @@ func (ca *CustodiaAPIv1) IntrospectToken(token string) (*TokenInfo, error) {
 		return nil, err
 	}
 	tokenInfo := TokenInfo{}
-	if err := json.Unmarshal([]byte(resp), &tokenInfo); err != nil {
+	if err := decodeJSON(resp, &tokenInfo); err != nil {
 		return nil, err
 	}
 
@@ -454,7 +453,7 @@ func (ca *CustodiaAPIv1) UserInfo(schema *UserSchema) (*User, error) {
 
 	// JSON: unmarshal resp content
 	userEnvelope := UserEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &userEnvelope); err != nil {
+	if err := decodeJSON(resp, &userEnvelope); err != nil {
 		return nil, err
 	}
 
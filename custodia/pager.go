@@ -0,0 +1,225 @@
+package custodia
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// DefaultPageSize is the page size used by the pagers when not given
+const DefaultPageSize = 100
+
+// PageInfo is the pagination info returned by list and search calls
+type PageInfo struct {
+	Count int `json:"count"`
+	TotalCount int `json:"total_count"`
+	Limit int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// listPage GETs path with queryParams and unmarshals the response content
+// into envelope, returning the page info
+func (ca *CustodiaAPIv1) listPage(path string, queryParams map[string]string,
+	envelope any) (PageInfo, error) {
+	page := PageInfo{}
+	u, err := url.Parse(path)
+	if err != nil {
+		return page, fmt.Errorf("error parsing url: %v", err)
+	}
+
+	// Adding query params
+	q := u.Query()
+	for k, v := range queryParams {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := ca.Call("GET", u.String(), nil)
+	if err != nil {
+		return page, err
+	}
+
+	// JSON: unmarshal resp content
+	if err := decodeJSON(resp, envelope); err != nil {
+		return page, err
+	}
+	if err := decodeJSON(resp, &page); err != nil {
+		return page, err
+	}
+	return page, nil
+}
+
+// pageParams returns the query params to get the page at offset
+func pageParams(offset, limit int) map[string]string {
+	return map[string]string{"offset": strconv.Itoa(offset),
+		"limit": strconv.Itoa(limit)}
+}
+
+// PageFetcher returns the page of (at most) limit items starting at offset
+type PageFetcher[T any] func(offset, limit int) ([]T, PageInfo, error)
+
+type pageResult[T any] struct {
+	items []T
+	page PageInfo
+	err error
+}
+
+// Pager iterates over all the items of a list or search call, fetching
+// the pages on need. Use it like a bufio.Scanner:
+//
+//	pager := ca.IterRepositories(ctx, 0)
+//	for pager.Next() {
+//		repo := pager.Value()
+//	}
+//	if err := pager.Err(); err != nil { ... }
+//
+// A Pager is not safe for concurrent use.
+type Pager[T any] struct {
+	ctx context.Context
+	fetch PageFetcher[T]
+	pageSize int
+	prefetch bool
+
+	items []T
+	current T
+	offset int
+	page PageInfo
+	fetched bool
+	done bool
+	err error
+	pending chan pageResult[T]
+}
+
+// NewPager returns a Pager getting the pages with fetch. pageSize <= 0
+// means DefaultPageSize. The iteration stops when ctx is done.
+func NewPager[T any](ctx context.Context, pageSize int,
+	fetch PageFetcher[T]) *Pager[T] {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	return &Pager[T]{ctx: ctx, fetch: fetch, pageSize: pageSize}
+}
+
+// errPager returns a Pager which fails with err on the first Next
+func errPager[T any](err error) *Pager[T] {
+	return &Pager[T]{ctx: context.Background(), err: err}
+}
+
+// WithPrefetch enables fetching the next page in background while the
+// current one is consumed. The requests run concurrently with the caller,
+// so the API RawResponse is not reliable while iterating (the calls of the
+// package don't depend on it).
+func (p *Pager[T]) WithPrefetch() *Pager[T] {
+	p.prefetch = true
+	return p
+}
+
+// Next advances to the next item, which is then available with Value. It
+// returns false at the end of the items or on error (see Err).
+func (p *Pager[T]) Next() bool {
+	if p.err != nil {
+		return false
+	}
+	for len(p.items) == 0 {
+		if p.done {
+			return false
+		}
+		if err := p.ctx.Err(); err != nil {
+			p.err = err
+			return false
+		}
+		result := p.nextPage()
+		if result.err != nil {
+			p.err = result.err
+			return false
+		}
+		p.setPage(result)
+	}
+
+	p.current = p.items[0]
+	p.items = p.items[1:]
+	return true
+}
+
+// nextPage returns the prefetched page, or fetches it
+func (p *Pager[T]) nextPage() pageResult[T] {
+	if p.pending == nil {
+		items, page, err := p.fetch(p.offset, p.pageSize)
+		return pageResult[T]{items: items, page: page, err: err}
+	}
+
+	pending := p.pending
+	p.pending = nil
+	select {
+	case result := <-pending:
+		return result
+	case <-p.ctx.Done():
+		return pageResult[T]{err: p.ctx.Err()}
+	}
+}
+
+// setPage stores the fetched page and starts the prefetch of the next one
+func (p *Pager[T]) setPage(result pageResult[T]) {
+	p.items = result.items
+	p.page = result.page
+	p.fetched = true
+	p.offset += len(result.items)
+
+	// the server may return less items than asked (e.g. capped limit)
+	limit := p.pageSize
+	if result.page.Limit > 0 {
+		limit = result.page.Limit
+	}
+	p.done = len(result.items) == 0 || len(result.items) < limit ||
+		(result.page.TotalCount > 0 && p.offset >= result.page.TotalCount)
+
+	if p.prefetch && !p.done {
+		// buffered: the goroutine never blocks, even if the pager is dropped
+		pending := make(chan pageResult[T], 1)
+		offset := p.offset
+		go func() {
+			items, page, err := p.fetch(offset, p.pageSize)
+			pending <- pageResult[T]{items: items, page: page, err: err}
+		}()
+		p.pending = pending
+	}
+}
+
+// Value returns the current item
+func (p *Pager[T]) Value() T {
+	return p.current
+}
+
+// Err returns the error which stopped the iteration, if any. It's the
+// context error when the context is done.
+func (p *Pager[T]) Err() error {
+	return p.err
+}
+
+// TotalCount returns the total number of items as reported by the server,
+// or -1 if no page was fetched yet
+func (p *Pager[T]) TotalCount() int {
+	if !p.fetched {
+		return -1
+	}
+	return p.page.TotalCount
+}
+
+// Page returns the info of the last fetched page
+func (p *Pager[T]) Page() PageInfo {
+	return p.page
+}
+
+// All returns all the remaining items. On error, the items collected so far
+// are returned with it.
+func (p *Pager[T]) All() ([]T, error) {
+	result := []T{}
+	for p.Next() {
+		result = append(result, p.Value())
+	}
+	return result, p.Err()
+}
@@ -0,0 +1,237 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// fakeFetcher returns pages of the ints [0, total), serving at most
+// maxLimit items per page, and records the requested offsets
+func fakeFetcher(total, maxLimit int, offsets *[]int) PageFetcher[int] {
+	return func(offset, limit int) ([]int, PageInfo, error) {
+		*offsets = append(*offsets, offset)
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+		items := []int{}
+		for i := offset; i < total && i < offset+limit; i++ {
+			items = append(items, i)
+		}
+		return items, PageInfo{Count: len(items), TotalCount: total,
+			Limit: limit, Offset: offset}, nil
+	}
+}
+
+func TestPager(t *testing.T) {
+	want := []int{}
+	for i := 0; i < 25; i++ {
+		want = append(want, i)
+	}
+
+	var tests = []struct {
+		pageSize int
+		maxLimit int
+		prefetch bool
+		offsets []int
+	}{
+		{10, 100, false, []int{0, 10, 20}},
+		{5, 100, true, []int{0, 5, 10, 15, 20}},
+		// the server caps the limit
+		{50, 10, false, []int{0, 10, 20}},
+		{25, 100, true, []int{0}},
+	}
+	for i, test := range tests {
+		offsets := []int{}
+		pager := NewPager(context.Background(), test.pageSize,
+			fakeFetcher(25, test.maxLimit, &offsets))
+		if test.prefetch {
+			pager.WithPrefetch()
+		}
+		if pager.TotalCount() != -1 {
+			t.Errorf("test %d: expected unknown total count", i)
+		}
+		got, err := pager.All()
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("test %d: bad items, got: %v", i, got)
+		}
+		if !reflect.DeepEqual(test.offsets, offsets) {
+			t.Errorf("test %d: bad offsets, got: %v want: %v", i, offsets,
+				test.offsets)
+		}
+		if pager.TotalCount() != 25 {
+			t.Errorf("test %d: bad total count %d", i, pager.TotalCount())
+		}
+	}
+
+	// empty list
+	offsets := []int{}
+	pager := NewPager(nil, 0, fakeFetcher(0, 100, &offsets))
+	if pager.Next() || pager.Err() != nil || pager.TotalCount() != 0 {
+		t.Errorf("empty: expected no items and no error")
+	}
+
+	// errors stop the iteration, items read so far are returned
+	fetchErr := errors.New("boom")
+	fetch := func(offset, limit int) ([]int, PageInfo, error) {
+		if offset > 0 {
+			return nil, PageInfo{}, fetchErr
+		}
+		return []int{1, 2}, PageInfo{TotalCount: 4, Limit: 2}, nil
+	}
+	got, err := NewPager(nil, 2, fetch).All()
+	if !errors.Is(err, fetchErr) || !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("error: got %v, %v", got, err)
+	}
+
+	// context cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	offsets = []int{}
+	pager = NewPager(ctx, 5, fakeFetcher(25, 100, &offsets)).WithPrefetch()
+	count := 0
+	for pager.Next() {
+		count++
+		if count == 7 {
+			cancel()
+		}
+	}
+	if !errors.Is(pager.Err(), context.Canceled) || count != 10 {
+		t.Errorf("cancel: got %d items, error %v", count, pager.Err())
+	}
+}
+
+func TestIterCalls(t *testing.T) {
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	schemaId := uuid.New()
+	repos := []any{}
+	for i := 0; i < 5; i++ {
+		repos = append(repos, map[string]any{
+			"repository_id": uuid.New().String(),
+			"description": fmt.Sprintf("repo %d", i),
+			"is_active": true,
+		})
+	}
+
+	page := func(r *http.Request, key string, items []any) map[string]any {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := min(offset+limit, len(items))
+		return map[string]any{key: items[offset:end], "count": end - offset,
+			"total_count": len(items), "limit": limit, "offset": offset}
+	}
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		var response map[string]any
+		if r.URL.Path == "/api/v1/repositories" && r.Method == "GET" {
+			response = page(r, "repositories", repos)
+		} else if r.URL.Path == fmt.Sprintf("/api/v1/search/documents/%s",
+			schemaId) && r.Method == "POST" {
+			docs := []any{}
+			for i := 0; i < 3; i++ {
+				docs = append(docs, map[string]any{
+					"document_id": uuid.New().String(),
+					"schema_id": schemaId.String(),
+					"is_active": true,
+				})
+			}
+			response = page(r, "documents", docs)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(response)
+		envelope.Data = data
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	pager := custodia.IterRepositories(context.Background(), 2)
+	got := []string{}
+	for pager.Next() {
+		got = append(got, pager.Value().Description)
+	}
+	want := []string{"repo 0", "repo 1", "repo 2", "repo 3", "repo 4"}
+	if pager.Err() != nil || !reflect.DeepEqual(want, got) {
+		t.Errorf("IterRepositories: got %v, %v", got, pager.Err())
+	}
+	if pager.TotalCount() != 5 {
+		t.Errorf("IterRepositories: bad total count %d", pager.TotalCount())
+	}
+
+	docs, err := custodia.IterSearchDocuments(context.Background(), schemaId,
+		NoContent, map[string]any{}, nil, 2).All()
+	if err != nil || len(docs) != 3 {
+		t.Errorf("IterSearchDocuments: got %d documents, %v", len(docs), err)
+	}
+
+	_, err = custodia.IterSearchDocuments(context.Background(), schemaId,
+		Count, map[string]any{}, nil, 2).All()
+	if err == nil {
+		t.Errorf("IterSearchDocuments: expected error with Count")
+	}
+}
+
+func TestPagerPrefetchRawCalls(t *testing.T) {
+	blobId := uuid.New()
+	repos := []any{}
+	for i := 0; i < 20; i++ {
+		repos = append(repos, map[string]any{
+			"repository_id": uuid.New().String(), "is_active": true,
+			"description": fmt.Sprintf("repo %d", i)})
+	}
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == fmt.Sprintf("/api/v1/blobs/%s", blobId) {
+			w.Write([]byte("blob data"))
+			return
+		}
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := min(offset+limit, len(repos))
+		envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+		envelope.Data, _ = json.Marshal(map[string]any{
+			"repositories": repos[offset:end], "count": end - offset,
+			"total_count": len(repos), "limit": limit, "offset": offset})
+		out, _ := json.Marshal(envelope)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+	custodia := NewCustodiaAPIv1(common.NewClient(server.URL,
+		common.GetFakeAuth()))
+
+	// the blob body is the one of its own response, not of the prefetch
+	pager := custodia.IterRepositories(context.Background(), 1).WithPrefetch()
+	for pager.Next() {
+		reader, err := custodia.GetBlobData(blobId)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		if string(data) != "blob data" {
+			t.Fatalf("GetBlobData: bad body %q", data)
+		}
+	}
+	if pager.Err() != nil {
+		t.Errorf("unexpected error: %v", pager.Err())
+	}
+}
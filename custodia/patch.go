@@ -0,0 +1,211 @@
+package custodia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// unsetMarker is the type of Unset
+type unsetMarker struct{}
+
+// Unset is a patch value removing the field from the content, e.g.
+// Patch{Content: map[string]any{"nickname": Unset}}
+var Unset = unsetMarker{}
+
+// errNoChanges stops a patch which doesn't change anything
+var errNoChanges = errors.New("no changes")
+
+// Patch is a partial update: only the fields in Content are changed (or
+// removed, with Unset), the others are kept. IsActive is changed only if
+// not nil.
+type Patch struct {
+	Content map[string]any
+	IsActive *bool
+}
+
+// Define ChangeKind
+type ChangeKind int
+
+const (
+	FieldAdded ChangeKind = iota + 1
+	FieldModified
+	FieldRemoved
+)
+
+func (ck ChangeKind) Choices() []string {
+	return []string{"added", "modified", "removed"}
+}
+
+func (ck ChangeKind) String() string {
+	return ck.Choices()[ck-1]
+}
+
+func (ck ChangeKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ck.String())
+}
+
+func (ck *ChangeKind) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, ck.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("ChangeKind: received unknown value '%v'", value)
+	}
+
+	*ck = ChangeKind(intValue)
+	return nil
+}
+
+// FieldChange is the change of a single field of a content
+type FieldChange struct {
+	Field string `json:"field"`
+	Kind ChangeKind `json:"kind"`
+	// Old is nil for added fields, New for removed ones
+	Old any `json:"old,omitempty"`
+	New any `json:"new,omitempty"`
+}
+
+// Diff returns the changes from old to new, sorted by field name. Values
+// are compared by value (e.g. int64(1) equals 1.0, dates as dates).
+func Diff(old, new map[string]any) []FieldChange {
+	names := []string{}
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, name := range names {
+		oldValue, inOld := old[name]
+		newValue, inNew := new[name]
+		switch {
+		case !inOld:
+			changes = append(changes, FieldChange{Field: name,
+				Kind: FieldAdded, New: newValue})
+		case !inNew:
+			changes = append(changes, FieldChange{Field: name,
+				Kind: FieldRemoved, Old: oldValue})
+		case !valuesEqual(oldValue, newValue):
+			changes = append(changes, FieldChange{Field: name,
+				Kind: FieldModified, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
+
+// applyPatch returns content with patch applied, the patched values
+// converted to the types of their fields
+func applyPatch(content map[string]any, patch map[string]any,
+	schema StructureMapper) (map[string]any, error) {
+	structure := schema.getStructureAsMap()
+	merged := map[string]any{}
+	for name, value := range content {
+		merged[name] = value
+	}
+
+	var ee []error
+	for name, value := range patch {
+		if value == Unset {
+			delete(merged, name)
+			continue
+		}
+		field, ok := structure[name]
+		if !ok {
+			ee = append(ee, fmt.Errorf("field '%s': not defined in " +
+				"structure", name))
+			continue
+		}
+		if value != nil {
+			converted, err := convertDefault(value, field)
+			if err != nil {
+				ee = append(ee, err)
+				continue
+			}
+			value = converted
+		}
+		merged[name] = value
+	}
+	if len(ee) > 0 {
+		return nil, fmt.Errorf("patch errors: %w", errors.Join(ee...))
+	}
+	return merged, nil
+}
+
+// PatchDocument merges patch into the current content of the document,
+// validates it against schema and writes it, returning the updated
+// document and the changed fields. Nothing is written when the patch
+// doesn't change anything.
+// The write is conditional and retried on conflicts as in ModifyDocument,
+// so concurrent changes to other fields are kept.
+func (ca *CustodiaAPIv1) PatchDocument(schema Schema, documentId uuid.UUID,
+	patch Patch) (*Document, []FieldChange, error) {
+	var changes []FieldChange
+	var current *Document
+	updated, err := ca.ModifyDocument(schema, documentId,
+		func(doc *Document) error {
+			current = doc
+			merged, err := applyPatch(doc.Content, patch.Content, &schema)
+			if err != nil {
+				return err
+			}
+			changes = Diff(doc.Content, merged)
+			isActive := doc.IsActive
+			if patch.IsActive != nil {
+				isActive = *patch.IsActive
+			}
+			if len(changes) == 0 && isActive == doc.IsActive {
+				return errNoChanges
+			}
+			doc.Content, doc.IsActive = merged, isActive
+			return nil
+		})
+	if err == errNoChanges {
+		return current, changes, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return updated, changes, nil
+}
+
+// PatchUser merges patch into the current attributes of the user, as
+// PatchDocument
+func (ca *CustodiaAPIv1) PatchUser(userSchema UserSchema, userId uuid.UUID,
+	patch Patch) (*User, []FieldChange, error) {
+	var changes []FieldChange
+	var current *User
+	updated, err := ca.ModifyUser(userSchema, userId, func(user *User) error {
+		current = user
+		merged, err := applyPatch(user.Attributes, patch.Content, &userSchema)
+		if err != nil {
+			return err
+		}
+		changes = Diff(user.Attributes, merged)
+		isActive := user.IsActive
+		if patch.IsActive != nil {
+			isActive = *patch.IsActive
+		}
+		if len(changes) == 0 && isActive == user.IsActive {
+			return errNoChanges
+		}
+		user.Attributes, user.IsActive = merged, isActive
+		return nil
+	})
+	if err == errNoChanges {
+		return current, changes, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return updated, changes, nil
+}
@@ -0,0 +1,143 @@
+package custodia
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestDiff(t *testing.T) {
+	old := map[string]any{"a": int64(1), "b": "x", "c": NewDate(2020, 1, 2),
+		"d": []int64{1, 2}}
+	new := map[string]any{"a": 1.0, "b": "y", "c": NewDate(2020, 1, 2),
+		"d": []int64{1, 3}, "e": nil}
+	want := []FieldChange{
+		{Field: "b", Kind: FieldModified, Old: "x", New: "y"},
+		{Field: "d", Kind: FieldModified, Old: []int64{1, 2},
+			New: []int64{1, 3}},
+		{Field: "e", Kind: FieldAdded},
+	}
+	if got := Diff(old, new); !reflect.DeepEqual(want, got) {
+		t.Errorf("bad diff, got: %v want: %v", got, want)
+	}
+	removed := Diff(map[string]any{"a": 1}, map[string]any{})
+	if len(removed) != 1 || removed[0].Kind != FieldRemoved {
+		t.Errorf("bad diff, got: %v", removed)
+	}
+}
+
+func TestPatchDocument(t *testing.T) {
+	store := &versionedServer{id: uuid.New(),
+		content: map[string]any{"name": "John", "age": 30,
+			"nickname": "jj"},
+		lastUpdate: time.Date(2025, 4, 14, 5, 9, 54, 0, time.UTC)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr},
+		{Name: "age", Type: TypeInt},
+		{Name: "nickname", Type: TypeStr},
+		{Name: "born", Type: TypeDate},
+	}}
+
+	doc, changes, err := custodia.PatchDocument(schema, store.id, Patch{
+		Content: map[string]any{"age": 31, "nickname": Unset,
+			"born": "1994-05-06", "name": "John"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{[]FieldChange{
+			{Field: "age", Kind: FieldModified, Old: int64(30),
+				New: int64(31)},
+			{Field: "born", Kind: FieldAdded, New: NewDate(1994, 5, 6)},
+			{Field: "nickname", Kind: FieldRemoved, Old: "jj"},
+		}, changes},
+		{map[string]any{"name": "John", "age": int64(31),
+			"born": NewDate(1994, 5, 6)}, doc.Content},
+		{map[string]any{"name": "John", "age": float64(31),
+			"born": "1994-05-06"}, store.content},
+		{1, store.puts},
+	}
+
+	// no changes: nothing is written
+	doc, changes, err = custodia.PatchDocument(schema, store.id, Patch{
+		Content: map[string]any{"age": int64(31)}})
+	active := true
+	tests = append(tests, []struct {
+		want any
+		got any
+	}{
+		{nil, err},
+		{0, len(changes)},
+		{int64(31), doc.Content["age"]},
+		{1, store.puts},
+	}...)
+	_, changes, err = custodia.PatchDocument(schema, store.id, Patch{
+		IsActive: &active})
+	tests = append(tests, []struct {
+		want any
+		got any
+	}{
+		{nil, err},
+		{1, store.puts},
+	}...)
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	// validation errors
+	var errorTests = []struct {
+		patch map[string]any
+		want string
+	}{
+		{map[string]any{"missing": 1}, "field 'missing': not defined"},
+		{map[string]any{"age": "old"}, "field 'age'"},
+		{map[string]any{"born": "1994-02-30"}, "field 'born'"},
+	}
+	for i, test := range errorTests {
+		_, _, err := custodia.PatchDocument(schema, store.id,
+			Patch{Content: test.patch})
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("error %d: expected '%s', got: %v", i, test.want, err)
+		}
+	}
+	if store.puts != 1 {
+		t.Errorf("invalid patches were written")
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	store := &versionedServer{id: uuid.New(), users: true,
+		content: map[string]any{"name": "John"},
+		lastUpdate: time.Date(2025, 4, 14, 5, 9, 54, 0, time.UTC)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	userSchema := UserSchema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}, {Name: "age", Type: TypeInt}}}
+
+	inactive := false
+	user, changes, err := custodia.PatchUser(userSchema, store.id, Patch{
+		Content: map[string]any{"age": 40}, IsActive: &inactive})
+	want := []FieldChange{{Field: "age", Kind: FieldAdded, New: int64(40)}}
+	if err != nil || !reflect.DeepEqual(want, changes) ||
+		user.Attributes["name"] != "John" || store.puts != 1 {
+		t.Errorf("got %v, %v, %v", user, changes, err)
+	}
+}
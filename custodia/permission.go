@@ -30,6 +30,11 @@ func (ps PermissionScope) MarshalJSON() ([]byte, error) {
     return json.Marshal(ps.String())
 }
 
+// MarshalText makes the maps keyed by scope marshal with the scope names
+func (ps PermissionScope) MarshalText() ([]byte, error) {
+    return []byte(ps.String()), nil
+}
+
 func (ps* PermissionScope) UnmarshalJSON(data []byte) error {
     var value string
 
@@ -247,7 +252,7 @@ func (ca *CustodiaAPIv1) PermissionOnResources(action PermissionAction,
 	error) {
 	url := fmt.Sprintf("/perms/%s/%s/%s/%s", action, resourceType.UrlString(),
         subjectType.UrlString(), subjectId.String())
-	params := map[string]any{"data": permissions}
+	params := map[string]any{"_data": permissions}
 	_, err := ca.Call("POST", url, params)
     if err!= nil {
         return err
@@ -264,7 +269,7 @@ func (ca *CustodiaAPIv1) PermissionOnResource(action PermissionAction,
     url := fmt.Sprintf("/perms/%s/%s/%s/%s/%s", action,
         resourceType.UrlString(), resourceId.String(), subjectType.UrlString(),
         subjectId.String())
-    params := map[string]any{"data": permissions}
+    params := map[string]any{"_data": permissions}
     _, err := ca.Call("POST", url, params)
     if err!= nil {
         return err
@@ -283,7 +288,7 @@ func (ca *CustodiaAPIv1) PermissionOnResourceChildren(action PermissionAction,
         resourceType.UrlString(), resourceId.String(),
         resourceChildType.UrlString(), subjectType.UrlString(),
         subjectId.String())
-	params := map[string]any{"data": permissions}
+	params := map[string]any{"_data": permissions}
 	_, err := ca.Call("POST", url, params)
 	if err!= nil {
 		return err
@@ -301,7 +306,7 @@ func (ca *CustodiaAPIv1) ReadAllPermissions() ([]Resource, error) {
 
     // JSON: unmarshal resp content
     resourcesEnvelope := map[string][]Resource{}
-    if err := json.Unmarshal([]byte(resp), &resourcesEnvelope); err!= nil {
+    if err := decodeJSON(resp, &resourcesEnvelope); err!= nil {
         return nil, err
     }
 
@@ -322,7 +327,7 @@ func (ca *CustodiaAPIv1) ReadPermissionsOnDocument(documentId uuid.UUID) (
     }
 	// JSON: unmarshal resp content
 	resourcesEnvelope := map[string][]Resource{}
-    if err := json.Unmarshal([]byte(resp), &resourcesEnvelope); err!= nil {
+    if err := decodeJSON(resp, &resourcesEnvelope); err!= nil {
         return nil, err
     }
 
@@ -344,7 +349,7 @@ func (ca *CustodiaAPIv1) ReadPermissionsOnUser(userId uuid.UUID) ([]Resource,
     }
     // JSON: unmarshal resp content
     resourcesEnvelope := map[string][]Resource{}
-    if err := json.Unmarshal([]byte(resp), &resourcesEnvelope); err!= nil {
+    if err := decodeJSON(resp, &resourcesEnvelope); err!= nil {
         return nil, err
     }
 
@@ -365,7 +370,7 @@ func (ca *CustodiaAPIv1) ReadPermissionsOnGroup(groupId uuid.UUID) ([]Resource,
     }
     // JSON: unmarshal resp content
     resourcesEnvelope := map[string][]Resource{}
-    if err := json.Unmarshal([]byte(resp), &resourcesEnvelope); err!= nil {
+    if err := decodeJSON(resp, &resourcesEnvelope); err!= nil {
         return nil, err
     }
 
@@ -3,6 +3,7 @@ package custodia
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -82,7 +83,13 @@ func TestPermission(t *testing.T) {
         },
     }
 
+    // bodies are the request bodies of the grant and revoke calls
+    bodies := []string{}
     mockHandler := func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" {
+            body, _ := io.ReadAll(r.Body)
+            bodies = append(bodies, string(body))
+        }
         if r.URL.Path == fmt.Sprintf(
             "/api/v1/perms/grant/repositories/users/%s", dummyUUID,
         ) && r.Method == "POST" {
@@ -180,6 +187,12 @@ func TestPermission(t *testing.T) {
         t.Errorf("unexpected error: %v", err)
     }
 
+    // the permissions are sent in the body, keyed by scope name
+    want := `{"authorize":[],"manage":["C","L","R"]}`
+    if !reflect.DeepEqual([]string{want, want, want}, bodies) {
+        t.Errorf("bad permission bodies, got: %v want: %v", bodies, want)
+    }
+
     // test ReadAllPermissions
     allPerms, err := custodia.ReadAllPermissions()
     if err != nil {
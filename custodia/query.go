@@ -0,0 +1,445 @@
+package custodia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Query is a node of the Custodia search DSL: a field filter (see Field)
+// or a logical operator (And, Or, Not). Use BuildQuery to get the map
+// accepted by SearchDocuments and SearchUsers.
+type Query interface {
+	// querySpec returns the node as in the search DSL
+	querySpec() map[string]any
+	// check returns the errors of the node against the given structure
+	check(structure map[string]SchemaField) []error
+}
+
+// Search operators
+const OpEq, OpLt, OpLte, OpGt, OpGte = "eq", "lt", "lte", "gt", "gte"
+const OpIn, OpIs, OpLike = "in", "is", "like"
+
+// searchOperators maps each field type to the operators it supports. Types
+// not listed (base64, json, blob) can't be searched.
+var searchOperators = map[string][]string{
+	TypeInt: {OpEq, OpLt, OpLte, OpGt, OpGte, OpIn, OpIs},
+	TypeFloat: {OpEq, OpLt, OpLte, OpGt, OpGte, OpIn, OpIs},
+	TypeDate: {OpEq, OpLt, OpLte, OpGt, OpGte, OpIn, OpIs},
+	TypeTime: {OpEq, OpLt, OpLte, OpGt, OpGte, OpIn, OpIs},
+	TypeDateTime: {OpEq, OpLt, OpLte, OpGt, OpGte, OpIn, OpIs},
+	TypeStr: {OpEq, OpIn, OpIs, OpLike},
+	TypeText: {OpEq, OpIn, OpIs, OpLike},
+	TypeBool: {OpEq, OpIs},
+}
+
+// arraySearchOperators are the operators supported by array fields, the
+// value is matched against the items
+var arraySearchOperators = []string{OpEq, OpIn, OpIs}
+
+// FieldRef is a field of the structure, used to build filters
+type FieldRef struct {
+	name string
+}
+
+// Field returns a reference to the field name, e.g. Field("age").Gt(30)
+func Field(name string) FieldRef {
+	return FieldRef{name: name}
+}
+
+// FieldFilter filters the results on the value of a field
+type FieldFilter struct {
+	Field string
+	Op string
+	Value any
+}
+
+func (f FieldRef) Eq(value any) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpEq, Value: value}
+}
+
+func (f FieldRef) Lt(value any) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpLt, Value: value}
+}
+
+func (f FieldRef) Lte(value any) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpLte, Value: value}
+}
+
+func (f FieldRef) Gt(value any) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpGt, Value: value}
+}
+
+func (f FieldRef) Gte(value any) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpGte, Value: value}
+}
+
+// In matches the fields equal to any of values
+func (f FieldRef) In(values ...any) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpIn, Value: values}
+}
+
+// Is matches the fields which are null (nil), true or false
+func (f FieldRef) Is(value any) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpIs, Value: value}
+}
+
+// Like matches string fields against pattern, where '*' matches any
+// sequence of characters and '?' a single one
+func (f FieldRef) Like(pattern string) *FieldFilter {
+	return &FieldFilter{Field: f.name, Op: OpLike, Value: pattern}
+}
+
+func (ff *FieldFilter) querySpec() map[string]any {
+	value := ff.Value
+	if ff.Op == OpIn {
+		items := []any{}
+		for _, item := range filterValues(ff) {
+			items = append(items, jsonValue(item))
+		}
+		value = items
+	} else {
+		value = jsonValue(value)
+	}
+	return map[string]any{"field": ff.Field, "type": ff.Op, "value": value}
+}
+
+// checkQueryValue checks that value can be compared with the field
+func checkQueryValue(value any, field SchemaField) error {
+	// parameters are checked when registering the saved query
+	if _, isParam := value.(ParamRef); isParam {
+		return nil
+	}
+	if itemType, isArray := arrayItemType(field.Type); isArray {
+		field.Type = itemType
+	}
+	_, err := convertDefault(value, field)
+	return err
+}
+
+func (ff *FieldFilter) check(structure map[string]SchemaField) []error {
+	field, ok := structure[ff.Field]
+	if !ok {
+		return []error{fmt.Errorf("field '%s': not defined in structure",
+			ff.Field)}
+	}
+
+	var ee []error
+	if !field.Indexed {
+		ee = append(ee, fmt.Errorf("field '%s': not indexed", ff.Field))
+	}
+
+	operators, ok := searchOperators[field.Type]
+	if _, isArray := arrayItemType(field.Type); isArray {
+		operators, ok = arraySearchOperators, true
+	}
+	if !ok {
+		return append(ee, fmt.Errorf("field '%s': type '%s' can't be " +
+			"searched", ff.Field, field.Type))
+	}
+	if indexOf(ff.Op, operators) < 0 {
+		return append(ee, fmt.Errorf("field '%s': operator '%s' not " +
+			"supported by type '%s'", ff.Field, ff.Op, field.Type))
+	}
+
+	switch ff.Op {
+	case OpIs:
+		_, isParam := ff.Value.(ParamRef)
+		if ff.Value != nil && ff.Value != true && ff.Value != false &&
+			!isParam {
+			ee = append(ee, fmt.Errorf("field '%s': 'is' expects nil, true " +
+				"or false, got: %v", ff.Field, ff.Value))
+		}
+	case OpIn:
+		values := filterValues(ff)
+		if !isSlice(ff.Value) {
+			ee = append(ee, fmt.Errorf("field '%s': 'in' expects a list, " +
+				"got: %v", ff.Field, ff.Value))
+			break
+		}
+		if len(values) == 0 {
+			ee = append(ee, fmt.Errorf("field '%s': 'in' expects at least " +
+				"one value", ff.Field))
+		}
+		for _, value := range values {
+			if err := checkQueryValue(value, field); err != nil {
+				ee = append(ee, err)
+			}
+		}
+	case OpLike:
+		// the pattern is a string, already enforced by Like
+	default:
+		if err := checkQueryValue(ff.Value, field); err != nil {
+			ee = append(ee, err)
+		}
+	}
+	return ee
+}
+
+// logicalQuery combines other queries with and/or
+type logicalQuery struct {
+	op string
+	queries []Query
+}
+
+// And matches the results matching all the queries
+func And(queries ...Query) Query {
+	return &logicalQuery{op: "and", queries: queries}
+}
+
+// Or matches the results matching at least one of the queries
+func Or(queries ...Query) Query {
+	return &logicalQuery{op: "or", queries: queries}
+}
+
+func (lq *logicalQuery) querySpec() map[string]any {
+	specs := []map[string]any{}
+	for _, query := range lq.queries {
+		specs = append(specs, query.querySpec())
+	}
+	return map[string]any{lq.op: specs}
+}
+
+func (lq *logicalQuery) check(structure map[string]SchemaField) []error {
+	var ee []error
+	if len(lq.queries) == 0 {
+		ee = append(ee, fmt.Errorf("'%s' expects at least one query", lq.op))
+	}
+	for _, query := range lq.queries {
+		ee = append(ee, query.check(structure)...)
+	}
+	return ee
+}
+
+// notQuery negates a query
+type notQuery struct {
+	query Query
+}
+
+// Not matches the results not matching query
+func Not(query Query) Query {
+	return &notQuery{query: query}
+}
+
+func (nq *notQuery) querySpec() map[string]any {
+	return map[string]any{"not": nq.query.querySpec()}
+}
+
+func (nq *notQuery) check(structure map[string]SchemaField) []error {
+	return nq.query.check(structure)
+}
+
+// BuildQuery returns the search DSL of query. If schema is not nil, the
+// queried fields must exist, be indexed and support the used operators.
+func BuildQuery(schema StructureMapper, query Query) (map[string]any, error) {
+	if query == nil {
+		return nil, fmt.Errorf("query is nil")
+	}
+	for _, ff := range queryFilters(query) {
+		if ff.Op == OpIn && !isSlice(ff.Value) {
+			return nil, fmt.Errorf("field '%s': 'in' expects a list, got: " +
+				"%v", ff.Field, ff.Value)
+		}
+	}
+	if names := queryParamNames(query); len(names) > 0 {
+		return nil, fmt.Errorf("unbound parameters: %v", names)
+	}
+	if schema != nil {
+		ee := query.check(schema.getStructureAsMap())
+		if len(ee) > 0 {
+			return nil, fmt.Errorf("query errors: %w", errors.Join(ee...))
+		}
+	}
+	return query.querySpec(), nil
+}
+
+// ParseQuery returns the Query of the search DSL dsl, as decoded from
+// JSON. Values like {"$param": "name"} are parameters (see SavedQuery).
+func ParseQuery(dsl map[string]any) (Query, error) {
+	for _, op := range []string{"and", "or"} {
+		value, ok := dsl[op]
+		if !ok {
+			continue
+		}
+		if len(dsl) != 1 {
+			return nil, fmt.Errorf("'%s' node with other keys", op)
+		}
+		nodes, err := queryNodes(value)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", op, err)
+		}
+		queries := []Query{}
+		for _, node := range nodes {
+			query, err := ParseQuery(node)
+			if err != nil {
+				return nil, err
+			}
+			queries = append(queries, query)
+		}
+		return &logicalQuery{op: op, queries: queries}, nil
+	}
+
+	if value, ok := dsl["not"]; ok {
+		node, isNode := value.(map[string]any)
+		if !isNode || len(dsl) != 1 {
+			return nil, fmt.Errorf("'not' expects a single query node")
+		}
+		query, err := ParseQuery(node)
+		if err != nil {
+			return nil, err
+		}
+		return &notQuery{query: query}, nil
+	}
+
+	name, _ := dsl["field"].(string)
+	op, _ := dsl["type"].(string)
+	value, hasValue := dsl["value"]
+	if name == "" || op == "" || !hasValue || len(dsl) != 3 {
+		return nil, fmt.Errorf("bad query node %v: expected 'field', " +
+			"'type' and 'value'", dsl)
+	}
+	value, err := parseQueryValue(value)
+	if err != nil {
+		return nil, fmt.Errorf("field '%s': %w", name, err)
+	}
+	if op == OpIn {
+		values, isList := value.([]any)
+		if _, isParam := value.(ParamRef); isParam {
+			values, isList = []any{value}, true
+		}
+		if !isList {
+			return nil, fmt.Errorf("field '%s': 'in' expects a list, got: " +
+				"%v", name, value)
+		}
+		value = values
+	}
+	return &FieldFilter{Field: name, Op: op, Value: value}, nil
+}
+
+// parseQueryValue returns value with the parameters as ParamRef
+func parseQueryValue(value any) (any, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		name, ok := v["$param"].(string)
+		if !ok || len(v) != 1 {
+			return nil, fmt.Errorf("bad value %v", v)
+		}
+		return Param(name), nil
+	case []any:
+		values := []any{}
+		for _, item := range v {
+			parsed, err := parseQueryValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, parsed)
+		}
+		return values, nil
+	}
+	return value, nil
+}
+
+// Define SortOrder
+type SortOrder int
+
+const (
+	SortAsc SortOrder = iota + 1
+	SortDesc
+)
+
+func (so SortOrder) Choices() []string {
+	return []string{"asc", "desc"}
+}
+
+func (so SortOrder) String() string {
+	return so.Choices()[so-1]
+}
+
+func (so SortOrder) MarshalJSON() ([]byte, error) {
+	if so < SortAsc || so > SortDesc {
+		return nil, fmt.Errorf("SortOrder: unknown value %d", so)
+	}
+	return json.Marshal(so.String())
+}
+
+func (so *SortOrder) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, so.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("SortOrder: received unknown value '%v'", value)
+	}
+
+	*so = SortOrder(intValue)
+	return nil
+}
+
+// SortSpec sorts the results on a field. Multiple specs are applied in
+// order (the first is the primary key).
+type SortSpec struct {
+	Field string `json:"field"`
+	Order SortOrder `json:"order"`
+}
+
+// Asc sorts on field in ascending order
+func (f FieldRef) Asc() SortSpec {
+	return SortSpec{Field: f.name, Order: SortAsc}
+}
+
+// Desc sorts on field in descending order
+func (f FieldRef) Desc() SortSpec {
+	return SortSpec{Field: f.name, Order: SortDesc}
+}
+
+// BuildSort returns the sort DSL of specs, where a zero Order is SortAsc.
+// If schema is not nil, the fields must exist, be indexed and sortable.
+func BuildSort(schema StructureMapper, specs ...SortSpec) ([]SortSpec,
+	error) {
+	var ee []error
+	result := []SortSpec{}
+	for _, spec := range specs {
+		if spec.Order == 0 {
+			spec.Order = SortAsc
+		} else if spec.Order != SortAsc && spec.Order != SortDesc {
+			ee = append(ee, fmt.Errorf("field '%s': unknown sort order %d",
+				spec.Field, spec.Order))
+		}
+		result = append(result, spec)
+	}
+	if schema == nil {
+		if len(ee) > 0 {
+			return nil, fmt.Errorf("sort errors: %w", errors.Join(ee...))
+		}
+		return result, nil
+	}
+
+	structure := schema.getStructureAsMap()
+	seen := map[string]bool{}
+	for _, spec := range result {
+		field, ok := structure[spec.Field]
+		if !ok {
+			ee = append(ee, fmt.Errorf("field '%s': not defined in structure",
+				spec.Field))
+			continue
+		}
+		if !field.Indexed {
+			ee = append(ee, fmt.Errorf("field '%s': not indexed", spec.Field))
+		}
+		if _, ok := searchOperators[field.Type]; !ok {
+			ee = append(ee, fmt.Errorf("field '%s': type '%s' can't be " +
+				"sorted", spec.Field, field.Type))
+		}
+		if seen[spec.Field] {
+			ee = append(ee, fmt.Errorf("field '%s': sorted more than once",
+				spec.Field))
+		}
+		seen[spec.Field] = true
+	}
+	if len(ee) > 0 {
+		return nil, fmt.Errorf("sort errors: %w", errors.Join(ee...))
+	}
+	return result, nil
+}
@@ -0,0 +1,230 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestBuildQuery(t *testing.T) {
+	schema := &Schema{
+		Id: uuid.New(),
+		Description: "unittest",
+		Structure: []SchemaField{
+			{Name: "age", Type: TypeInt, Indexed: true},
+			{Name: "name", Type: TypeStr, Indexed: true},
+			{Name: "active", Type: TypeBool, Indexed: true},
+			{Name: "born", Type: TypeDate, Indexed: true},
+			{Name: "tags", Type: TypeArrayStr, Indexed: true},
+			{Name: "notes", Type: TypeText},
+			{Name: "photo", Type: TypeBase64, Indexed: true},
+		},
+	}
+
+	query := And(
+		Field("age").Gt(30),
+		Or(Field("name").Like("Ant*"), Field("name").In("a", "b")),
+		Not(Field("active").Is(false)),
+		Field("born").Lte(NewDate(2000, 1, 1)),
+	)
+	got, err := BuildQuery(schema, query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := json.Marshal(got)
+	want := `{"and":[{"field":"age","type":"gt","value":30},` +
+		`{"or":[{"field":"name","type":"like","value":"Ant*"},` +
+		`{"field":"name","type":"in","value":["a","b"]}]},` +
+		`{"not":{"field":"active","type":"is","value":false}},` +
+		`{"field":"born","type":"lte","value":"2000-01-01"}]}`
+	if string(data) != want {
+		t.Errorf("bad query, got: %s want: %s", data, want)
+	}
+
+	// errors against the schema
+	var errorTests = []struct {
+		query Query
+		want string
+	}{
+		{Field("missing").Eq(1), "not defined in structure"},
+		{Field("notes").Eq("x"), "field 'notes': not indexed"},
+		{Field("name").Gt("x"), "operator 'gt' not supported"},
+		{Field("active").Like("x"), "operator 'like' not supported"},
+		{Field("photo").Eq("eA=="), "type 'base64' can't be searched"},
+		{Field("age").Eq("abc"), "field 'age'"},
+		{Field("age").Is(42), "'is' expects nil, true or false"},
+		{Field("age").In(), "'in' expects at least one value"},
+		{&FieldFilter{Field: "age", Op: OpIn, Value: 42},
+			"'in' expects a list"},
+		{&FieldFilter{Field: "age", Op: OpIn, Value: []string{"abc"}},
+			"field 'age'"},
+		{Field("born").Eq("2023-02-30"), "field 'born'"},
+		{Or(), "'or' expects at least one query"},
+	}
+	for i, test := range errorTests {
+		_, err := BuildQuery(schema, test.query)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("test %d: expected error '%s', got: %v", i, test.want,
+				err)
+		}
+	}
+
+	// arrays match their items, without schema nothing is checked
+	if _, err := BuildQuery(schema, Field("tags").In("x", "y")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := BuildQuery(nil, Field("notes").Gt(1)); err != nil {
+		t.Errorf("unexpected error without schema: %v", err)
+	}
+
+	// any slice is a list of values
+	built, err := BuildQuery(nil, &FieldFilter{Field: "name", Op: OpIn,
+		Value: []string{"a", "b"}})
+	wantIn := map[string]any{"field": "name", "type": "in",
+		"value": []any{"a", "b"}}
+	if err != nil || !reflect.DeepEqual(wantIn, built) {
+		t.Errorf("BuildQuery: got %v, %v want: %v", built, err, wantIn)
+	}
+	if _, err := BuildQuery(nil, &FieldFilter{Field: "name", Op: OpIn,
+		Value: "a"}); err == nil {
+		t.Errorf("expected error with a non-list 'in' value")
+	}
+
+	// sort
+	specs, err := BuildSort(schema, Field("age").Desc(), Field("name").Asc())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ = json.Marshal(specs)
+	want = `[{"field":"age","order":"desc"},{"field":"name","order":"asc"}]`
+	if string(data) != want {
+		t.Errorf("bad sort, got: %s want: %s", data, want)
+	}
+	// a zero order is ascending, unknown orders are errors
+	specs, err = BuildSort(nil, SortSpec{Field: "age"})
+	wantSpecs := []SortSpec{{Field: "age", Order: SortAsc}}
+	if err != nil || !reflect.DeepEqual(wantSpecs, specs) {
+		t.Errorf("BuildSort: got %v, %v want: %v", specs, err, wantSpecs)
+	}
+	if _, err := BuildSort(nil, SortSpec{Field: "age", Order: 3}); err == nil {
+		t.Errorf("BuildSort: expected error on unknown order")
+	}
+	if _, err := json.Marshal(SortSpec{Field: "age"}); err == nil {
+		t.Errorf("expected error marshalling a zero order")
+	}
+
+	_, err = BuildSort(schema, Field("notes").Asc(), Field("tags").Asc(),
+		Field("age").Asc(), Field("age").Desc())
+	for _, want := range []string{"'notes': not indexed",
+		"'tags': type 'array[string]' can't be sorted",
+		"'age': sorted more than once"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("BuildSort: expected error '%s', got: %v", want, err)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	text := `{"and":[{"field":"age","type":"gt","value":30},` +
+		`{"or":[{"field":"name","type":"like","value":"Ant*"},` +
+		`{"field":"name","type":"in","value":["a","b"]}]},` +
+		`{"not":{"field":"active","type":"is","value":false}}]}`
+	var dsl map[string]any
+	decodeJSON(text, &dsl)
+	query, err := ParseQuery(dsl)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	built, err := BuildQuery(nil, query)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := json.Marshal(built)
+	if string(data) != text {
+		t.Errorf("bad round trip, got: %s want: %s", data, text)
+	}
+
+	// parameters
+	dsl = map[string]any{}
+	decodeJSON(`{"field":"age","type":"in","value":{"$param":"ages"}}`, &dsl)
+	query, err = ParseQuery(dsl)
+	want := &FieldFilter{Field: "age", Op: OpIn,
+		Value: []any{Param("ages")}}
+	if err != nil || !reflect.DeepEqual(want, query) {
+		t.Errorf("param: got %v, %v", query, err)
+	}
+	if _, err := BuildQuery(nil, query); err == nil ||
+		!strings.Contains(err.Error(), "unbound parameters: [ages]") {
+		t.Errorf("expected unbound parameters error, got: %v", err)
+	}
+
+	var errorTests = []string{
+		`{"or":[], "not":{}}`,
+		`{"not":[]}`,
+		`{"field":"age","type":"eq"}`,
+		`{"field":"age","type":"in","value":1}`,
+		`{"field":"age","type":"eq","value":{"$other":"x"}}`,
+	}
+	for i, test := range errorTests {
+		dsl = map[string]any{}
+		decodeJSON(test, &dsl)
+		if _, err := ParseQuery(dsl); err == nil {
+			t.Errorf("error %d: expected error", i)
+		}
+	}
+}
+
+func TestSearchSendsQuery(t *testing.T) {
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	schemaId := uuid.New()
+	var body map[string]any
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == fmt.Sprintf("/api/v1/search/documents/%s",
+			schemaId) && r.Method == "POST" {
+			json.NewDecoder(r.Body).Decode(&body)
+			envelope.Data = []byte(`{"documents": [], "count": 0, ` +
+				`"total_count": 0, "limit": 10, "offset": 0}`)
+			out, _ := json.Marshal(envelope)
+			w.WriteHeader(http.StatusOK)
+			w.Write(out)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	query, _ := BuildQuery(nil, Field("age").Gte(18))
+	sort, _ := BuildSort(nil, Field("age").Asc())
+	_, err := custodia.SearchDocuments(schemaId, Count, query, sort, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{"COUNT", body["result_type"]},
+		{map[string]any{"field": "age", "type": "gte", "value": float64(18)},
+			body["query"]},
+		{[]any{map[string]any{"field": "age", "order": "asc"}}, body["sort"]},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+}
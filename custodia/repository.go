@@ -1,9 +1,8 @@
 package custodia
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/url"
 
 	"github.com/google/uuid"
 	"github.com/simplereach/timeutils"
@@ -40,7 +39,7 @@ func (ca *CustodiaAPIv1) CreateRepository(description string, isActive bool) (
 
 	// JSON: unmarshal resp content
 	repoEnvelope := RepositoryEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &repoEnvelope); err != nil {
+	if err := decodeJSON(resp, &repoEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -58,7 +57,7 @@ func (ca *CustodiaAPIv1) ReadRepository(repoId uuid.UUID) (*Repository,
 
 	// JSON: unmarshal resp content
 	repoEnvelope := RepositoryEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &repoEnvelope); err != nil {
+	if err := decodeJSON(resp, &repoEnvelope); err != nil {
 		return nil, err
 	}
 	return repoEnvelope.Repository, nil
@@ -79,7 +78,7 @@ func (ca *CustodiaAPIv1) UpdateRepository(repoId uuid.UUID, description string,
 
 	// JSON: unmarshal resp content overwriting the old repository
 	repoEnvelope := RepositoryEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &repoEnvelope); err != nil {
+	if err := decodeJSON(resp, &repoEnvelope); err != nil {
 		return nil, err
 	}
 	return repoEnvelope.Repository, nil
@@ -106,32 +105,30 @@ func (ca *CustodiaAPIv1) DeleteRepository(repoId uuid.UUID, force bool) (
 //   limit: int : maximum number of items to return in a single page
 func (ca *CustodiaAPIv1) ListRepositories(queryParams map[string]string) (
 	[]*Repository, error) {
-	u, err := url.Parse("/repositories")
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+	result, _, err := ca.listRepositories(queryParams)
+	return result, err
+}
 
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listRepositories(queryParams map[string]string) (
+	[]*Repository, PageInfo, error) {
 	reposEnvelope := RepositoriesEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &reposEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage("/repositories", queryParams, &reposEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
 
 	result := []*Repository{}
 	for _, repo := range reposEnvelope.Repositories {
 		result = append(result, &repo)
 	}
-	return result, nil
+	return result, page, nil
+}
+
+// IterRepositories returns a Pager over all the repositories
+func (ca *CustodiaAPIv1) IterRepositories(ctx context.Context,
+	pageSize int) *Pager[*Repository] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Repository,
+		PageInfo, error) {
+		return ca.listRepositories(pageParams(offset, limit))
+	})
 }
@@ -0,0 +1,553 @@
+package custodia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ParamRef is a parameter of a saved query, used in place of a filter
+// value and bound when the query is run
+type ParamRef struct {
+	name string
+}
+
+// Param returns a reference to the parameter name, e.g.
+// Field("age").Gte(Param("min_age"))
+func Param(name string) ParamRef {
+	return ParamRef{name: name}
+}
+
+// Name returns the name of the parameter
+func (p ParamRef) Name() string {
+	return p.name
+}
+
+// queryFilters returns the field filters of query, depth first
+func queryFilters(query Query) []*FieldFilter {
+	switch q := query.(type) {
+	case *FieldFilter:
+		return []*FieldFilter{q}
+	case *logicalQuery:
+		filters := []*FieldFilter{}
+		for _, child := range q.queries {
+			filters = append(filters, queryFilters(child)...)
+		}
+		return filters
+	case *notQuery:
+		return queryFilters(q.query)
+	}
+	return nil
+}
+
+// filterValues returns the values of a filter, which are many with 'in'
+// (any slice, e.g. []string)
+func filterValues(ff *FieldFilter) []any {
+	if ff.Op == OpIn && isSlice(ff.Value) {
+		values, _ := decodeArray(ff.Value)
+		return values
+	}
+	return []any{ff.Value}
+}
+
+// queryParamNames returns the sorted names of the parameters in query
+func queryParamNames(query Query) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, ff := range queryFilters(query) {
+		for _, value := range filterValues(ff) {
+			if ref, ok := value.(ParamRef); ok && !seen[ref.name] {
+				seen[ref.name] = true
+				names = append(names, ref.name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bindQuery returns a copy of query with the parameters replaced by values.
+// A list parameter of an 'in' filter is expanded to its items.
+func bindQuery(query Query, values map[string]any) Query {
+	switch q := query.(type) {
+	case *FieldFilter:
+		value := q.Value
+		if q.Op == OpIn {
+			items := []any{}
+			for _, item := range filterValues(q) {
+				ref, isParam := item.(ParamRef)
+				if !isParam {
+					items = append(items, item)
+				} else if bound := values[ref.name]; isSlice(bound) {
+					expanded, _ := decodeArray(bound)
+					items = append(items, expanded...)
+				} else {
+					items = append(items, bound)
+				}
+			}
+			value = items
+		} else if ref, isParam := value.(ParamRef); isParam {
+			value = values[ref.name]
+		}
+		return &FieldFilter{Field: q.Field, Op: q.Op, Value: value}
+	case *logicalQuery:
+		queries := []Query{}
+		for _, child := range q.queries {
+			queries = append(queries, bindQuery(child, values))
+		}
+		return &logicalQuery{op: q.op, queries: queries}
+	case *notQuery:
+		return &notQuery{query: bindQuery(q.query, values)}
+	}
+	panic(fmt.Sprintf("unhandled query type '%T'", query))
+}
+
+// QueryParam declares a parameter of a saved query. Parameters without a
+// default are required.
+type QueryParam struct {
+	Name string `json:"name"`
+	// Type is a field type (e.g. TypeInt). A list parameter (e.g.
+	// "array[integer]") can be the only value of an 'in' filter.
+	Type string `json:"type"`
+	Description string `json:"description,omitempty"`
+	Default any `json:"default,omitempty"`
+}
+
+// SavedQuery is a named search on the documents of a schema or on the
+// users of a user schema, with typed parameters
+type SavedQuery struct {
+	Name string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// SchemaId is the schema of the searched documents, UserSchemaId the
+	// user schema of the searched users: only one must be set
+	SchemaId uuid.UUID `json:"schema_id,omitempty"`
+	UserSchemaId uuid.UUID `json:"user_schema_id,omitempty"`
+	// ResultType defaults to FullContent
+	ResultType ResultType `json:"result_type,omitempty"`
+	Params []QueryParam `json:"params,omitempty"`
+	// Query uses Param for the parameters. In JSON, it's the search DSL
+	// with {"$param": "name"} values.
+	Query Query `json:"-"`
+	Sort []SortSpec `json:"sort,omitempty"`
+}
+
+func (sq *SavedQuery) UnmarshalJSON(data []byte) error {
+	type savedQuery SavedQuery
+	aux := struct {
+		*savedQuery
+		Query json.RawMessage `json:"query"`
+	}{savedQuery: (*savedQuery)(sq)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.Query) == 0 {
+		return fmt.Errorf("saved query '%s': missing query", sq.Name)
+	}
+
+	// numbers as json.Number, like the other decoded values
+	var dsl map[string]any
+	if err := decodeJSON(string(aux.Query), &dsl); err != nil {
+		return fmt.Errorf("saved query '%s': %w", sq.Name, err)
+	}
+	query, err := ParseQuery(dsl)
+	if err != nil {
+		return fmt.Errorf("saved query '%s': %w", sq.Name, err)
+	}
+	sq.Query = query
+	return nil
+}
+
+// String returns the signature and the description of the query, e.g.
+// "adults(min_age integer = 18): documents of <schema id>, the adults"
+func (sq *SavedQuery) String() string {
+	params := []string{}
+	for _, param := range sq.Params {
+		s := fmt.Sprintf("%s %s", param.Name, param.Type)
+		if param.Default != nil {
+			s += fmt.Sprintf(" = %v", jsonValue(param.Default))
+		}
+		params = append(params, s)
+	}
+	target := fmt.Sprintf("documents of %s", sq.SchemaId)
+	if sq.UserSchemaId != uuid.Nil {
+		target = fmt.Sprintf("users of %s", sq.UserSchemaId)
+	}
+	s := fmt.Sprintf("%s(%s): %s", sq.Name, strings.Join(params, ", "),
+		target)
+	if sq.Description != "" {
+		s += ", " + sq.Description
+	}
+	return s
+}
+
+// registeredQuery is a validated saved query, with its schema
+type registeredQuery struct {
+	saved SavedQuery
+	params map[string]QueryParam
+	schema *Schema
+	userSchema *UserSchema
+}
+
+// QueryRegistry is a catalogue of saved queries, validated against their
+// schema on registration. It's safe for concurrent use.
+type QueryRegistry struct {
+	ca *CustodiaAPIv1
+	mutex sync.RWMutex
+	queries map[string]*registeredQuery
+}
+
+// NewQueryRegistry returns an empty registry running the queries with ca
+func NewQueryRegistry(ca *CustodiaAPIv1) *QueryRegistry {
+	return &QueryRegistry{ca: ca, queries: map[string]*registeredQuery{}}
+}
+
+// Register validates sq against its schema (or user schema), which is read
+// from the API (once, then cached), and adds it to the registry
+func (r *QueryRegistry) Register(sq *SavedQuery) error {
+	if sq == nil {
+		return fmt.Errorf("saved query is nil")
+	}
+	if sq.SchemaId != uuid.Nil && sq.UserSchemaId != uuid.Nil {
+		return fmt.Errorf("saved query '%s': both schema and user schema " +
+			"set", sq.Name)
+	}
+	if sq.SchemaId != uuid.Nil {
+		schema, err := r.ca.cachedSchema(sq.SchemaId)
+		if err != nil {
+			return fmt.Errorf("saved query '%s': %w", sq.Name, err)
+		}
+		return r.RegisterWithSchema(sq, schema)
+	} else if sq.UserSchemaId != uuid.Nil {
+		userSchema, err := r.ca.cachedUserSchema(sq.UserSchemaId)
+		if err != nil {
+			return fmt.Errorf("saved query '%s': %w", sq.Name, err)
+		}
+		return r.RegisterWithSchema(sq, userSchema)
+	}
+	return fmt.Errorf("saved query '%s': no schema or user schema set",
+		sq.Name)
+}
+
+// RegisterWithSchema validates sq against schema, a *Schema or a
+// *UserSchema, and adds it to the registry. The schema (or user schema) id
+// of sq is set from schema when missing.
+func (r *QueryRegistry) RegisterWithSchema(sq *SavedQuery,
+	schema StructureMapper) error {
+	if sq == nil {
+		return fmt.Errorf("saved query is nil")
+	}
+	entry := &registeredQuery{saved: *sq}
+	saved := &entry.saved
+	switch s := schema.(type) {
+	case *Schema:
+		if saved.SchemaId == uuid.Nil {
+			saved.SchemaId = s.Id
+		}
+		if saved.SchemaId != s.Id || saved.UserSchemaId != uuid.Nil {
+			return fmt.Errorf("saved query '%s': schema %s doesn't match",
+				sq.Name, s.Id)
+		}
+		entry.schema = s
+	case *UserSchema:
+		if saved.UserSchemaId == uuid.Nil {
+			saved.UserSchemaId = s.Id
+		}
+		if saved.UserSchemaId != s.Id || saved.SchemaId != uuid.Nil {
+			return fmt.Errorf("saved query '%s': user schema %s doesn't " +
+				"match", sq.Name, s.Id)
+		}
+		entry.userSchema = s
+	default:
+		return fmt.Errorf("saved query '%s': expected a *Schema or a " +
+			"*UserSchema, got: %T", sq.Name, schema)
+	}
+	if saved.ResultType == 0 {
+		saved.ResultType = FullContent
+	}
+
+	params, err := checkSavedQuery(saved, schema)
+	if err != nil {
+		return fmt.Errorf("saved query '%s': %w", sq.Name, err)
+	}
+	entry.params = params
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.queries[saved.Name]; exists {
+		return fmt.Errorf("saved query '%s': already registered", sq.Name)
+	}
+	r.queries[saved.Name] = entry
+	return nil
+}
+
+// checkSavedQuery checks sq against the structure of schema, returning its
+// params (with converted defaults) by name
+func checkSavedQuery(sq *SavedQuery, schema StructureMapper) (
+	map[string]QueryParam, error) {
+	if sq.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if sq.Query == nil {
+		return nil, fmt.Errorf("query is nil")
+	}
+	structure := schema.getStructureAsMap()
+	// users can be searched by username too
+	if _, isUserSchema := schema.(*UserSchema); isUserSchema {
+		structure["username"] = SchemaField{Name: "username", Type: TypeStr,
+			Indexed: true}
+	}
+
+	var ee []error
+	params := map[string]QueryParam{}
+	for _, param := range sq.Params {
+		if _, exists := params[param.Name]; exists {
+			ee = append(ee, fmt.Errorf("parameter '%s': declared more than " +
+				"once", param.Name))
+			continue
+		}
+		if param.Name == "" || !isKnownType(param.Type) {
+			ee = append(ee, fmt.Errorf("parameter '%s': bad type '%s'",
+				param.Name, param.Type))
+			continue
+		}
+		if param.Default != nil {
+			converted, err := convertDefault(param.Default,
+				SchemaField{Name: param.Name, Type: param.Type})
+			if err != nil {
+				ee = append(ee, fmt.Errorf("parameter '%s': bad default: %w",
+					param.Name, err))
+				continue
+			}
+			param.Default = converted
+		}
+		params[param.Name] = param
+	}
+
+	ee = append(ee, sq.Query.check(structure)...)
+
+	// parameters must be declared, of the type of their fields
+	used := map[string]bool{}
+	for _, ff := range queryFilters(sq.Query) {
+		field, ok := structure[ff.Field]
+		if !ok {
+			continue  // already reported
+		}
+		expected := field.Type
+		if itemType, isArray := arrayItemType(field.Type); isArray {
+			expected = itemType
+		}
+		if ff.Op == OpIs {
+			expected = TypeBool
+		}
+
+		values := filterValues(ff)
+		for _, value := range values {
+			ref, isParam := value.(ParamRef)
+			if !isParam {
+				continue
+			}
+			used[ref.name] = true
+			param, declared := params[ref.name]
+			if !declared {
+				ee = append(ee, fmt.Errorf("field '%s': parameter '%s' not " +
+					"declared", ff.Field, ref.name))
+				continue
+			}
+			paramType := param.Type
+			// a list parameter is allowed as the only value of 'in'
+			if itemType, isList := arrayItemType(paramType); isList &&
+				ff.Op == OpIn && len(values) == 1 {
+				paramType = itemType
+			}
+			if !sameSearchType(paramType, expected) {
+				ee = append(ee, fmt.Errorf("field '%s': parameter '%s' of " +
+					"type '%s', expected '%s'", ff.Field, ref.name,
+					param.Type, expected))
+			}
+		}
+	}
+	for _, param := range sq.Params {
+		if !used[param.Name] {
+			ee = append(ee, fmt.Errorf("parameter '%s': not used",
+				param.Name))
+		}
+	}
+
+	if _, err := BuildSort(schema, sq.Sort...); err != nil {
+		ee = append(ee, err)
+	}
+	if len(ee) > 0 {
+		return nil, errors.Join(ee...)
+	}
+	return params, nil
+}
+
+// sameSearchType returns true if values of type a can be searched in
+// fields of type b: strings and texts are interchangeable
+func sameSearchType(a, b string) bool {
+	isString := func(t string) bool { return t == TypeStr || t == TypeText }
+	return a == b || (isString(a) && isString(b))
+}
+
+// Load decodes a saved query, or a list of them, in JSON from reader and
+// registers them (see Register). All the invalid queries are reported.
+func (r *QueryRegistry) Load(reader io.Reader) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	queries := []*SavedQuery{}
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &queries)
+	} else {
+		sq := &SavedQuery{}
+		err = json.Unmarshal(data, sq)
+		queries = append(queries, sq)
+	}
+	if err != nil {
+		return fmt.Errorf("error decoding saved queries: %w", err)
+	}
+
+	var ee []error
+	for _, sq := range queries {
+		if err := r.Register(sq); err != nil {
+			ee = append(ee, err)
+		}
+	}
+	return errors.Join(ee...)
+}
+
+// LoadFile loads the saved queries in the JSON file path (see Load)
+func (r *QueryRegistry) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := r.Load(file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Get returns the saved query name
+func (r *QueryRegistry) Get(name string) (*SavedQuery, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	entry, ok := r.queries[name]
+	if !ok {
+		return nil, false
+	}
+	saved := entry.saved
+	return &saved, true
+}
+
+// List returns all the saved queries, sorted by name
+func (r *QueryRegistry) List() []*SavedQuery {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	result := []*SavedQuery{}
+	for _, entry := range r.queries {
+		saved := entry.saved
+		result = append(result, &saved)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Unregister removes the saved query name
+func (r *QueryRegistry) Unregister(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.queries, name)
+}
+
+// lookup returns the saved query name with the search DSL of its query,
+// with params bound
+func (r *QueryRegistry) lookup(name string, params map[string]any) (
+	*registeredQuery, map[string]any, error) {
+	r.mutex.RLock()
+	entry, ok := r.queries[name]
+	r.mutex.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("saved query '%s' not found", name)
+	}
+
+	var ee []error
+	for key := range params {
+		if _, declared := entry.params[key]; !declared {
+			ee = append(ee, fmt.Errorf("parameter '%s': unknown", key))
+		}
+	}
+	values := map[string]any{}
+	for _, param := range entry.params {
+		value, given := params[param.Name]
+		if !given {
+			if param.Default == nil {
+				ee = append(ee, fmt.Errorf("parameter '%s': missing",
+					param.Name))
+			}
+			values[param.Name] = param.Default
+			continue
+		}
+		converted, err := convertDefault(value, SchemaField{Name: param.Name,
+			Type: param.Type})
+		if err != nil {
+			ee = append(ee, fmt.Errorf("parameter '%s': %w", param.Name, err))
+			continue
+		}
+		values[param.Name] = converted
+	}
+	if len(ee) > 0 {
+		return nil, nil, fmt.Errorf("saved query '%s': %w", name,
+			errors.Join(ee...))
+	}
+
+	// already checked on registration
+	query, err := BuildQuery(nil, bindQuery(entry.saved.Query, values))
+	if err != nil {
+		return nil, nil, fmt.Errorf("saved query '%s': %w", name, err)
+	}
+	return entry, query, nil
+}
+
+// Build returns the search DSL of the saved query name with params bound,
+// as accepted by SearchDocuments and SearchUsers
+func (r *QueryRegistry) Build(name string, params map[string]any) (
+	map[string]any, error) {
+	_, query, err := r.lookup(name, params)
+	return query, err
+}
+
+// Run runs the saved query name with params bound. Parameters are
+// converted to their types, e.g. "2024-01-31" for a date.
+// queryParams (optional):
+//   offset: int: number of items to skip from the beginning of the list
+//   limit: int : maximum number of items to return in a single page
+func (r *QueryRegistry) Run(name string, params map[string]any,
+	queryParams map[string]string) (*SearchResponse, error) {
+	entry, query, err := r.lookup(name, params)
+	if err != nil {
+		return nil, err
+	}
+	var sortSpecs any
+	if len(entry.saved.Sort) > 0 {
+		sortSpecs = entry.saved.Sort
+	}
+	if entry.userSchema != nil {
+		return r.ca.searchUsers(entry.saved.UserSchemaId, entry.userSchema,
+			entry.saved.ResultType, query, sortSpecs, queryParams)
+	}
+	return r.ca.searchDocuments(entry.saved.SchemaId, entry.schema,
+		entry.saved.ResultType, query, sortSpecs, queryParams)
+}
@@ -0,0 +1,238 @@
+package custodia
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestSavedQueryRegistration(t *testing.T) {
+	schema := &Schema{
+		Id: uuid.New(),
+		Structure: []SchemaField{
+			{Name: "age", Type: TypeInt, Indexed: true},
+			{Name: "name", Type: TypeStr, Indexed: true},
+			{Name: "born", Type: TypeDate, Indexed: true},
+			{Name: "tags", Type: TypeArrayStr, Indexed: true},
+			{Name: "active", Type: TypeBool, Indexed: true},
+		},
+	}
+	registry := NewQueryRegistry(nil)
+
+	adults := &SavedQuery{
+		Name: "adults",
+		Description: "the adults born after a date",
+		Params: []QueryParam{
+			{Name: "min_age", Type: TypeInt, Default: 18},
+			{Name: "born_after", Type: TypeDate},
+			{Name: "tags", Type: TypeArrayStr},
+		},
+		Query: And(Field("age").Gte(Param("min_age")),
+			Field("born").Gt(Param("born_after")),
+			Field("tags").In(Param("tags")),
+			Field("active").Is(true)),
+		Sort: []SortSpec{Field("age").Desc()},
+	}
+	if err := registry.RegisterWithSchema(adults, schema); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.RegisterWithSchema(adults, schema); err == nil ||
+		!strings.Contains(err.Error(), "already registered") {
+		t.Errorf("expected duplicate error, got: %v", err)
+	}
+
+	query, err := registry.Build("adults", map[string]any{
+		"born_after": "2000-01-31", "tags": []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := json.Marshal(query)
+	want := `{"and":[{"field":"age","type":"gte","value":18},` +
+		`{"field":"born","type":"gt","value":"2000-01-31"},` +
+		`{"field":"tags","type":"in","value":["a","b"]},` +
+		`{"field":"active","type":"is","value":true}]}`
+	if string(data) != want {
+		t.Errorf("bad query, got: %s want: %s", data, want)
+	}
+
+	saved, ok := registry.Get("adults")
+	wantDoc := fmt.Sprintf("adults(min_age integer = 18, born_after date, " +
+		"tags array[string]): documents of %s, the adults born after a date",
+		schema.Id)
+	if !ok || saved.String() != wantDoc || saved.ResultType != FullContent {
+		t.Errorf("bad saved query: %v", saved)
+	}
+
+	// binding errors
+	var bindTests = []struct {
+		params map[string]any
+		want string
+	}{
+		{map[string]any{"tags": []string{"a"}}, "'born_after': missing"},
+		{map[string]any{"born_after": "2000-02-30", "tags": []string{"a"}},
+			"'born_after'"},
+		{map[string]any{"born_after": "2000-01-01", "tags": []string{"a"},
+			"other": 1}, "'other': unknown"},
+	}
+	for i, test := range bindTests {
+		_, err := registry.Build("adults", test.params)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("bind %d: expected '%s', got: %v", i, test.want, err)
+		}
+	}
+	if _, err := registry.Build("missing", nil); err == nil {
+		t.Errorf("expected error for missing query")
+	}
+
+	// validation errors
+	var errorTests = []struct {
+		sq *SavedQuery
+		want string
+	}{
+		{&SavedQuery{Name: "q", Query: Field("age").Eq(Param("x"))},
+			"parameter 'x' not declared"},
+		{&SavedQuery{Name: "q", Params: []QueryParam{{Name: "x",
+			Type: TypeStr}}, Query: Field("age").Eq(Param("x"))},
+			"parameter 'x' of type 'string', expected 'integer'"},
+		{&SavedQuery{Name: "q", Params: []QueryParam{{Name: "x",
+			Type: TypeInt}, {Name: "y", Type: TypeInt}},
+			Query: Field("age").Eq(Param("x"))}, "'y': not used"},
+		{&SavedQuery{Name: "q", Params: []QueryParam{{Name: "x",
+			Type: "money"}}, Query: Field("age").Eq(Param("x"))},
+			"bad type 'money'"},
+		{&SavedQuery{Name: "q", Params: []QueryParam{{Name: "x",
+			Type: TypeArrayInt}}, Query: Field("age").Eq(Param("x"))},
+			"expected 'integer'"},
+		{&SavedQuery{Name: "q", Params: []QueryParam{{Name: "x",
+			Type: TypeDate, Default: "nope"}},
+			Query: Field("born").Eq(Param("x"))}, "bad default"},
+		{&SavedQuery{Name: "q", Query: Field("missing").Eq(1)},
+			"not defined in structure"},
+		{&SavedQuery{Name: "q", Query: Field("age").Eq(1),
+			Sort: []SortSpec{Field("tags").Asc()}}, "can't be sorted"},
+		{&SavedQuery{Name: "q", SchemaId: uuid.New(),
+			Query: Field("age").Eq(1)}, "doesn't match"},
+		{&SavedQuery{Query: Field("age").Eq(1)}, "missing name"},
+	}
+	for i, test := range errorTests {
+		err := registry.RegisterWithSchema(test.sq, schema)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("error %d: expected '%s', got: %v", i, test.want, err)
+		}
+	}
+	if len(registry.List()) != 1 {
+		t.Errorf("invalid queries were registered: %v", registry.List())
+	}
+}
+
+func TestSavedQueryRun(t *testing.T) {
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	schemaId, userSchemaId := uuid.New(), uuid.New()
+	var body map[string]any
+	var searchPath string
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		var response map[string]any
+		if r.URL.Path == fmt.Sprintf("/api/v1/schemas/%s", schemaId) {
+			response = map[string]any{"schema": map[string]any{
+				"schema_id": schemaId.String(),
+				"structure": []any{map[string]any{"name": "age",
+					"type": "integer", "indexed": true}},
+			}}
+		} else if r.URL.Path == fmt.Sprintf("/api/v1/user_schemas/%s",
+			userSchemaId) {
+			response = map[string]any{"user_schema": map[string]any{
+				"user_schema_id": userSchemaId.String(),
+				"structure": []any{},
+			}}
+		} else if strings.HasPrefix(r.URL.Path, "/api/v1/search/") {
+			searchPath = r.URL.Path
+			body = map[string]any{}
+			json.NewDecoder(r.Body).Decode(&body)
+			response = map[string]any{"count": 3}
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(response)
+		envelope.Data = data
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	registry := NewQueryRegistry(custodia)
+
+	file := filepath.Join(t.TempDir(), "queries.json")
+	os.WriteFile(file, []byte(fmt.Sprintf(`[
+		{"name": "older_than", "schema_id": "%s", "result_type": "COUNT",
+		 "params": [{"name": "age", "type": "integer"}],
+		 "query": {"field": "age", "type": "gt", "value": {"$param": "age"}}},
+		{"name": "by_username", "user_schema_id": "%s",
+		 "params": [{"name": "names", "type": "array[string]"}],
+		 "query": {"field": "username", "type": "in",
+		           "value": {"$param": "names"}}}
+	]`, schemaId, userSchemaId)), 0644)
+	if err := registry.LoadFile(file); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names := []string{}
+	for _, sq := range registry.List() {
+		names = append(names, sq.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"by_username", "older_than"}) {
+		t.Errorf("bad list: %v", names)
+	}
+
+	resp, err := registry.Run("older_than", map[string]any{"age": 40}, nil)
+	if err != nil || resp.Count != 3 {
+		t.Fatalf("run: got %v, %v", resp, err)
+	}
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{fmt.Sprintf("/api/v1/search/documents/%s", schemaId), searchPath},
+		{"COUNT", body["result_type"]},
+		{map[string]any{"field": "age", "type": "gt", "value": float64(40)},
+			body["query"]},
+	}
+	_, err = registry.Run("by_username", map[string]any{
+		"names": []any{"jdoe", "mrossi"}}, nil)
+	if err != nil {
+		t.Fatalf("run: unexpected error: %v", err)
+	}
+	tests = append(tests, []struct {
+		want any
+		got any
+	}{
+		{fmt.Sprintf("/api/v1/search/users/%s", userSchemaId), searchPath},
+		{map[string]any{"field": "username", "type": "in",
+			"value": []any{"jdoe", "mrossi"}}, body["query"]},
+	}...)
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	// invalid file content
+	err = registry.Load(strings.NewReader(`{"name": "broken"}`))
+	if err == nil || !strings.Contains(err.Error(), "missing query") {
+		t.Errorf("expected missing query error, got: %v", err)
+	}
+}
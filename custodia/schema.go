@@ -1,9 +1,8 @@
 package custodia
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/url"
 
 	"github.com/google/uuid"
 	"github.com/simplereach/timeutils"
@@ -16,6 +15,7 @@ type SchemaField struct {
 	Indexed bool `json:"indexed,omitempty"`
 	Default any `json:"default,omitempty"`
 	Insensitive bool `json:"insensitive,omitempty"`
+	Constraints *FieldConstraints `json:"-"`  // client-side only
 }
 
 type Schema struct {
@@ -26,6 +26,7 @@ type Schema struct {
 	LastUpdate timeutils.Time `json:"last_update,omitempty"`
 	IsActive bool `json:"is_active"`
 	Structure []SchemaField `json:"structure"`
+	Rules []CrossFieldRule `json:"-"`  // client-side only
 }
 
 type SchemaEnvelope struct {
@@ -37,17 +38,18 @@ type SchemasEnvelope struct {
 }
 
 // adjustDefaultType fixes the automatic interface-to-type conversion done
-// by json.Unmarshal to the desired type (e.g. json int values are
-// automatically decoded to float64 and we want int instead)
+// by json.Unmarshal to the type expected in contents (e.g. json int values
+// are automatically decoded to float64 and we want int64 instead, dates are
+// strings and we want time.Time). Unknown types and values which can't be
+// converted are left untouched.
 func (f *SchemaField) adjustDefaultType() {
-	if f.Default == nil {
+	if f.Default == nil || !isKnownType(f.Type) {
 		return
 	}
 
-	switch f.Type {
-	case "integer":
-		floatVal, _ := f.Default.(float64)
-		f.Default = int(floatVal)
+	converted, err := convertDefault(f.Default, *f)
+	if err == nil {
+		f.Default = converted
 	}
 }
 
@@ -75,7 +77,7 @@ func (ca *CustodiaAPIv1) CreateSchema(repoId uuid.UUID, descritpion string,
 
 	// JSON: unmarshal resp content
 	schemaEnvelope := SchemaEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &schemaEnvelope); err != nil {
+	if err := decodeJSON(resp, &schemaEnvelope); err != nil {
 		return nil, err
 	}
 	schemaEnvelope.Schema.adjustDefaultTypes()
@@ -93,7 +95,7 @@ func (ca *CustodiaAPIv1) ReadSchema(schemaId uuid.UUID) (*Schema, error) {
 
 	// JSON: unmarshal resp content
 	schemaEnvelope := SchemaEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &schemaEnvelope); err != nil {
+	if err := decodeJSON(resp, &schemaEnvelope); err != nil {
 		return nil, err
 	}
 	schemaEnvelope.Schema.adjustDefaultTypes()
@@ -118,10 +120,11 @@ func (ca *CustodiaAPIv1) UpdateSchema(schemaId uuid.UUID, description string,
 		if err != nil {
 			return nil, err
 		}
+		ca.schemaCache.Delete(schemaId)
 
 		// JSON: unmarshal resp content and return new schema
 		schemaEnvelope := SchemaEnvelope{}
-		if err := json.Unmarshal([]byte(resp), &schemaEnvelope); err != nil {
+		if err := decodeJSON(resp, &schemaEnvelope); err != nil {
 			return nil, err
 		}
 		schemaEnvelope.Schema.adjustDefaultTypes()
@@ -148,6 +151,7 @@ func (ca *CustodiaAPIv1) DeleteSchema(schemaId uuid.UUID, force bool,
 	if err != nil {
 		return err
 	}
+	ca.schemaCache.Delete(schemaId)
 	return nil
 }
 
@@ -158,27 +162,17 @@ func (ca *CustodiaAPIv1) DeleteSchema(schemaId uuid.UUID, force bool,
 func (ca *CustodiaAPIv1) ListSchemas(repoId uuid.UUID,
 	queryParams map[string]string) ([]*Schema, error,
 ) {
-	u, err := url.Parse(fmt.Sprintf("/repositories/%s/schemas", repoId))
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+	result, _, err := ca.listSchemas(repoId, queryParams)
+	return result, err
+}
 
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listSchemas(repoId uuid.UUID,
+	queryParams map[string]string) ([]*Schema, PageInfo, error) {
 	schemasEnvelope := SchemasEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &schemasEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage(fmt.Sprintf("/repositories/%s/schemas", repoId),
+		queryParams, &schemasEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
 
 	result := []*Schema{}
@@ -187,7 +181,16 @@ func (ca *CustodiaAPIv1) ListSchemas(repoId uuid.UUID,
 		schema.adjustDefaultTypes()
 	}
 
-	return result, nil
+	return result, page, nil
+}
+
+// IterSchemas returns a Pager over all the schemas of a repository
+func (ca *CustodiaAPIv1) IterSchemas(ctx context.Context, repoId uuid.UUID,
+	pageSize int) *Pager[*Schema] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Schema,
+		PageInfo, error) {
+		return ca.listSchemas(repoId, pageParams(offset, limit))
+	})
 }
 
 // getStructureAsMap returns the list of fields in a map using the Name
@@ -199,3 +202,8 @@ func (s *Schema) getStructureAsMap() map[string]SchemaField {
 	}
 	return result
 }
+
+// getRules returns the client-side cross-field rules of the schema
+func (s *Schema) getRules() []CrossFieldRule {
+	return s.Rules
+}
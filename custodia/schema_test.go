@@ -188,7 +188,7 @@ func TestSchemaCRUDL(t *testing.T) {
             {"IntField", schema.Structure[0].Name},
             {"integer", schema.Structure[0].Type},
             {true, schema.Structure[0].Indexed},
-            {42, schema.Structure[0].Default},
+            {int64(42), schema.Structure[0].Default},
             {"StrField", schema.Structure[1].Name},
             {"string", schema.Structure[1].Type},
             {"asd", schema.Structure[1].Default},
@@ -237,7 +237,7 @@ func TestSchemaCRUDL(t *testing.T) {
             {"IntField", schema.Structure[0].Name},
             {"integer", schema.Structure[0].Type},
             {true, schema.Structure[0].Indexed},
-            {42, schema.Structure[0].Default},
+            {int64(42), schema.Structure[0].Default},
             {"StrField", schema.Structure[1].Name},
             {"string", schema.Structure[1].Type},
             {"asd", schema.Structure[1].Default},
@@ -288,7 +288,7 @@ func TestSchemaCRUDL(t *testing.T) {
             {"IntField", schema.Structure[0].Name},
             {"integer", schema.Structure[0].Type},
             {true, schema.Structure[0].Indexed},
-            {42, schema.Structure[0].Default},
+            {int64(42), schema.Structure[0].Default},
             {"StrField", schema.Structure[1].Name},
             {"string", schema.Structure[1].Type},
             {"asd", schema.Structure[1].Default},
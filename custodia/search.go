@@ -1,7 +1,9 @@
 package custodia
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 
@@ -11,6 +13,10 @@ import (
 type SearchResponse struct {
 	Documents []*Document `json:"documents,omitempty"`
 	Users []*User `json:"users,omitempty"`
+	// Ids is set with result type OnlyId
+	Ids []uuid.UUID `json:"IDs,omitempty"`
+	// Exists is set with result types Exists and UsernameExists
+	Exists bool `json:"exists,omitempty"`
 	Count int `json:"count"`
 	TotalCount int `json:"total_count"`
 	Limit int `json:"limit"`
@@ -56,15 +62,106 @@ func (rt* ResultType) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// cachedSchema returns the schema schemaId, reading it only the first time
+func (ca *CustodiaAPIv1) cachedSchema(schemaId uuid.UUID) (*Schema, error) {
+	if schema, ok := ca.schemaCache.Load(schemaId); ok {
+		return schema.(*Schema), nil
+	}
+	schema, err := ca.ReadSchema(schemaId)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema %s: %w", schemaId, err)
+	}
+	ca.schemaCache.Store(schemaId, schema)
+	return schema, nil
+}
+
+// cachedUserSchema returns the user schema userSchemaId, reading it only the
+// first time
+func (ca *CustodiaAPIv1) cachedUserSchema(userSchemaId uuid.UUID) (
+	*UserSchema, error) {
+	if userSchema, ok := ca.userSchemaCache.Load(userSchemaId); ok {
+		return userSchema.(*UserSchema), nil
+	}
+	userSchema, err := ca.ReadUserSchema(userSchemaId)
+	if err != nil {
+		return nil, fmt.Errorf("error reading user schema %s: %w",
+			userSchemaId, err)
+	}
+	ca.userSchemaCache.Store(userSchemaId, userSchema)
+	return userSchema, nil
+}
+
+// ClearSchemaCache forgets the schemas and user schemas read to convert
+// the search results. Schemas updated or deleted with this client are
+// already removed from the cache.
+func (ca *CustodiaAPIv1) ClearSchemaCache() {
+	ca.schemaCache.Range(func(key, _ any) bool {
+		ca.schemaCache.Delete(key)
+		return true
+	})
+	ca.userSchemaCache.Range(func(key, _ any) bool {
+		ca.userSchemaCache.Delete(key)
+		return true
+	})
+}
+
+// search sends a search request to path and decodes the response
+func (ca *CustodiaAPIv1) search(path string, resultType ResultType,
+	query map[string]any, sort any) (*SearchResponse, error) {
+	data := map[string]any{"result_type": resultType.String(),
+		"query": query}
+	if sort != nil {
+		data["sort"] = sort
+	}
+	params := map[string]any{"_data": data}
+	resp, err := ca.Call("POST", path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON: unmarshal resp content
+	searchResponse := &SearchResponse{}
+	if err := decodeJSON(resp, searchResponse); err != nil {
+		return nil, err
+	}
+	return searchResponse, nil
+}
+
 // Search documents
+// query is the search DSL, see BuildQuery to build it from a Query.
+// sort (optional) is a []SortSpec (see BuildSort) or the raw sort DSL.
+// With FullContent, the contents are converted with the schema, which is
+// read (once, then cached) when needed. Use SearchDocumentsWithSchema if
+// the schema is already at hand.
 // queryParams (optional):
 //   offset: int: number of items to skip from the beginning of the list
 //   limit: int : maximum number of items to return in a single page
 func (ca *CustodiaAPIv1) SearchDocuments(schemaId uuid.UUID,
 	resultType ResultType, query map[string]any,
-	sort map[string]any, queryParams map[string]string) (
+	sort any, queryParams map[string]string) (
 		*SearchResponse, error,
 ) {
+	return ca.searchDocuments(schemaId, nil, resultType, query, sort,
+		queryParams)
+}
+
+// Search documents, converting the contents with schema
+// Arguments are as in SearchDocuments
+func (ca *CustodiaAPIv1) SearchDocumentsWithSchema(schema *Schema,
+	resultType ResultType, query map[string]any,
+	sort any, queryParams map[string]string) (
+		*SearchResponse, error,
+) {
+	if schema == nil {
+		return nil, fmt.Errorf("schema is nil")
+	}
+	return ca.searchDocuments(schema.Id, schema, resultType, query, sort,
+		queryParams)
+}
+
+func (ca *CustodiaAPIv1) searchDocuments(schemaId uuid.UUID, schema *Schema,
+	resultType ResultType, query map[string]any, sort any,
+	queryParams map[string]string) (*SearchResponse, error) {
 	u, err := url.Parse(fmt.Sprintf("/search/documents/%s", schemaId))
 	if err != nil {
 		return nil, fmt.Errorf("error parsing url: %v", err)
@@ -77,53 +174,234 @@ func (ca *CustodiaAPIv1) SearchDocuments(schemaId uuid.UUID,
 	}
 	u.RawQuery = q.Encode()
 
-	// Handling POST data
-	data := map[string]any{"result_type": resultType.String(),
-		"query": query}
-	if sort != nil {
-		data["sort"] = sort
+	if ca.SearchRecorder != nil {
+		ca.SearchRecorder.record(searchTarget{id: schemaId, users: false}, query,
+			sort)
 	}
-	params := map[string]any{"_data": true}
-	resp, err := ca.Call("POST", u.String(), params)
+	searchResponse, err := ca.search(u.String(), resultType, query, sort)
 	if err != nil {
 		return nil, err
 	}
-
-	// JSON: unmarshal resp content
-	searchResponse := &SearchResponse{}
-	if err := json.Unmarshal([]byte(resp), searchResponse); err != nil {
-		return nil, err
+	if resultType != FullContent || len(searchResponse.Documents) == 0 {
+		return searchResponse, nil
 	}
 
-	// FIXME: golang unmarshals returns always float64 for numbers
-	//   dunno if let the user do this, or force convertion of the
-	//   underlying type in SearchDocuments (but we need the schema!)
-	//   Check `ReadDocument` for more (there we apply conversion)
-
+	// convert values to concrete types, as in ReadDocument
+	if schema == nil {
+		schema, err = ca.cachedSchema(schemaId)
+		if err != nil {
+			return searchResponse, err
+		}
+	}
+	ee := []error{}
+	for _, doc := range searchResponse.Documents {
+		converted, errs := convertData(doc.Content, schema)
+		if len(errs) > 0 {
+			ee = append(ee, fmt.Errorf("document %s: %w", doc.Id,
+				errors.Join(errs...)))
+			continue
+		}
+		doc.Content = converted
+	}
+	if len(ee) > 0 {
+		err := fmt.Errorf("conversion errors: %w", errors.Join(ee...))
+		return searchResponse, err
+	}
 	return searchResponse, nil
 }
 
 // Search users
+// query and sort are as in SearchDocuments. With FullContent, the
+// attributes are converted with the user schema, read (once, then cached)
+// when needed.
 func (ca *CustodiaAPIv1) SearchUsers(userSchemaId uuid.UUID,
 	resultType ResultType, query map[string]any,
-	sort map[string]any) (*SearchResponse, error) {
-	url := fmt.Sprintf("/search/users/%s", userSchemaId)
-	data := map[string]any{"result_type": resultType.String(),
-		"query": query}
-	if sort != nil {
-		data["sort"] = sort
+	sort any) (*SearchResponse, error) {
+	return ca.searchUsers(userSchemaId, nil, resultType, query, sort, nil)
+}
+
+// Search users, converting the attributes with userSchema
+func (ca *CustodiaAPIv1) SearchUsersWithSchema(userSchema *UserSchema,
+	resultType ResultType, query map[string]any,
+	sort any) (*SearchResponse, error) {
+	if userSchema == nil {
+		return nil, fmt.Errorf("user schema is nil")
 	}
-	params := map[string]any{"_data": data}
-	resp, err := ca.Call("POST", url, params)
+	return ca.searchUsers(userSchema.Id, userSchema, resultType, query, sort,
+		nil)
+}
+
+func (ca *CustodiaAPIv1) searchUsers(userSchemaId uuid.UUID,
+	userSchema *UserSchema, resultType ResultType, query map[string]any,
+	sort any, queryParams map[string]string) (*SearchResponse, error) {
+	u, err := url.Parse(fmt.Sprintf("/search/users/%s", userSchemaId))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error parsing url: %v", err)
 	}
 
-	// JSON: unmarshal resp content
-	searchResponse := &SearchResponse{}
-	if err := json.Unmarshal([]byte(resp), searchResponse); err != nil {
+	// Adding query params
+	q := u.Query()
+	for k, v := range queryParams {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+
+	if ca.SearchRecorder != nil {
+		ca.SearchRecorder.record(searchTarget{id: userSchemaId, users: true}, query,
+			sort)
+	}
+	searchResponse, err := ca.search(u.String(), resultType, query, sort)
+	if err != nil {
 		return nil, err
 	}
+	if resultType != FullContent || len(searchResponse.Users) == 0 {
+		return searchResponse, nil
+	}
 
+	// convert values to concrete types, as in ReadUser
+	if userSchema == nil {
+		userSchema, err = ca.cachedUserSchema(userSchemaId)
+		if err != nil {
+			return searchResponse, err
+		}
+	}
+	ee := []error{}
+	for _, user := range searchResponse.Users {
+		converted, errs := convertData(user.Attributes, userSchema)
+		if len(errs) > 0 {
+			ee = append(ee, fmt.Errorf("user %s: %w", user.Id,
+				errors.Join(errs...)))
+			continue
+		}
+		user.Attributes = converted
+	}
+	if len(ee) > 0 {
+		err := fmt.Errorf("conversion errors: %w", errors.Join(ee...))
+		return searchResponse, err
+	}
 	return searchResponse, nil
 }
+
+// Page returns the pagination info of the response
+func (sr *SearchResponse) Page() PageInfo {
+	return PageInfo{Count: sr.Count, TotalCount: sr.TotalCount,
+		Limit: sr.Limit, Offset: sr.Offset}
+}
+
+// IterSearchDocuments returns a Pager over all the documents matching
+// query. resultType must be FullContent or NoContent, the other arguments
+// are as in SearchDocuments.
+func (ca *CustodiaAPIv1) IterSearchDocuments(ctx context.Context,
+	schemaId uuid.UUID, resultType ResultType, query map[string]any,
+	sort any, pageSize int) *Pager[*Document] {
+	if resultType != FullContent && resultType != NoContent {
+		return errPager[*Document](fmt.Errorf("result type %s can't be " +
+			"paginated", resultType))
+	}
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*Document,
+		PageInfo, error) {
+		resp, err := ca.searchDocuments(schemaId, nil, resultType, query,
+			sort, pageParams(offset, limit))
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		return resp.Documents, resp.Page(), nil
+	})
+}
+
+// IterSearchUsers returns a Pager over all the users matching query.
+// resultType must be FullContent or NoContent, the other arguments are as
+// in SearchUsers.
+func (ca *CustodiaAPIv1) IterSearchUsers(ctx context.Context,
+	userSchemaId uuid.UUID, resultType ResultType, query map[string]any,
+	sort any, pageSize int) *Pager[*User] {
+	if resultType != FullContent && resultType != NoContent {
+		return errPager[*User](fmt.Errorf("result type %s can't be " +
+			"paginated", resultType))
+	}
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*User,
+		PageInfo, error) {
+		resp, err := ca.searchUsers(userSchemaId, nil, resultType, query,
+			sort, pageParams(offset, limit))
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		return resp.Users, resp.Page(), nil
+	})
+}
+
+// CountDocuments returns the number of documents matching query
+func (ca *CustodiaAPIv1) CountDocuments(schemaId uuid.UUID,
+	query map[string]any) (int, error) {
+	resp, err := ca.SearchDocuments(schemaId, Count, query, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// DocumentsExist returns true if at least one document matches query
+func (ca *CustodiaAPIv1) DocumentsExist(schemaId uuid.UUID,
+	query map[string]any) (bool, error) {
+	resp, err := ca.SearchDocuments(schemaId, Exists, query, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	return resp.Exists, nil
+}
+
+// SearchDocumentIds returns the ids of the documents matching query
+// sort and queryParams are as in SearchDocuments
+func (ca *CustodiaAPIv1) SearchDocumentIds(schemaId uuid.UUID,
+	query map[string]any, sort any, queryParams map[string]string) (
+	[]uuid.UUID, error) {
+	resp, err := ca.SearchDocuments(schemaId, OnlyId, query, sort,
+		queryParams)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ids, nil
+}
+
+// CountUsers returns the number of users matching query
+func (ca *CustodiaAPIv1) CountUsers(userSchemaId uuid.UUID,
+	query map[string]any) (int, error) {
+	resp, err := ca.SearchUsers(userSchemaId, Count, query, nil)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// UsersExist returns true if at least one user matches query
+func (ca *CustodiaAPIv1) UsersExist(userSchemaId uuid.UUID,
+	query map[string]any) (bool, error) {
+	resp, err := ca.SearchUsers(userSchemaId, Exists, query, nil)
+	if err != nil {
+		return false, err
+	}
+	return resp.Exists, nil
+}
+
+// SearchUserIds returns the ids of the users matching query
+func (ca *CustodiaAPIv1) SearchUserIds(userSchemaId uuid.UUID,
+	query map[string]any, sort any) ([]uuid.UUID, error) {
+	resp, err := ca.SearchUsers(userSchemaId, OnlyId, query, sort)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ids, nil
+}
+
+// UsernameExists returns true if username is already taken in the user
+// schema
+func (ca *CustodiaAPIv1) UsernameExists(userSchemaId uuid.UUID,
+	username string) (bool, error) {
+	query := map[string]any{"field": "username", "type": OpEq,
+		"value": username}
+	resp, err := ca.SearchUsers(userSchemaId, UsernameExists, query, nil)
+	if err != nil {
+		return false, err
+	}
+	return resp.Exists, nil
+}
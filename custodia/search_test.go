@@ -58,11 +58,66 @@ func TestSearch(t *testing.T) {
 		"offset": 0,
 	}
 
+	// schemas used to convert the results
+	schemaResponse := map[string]any{
+		"schema": map[string]any{
+			"schema_id": dummyUUID.String(),
+			"description": "unittest",
+			"is_active": true,
+			"structure": []any{
+				map[string]any{"name": "antani", "type": "integer",
+					"indexed": true},
+			},
+		},
+	}
+	userSchemaResponse := map[string]any{
+		"user_schema": map[string]any{
+			"user_schema_id": dummyUUID.String(),
+			"description": "unittest",
+			"is_active": true,
+			"structure": []any{
+				map[string]any{"name": "antani", "type": "float",
+					"indexed": true},
+			},
+		},
+	}
+	schemaReads := 0
+	body := map[string]any{}
+
 	mockHandler := func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == fmt.Sprintf(
+		if r.URL.Path == fmt.Sprintf("/api/v1/schemas/%s", dummyUUID) &&
+			r.Method == "GET" {
+			schemaReads++
+			data, _ := json.Marshal(schemaResponse)
+			envelope.Data = data
+			out, _ := json.Marshal(envelope)
+			w.WriteHeader(http.StatusOK)
+			w.Write(out)
+		} else if r.URL.Path == fmt.Sprintf("/api/v1/user_schemas/%s",
+			dummyUUID) && r.Method == "GET" {
+			schemaReads++
+			data, _ := json.Marshal(userSchemaResponse)
+			envelope.Data = data
+			out, _ := json.Marshal(envelope)
+			w.WriteHeader(http.StatusOK)
+			w.Write(out)
+		} else if r.URL.Path == fmt.Sprintf(
 			"/api/v1/search/documents/%s", dummyUUID,
 		) && r.Method == "POST" {
-			data, _ := json.Marshal(docsResponse)
+			body = map[string]any{}
+			json.NewDecoder(r.Body).Decode(&body)
+			response := docsResponse
+			switch body["result_type"] {
+			case "COUNT":
+				response = map[string]any{"count": 7}
+			case "EXISTS":
+				response = map[string]any{"exists": true}
+			case "ONLY_ID":
+				response = map[string]any{"IDs": []string{
+					dummyUUID.String()}, "count": 1, "total_count": 1,
+					"limit": 10, "offset": 0}
+			}
+			data, _ := json.Marshal(response)
 			envelope.Data = data
 			out, _ := json.Marshal(envelope)
 			w.WriteHeader(http.StatusOK)
@@ -70,7 +125,13 @@ func TestSearch(t *testing.T) {
 		} else if r.URL.Path == fmt.Sprintf(
 			"/api/v1/search/users/%s", dummyUUID,
 		) && r.Method == "POST" {
-			data, _ := json.Marshal(usersResponse)
+			body = map[string]any{}
+			json.NewDecoder(r.Body).Decode(&body)
+			response := usersResponse
+			if body["result_type"] == "USERNAME_EXISTS" {
+				response = map[string]any{"exists": false}
+			}
+			data, _ := json.Marshal(response)
 			envelope.Data = data
 			out, _ := json.Marshal(envelope)
 			w.WriteHeader(http.StatusOK)
@@ -131,10 +192,8 @@ func TestSearch(t *testing.T) {
 			{2015, resp.Documents[0].LastUpdate.Year()},
 			{3, int(resp.Documents[0].LastUpdate.Month())},
 			{13, resp.Documents[0].LastUpdate.Day()},
-			// FIXME: golang unmarshals returns always float64 (not ints)
-			//   dunno if let the user do this, or force convertion of the
-			//   underlying type in SearchDocuments (but we need the schema!)
-			{42.0, resp.Documents[0].Content["antani"].(float64)},
+			// content is converted with the schema
+			{int64(42), resp.Documents[0].Content["antani"]},
 		}
 
 		for i, test := range tests {
@@ -176,7 +235,7 @@ func TestSearch(t *testing.T) {
 			{2015, resp.Users[0].LastUpdate.Year()},
 			{3, int(resp.Users[0].LastUpdate.Month())},
 			{13, resp.Users[0].LastUpdate.Day()},
-			{3.14, resp.Users[0].Attributes["antani"].(float64)},
+			{3.14, resp.Users[0].Attributes["antani"]},
 		}
 
 		for i, test := range tests {
@@ -186,4 +245,64 @@ func TestSearch(t *testing.T) {
 			}
 		}
 	}
+
+	// schemas are read once, then cached
+	custodia.SearchDocuments(dummyUUID, FullContent, query, nil, nil)
+	if schemaReads != 2 {
+		t.Errorf("expected 2 schema reads, got %d", schemaReads)
+	}
+	custodia.ClearSchemaCache()
+	custodia.SearchDocuments(dummyUUID, FullContent, query, nil, nil)
+	if schemaReads != 3 {
+		t.Errorf("expected 3 schema reads, got %d", schemaReads)
+	}
+
+	// a given schema is used as is
+	schema := &Schema{Id: dummyUUID, Structure: []SchemaField{
+		{Name: "antani", Type: TypeFloat}}}
+	resp, err = custodia.SearchDocumentsWithSchema(schema, FullContent, query,
+		nil, nil)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if resp.Documents[0].Content["antani"] != float64(42) {
+		t.Errorf("SearchDocumentsWithSchema: bad value %#v",
+			resp.Documents[0].Content["antani"])
+	}
+
+	// conversion errors are reported, raw values are kept
+	schema.Structure = []SchemaField{{Name: "antani", Type: TypeBool}}
+	resp, err = custodia.SearchDocumentsWithSchema(schema, FullContent, query,
+		nil, nil)
+	if err == nil {
+		t.Errorf("expected conversion error")
+	} else if resp.Documents[0].Content["antani"] != json.Number("42") {
+		t.Errorf("expected raw value, got %#v",
+			resp.Documents[0].Content["antani"])
+	}
+
+	// result type helpers
+	count, err := custodia.CountDocuments(dummyUUID, query)
+	if err != nil || count != 7 {
+		t.Errorf("CountDocuments: got %d, %v", count, err)
+	}
+	exists, err := custodia.DocumentsExist(dummyUUID, query)
+	if err != nil || !exists {
+		t.Errorf("DocumentsExist: got %v, %v", exists, err)
+	}
+	ids, err := custodia.SearchDocumentIds(dummyUUID, query, nil, nil)
+	if err != nil || !reflect.DeepEqual(ids, []uuid.UUID{dummyUUID}) {
+		t.Errorf("SearchDocumentIds: got %v, %v", ids, err)
+	}
+	exists, err = custodia.UsernameExists(dummyUUID, "unittest")
+	if err != nil || exists {
+		t.Errorf("UsernameExists: got %v, %v", exists, err)
+	}
+	want := map[string]any{"field": "username", "type": "eq",
+		"value": "unittest"}
+	if !reflect.DeepEqual(body["query"], want) {
+		t.Errorf("UsernameExists: bad query %v", body["query"])
+	}
+	if schemaReads != 3 {
+		t.Errorf("helpers should not read schemas, got %d", schemaReads)
+	}
 }
@@ -0,0 +1,313 @@
+package custodia
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultBatchSize is the maximum number of events in a batch of Forward
+// when not given
+const DefaultBatchSize = 100
+
+// SignatureHeader is the header of the HMAC-SHA256 signature of the
+// WebhookSink requests, as "sha256=<hex digest of the body>"
+const SignatureHeader = "X-Custodia-Signature"
+
+// Sink is a destination of change events
+type Sink interface {
+	// Write delivers a batch of events, returning when they are stored (or
+	// acknowledged) by the destination. On errors the whole batch is
+	// delivered again, so destinations may receive duplicates.
+	Write(ctx context.Context, events []ChangeEvent) error
+	Close() error
+}
+
+// WriterSink writes each event as a JSON line (NDJSON) to W
+type WriterSink struct {
+	W io.Writer
+	mutex sync.Mutex
+}
+
+// NewStdoutSink returns a WriterSink on the standard output
+func NewStdoutSink() *WriterSink {
+	return &WriterSink{W: os.Stdout}
+}
+
+// marshalLines returns events as JSON lines
+func marshalLines(events []ChangeEvent) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func (ws *WriterSink) Write(ctx context.Context, events []ChangeEvent) error {
+	data, err := marshalLines(events)
+	if err != nil {
+		return err
+	}
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	_, err = ws.W.Write(data)
+	return err
+}
+
+func (ws *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes the events as JSON lines to files of Dir named
+// <Prefix>-<creation time>.ndjson, synced after each batch. A new file is
+// started when the current one would exceed MaxBytes, or is older than
+// MaxAge; a batch is never split across files.
+type FileSink struct {
+	Dir string
+	// Prefix of the file names, "changes" if empty
+	Prefix string
+	// MaxBytes and MaxAge limit the size and age of a file, 0 means no limit
+	MaxBytes int64
+	MaxAge time.Duration
+
+	mutex sync.Mutex
+	file *os.File
+	size int64
+	opened time.Time
+}
+
+// Files returns the paths of the files written, oldest first
+func (fs *FileSink) Files() ([]string, error) {
+	return filepath.Glob(filepath.Join(fs.Dir, fs.prefix() + "-*.ndjson"))
+}
+
+func (fs *FileSink) prefix() string {
+	if fs.Prefix == "" {
+		return "changes"
+	}
+	return fs.Prefix
+}
+
+// rotate closes the current file and opens a new one
+func (fs *FileSink) rotate() error {
+	if err := fs.closeFile(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s.ndjson", fs.prefix(),
+		now.Format("20060102T150405.000000000Z"))
+	file, err := os.OpenFile(filepath.Join(fs.Dir, name),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	fs.file, fs.size, fs.opened = file, 0, now
+	return nil
+}
+
+func (fs *FileSink) closeFile() error {
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+func (fs *FileSink) Write(ctx context.Context, events []ChangeEvent) error {
+	data, err := marshalLines(events)
+	if err != nil {
+		return err
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	full := fs.MaxBytes > 0 && fs.size > 0 &&
+		fs.size + int64(len(data)) > fs.MaxBytes
+	old := fs.MaxAge > 0 && time.Since(fs.opened) > fs.MaxAge
+	if fs.file == nil || full || old {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.file.Write(data)
+	fs.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+func (fs *FileSink) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.closeFile()
+}
+
+// WebhookSink POSTs each batch to URL as {"events": [...]}. With a Secret
+// the body is signed with HMAC-SHA256 in SignatureHeader (see
+// VerifySignature). Temporary errors (network errors, 429 and 5xx
+// responses) are retried as in BulkOptions.
+type WebhookSink struct {
+	URL string
+	Secret []byte
+	// Client is the HTTP client, http.DefaultClient if nil
+	Client *http.Client
+	// Header has additional headers of the requests
+	Header http.Header
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled at each
+	// retry, 0 means DefaultRetryBackoff
+	RetryBackoff time.Duration
+}
+
+// Sign returns the signature of body with secret, as in SignatureHeader
+func Sign(body, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature returns true if signature is the signature of body with
+// secret, for the receivers of a WebhookSink
+func VerifySignature(body, secret []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(body, secret)), []byte(signature))
+}
+
+// post sends body once, returning an *APIError on non-2xx responses
+func (ws *WebhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", ws.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range ws.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ws.Secret != nil {
+		req.Header.Set(SignatureHeader, Sign(body, ws.Secret))
+	}
+
+	client := ws.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &APIError{StatusCode: resp.StatusCode,
+			ResultCode: uint64(resp.StatusCode),
+			Message: http.StatusText(resp.StatusCode),
+			RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return nil
+}
+
+func (ws *WebhookSink) Write(ctx context.Context, events []ChangeEvent) error {
+	body, err := json.Marshal(map[string]any{"events": events})
+	if err != nil {
+		return err
+	}
+	backoff := ws.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err = ws.post(ctx, body)
+		if err == nil || attempt >= ws.MaxRetries || !isTemporary(err) {
+			return err
+		}
+		delay := backoff << attempt
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func (ws *WebhookSink) Close() error {
+	return nil
+}
+
+// ChannelSink sends the events on C, blocking until they are received
+type ChannelSink struct {
+	C chan<- ChangeEvent
+}
+
+func (cs ChannelSink) Write(ctx context.Context, events []ChangeEvent) error {
+	for _, event := range events {
+		select {
+		case cs.C <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close does nothing: C is owned by the caller
+func (cs ChannelSink) Close() error {
+	return nil
+}
+
+// ForwardOptions are the options of Forward
+type ForwardOptions struct {
+	WatchOptions
+	// BatchSize is the maximum number of events written at once, 0 means
+	// DefaultBatchSize. The events of a poll are written in batches, and
+	// the last one is written at the end of the poll.
+	BatchSize int
+}
+
+// Forward watches schema as Watch and writes the events to sink, in
+// batches. It blocks until ctx is done or a write fails, without closing
+// sink; writes failing with a temporary error are retried at the next
+// poll. The cursor is saved after each batch written, so the delivery is
+// at-least-once: after a restart, a batch which failed (or was being
+// written) is written again. A slow sink slows down the polling.
+func (ca *CustodiaAPIv1) Forward(ctx context.Context, schema *Schema,
+	sink Sink, opts *ForwardOptions) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if schema == nil {
+		return fmt.Errorf("schema is nil")
+	}
+	if opts == nil {
+		opts = &ForwardOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	return ca.watch(ctx, schema, &opts.WatchOptions, batchSize,
+		func(events []ChangeEvent) error {
+			if err := sink.Write(ctx, events); err != nil {
+				return fmt.Errorf("error writing %d events: %w", len(events),
+					err)
+			}
+			return nil
+		})
+}
@@ -0,0 +1,212 @@
+package custodia
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// testEvents returns count events of documents named by their index
+func testEvents(count int) []ChangeEvent {
+	events := []ChangeEvent{}
+	for i := 0; i < count; i++ {
+		events = append(events, ChangeEvent{Type: ChangeCreated,
+			Document: &Document{Id: uuid.New(), IsActive: true,
+				Content: map[string]any{"name": string(rune('a' + i))}}})
+	}
+	return events
+}
+
+// readLines returns the names of the events in the NDJSON files
+func readLines(t *testing.T, paths ...string) []string {
+	names := []string{}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			event := ChangeEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				t.Fatalf("bad line %q: %v", scanner.Text(), err)
+			}
+			names = append(names, event.Document.Content["name"].(string))
+		}
+		file.Close()
+	}
+	return names
+}
+
+func TestFileSink(t *testing.T) {
+	events := testEvents(5)
+	line, _ := marshalLines(events[:1])
+	sink := &FileSink{Dir: t.TempDir(), Prefix: "docs",
+		MaxBytes: int64(len(line)) * 2}
+
+	// batches are not split: a, b | c, d | e
+	errs := []error{}
+	for _, batch := range [][]ChangeEvent{events[:1], events[1:2],
+		events[2:4], events[4:]} {
+		errs = append(errs, sink.Write(context.Background(), batch))
+	}
+	errs = append(errs, sink.Close())
+	files, err := sink.Files()
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{[]error{nil, nil, nil, nil, nil}, errs},
+		{nil, err},
+		{3, len(files)},
+		{[]string{"a", "b", "c", "d", "e"}, readLines(t, files...)},
+		{[]string{"c", "d"}, readLines(t, files[1])},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("FileSink %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	out := bytes.Buffer{}
+	writer := &WriterSink{W: &out}
+	err = writer.Write(context.Background(), events[:2])
+	lines, _ := marshalLines(events[:2])
+	if err != nil || !bytes.Equal(out.Bytes(), lines) ||
+		bytes.Count(lines, []byte("\n")) != 2 {
+		t.Errorf("WriterSink: unexpected output %q, %v", out.String(), err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	secret := []byte("s3cr3t")
+	var mutex sync.Mutex
+	calls := 0
+	received := []ChangeEvent{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if !VerifySignature(body, secret, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		payload := struct{
+			Events []ChangeEvent `json:"events"`
+		}{}
+		json.Unmarshal(body, &payload)
+		received = append(received, payload.Events...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	events := testEvents(2)
+	sink := &WebhookSink{URL: server.URL, Secret: secret, MaxRetries: 1,
+		RetryBackoff: time.Millisecond}
+	err := sink.Write(context.Background(), events)
+	if err != nil || calls != 2 || len(received) != 2 ||
+		received[1].Document.Id != events[1].Document.Id {
+		t.Errorf("unexpected delivery: %d calls, %v, %v", calls, received,
+			err)
+	}
+
+	// wrong secret: not retried
+	calls = 0
+	sink.Secret = []byte("wrong")
+	err = sink.Write(context.Background(), events)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 401 {
+		t.Errorf("expected a 401, got: %v", err)
+	}
+	if VerifySignature([]byte("body"), secret, Sign([]byte("other"),
+		secret)) {
+		t.Errorf("bad signature verified")
+	}
+}
+
+// failingSink fails the writes of the events of a document
+type failingSink struct {
+	ChannelSink
+	failOn uuid.UUID
+}
+
+func (fs *failingSink) Write(ctx context.Context, events []ChangeEvent) error {
+	for _, event := range events {
+		if event.Document.Id == fs.failOn {
+			return errors.New("boom")
+		}
+	}
+	return fs.ChannelSink.Write(ctx, events)
+}
+
+func TestForward(t *testing.T) {
+	feed := &feedServer{}
+	server := httptest.NewServer(feed)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := &Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+
+	t0 := time.Date(2025, 4, 14, 5, 9, 54, 0, time.UTC)
+	alice := feed.add(t0, "alice")
+	bob := feed.add(t0.Add(time.Second), "bob")
+	feed.add(t0.Add(2 * time.Second), "carol")
+
+	// the batch with bob fails: alice is delivered, bob and carol are not
+	store := &MemoryCursorStore{}
+	events := make(chan ChangeEvent, 10)
+	sink := &failingSink{ChannelSink: ChannelSink{C: events}, failOn: bob.Id}
+	opts := &ForwardOptions{WatchOptions: WatchOptions{Store: store,
+		Interval: time.Millisecond}, BatchSize: 2}
+	err := custodia.Forward(context.Background(), schema, sink, opts)
+	if err == nil || len(events) != 0 {
+		t.Errorf("expected a failure, got: %v, %d events", err, len(events))
+	}
+	opts.BatchSize = 1
+	err = custodia.Forward(context.Background(), schema, sink, opts)
+	if err == nil || len(events) != 1 || (<-events).Document.Id != alice.Id {
+		t.Errorf("expected alice delivered, got: %v", err)
+	}
+
+	// after a restart the failed batch is delivered again
+	sink.failOn = uuid.Nil
+	opts.BatchSize = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- custodia.Forward(ctx, schema, sink, opts)
+	}()
+	names := []string{}
+	for _, event := range []ChangeEvent{<-events, <-events} {
+		names = append(names, event.Document.Content["name"].(string))
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected the context error, got: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"bob", "carol"}) {
+		t.Errorf("unexpected events: %v", names)
+	}
+}
@@ -0,0 +1,661 @@
+package custodia
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// The SQL-like query language, compiled to search requests:
+//
+//	SELECT * FROM patients WHERE age > 30 AND city = 'Trento'
+//	    ORDER BY last_name, age DESC LIMIT 50 OFFSET 100
+//
+// The select list sets the result type:
+//
+//	*         FullContent
+//	METADATA  NoContent
+//	ID        OnlyId
+//	COUNT(*)  Count
+//	EXISTS    Exists
+//
+// Conditions support =, != (or <>), <, <=, >, >=, [NOT] IN (...),
+// [NOT] LIKE, IS [NOT] NULL/TRUE/FALSE, AND, OR, NOT and parentheses.
+// LIKE patterns use '%' for any sequence of characters and '_' for a single
+// one. Strings are single-quoted ('' escapes a quote), identifiers can be
+// double-quoted. Keywords are case-insensitive.
+
+// Table is a schema (or user schema) which can be queried by name
+type Table struct {
+	Id uuid.UUID
+	// Users is true for user schemas
+	Users bool
+	// Schema (optional) is used to check the query fields
+	Schema StructureMapper
+}
+
+// Catalog maps the table names to their schemas
+type Catalog map[string]Table
+
+// tableName returns the table name of a schema description, e.g.
+// "Blood tests" is "blood_tests"
+func tableName(description string) string {
+	isSeparator := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+	fields := strings.FieldsFunc(strings.ToLower(description), isSeparator)
+	return strings.Join(fields, "_")
+}
+
+// LoadCatalog returns a Catalog with the schemas of the given repositories
+// and all the user schemas, named after their descriptions (lower case,
+// words joined by '_'). Duplicated names are errors.
+func (ca *CustodiaAPIv1) LoadCatalog(ctx context.Context,
+	repoIds ...uuid.UUID) (Catalog, error) {
+	catalog := Catalog{}
+	add := func(description string, table Table) error {
+		name := tableName(description)
+		if _, exists := catalog[name]; exists {
+			return fmt.Errorf("duplicated table name '%s'", name)
+		}
+		catalog[name] = table
+		return nil
+	}
+
+	for _, repoId := range repoIds {
+		schemas := ca.IterSchemas(ctx, repoId, 0)
+		for schemas.Next() {
+			schema := schemas.Value()
+			if err := add(schema.Description, Table{Id: schema.Id,
+				Schema: schema}); err != nil {
+				return nil, err
+			}
+		}
+		if err := schemas.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	userSchemas := ca.IterUserSchemas(ctx, 0)
+	for userSchemas.Next() {
+		userSchema := userSchemas.Value()
+		if err := add(userSchema.Description, Table{Id: userSchema.Id,
+			Users: true, Schema: userSchema}); err != nil {
+			return nil, err
+		}
+	}
+	if err := userSchemas.Err(); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// SyntaxError is an error in the query text, at the given position
+type SyntaxError struct {
+	// Offset is the byte offset in the text, Line and Column start from 1
+	Offset int
+	Line int
+	Column int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line,
+		e.Column, e.Message)
+}
+
+// CompiledQuery is a query text compiled to a search request
+type CompiledQuery struct {
+	Table string
+	Target Table
+	ResultType ResultType
+	Query map[string]any
+	Sort []SortSpec
+	// Limit and Offset are 0 when not given
+	Limit int
+	Offset int
+}
+
+// QueryParams returns the pagination query params of the search
+func (cq *CompiledQuery) QueryParams() map[string]string {
+	params := map[string]string{}
+	if cq.Limit > 0 {
+		params["limit"] = strconv.Itoa(cq.Limit)
+	}
+	if cq.Offset > 0 {
+		params["offset"] = strconv.Itoa(cq.Offset)
+	}
+	return params
+}
+
+// Query compiles text with catalog and runs the search
+func (ca *CustodiaAPIv1) Query(text string, catalog Catalog) (
+	*SearchResponse, error) {
+	cq, err := CompileQuery(text, catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	var sort any
+	if len(cq.Sort) > 0 {
+		sort = cq.Sort
+	}
+	if cq.Target.Users {
+		userSchema, _ := cq.Target.Schema.(*UserSchema)
+		return ca.searchUsers(cq.Target.Id, userSchema, cq.ResultType,
+			cq.Query, sort, cq.QueryParams())
+	}
+	schema, _ := cq.Target.Schema.(*Schema)
+	return ca.searchDocuments(cq.Target.Id, schema, cq.ResultType, cq.Query,
+		sort, cq.QueryParams())
+}
+
+// CompileQuery parses text and compiles it to a search request, resolving
+// the table name with catalog
+func CompileQuery(text string, catalog Catalog) (*CompiledQuery, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{text: text, tokens: tokens}
+	return p.parse(catalog)
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota + 1
+	tokenIdent
+	tokenQuotedIdent
+	tokenNumber
+	tokenString
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	offset int
+}
+
+// syntaxError returns a SyntaxError at offset of text
+func syntaxError(text string, offset int, format string,
+	args ...any) *SyntaxError {
+	line, column := 1, 1
+	for _, r := range text[:offset] {
+		if r == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return &SyntaxError{Offset: offset, Line: line, Column: column,
+		Message: fmt.Sprintf(format, args...)}
+}
+
+func lexQuery(text string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(text)
+	// byte offsets of the runes, for positions
+	offsets := make([]int, len(runes)+1)
+	offset := 0
+	for i, r := range runes {
+		offsets[i] = offset
+		offset += len(string(r))
+	}
+	offsets[len(runes)] = offset
+
+	isIdentRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+	}
+
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent,
+				text: string(runes[start:i]), offset: offsets[start]})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) &&
+			unicode.IsDigit(runes[i+1])):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) ||
+				runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber,
+				text: string(runes[start:i]), offset: offsets[start]})
+		case r == '\'' || r == '"':
+			// '' (or "") escapes the quote
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(runes) {
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						sb.WriteRune(r)
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, syntaxError(text, offsets[start],
+					"unterminated string")
+			}
+			kind := tokenString
+			if r == '"' {
+				kind = tokenQuotedIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: sb.String(),
+				offset: offsets[start]})
+		default:
+			symbol := string(r)
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				if two == "<=" || two == ">=" || two == "!=" || two == "<>" {
+					symbol = two
+				}
+			}
+			if strings.IndexAny(symbol, "(),*=<>!") < 0 || symbol == "!" {
+				return nil, syntaxError(text, offsets[start],
+					"unexpected character '%c'", r)
+			}
+			i += len([]rune(symbol))
+			tokens = append(tokens, token{kind: tokenSymbol, text: symbol,
+				offset: offsets[start]})
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, offset: len(text)})
+	return tokens, nil
+}
+
+// Parser
+
+type queryParser struct {
+	text string
+	tokens []token
+	pos int
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// describe returns the token as shown in errors
+func (tok token) describe() string {
+	if tok.kind == tokenEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("'%s'", tok.text)
+}
+
+func (p *queryParser) errorAt(tok token, format string,
+	args ...any) *SyntaxError {
+	return syntaxError(p.text, tok.offset, format, args...)
+}
+
+// isKeyword returns true if tok is the (case-insensitive) keyword
+func (tok token) isKeyword(keyword string) bool {
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, keyword)
+}
+
+// accept consumes the next token if it's the keyword or symbol
+func (p *queryParser) accept(keyword string) bool {
+	tok := p.peek()
+	if tok.isKeyword(keyword) || (tok.kind == tokenSymbol &&
+		tok.text == keyword) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expect(keyword string) error {
+	if !p.accept(keyword) {
+		tok := p.peek()
+		return p.errorAt(tok, "expected %s, got %s", keyword, tok.describe())
+	}
+	return nil
+}
+
+// reserved keywords can't be used as plain identifiers
+var reservedKeywords = []string{"SELECT", "FROM", "WHERE", "ORDER", "BY",
+	"LIMIT", "OFFSET", "AND", "OR", "NOT", "IN", "IS", "LIKE", "NULL",
+	"TRUE", "FALSE", "ASC", "DESC"}
+
+func (p *queryParser) identifier(what string) (string, error) {
+	tok := p.next()
+	if tok.kind == tokenQuotedIdent {
+		return tok.text, nil
+	}
+	if tok.kind == tokenIdent &&
+		indexOf(strings.ToUpper(tok.text), reservedKeywords) < 0 {
+		return tok.text, nil
+	}
+	return "", p.errorAt(tok, "expected %s, got %s", what, tok.describe())
+}
+
+func (p *queryParser) integer(what string) (int, error) {
+	tok := p.next()
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != tokenNumber || err != nil || n < 0 {
+		return 0, p.errorAt(tok, "expected %s, got %s", what, tok.describe())
+	}
+	return n, nil
+}
+
+func (p *queryParser) parse(catalog Catalog) (*CompiledQuery, error) {
+	cq := &CompiledQuery{}
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+
+	// select list
+	tok := p.next()
+	switch {
+	case tok.kind == tokenSymbol && tok.text == "*":
+		cq.ResultType = FullContent
+	case tok.isKeyword("METADATA"):
+		cq.ResultType = NoContent
+	case tok.isKeyword("ID"):
+		cq.ResultType = OnlyId
+	case tok.isKeyword("EXISTS"):
+		cq.ResultType = Exists
+	case tok.isKeyword("COUNT"):
+		for _, symbol := range []string{"(", "*", ")"} {
+			if err := p.expect(symbol); err != nil {
+				return nil, err
+			}
+		}
+		cq.ResultType = Count
+	default:
+		return nil, p.errorAt(tok, "expected *, METADATA, ID, COUNT(*) or " +
+			"EXISTS, got %s", tok.describe())
+	}
+
+	// table
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	tableTok := p.peek()
+	name, err := p.identifier("table name")
+	if err != nil {
+		return nil, err
+	}
+	table, ok := catalog[name]
+	if !ok {
+		return nil, p.errorAt(tableTok, "unknown table '%s'", name)
+	}
+	cq.Table, cq.Target = name, table
+
+	var query Query
+	if p.accept("WHERE") {
+		query, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.accept("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			field, err := p.identifier("field name")
+			if err != nil {
+				return nil, err
+			}
+			spec := Field(field).Asc()
+			if p.accept("DESC") {
+				spec = Field(field).Desc()
+			} else {
+				p.accept("ASC")
+			}
+			cq.Sort = append(cq.Sort, spec)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	if p.accept("LIMIT") {
+		if cq.Limit, err = p.integer("limit"); err != nil {
+			return nil, err
+		}
+	}
+	if p.accept("OFFSET") {
+		if cq.Offset, err = p.integer("offset"); err != nil {
+			return nil, err
+		}
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorAt(tok, "unexpected %s", tok.describe())
+	}
+
+	// check the fields against the schema, if known
+	schema := table.Schema
+	if query == nil {
+		cq.Query = map[string]any{}
+	} else if cq.Query, err = BuildQuery(schema, query); err != nil {
+		return nil, err
+	}
+	if cq.Sort, err = BuildSort(schema, cq.Sort...); err != nil {
+		return nil, err
+	}
+	return cq, nil
+}
+
+// parseOr parses: and (OR and)*
+func (p *queryParser) parseOr() (Query, error) {
+	queries := []Query{}
+	for {
+		query, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+		if !p.accept("OR") {
+			break
+		}
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return Or(queries...), nil
+}
+
+// parseAnd parses: unary (AND unary)*
+func (p *queryParser) parseAnd() (Query, error) {
+	queries := []Query{}
+	for {
+		query, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+		if !p.accept("AND") {
+			break
+		}
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return And(queries...), nil
+}
+
+// parseUnary parses: NOT unary | '(' or ')' | predicate
+func (p *queryParser) parseUnary() (Query, error) {
+	if p.accept("NOT") {
+		query, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(query), nil
+	}
+	if p.accept("(") {
+		query, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return query, nil
+	}
+	return p.parsePredicate()
+}
+
+// parsePredicate parses a condition on a field
+func (p *queryParser) parsePredicate() (Query, error) {
+	name, err := p.identifier("field name or condition")
+	if err != nil {
+		return nil, err
+	}
+	field := Field(name)
+
+	tok := p.next()
+	if tok.kind == tokenSymbol {
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		switch tok.text {
+		case "=":
+			return field.Eq(value), nil
+		case "!=", "<>":
+			return Not(field.Eq(value)), nil
+		case "<":
+			return field.Lt(value), nil
+		case "<=":
+			return field.Lte(value), nil
+		case ">":
+			return field.Gt(value), nil
+		case ">=":
+			return field.Gte(value), nil
+		}
+		return nil, p.errorAt(tok, "unexpected %s", tok.describe())
+	}
+
+	negate := false
+	if tok.isKeyword("NOT") {
+		negate = true
+		tok = p.next()
+	}
+	var query Query
+	switch {
+	case tok.isKeyword("IN"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		values := []any{}
+		for {
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		query = field.In(values...)
+	case tok.isKeyword("LIKE"):
+		patternTok := p.next()
+		if patternTok.kind != tokenString {
+			return nil, p.errorAt(patternTok, "expected a string pattern, " +
+				"got %s", patternTok.describe())
+		}
+		query = field.Like(sqlLikeToPattern(patternTok.text))
+	case tok.isKeyword("IS") && !negate:
+		if p.accept("NOT") {
+			negate = true
+		}
+		valueTok := p.next()
+		switch {
+		case valueTok.isKeyword("NULL"):
+			query = field.Is(nil)
+		case valueTok.isKeyword("TRUE"):
+			query = field.Is(true)
+		case valueTok.isKeyword("FALSE"):
+			query = field.Is(false)
+		default:
+			return nil, p.errorAt(valueTok, "expected NULL, TRUE or FALSE, " +
+				"got %s", valueTok.describe())
+		}
+	default:
+		expected := "an operator"
+		if negate {
+			expected = "IN or LIKE"
+		}
+		return nil, p.errorAt(tok, "expected %s, got %s", expected,
+			tok.describe())
+	}
+
+	if negate {
+		return Not(query), nil
+	}
+	return query, nil
+}
+
+// literal parses a string, number, TRUE or FALSE. NULL is not a value
+// (nothing equals it): it's only matched by IS NULL.
+func (p *queryParser) literal() (any, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokenString:
+		return tok.text, nil
+	case tok.kind == tokenNumber:
+		if i, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(tok.text, 64); err == nil {
+			return f, nil
+		}
+		return nil, p.errorAt(tok, "bad number %s", tok.describe())
+	case tok.isKeyword("TRUE"):
+		return true, nil
+	case tok.isKeyword("FALSE"):
+		return false, nil
+	case tok.isKeyword("NULL"):
+		return nil, p.errorAt(tok, "NULL is not a value, use IS NULL or " +
+			"IS NOT NULL")
+	}
+	return nil, p.errorAt(tok, "expected a value, got %s", tok.describe())
+}
+
+// sqlLikeToPattern converts a SQL LIKE pattern ('%', '_') to the search
+// DSL one ('*', '?')
+func sqlLikeToPattern(pattern string) string {
+	return strings.NewReplacer("%", "*", "_", "?").Replace(pattern)
+}
@@ -0,0 +1,205 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+func TestCompileQuery(t *testing.T) {
+	patients := &Schema{
+		Id: uuid.New(),
+		Description: "Patients",
+		Structure: []SchemaField{
+			{Name: "age", Type: TypeInt, Indexed: true},
+			{Name: "city", Type: TypeStr, Indexed: true},
+			{Name: "last_name", Type: TypeStr, Indexed: true},
+			{Name: "notes", Type: TypeText},
+		},
+	}
+	catalog := Catalog{
+		"patients": {Id: patients.Id, Schema: patients},
+		"doctors": {Id: uuid.New(), Users: true},
+	}
+
+	text := "SELECT * FROM patients WHERE age > 30 AND city = 'Trento' " +
+		"ORDER BY last_name LIMIT 50"
+	cq, err := CompileQuery(text, catalog)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	query, _ := json.Marshal(cq.Query)
+	sort, _ := json.Marshal(cq.Sort)
+	var tests = []struct {
+		want any
+		got any
+	}{
+		{"patients", cq.Table},
+		{patients.Id, cq.Target.Id},
+		{FullContent, cq.ResultType},
+		{`{"and":[{"field":"age","type":"gt","value":30},` +
+			`{"field":"city","type":"eq","value":"Trento"}]}`, string(query)},
+		{`[{"field":"last_name","order":"asc"}]`, string(sort)},
+		{map[string]string{"limit": "50"}, cq.QueryParams()},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("test %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+
+	// grammar: result types, operators and precedence
+	var grammarTests = []struct {
+		text string
+		resultType ResultType
+		query string
+	}{
+		{"select count(*) from doctors", Count, `{}`},
+		{"SELECT id FROM doctors WHERE NOT (a = 1 OR b <> 'x''y')", OnlyId,
+			`{"not":{"or":[{"field":"a","type":"eq","value":1},` +
+			`{"not":{"field":"b","type":"eq","value":"x'y"}}]}}`},
+		{"SELECT EXISTS FROM doctors WHERE a IN (1, 2.5) OR b = 1 AND c = 2",
+			Exists, `{"or":[{"field":"a","type":"in","value":[1,2.5]},` +
+			`{"and":[{"field":"b","type":"eq","value":1},` +
+			`{"field":"c","type":"eq","value":2}]}]}`},
+		{`SELECT METADATA FROM doctors WHERE "last name" LIKE 'Ro%s_' ` +
+			`AND x IS NOT NULL AND y NOT IN (-1) AND z IS TRUE`, NoContent,
+			`{"and":[{"field":"last name","type":"like","value":"Ro*s?"},` +
+			`{"not":{"field":"x","type":"is","value":null}},` +
+			`{"not":{"field":"y","type":"in","value":[-1]}},` +
+			`{"field":"z","type":"is","value":true}]}`},
+	}
+	for i, test := range grammarTests {
+		cq, err := CompileQuery(test.text, catalog)
+		if err != nil {
+			t.Errorf("grammar %d: unexpected error: %v", i, err)
+			continue
+		}
+		query, _ := json.Marshal(cq.Query)
+		if cq.ResultType != test.resultType || string(query) != test.query {
+			t.Errorf("grammar %d: got %s %s", i, cq.ResultType, query)
+		}
+	}
+
+	// syntax errors report the position
+	var errorTests = []struct {
+		text string
+		line int
+		column int
+		message string
+	}{
+		{"SELEC * FROM patients", 1, 1, "expected SELECT, got 'SELEC'"},
+		{"SELECT * FROM nowhere", 1, 15, "unknown table 'nowhere'"},
+		{"SELECT * FROM patients WHERE age >", 1, 35,
+			"expected a value, got end of query"},
+		{"SELECT * FROM patients\nWHERE city = 'Trento", 2, 14,
+			"unterminated string"},
+		{"SELECT * FROM patients WHERE age ~ 3", 1, 34,
+			"unexpected character '~'"},
+		{"SELECT * FROM patients LIMIT 10 extra", 1, 33,
+			"unexpected 'extra'"},
+		{"SELECT * FROM patients WHERE (age = 1", 1, 38,
+			"expected ), got end of query"},
+		{"SELECT * FROM patients WHERE age NOT = 1", 1, 38,
+			"expected IN or LIKE, got '='"},
+		{"SELECT * FROM patients WHERE city != NULL", 1, 38,
+			"NULL is not a value, use IS NULL or IS NOT NULL"},
+		{"SELECT * FROM patients WHERE age IN (1, NULL)", 1, 41,
+			"NULL is not a value, use IS NULL or IS NOT NULL"},
+	}
+	for i, test := range errorTests {
+		_, err := CompileQuery(test.text, catalog)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("error %d: expected SyntaxError, got: %v", i, err)
+			continue
+		}
+		if syntaxErr.Line != test.line || syntaxErr.Column != test.column ||
+			syntaxErr.Message != test.message {
+			t.Errorf("error %d: got %d:%d %s", i, syntaxErr.Line,
+				syntaxErr.Column, syntaxErr.Message)
+		}
+	}
+
+	// fields are checked against the schema
+	_, err = CompileQuery("SELECT * FROM patients WHERE notes = 'x'", catalog)
+	if err == nil {
+		t.Errorf("expected error on not indexed field")
+	}
+	_, err = CompileQuery("SELECT * FROM patients ORDER BY notes", catalog)
+	if err == nil {
+		t.Errorf("expected error on not indexed sort field")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	repoId, schemaId, userSchemaId := uuid.New(), uuid.New(), uuid.New()
+	var body map[string]any
+	var rawQuery string
+
+	mockHandler := func(w http.ResponseWriter, r *http.Request) {
+		var response any
+		switch {
+		case r.URL.Path == fmt.Sprintf("/api/v1/repositories/%s/schemas",
+			repoId):
+			response = map[string]any{"schemas": []any{map[string]any{
+				"schema_id": schemaId.String(), "description": "Blood tests",
+				"structure": []any{map[string]any{"name": "value",
+					"type": "integer", "indexed": true}},
+			}}, "count": 1, "total_count": 1, "limit": 100, "offset": 0}
+		case r.URL.Path == "/api/v1/user_schemas":
+			response = map[string]any{"user_schemas": []any{map[string]any{
+				"user_schema_id": userSchemaId.String(),
+				"description": "Doctors", "structure": []any{},
+			}}, "count": 1, "total_count": 1, "limit": 100, "offset": 0}
+		case r.URL.Path == fmt.Sprintf("/api/v1/search/documents/%s",
+			schemaId):
+			body = map[string]any{}
+			json.NewDecoder(r.Body).Decode(&body)
+			rawQuery = r.URL.RawQuery
+			response = map[string]any{"count": 3}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := json.Marshal(response)
+		envelope.Data = data
+		out, _ := json.Marshal(envelope)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+	server := httptest.NewServer(http.HandlerFunc(mockHandler))
+	defer server.Close()
+
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+
+	catalog, err := custodia.LoadCatalog(context.Background(), repoId)
+	if err != nil {
+		t.Fatalf("LoadCatalog: unexpected error: %v", err)
+	}
+	if catalog["blood_tests"].Id != schemaId ||
+		!catalog["doctors"].Users {
+		t.Errorf("LoadCatalog: bad catalog %v", catalog)
+	}
+
+	resp, err := custodia.Query("SELECT COUNT(*) FROM blood_tests WHERE " +
+		"value >= 10 OFFSET 20", catalog)
+	if err != nil {
+		t.Fatalf("Query: unexpected error: %v", err)
+	}
+	if resp.Count != 3 || body["result_type"] != "COUNT" ||
+		rawQuery != "offset=20" {
+		t.Errorf("Query: got %d, %v, %s", resp.Count, body, rawQuery)
+	}
+}
@@ -1,10 +1,9 @@
 package custodia
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"net/url"
 
 	"github.com/google/uuid"
 	"github.com/simplereach/timeutils"
@@ -34,12 +33,17 @@ type UsersEnvelope struct {
 // [C]reate a new user
 func (ca *CustodiaAPIv1) CreateUser(userSchema *UserSchema, isActive bool,
 	attributes map[string]any) (*User, error) {
-	// validate user content
-	contentErrors := validateContent(attributes,
-		userSchema.getStructureAsMap())
-	if len(contentErrors) > 0 {
-		e := fmt.Errorf("content errors: %w", errors.Join(contentErrors...))
-		return nil, e
+	if ca.FillDefaults {
+		withDefaults, err := userSchema.ApplyDefaults(attributes)
+		if err != nil {
+			return nil, err
+		}
+		attributes = withDefaults
+	}
+
+	// validate user content (types and constraints)
+	if err := validate(attributes, userSchema); err != nil {
+		return nil, err
 	}
 
 	doc := User{IsActive: isActive, Attributes: attributes}
@@ -51,7 +55,7 @@ func (ca *CustodiaAPIv1) CreateUser(userSchema *UserSchema, isActive bool,
 	}
 	// JSON: unmarshal resp content
 	userEnvelope := UserEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &userEnvelope); err != nil {
+	if err := decodeJSON(resp, &userEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -73,7 +77,7 @@ func (ca *CustodiaAPIv1) ReadUser(userSchema UserSchema, userId uuid.UUID) (
 
 	// JSON: unmarshal resp content
 	userEnvelope := UserEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &userEnvelope); err != nil {
+	if err := decodeJSON(resp, &userEnvelope); err != nil {
 		return nil, err
 	}
 
@@ -90,8 +94,22 @@ func (ca *CustodiaAPIv1) ReadUser(userSchema UserSchema, userId uuid.UUID) (
 }
 
 // [U]pdate an existent user
-func (ca *CustodiaAPIv1) UpdateUser(userId uuid.UUID , isActive bool,
+func (ca *CustodiaAPIv1) UpdateUser(userId uuid.UUID, isActive bool,
 	content map[string]any) (*User, error) {
+	return ca.UpdateUserWithSchema(nil, userId, isActive, content)
+}
+
+// UpdateUserWithSchema updates a user as UpdateUser. If userSchema is not
+// nil, content is validated before sending it and the returned attributes
+// are converted with it, as ReadUser does.
+func (ca *CustodiaAPIv1) UpdateUserWithSchema(userSchema *UserSchema,
+	userId uuid.UUID, isActive bool, content map[string]any) (*User, error) {
+	if userSchema != nil {
+		if err := validate(content, userSchema); err != nil {
+			return nil, err
+		}
+	}
+
 	url := fmt.Sprintf("/users/%s", userId)
 
 	// create a user with just the values we can send, and marshal it
@@ -104,11 +122,21 @@ func (ca *CustodiaAPIv1) UpdateUser(userId uuid.UUID , isActive bool,
 
 	// JSON: unmarshal resp content and return a fresh user instance
 	docEnvelope := UserEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &docEnvelope); err != nil {
+	if err := decodeJSON(resp, &docEnvelope); err != nil {
 		return nil, err
 	}
+	if userSchema == nil {
+		// PUT call returns the whole users, along with its content
+		return docEnvelope.User, nil
+	}
 
-	// PUT call returns the whole users, along with its content
+	// convert values to concrete types
+	converted, ee := convertData(docEnvelope.User.Attributes, userSchema)
+	if len(ee) > 0 {
+		err := fmt.Errorf("conversion errors: %w", errors.Join(ee...))
+		return docEnvelope.User, err
+	}
+	docEnvelope.User.Attributes = converted
 	return docEnvelope.User, nil
 }
 
@@ -140,33 +168,32 @@ func (ca *CustodiaAPIv1) DeleteUser(userId uuid.UUID, force, consistent bool) (
 func (ca *CustodiaAPIv1) ListUsers(userSchemaId uuid.UUID,
 	queryParams map[string]string) ([]*User, error,
 ) {
-	u, err := url.Parse(fmt.Sprintf("/user_schemas/%s/users", userSchemaId))
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range(queryParams) {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
+	result, _, err := ca.listUsers(userSchemaId, queryParams)
+	return result, err
+}
 
-	resp, err := ca.Call("GET", u.String(), nil)
+func (ca *CustodiaAPIv1) listUsers(userSchemaId uuid.UUID,
+	queryParams map[string]string) ([]*User, PageInfo, error) {
+	usersEnvelope := UsersEnvelope{}
+	page, err := ca.listPage(fmt.Sprintf("/user_schemas/%s/users",
+		userSchemaId), queryParams, &usersEnvelope)
 	if err != nil {
-		return nil, err
-	}
-
-	// JSON: unmarshal resp content
-	docusEnvelope := UsersEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &docusEnvelope); err != nil {
-		return nil, err
+		return nil, page, err
 	}
 
 	result := []*User{}
-	for _, doc := range docusEnvelope.Users {
-		result = append(result, &doc)
+	for _, user := range usersEnvelope.Users {
+		result = append(result, &user)
 	}
 
-	return result, nil
+	return result, page, nil
+}
+
+// IterUsers returns a Pager over all the users of a user schema
+func (ca *CustodiaAPIv1) IterUsers(ctx context.Context,
+	userSchemaId uuid.UUID, pageSize int) *Pager[*User] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*User,
+		PageInfo, error) {
+		return ca.listUsers(userSchemaId, pageParams(offset, limit))
+	})
 }
@@ -1,9 +1,8 @@
 package custodia
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/url"
 
 	"github.com/google/uuid"
 	"github.com/simplereach/timeutils"
@@ -17,6 +16,7 @@ type UserSchema struct {
 	LastUpdate timeutils.Time `json:"last_update,omitempty"`
 	IsActive bool `json:"is_active"`
 	Structure []SchemaField `json:"structure"`
+	Rules []CrossFieldRule `json:"-"`  // client-side only
 }
 
 type UserSchemaEnvelope struct {
@@ -51,7 +51,7 @@ func (ca *CustodiaAPIv1) CreateUserSchema(descritpion string, isActive bool,
 
 	// JSON: unmarshal resp content
 	schemaEnvelope := UserSchemaEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &schemaEnvelope); err != nil {
+	if err := decodeJSON(resp, &schemaEnvelope); err != nil {
 		return nil, err
 	}
 	schemaEnvelope.UserSchema.adjustDefaultTypes()
@@ -70,7 +70,7 @@ func (ca *CustodiaAPIv1) ReadUserSchema(userSchemaId uuid.UUID) (*UserSchema,
 
 	// JSON: unmarshal resp content
 	schemaEnvelope := UserSchemaEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &schemaEnvelope); err != nil {
+	if err := decodeJSON(resp, &schemaEnvelope); err != nil {
 		return nil, err
 	}
 	schemaEnvelope.UserSchema.adjustDefaultTypes()
@@ -96,10 +96,11 @@ func (ca *CustodiaAPIv1) UpdateUserSchema(userSchemaId uuid.UUID,
 	if err != nil {
 		return nil, err
 	}
+	ca.userSchemaCache.Delete(userSchemaId)
 
 	// JSON: unmarshal resp content and return new user schema
 	schemaEnvelope := UserSchemaEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &schemaEnvelope); err != nil {
+	if err := decodeJSON(resp, &schemaEnvelope); err != nil {
 		return nil, err
 	}
 	schemaEnvelope.UserSchema.adjustDefaultTypes()
@@ -120,6 +121,7 @@ func (ca *CustodiaAPIv1) DeleteUserSchema(userSchemaId uuid.UUID, force bool) (
 	if err != nil {
 		return err
 	}
+	ca.userSchemaCache.Delete(userSchemaId)
 	return nil
 }
 
@@ -130,27 +132,16 @@ func (ca *CustodiaAPIv1) DeleteUserSchema(userSchemaId uuid.UUID, force bool) (
 func (ca *CustodiaAPIv1) ListUserSchemas(queryParams map[string]string) (
 	[]*UserSchema, error,
 ) {
-	u, err := url.Parse("/user_schemas")
-	if err != nil {
-		return nil, fmt.Errorf("error parsing url: %v", err)
-	}
-
-	// Adding query params
-	q := u.Query()
-	for k, v := range queryParams {
-		q.Set(k, v)
-	}
-	u.RawQuery = q.Encode()
-
-	resp, err := ca.Call("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+	result, _, err := ca.listUserSchemas(queryParams)
+	return result, err
+}
 
-	// JSON: unmarshal resp content
+func (ca *CustodiaAPIv1) listUserSchemas(queryParams map[string]string) (
+	[]*UserSchema, PageInfo, error) {
 	schemasEnvelope := UserSchemasEnvelope{}
-	if err := json.Unmarshal([]byte(resp), &schemasEnvelope); err != nil {
-		return nil, err
+	page, err := ca.listPage("/user_schemas", queryParams, &schemasEnvelope)
+	if err != nil {
+		return nil, page, err
 	}
 
 	result := []*UserSchema{}
@@ -159,7 +150,16 @@ func (ca *CustodiaAPIv1) ListUserSchemas(queryParams map[string]string) (
 		schema.adjustDefaultTypes()
 	}
 
-	return result, nil
+	return result, page, nil
+}
+
+// IterUserSchemas returns a Pager over all the user schemas
+func (ca *CustodiaAPIv1) IterUserSchemas(ctx context.Context,
+	pageSize int) *Pager[*UserSchema] {
+	return NewPager(ctx, pageSize, func(offset, limit int) ([]*UserSchema,
+		PageInfo, error) {
+		return ca.listUserSchemas(pageParams(offset, limit))
+	})
 }
 
 // getStructureAsMap returns the list of fields in a map using the Name
@@ -171,3 +171,8 @@ func (us *UserSchema) getStructureAsMap() map[string]SchemaField {
 	}
 	return result
 }
+
+// getRules returns the client-side cross-field rules of the user schema
+func (us *UserSchema) getRules() []CrossFieldRule {
+	return us.Rules
+}
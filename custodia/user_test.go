@@ -223,3 +223,59 @@ func TestUserCRUDL(t *testing.T) {
             users, []*User{})
     }
 }
+
+func TestUpdateUserWithSchema(t *testing.T) {
+    envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+    userId := uuid.New()
+
+    mockHandler := func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == fmt.Sprintf("/api/v1/users/%s", userId) &&
+            r.Method == "PUT" {
+            envelope.Data = []byte(fmt.Sprintf(`{"user": {"user_id": "%s",
+                "username": "jdoe", "is_active": true, "attributes":
+                {"age": 42, "born": "1970-01-01"}}}`, userId))
+            out, _ := json.Marshal(envelope)
+            w.WriteHeader(http.StatusOK)
+            w.Write(out)
+        } else {
+            w.WriteHeader(http.StatusNotFound)
+        }
+    }
+    server := httptest.NewServer(http.HandlerFunc(mockHandler))
+    defer server.Close()
+
+    client := common.NewClient(server.URL, common.GetFakeAuth())
+    custodia := NewCustodiaAPIv1(client)
+
+    userSchema := UserSchema{Id: uuid.New(), Structure: []SchemaField{
+        {Name: "age", Type: TypeInt},
+        {Name: "born", Type: TypeDate},
+    }}
+    content := map[string]any{"age": int64(42),
+        "born": NewDate(1970, 1, 1)}
+    user, err := custodia.UpdateUserWithSchema(&userSchema, userId, true,
+        content)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    raw, err := custodia.UpdateUser(userId, true, content)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    var tests = []struct {
+        want any
+        got any
+    }{
+        {content, user.Attributes},
+        // without schema the attributes are not converted
+        {json.Number("42"), raw.Attributes["age"]},
+        {"1970-01-01", raw.Attributes["born"]},
+    }
+    for i, test := range tests {
+        if !reflect.DeepEqual(test.want, test.got) {
+            t.Errorf("test %d: bad value, got: %#v want: %#v", i, test.got,
+                test.want)
+        }
+    }
+}
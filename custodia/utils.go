@@ -5,14 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-
+	"math"
+	"math/big"
+	"sort"
 	"strconv"
-	"strings"
-	"time"
 
 	"github.com/dzanotelli/chino/common"
 	"github.com/google/uuid"
-	"github.com/simplereach/timeutils"
 )
 
 const TypeInt, TypeArrayInt = "integer", "array[integer]"
@@ -22,6 +21,25 @@ const TypeBool = "boolean"
 const TypeDate, TypeTime, TypeDateTime = "date", "time", "datetime"
 const TypeBase64, TypeJson, TypeBlob = "base64", "json", "blob"
 
+// Extensions: arrays of the other scalar types, handled like the
+// standard ones (see arrays.go)
+const TypeArrayBool, TypeArrayDate = "array[boolean]", "array[date]"
+const TypeArrayTime, TypeArrayDateTime = "array[time]", "array[datetime]"
+
+// scalarTypes lists all the non-array field types handled by the client
+var scalarTypes = []string{TypeInt, TypeFloat, TypeStr, TypeText, TypeBool,
+	TypeDate, TypeTime, TypeDateTime, TypeBase64, TypeJson, TypeBlob}
+
+// isKnownType returns true if fieldType is handled by the client: a scalar
+// type or an array of a scalar type
+func isKnownType(fieldType string) bool {
+	if itemType, isArray := arrayItemType(fieldType); isArray {
+		_, ok := arrayGoTypes[itemType]
+		return ok
+	}
+	return indexOf(fieldType, scalarTypes) >= 0
+}
+
 // Return the index of the first found occurence of word in data
 // or -1 if not found
 func indexOf(word string, data []string) (int) {
@@ -33,174 +51,199 @@ func indexOf(word string, data []string) (int) {
     return -1
 }
 
+// validateContent checks that every value in data has the Go type expected
+// by its field, then applies the field constraints (if any)
 func validateContent(data map[string]any,
-	structure map[string]SchemaField) []error {
-	var errors []error
-	var err error
+	structure map[string]SchemaField) []*FieldError {
+	var errors []*FieldError
 
-	for key, value := range data {
+	// iterate sorted keys, so errors are reported in a stable order
+	keys := []string{}
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := data[key]
 		field, ok := structure[key]
 		if !ok {
-			err = fmt.Errorf("field '%s' not defined in given structure", key)
-			errors = append(errors, err)
+			errors = append(errors, &FieldError{Field: key, Rule: "unknown",
+				Message: "not defined in given structure"})
+			continue
+		}
+
+		// nil values are allowed only on nullable fields
+		if value == nil && field.Constraints != nil &&
+			field.Constraints.Nullable {
 			continue
 		}
 
 		// field exist, check that is of the right type
-		var val any
-		switch field.Type {
-		case TypeInt:
-			val, ok = value.(int64)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be int64", key)
-			}
-		case TypeFloat:
-			val, ok = value.(float64)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be float64", key)
-			}
-		case TypeStr, TypeText:
-			val, ok = value.(string)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be string", key)
-				break
-			}
-			converted := fmt.Sprintf("%v", val)
-			if field.Type == "string" && len(converted) > 255 {
-				ok = false
-				err = fmt.Errorf("field '%s' exceeded max lenght of 255 chars",
-					key)
-			}
-		case TypeBool:
-			val, ok = value.(bool)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be bool", key)
-			}
-		case TypeDate, TypeTime, TypeDateTime:
-			val, ok = value.(time.Time)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be time.Time", key)
-			}
-		case TypeBase64:
-			val, ok = value.(string)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be a string " +
-					"(in base64 format)", key)
-				break
-			}
-			converted := fmt.Sprintf("%v", val)
-			_, err = base64.StdEncoding.DecodeString(converted)
-			if err != nil {
-				err = fmt.Errorf("field '%s' expected to be a valid base64 " +
-					"string", key)
-			}
-		case TypeJson:
-			val, ok = value.(string)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be a string " +
-					"(in json format)", key)
-				break
-			}
-			converted := fmt.Sprintf("%v", val)
-			if !json.Valid([]byte(converted)) {
-				err = fmt.Errorf("field '%s' expected to be a valid json " +
-					"string", key)
-			}
-		case TypeArrayInt:
-			val, ok = value.([]int64)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be a slice of int64",
-					key)
-			}
-		case TypeArrayFloat:
-			val, ok = value.([]float64)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be a slice of " +
-				"float64", key)
-			}
-		case TypeArrayStr:
-			val, ok = value.([]string)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be a slice of " +
-				"string", key)
-			}
-		case TypeBlob:
-			val, ok = value.(string)
-			if !ok {
-				err = fmt.Errorf("field '%s' expected to be a string " +
-				"(UUID referencing a blob_id)", key)
-				break
-			}
-			converted := fmt.Sprintf("%v", val)
-			if len(converted) > 0 && !common.IsValidUUID(converted) {
-				err = fmt.Errorf("field '%s' expected to be a valid " +
-					"UUID (referencing a blob_id)", key)
-			}
-		default:
-			err = fmt.Errorf("unhandled type '%s' of field '%s'",
+		if !isKnownType(field.Type) {
+			err := fmt.Errorf("unhandled type '%s' of field '%s'",
 				field.Type, key)
 			panic(err)
 		}
+		var err error
+		if _, isArray := arrayItemType(field.Type); isArray {
+			err = checkArrayType(value, field.Type)
+		} else {
+			err = checkType(value, field.Type)
+		}
 
 		// an error occurred, save it
-		if !ok {
-			errors = append(errors, err)
+		if err != nil {
+			errors = append(errors, &FieldError{Field: key, Rule: "type",
+				Message: err.Error()})
+			continue
+		}
+
+		// type is right, check the constraints
+		if field.Constraints != nil {
+			errors = append(errors, checkConstraints(key, value,
+				field.Constraints)...)
 		}
 	}
 	return errors
 }
 
-// Manually parse a JSON array of int, floats or strings
-func parseJSONArray(strArray string, itemType string) ([]any,
-	error) {
-	var result []any
-	var ee []error
-	var err error
-
-	// remove brackets and split values
-	strArray = strings.TrimLeft(strArray, "[")
-	strArray = strings.TrimRight(strArray, "]")
-
-	splitted := strings.Split(strArray, ",")
-	for i, v := range splitted {
-		splitted[i] = strings.Trim(v, " ")
+// checkType checks that value has the Go type expected for the (scalar)
+// fieldType, and that it's valid
+func checkType(value any, fieldType string) error {
+	var ok bool
+	switch fieldType {
+	case TypeInt:
+		if _, ok = value.(int64); !ok {
+			return fmt.Errorf("expected to be int64")
+		}
+	case TypeFloat:
+		if _, ok = value.(float64); !ok {
+			return fmt.Errorf("expected to be float64")
+		}
+	case TypeStr, TypeText:
+		val, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected to be string")
+		}
+		if fieldType == TypeStr && len(val) > 255 {
+			return fmt.Errorf("exceeded max lenght of 255 chars")
+		}
+	case TypeBool:
+		if _, ok = value.(bool); !ok {
+			return fmt.Errorf("expected to be bool")
+		}
+	case TypeDate:
+		date, ok := value.(Date)
+		if !ok {
+			return fmt.Errorf("expected to be custodia.Date")
+		} else if !date.IsValid() {
+			return fmt.Errorf("invalid date '%s'", date)
+		}
+	case TypeTime:
+		timeOfDay, ok := value.(TimeOfDay)
+		if !ok {
+			return fmt.Errorf("expected to be custodia.TimeOfDay")
+		} else if !timeOfDay.IsValid() {
+			return fmt.Errorf("invalid time '%s'", timeOfDay)
+		}
+	case TypeDateTime:
+		dateTime, ok := value.(DateTime)
+		if !ok {
+			return fmt.Errorf("expected to be custodia.DateTime")
+		} else if dateTime.IsZero() {
+			return fmt.Errorf("datetime is zero")
+		}
+	case TypeBase64:
+		val, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected to be a string (in base64 format)")
+		}
+		if _, err := base64.StdEncoding.DecodeString(val); err != nil {
+			return fmt.Errorf("expected to be a valid base64 string")
+		}
+	case TypeJson:
+		val, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected to be a string (in json format)")
+		}
+		if !json.Valid([]byte(val)) {
+			return fmt.Errorf("expected to be a valid json string")
+		}
+	case TypeBlob:
+		val, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected to be a string (UUID referencing " +
+				"a blob_id)")
+		}
+		if len(val) > 0 && !common.IsValidUUID(val) {
+			return fmt.Errorf("expected to be a valid UUID (referencing " +
+				"a blob_id)")
+		}
+	default:
+		panic(fmt.Sprintf("unhandled type '%s'", fieldType))
 	}
+	return nil
+}
 
-	switch itemType {
-	case TypeArrayInt:
-		for i, v := range splitted {
-			converted, e := strconv.ParseInt(v, 10, 64)
-			if e != nil {
-				ee = append(ee, fmt.Errorf("%d: ParseInt error", i))
-				result = append(result, nil)
-			} else {
-				result = append(result, converted)
-			}
+// toInt64 converts a decoded number to int64, without passing through
+// float64. Values which are not integers or overflow int64 are reported.
+func toInt64(value any) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
 		}
-	case TypeArrayFloat:
-		for i, v := range splitted {
-			converted, e := strconv.ParseFloat(v, 64)
-			if e != nil {
-				ee = append(ee, fmt.Errorf("%d: ParseFloat error", i))
-				result = append(result, nil)
-			} else {
-				result = append(result, converted)
-			}
+		// not a plain integer, it may be written as float (e.g. 4.2e1)
+		f, _, err := big.ParseFloat(string(v), 10, 256, big.ToNearestEven)
+		if err != nil {
+			return 0, fmt.Errorf("cannot convert '%s' to int64", v)
 		}
-	case TypeArrayStr:
-		// since we are manually parsing the JSON array of values, we need to
-		// remove the double quotes around each value
-		for _, v := range splitted {
-			result = append(result, strings.Trim(v, "\""))
+		if !f.IsInt() {
+			return 0, fmt.Errorf("value %s is not an integer", v)
 		}
-	default:
-		panic(fmt.Sprintf("unhandled type '%s'", itemType))
+		i, accuracy := f.Int64()
+		if accuracy != big.Exact {
+			return 0, fmt.Errorf("value %s overflows int64", v)
+		}
+		return i, nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("value %v is not an integer", v)
+		}
+		if v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, fmt.Errorf("value %v overflows int64", v)
+		}
+		return int64(v), nil
 	}
+	return 0, fmt.Errorf("cannot convert %v (%T) to int64", value, value)
+}
 
-	if len(ee) > 0 {
-		err = errors.Join(ee...)
+// toFloat64Exact converts a decoded number to float64, reporting values
+// out of the float64 range
+func toFloat64Exact(value any) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return 0, fmt.Errorf("value %s overflows float64", v)
+			}
+			return 0, fmt.Errorf("cannot convert '%s' to float64", v)
+		}
+		return f, nil
 	}
-	return result, err
+	return 0, fmt.Errorf("cannot convert %v (%T) to float64", value, value)
 }
 
 func convertField(value any, field SchemaField) (any, error) {
@@ -210,16 +253,15 @@ func convertField(value any, field SchemaField) (any, error) {
 
 	switch field.Type {
 	case TypeInt:
-		// json.Unmarshall always returns float64 for numbers
-		c, ok := value.(float64)
-		if !ok {
-			e = fmt.Errorf("field '%s': cannot convert to int64", field.Name)
+		// numbers are decoded as json.Number (see decodeJSON)
+		converted, err = toInt64(value)
+		if err != nil {
+			e = fmt.Errorf("field '%s': %w", field.Name, err)
 		}
-		converted = int64(c)
 	case TypeFloat:
-		converted, ok = value.(float64)
-		if !ok {
-			e = fmt.Errorf("field '%s': cannot convert to float64", field.Name)
+		converted, err = toFloat64Exact(value)
+		if err != nil {
+			e = fmt.Errorf("field '%s': %w", field.Name, err)
 		}
 	case TypeStr, TypeText, TypeBase64, TypeJson, TypeBlob:
 		converted = fmt.Sprintf("%v", value)
@@ -230,15 +272,15 @@ func convertField(value any, field SchemaField) (any, error) {
 		}
 	case TypeDate, TypeTime, TypeDateTime:
 		dateStr := fmt.Sprintf("%v", value)
-		converted, err = timeutils.ParseDateString(dateStr)
+		converted, err = parseTemporal(dateStr, field.Type)
 		if err != nil {
-			e = fmt.Errorf("field '%s': error while converting to " +
-				"time.Time, %w", field.Name, err)
+			e = fmt.Errorf("field '%s': %w", field.Name, err)
 		}
-	case TypeArrayInt, TypeArrayFloat, TypeArrayStr:
-		arrayStr := fmt.Sprintf("%v", value)
-		converted, e = parseJSONArray(arrayStr, field.Type)
 	default:
+		if _, isArray := arrayItemType(field.Type); isArray {
+			converted, e = convertArray(value, field)
+			break
+		}
 		e := fmt.Errorf("field '%s': type '%s' not handled", field.Name,
 			field.Type)
 		panic(e)
@@ -249,6 +291,7 @@ func convertField(value any, field SchemaField) (any, error) {
 
 type StructureMapper interface {
 	getStructureAsMap() map[string]SchemaField
+	getRules() []CrossFieldRule
 }
 
 func convertData(data map[string]any, schema StructureMapper) (
@@ -290,3 +333,17 @@ func convertData(data map[string]any, schema StructureMapper) (
 
 	return converted, errors
 }
+
+// convertDefault converts the default value of a field to the concrete type
+// expected in contents (the same checked by validateContent)
+func convertDefault(value any, field SchemaField) (any, error) {
+	// already of the right type (e.g. set in code), constraints not checked
+	field.Constraints = nil
+	structure := map[string]SchemaField{field.Name: field}
+	if len(validateContent(map[string]any{field.Name: value},
+		structure)) == 0 {
+		return value, nil
+	}
+
+	return convertField(value, field)
+}
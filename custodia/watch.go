@@ -0,0 +1,473 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultWatchInterval is the polling interval of Watch when not given
+const DefaultWatchInterval = 5 * time.Second
+
+// WatchOverlap is how far back each poll looks before the cursor, to catch
+// the documents sharing the timestamp of the cursor (the filters have a
+// precision of seconds), or stored with a slightly late timestamp. The
+// documents already seen in the overlap are not emitted again.
+const WatchOverlap = 2 * time.Second
+
+// maxWatchReads caps the reads of a poll waiting for the listed documents
+// to stop changing
+const maxWatchReads = 10
+
+// errWatchUnsettled is returned by a poll whose documents kept changing
+// while they were listed: nothing is emitted, the next poll retries
+var errWatchUnsettled = errors.New("documents kept changing while listed")
+
+// Define ChangeType
+type ChangeType int
+
+const (
+	ChangeCreated ChangeType = iota + 1
+	ChangeUpdated
+	ChangeDeactivated
+)
+
+func (ct ChangeType) Choices() []string {
+	return []string{"created", "updated", "deactivated"}
+}
+
+func (ct ChangeType) String() string {
+	return ct.Choices()[ct-1]
+}
+
+func (ct ChangeType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ct.String())
+}
+
+func (ct *ChangeType) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	intValue := indexOf(value, ct.Choices()) + 1  // enum starts from 1
+	if intValue < 1 {
+		return fmt.Errorf("ChangeType: received unknown value '%v'", value)
+	}
+
+	*ct = ChangeType(intValue)
+	return nil
+}
+
+// ChangeEvent is a change of a document seen by Watch. Changes made
+// between two polls are merged: a document created and then updated is a
+// single Created event, with its last content.
+type ChangeEvent struct {
+	Type ChangeType `json:"type"`
+	SchemaId uuid.UUID `json:"schema_id"`
+	Document *Document `json:"document"`
+}
+
+// WatchCursor is the position of a watch: the last update of the last
+// emitted document, with the documents emitted in the overlap window
+type WatchCursor struct {
+	LastUpdate time.Time `json:"last_update"`
+	// Seen maps the ids of the documents emitted in the overlap window to
+	// their last update
+	Seen map[uuid.UUID]time.Time `json:"seen"`
+}
+
+// advance moves the cursor past doc, forgetting the documents out of the
+// overlap window
+func (wc *WatchCursor) advance(doc *Document) {
+	lastUpdate := doc.LastUpdate.Time
+	if lastUpdate.After(wc.LastUpdate) {
+		wc.LastUpdate = lastUpdate
+	}
+	if wc.Seen == nil {
+		wc.Seen = map[uuid.UUID]time.Time{}
+	}
+	wc.Seen[doc.Id] = lastUpdate
+	// the documents at the start of the window or before it don't match the
+	// filter anymore
+	start := overlapStart(wc.LastUpdate)
+	for id, seen := range wc.Seen {
+		if !seen.After(start) {
+			delete(wc.Seen, id)
+		}
+	}
+}
+
+// seen returns true if doc was already emitted, with this last update
+func (wc *WatchCursor) seen(doc *Document) bool {
+	seen, ok := wc.Seen[doc.Id]
+	return ok && !doc.LastUpdate.Time.After(seen)
+}
+
+// CursorStore stores the watch cursors, so a restarted watch resumes
+// where it stopped
+type CursorStore interface {
+	// Load returns the cursor saved with key, nil if none
+	Load(key string) (*WatchCursor, error)
+	Save(key string, cursor *WatchCursor) error
+}
+
+// MemoryCursorStore is a CursorStore kept in memory
+type MemoryCursorStore struct {
+	mutex sync.Mutex
+	cursors map[string]WatchCursor
+}
+
+func (ms *MemoryCursorStore) Load(key string) (*WatchCursor, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	cursor, ok := ms.cursors[key]
+	if !ok {
+		return nil, nil
+	}
+	return cloneCursor(&cursor), nil
+}
+
+func (ms *MemoryCursorStore) Save(key string, cursor *WatchCursor) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if ms.cursors == nil {
+		ms.cursors = map[string]WatchCursor{}
+	}
+	ms.cursors[key] = *cloneCursor(cursor)
+	return nil
+}
+
+func cloneCursor(cursor *WatchCursor) *WatchCursor {
+	clone := &WatchCursor{LastUpdate: cursor.LastUpdate,
+		Seen: map[uuid.UUID]time.Time{}}
+	for id, seen := range cursor.Seen {
+		clone.Seen[id] = seen
+	}
+	return clone
+}
+
+// FileCursorStore stores each cursor in the JSON file <key>.json of Dir.
+// Files are replaced atomically, so a crash never leaves a broken cursor.
+type FileCursorStore struct {
+	Dir string
+}
+
+func (fs FileCursorStore) path(key string) string {
+	return filepath.Join(fs.Dir, key + ".json")
+}
+
+func (fs FileCursorStore) Load(key string) (*WatchCursor, error) {
+	data, err := os.ReadFile(fs.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cursor := &WatchCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, fmt.Errorf("cursor %s: %w", fs.path(key), err)
+	}
+	return cursor, nil
+}
+
+func (fs FileCursorStore) Save(key string, cursor *WatchCursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fs.Dir, key + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path(key))
+}
+
+// overlapStart returns the start of the overlap window of t, truncated to
+// the precision of the filters
+func overlapStart(t time.Time) time.Time {
+	return t.Add(-WatchOverlap).UTC().Truncate(time.Second)
+}
+
+// lastUpdateFilter returns the value of a last_update__gt filter catching
+// the items updated after t, and WatchOverlap before it
+func lastUpdateFilter(t time.Time) string {
+	return overlapStart(t).Format(time.RFC3339)
+}
+
+// WatchOptions are the options of Watch
+type WatchOptions struct {
+	// Interval is the polling interval, 0 means DefaultWatchInterval
+	Interval time.Duration
+	// Store (optional) keeps the cursor across restarts, with the schema id
+	// as key
+	Store CursorStore
+	// Since is where to start when there's no stored cursor: only the
+	// documents changed after it are emitted. The zero time emits all the
+	// documents.
+	Since time.Time
+	// PageSize is the page size of the list calls, 0 means DefaultPageSize
+	PageSize int
+	// CreatedOnly emits only the created documents, listed with the
+	// insert_date__gt filter too
+	CreatedOnly bool
+}
+
+// Watch polls the documents of schema changed since the cursor and passes
+// them, sorted by last update, to handler. It blocks until ctx is done, or
+// handler fails, and returns the error.
+// The cursor is saved after each event handled without errors: after a
+// restart, the event which failed (or was being handled) is emitted again
+// and no event is lost. Temporary errors (network errors, 429 and 5xx
+// responses) are retried at the next poll, like the polls whose documents
+// keep changing while they are listed (see watchList).
+func (ca *CustodiaAPIv1) Watch(ctx context.Context, schema *Schema,
+	opts *WatchOptions, handler func(ChangeEvent) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if schema == nil {
+		return fmt.Errorf("schema is nil")
+	}
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	return ca.watch(ctx, schema, opts, 1, func(events []ChangeEvent) error {
+		return handler(events[0])
+	})
+}
+
+// watch polls schema until ctx is done, passing the events to handler in
+// batches of at most batchSize events
+func (ca *CustodiaAPIv1) watch(ctx context.Context, schema *Schema,
+	opts *WatchOptions, batchSize int,
+	handler func([]ChangeEvent) error) error {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	key := schema.Id.String()
+
+	var cursor *WatchCursor
+	if opts.Store != nil {
+		var err error
+		if cursor, err = opts.Store.Load(key); err != nil {
+			return fmt.Errorf("error loading cursor: %w", err)
+		}
+	}
+	if cursor == nil {
+		cursor = &WatchCursor{LastUpdate: opts.Since,
+			Seen: map[uuid.UUID]time.Time{}}
+	}
+
+	for {
+		err := ca.watchPoll(ctx, schema, opts, key, cursor, batchSize,
+			handler)
+		if err != nil && !isTemporary(err) &&
+			!errors.Is(err, errWatchUnsettled) {
+			return err
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// watchPoll emits the documents changed since cursor in batches of at most
+// batchSize events, advancing it after each batch handled
+func (ca *CustodiaAPIv1) watchPoll(ctx context.Context, schema *Schema,
+	opts *WatchOptions, key string, cursor *WatchCursor, batchSize int,
+	handler func([]ChangeEvent) error) error {
+	// created documents are the ones inserted after the previous poll
+	baseline := cursor.LastUpdate
+
+	queryParams := map[string]string{"full_document": "true"}
+	if !cursor.LastUpdate.IsZero() {
+		queryParams["last_update__gt"] = lastUpdateFilter(cursor.LastUpdate)
+		if opts.CreatedOnly {
+			queryParams["insert_date__gt"] = lastUpdateFilter(
+				cursor.LastUpdate)
+		}
+	}
+	docs, err := ca.watchList(ctx, schema, opts.PageSize, queryParams)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].LastUpdate.Time.Before(docs[j].LastUpdate.Time)
+	})
+	batch := []ChangeEvent{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := handler(batch); err != nil {
+			return err
+		}
+		for _, event := range batch {
+			cursor.advance(event.Document)
+		}
+		batch = []ChangeEvent{}
+		if opts.Store != nil {
+			if err := opts.Store.Save(key, cursor); err != nil {
+				return fmt.Errorf("error saving cursor: %w", err)
+			}
+		}
+		return nil
+	}
+	for _, doc := range docs {
+		if cursor.seen(doc) || !doc.LastUpdate.Time.After(opts.Since) {
+			continue
+		}
+		// a document never updated is new, even if it ties with the cursor
+		event := ChangeEvent{Type: ChangeUpdated, SchemaId: schema.Id,
+			Document: doc}
+		if !doc.IsActive {
+			event.Type = ChangeDeactivated
+		} else if baseline.IsZero() || doc.InsertDate.Time.After(baseline) ||
+			doc.InsertDate.Time.Equal(doc.LastUpdate.Time) {
+			event.Type = ChangeCreated
+		}
+		if opts.CreatedOnly && event.Type != ChangeCreated {
+			continue
+		}
+		batch = append(batch, event)
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// watchList lists the documents matching queryParams. The list is paged by
+// offset, so the documents changing while it's read can shift the others
+// across the pages, unseen. When it doesn't fit a page, the list is read
+// again, bounded by the last update found by the first read, until two
+// reads match: within the bound the documents can only leave the list
+// (when updated, to be listed by the next poll), so the reads settle.
+// The latest version of the documents found by any read is returned.
+func (ca *CustodiaAPIv1) watchList(ctx context.Context, schema *Schema,
+	pageSize int, queryParams map[string]string) ([]*Document, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	read := func(filters map[string]string) ([]*Document, error) {
+		return NewPager(ctx, pageSize, func(offset, limit int) (
+			[]*Document, PageInfo, error) {
+			params := pageParams(offset, limit)
+			for k, v := range filters {
+				params[k] = v
+			}
+			return ca.listDocuments(schema, params)
+		}).All()
+	}
+
+	docs, err := read(queryParams)
+	if err != nil || len(docs) <= pageSize {
+		return docs, err
+	}
+
+	// the documents updated from now on are after the bound
+	var last time.Time
+	for _, doc := range docs {
+		if doc.LastUpdate.Time.After(last) {
+			last = doc.LastUpdate.Time
+		}
+	}
+	bounded := map[string]string{"last_update__lt": last.UTC().
+		Truncate(time.Second).Add(time.Second).Format(time.RFC3339)}
+	for k, v := range queryParams {
+		bounded[k] = v
+	}
+
+	latest := []*Document{}
+	index := map[uuid.UUID]int{}
+	merge := func(docs []*Document) {
+		for _, doc := range docs {
+			i, ok := index[doc.Id]
+			if !ok {
+				index[doc.Id] = len(latest)
+				latest = append(latest, doc)
+			} else if doc.LastUpdate.Time.After(latest[i].LastUpdate.Time) {
+				latest[i] = doc
+			}
+		}
+	}
+	merge(docs)
+	for i := 1; i < maxWatchReads; i++ {
+		again, err := read(bounded)
+		if err != nil {
+			return nil, err
+		}
+		merge(again)
+		if sameVersions(docs, again) {
+			return latest, nil
+		}
+		docs = again
+	}
+	return nil, errWatchUnsettled
+}
+
+// sameVersions returns true if a and b list the same documents, with the
+// same last updates
+func sameVersions(a, b []*Document) bool {
+	versions := map[uuid.UUID]time.Time{}
+	for _, doc := range a {
+		versions[doc.Id] = doc.LastUpdate.Time
+	}
+	found := map[uuid.UUID]bool{}
+	for _, doc := range b {
+		lastUpdate, ok := versions[doc.Id]
+		if !ok || !lastUpdate.Equal(doc.LastUpdate.Time) {
+			return false
+		}
+		found[doc.Id] = true
+	}
+	return len(found) == len(versions)
+}
+
+// WatchChannel runs Watch in background, sending the events on the
+// returned channel. The cursor is saved once the event is received. When
+// the watch stops, its error is sent on the error channel and both
+// channels are closed.
+func (ca *CustodiaAPIv1) WatchChannel(ctx context.Context, schema *Schema,
+	opts *WatchOptions) (<-chan ChangeEvent, <-chan error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	events := make(chan ChangeEvent)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		defer close(errs)
+		errs <- ca.Watch(ctx, schema, opts, func(event ChangeEvent) error {
+			select {
+			case events <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return events, errs
+}
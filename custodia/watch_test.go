@@ -0,0 +1,329 @@
+package custodia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dzanotelli/chino/common"
+	"github.com/google/uuid"
+)
+
+// feedServer lists the documents of a schema, filtered by last_update and
+// insert_date, in insertion order or by last update
+type feedServer struct {
+	mutex sync.Mutex
+	docs []*Document
+	byLastUpdate bool
+	// afterPage (optional) is called after serving a page, with the lock
+	afterPage func(offset int)
+}
+
+func (s *feedServer) add(insertDate time.Time, name string) *Document {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc := &Document{Id: uuid.New(), IsActive: true,
+		Content: map[string]any{"name": name}}
+	doc.InsertDate.Time, doc.LastUpdate.Time = insertDate, insertDate
+	s.docs = append(s.docs, doc)
+	return doc
+}
+
+func (s *feedServer) update(doc *Document, lastUpdate time.Time,
+	isActive bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc.LastUpdate.Time, doc.IsActive = lastUpdate, isActive
+}
+
+func (s *feedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	docs := append([]*Document{}, s.docs...)
+	if s.byLastUpdate {
+		sort.SliceStable(docs, func(i, j int) bool {
+			return docs[i].LastUpdate.Time.Before(docs[j].LastUpdate.Time)
+		})
+	}
+	matching := []map[string]any{}
+	since, _ := time.Parse(time.RFC3339, r.URL.Query().Get("last_update__gt"))
+	until, err := time.Parse(time.RFC3339,
+		r.URL.Query().Get("last_update__lt"))
+	if err != nil {
+		until = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	inserted, _ := time.Parse(time.RFC3339,
+		r.URL.Query().Get("insert_date__gt"))
+	for _, doc := range docs {
+		if doc.LastUpdate.Time.After(since) &&
+			doc.LastUpdate.Time.Before(until) &&
+			doc.InsertDate.Time.After(inserted) {
+			matching = append(matching, map[string]any{
+				"document_id": doc.Id, "is_active": doc.IsActive,
+				"insert_date": doc.InsertDate.Format(time.RFC3339Nano),
+				"last_update": doc.LastUpdate.Format(time.RFC3339Nano),
+				"content": doc.Content})
+		}
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	end := min(offset+limit, len(matching))
+	page := map[string]any{"count": end - offset,
+		"total_count": len(matching), "limit": limit, "offset": offset,
+		"documents": matching[offset:end]}
+
+	envelope := CustodiaEnvelope{Result: "success", ResultCode: 200}
+	envelope.Data, _ = json.Marshal(page)
+	out, _ := json.Marshal(envelope)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+	if s.afterPage != nil {
+		s.afterPage(offset)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	feed := &feedServer{}
+	server := httptest.NewServer(feed)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := &Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+	store := FileCursorStore{Dir: t.TempDir()}
+	opts := &WatchOptions{Store: store, PageSize: 2}
+
+	// each poll restarts from the stored cursor
+	var failOn uuid.UUID
+	poll := func() ([]string, error) {
+		cursor, err := store.Load(schema.Id.String())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cursor == nil {
+			cursor = &WatchCursor{}
+		}
+		events := []string{}
+		err = custodia.watchPoll(context.Background(), schema, opts,
+			schema.Id.String(), cursor, 1, func(batch []ChangeEvent) error {
+				event := batch[0]
+				if event.Document.Id == failOn {
+					return errors.New("boom")
+				}
+				events = append(events, event.Type.String() + " " +
+					event.Document.Content["name"].(string))
+				return nil
+			})
+		return events, err
+	}
+
+	t0 := time.Date(2025, 4, 14, 5, 9, 54, 100000000, time.UTC)
+	alice := feed.add(t0, "alice")
+	bob := feed.add(t0.Add(500 * time.Millisecond), "bob")
+	events1, err1 := poll()
+
+	// carol ties with bob, within the same second
+	feed.add(t0.Add(500 * time.Millisecond), "carol")
+	feed.update(alice, t0.Add(time.Second), true)
+	events2, err2 := poll()
+
+	feed.update(bob, t0.Add(2 * time.Second), false)
+	events3, err3 := poll()
+	events4, err4 := poll()
+
+	// a failed event is emitted again after a restart
+	dave := feed.add(t0.Add(3 * time.Second), "dave")
+	failOn = dave.Id
+	_, err5 := poll()
+	failOn = uuid.Nil
+	events6, err6 := poll()
+
+	tests := []struct {
+		want any
+		got any
+	}{
+		{[]string{"created alice", "created bob"}, events1},
+		{nil, err1},
+		{[]string{"created carol", "updated alice"}, events2},
+		{nil, err2},
+		{[]string{"deactivated bob"}, events3},
+		{nil, err3},
+		{[]string{}, events4},
+		{nil, err4},
+		{"boom", err5.Error()},
+		{[]string{"created dave"}, events6},
+		{nil, err6},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.want, test.got) {
+			t.Errorf("Watch %d: bad value, got: %v want: %v", i, test.got,
+				test.want)
+		}
+	}
+}
+
+func TestWatchSubSecond(t *testing.T) {
+	feed := &feedServer{}
+	server := httptest.NewServer(feed)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := &Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+
+	// alice is in the truncated second before the window, still matching
+	// the filter: she must stay seen
+	t0 := time.Date(2025, 4, 14, 5, 9, 0, 0, time.UTC)
+	feed.add(t0.Add(8300 * time.Millisecond), "alice")
+	feed.add(t0.Add(10500 * time.Millisecond), "bob")
+	cursor := &WatchCursor{}
+	events := []string{}
+	for i := 0; i < 3; i++ {
+		err := custodia.watchPoll(context.Background(), schema,
+			&WatchOptions{}, schema.Id.String(), cursor, 1,
+			func(batch []ChangeEvent) error {
+				events = append(events,
+					batch[0].Document.Content["name"].(string))
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(want, events) {
+		t.Errorf("Watch: bad events, got: %v want: %v", events, want)
+	}
+}
+
+func TestWatchShiftedPages(t *testing.T) {
+	feed := &feedServer{byLastUpdate: true}
+	server := httptest.NewServer(feed)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := &Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+
+	// alice is updated after the first page is read: she moves to the end
+	// of the list, shifting carol to the first page
+	t0 := time.Date(2025, 4, 14, 5, 9, 0, 0, time.UTC)
+	alice := feed.add(t0, "alice")
+	feed.add(t0.Add(10 * time.Second), "bob")
+	feed.add(t0.Add(20 * time.Second), "carol")
+	feed.afterPage = func(offset int) {
+		feed.afterPage = nil
+		alice.LastUpdate.Time = t0.Add(30 * time.Second)
+	}
+	cursor := &WatchCursor{}
+	events := []string{}
+	err := custodia.watchPoll(context.Background(), schema,
+		&WatchOptions{PageSize: 2}, schema.Id.String(), cursor, 1,
+		func(batch []ChangeEvent) error {
+			events = append(events,
+				batch[0].Document.Content["name"].(string))
+			return nil
+		})
+	want := []string{"bob", "carol", "alice"}
+	if err != nil || !reflect.DeepEqual(want, events) {
+		t.Errorf("Watch: bad events, got: %v, %v want: %v", events, err,
+			want)
+	}
+
+	// a document updated at every page leaves the bounded list: the reads
+	// settle
+	feed.afterPage = func(offset int) {
+		alice.LastUpdate.Time = alice.LastUpdate.Time.Add(time.Second)
+	}
+	feed.add(t0.Add(40 * time.Second), "dave")
+	feed.add(t0.Add(41 * time.Second), "erin")
+	events = []string{}
+	err = custodia.watchPoll(context.Background(), schema,
+		&WatchOptions{PageSize: 1}, schema.Id.String(), cursor, 1,
+		func(batch []ChangeEvent) error {
+			events = append(events,
+				batch[0].Document.Content["name"].(string))
+			return nil
+		})
+	want = []string{"alice", "dave", "erin"}
+	if err != nil || !reflect.DeepEqual(want, events) {
+		t.Errorf("Watch: bad events, got: %v, %v want: %v", events, err,
+			want)
+	}
+}
+
+func TestWatchCreatedOnly(t *testing.T) {
+	feed := &feedServer{}
+	server := httptest.NewServer(feed)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := &Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+
+	t0 := time.Date(2025, 4, 14, 5, 9, 0, 0, time.UTC)
+	alice := feed.add(t0, "alice")
+	feed.add(t0.Add(10 * time.Second), "bob")
+	feed.update(alice, t0.Add(20 * time.Second), true)
+	cursor := &WatchCursor{LastUpdate: t0.Add(5 * time.Second)}
+	events := []string{}
+	err := custodia.watchPoll(context.Background(), schema,
+		&WatchOptions{CreatedOnly: true}, schema.Id.String(), cursor, 1,
+		func(batch []ChangeEvent) error {
+			events = append(events, batch[0].Type.String() + " " +
+				batch[0].Document.Content["name"].(string))
+			return nil
+		})
+	if want := []string{"created bob"}; err != nil ||
+		!reflect.DeepEqual(want, events) {
+		t.Errorf("Watch: bad events, got: %v, %v want: %v", events, err,
+			want)
+	}
+}
+
+func TestWatchChannel(t *testing.T) {
+	feed := &feedServer{}
+	server := httptest.NewServer(feed)
+	defer server.Close()
+	client := common.NewClient(server.URL, common.GetFakeAuth())
+	custodia := NewCustodiaAPIv1(client)
+	schema := &Schema{Id: uuid.New(), Structure: []SchemaField{
+		{Name: "name", Type: TypeStr}}}
+
+	// only the changes after Since are emitted
+	t0 := time.Date(2025, 4, 14, 5, 9, 54, 0, time.UTC)
+	feed.add(t0, "alice")
+	bob := feed.add(t0.Add(time.Minute), "bob")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &MemoryCursorStore{}
+	events, errs := custodia.WatchChannel(ctx, schema, &WatchOptions{
+		Interval: 10 * time.Millisecond, Store: store,
+		Since: t0.Add(time.Second)})
+	event := <-events
+	if event.Type != ChangeCreated || event.Document.Id != bob.Id ||
+		event.SchemaId != schema.Id {
+		t.Errorf("unexpected event: %v", event)
+	}
+	carol := feed.add(t0.Add(2 * time.Minute), "carol")
+	if event = <-events; event.Document.Id != carol.Id {
+		t.Errorf("unexpected event: %v", event)
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected the context error, got: %v", err)
+	}
+
+	cursor, _ := store.Load(schema.Id.String())
+	if cursor == nil || !cursor.LastUpdate.Equal(t0.Add(2 * time.Minute)) {
+		t.Errorf("unexpected cursor: %v", cursor)
+	}
+}
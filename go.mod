@@ -4,10 +4,10 @@ go 1.22.0
 
 toolchain go1.22.2
 
-require github.com/google/uuid v1.6.0
-
 require (
-	github.com/simplereach/timeutils v1.2.0 // indirect
-	golang.org/x/exp v0.0.0-20241217172543-b2144cdd0a67 // indirect
-	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/simplereach/timeutils v1.2.0
+	golang.org/x/exp v0.0.0-20241217172543-b2144cdd0a67
 )
+
+require gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect